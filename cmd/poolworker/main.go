@@ -2,35 +2,73 @@ package main
 
 import (
 	"flag"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"os"
-	"path"
 
 	"github.com/onemorebsmith/kaspa-pool/src/kaspastratum"
 	"gopkg.in/yaml.v2"
 )
 
 func main() {
-	pwd, _ := os.Getwd()
-	fullPath := path.Join(pwd, "config.yaml")
-	log.Printf("loading config @ `%s`", fullPath)
-	rawCfg, err := ioutil.ReadFile(fullPath)
+	configPath := flag.String("config", "config.yaml", "path of the config file, settings can be overridden with "+
+		kaspastratum.EnvPrefix+"* environment variables")
+	printConfig := flag.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+	stratumPort := flag.String("stratum", "", "stratum port to listen on, default `:5555`")
+	rpcServer := flag.String("kaspa", "", "address of the kaspad node, default `localhost:16110`")
+	promPort := flag.String("prom", "", "address to serve prom stats, default `:2112`")
+	healthCheckPort := flag.String("hcp", "", `if defined will expose health checks on /livez and /readyz, default ""`)
+	logFile := flag.Bool("log", false, "write logs to `log.file.path` from the config, bridge.log if unset")
+	flag.Parse()
+
+	// flags win over both the file and the environment, but only if given.
+	// Reloads go through the same path so they stay applied
+	load := func() (kaspastratum.BridgeConfig, error) {
+		cfg, err := kaspastratum.LoadConfig(*configPath, os.LookupEnv)
+		if err != nil {
+			return cfg, err
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "stratum":
+				cfg.StratumPort = *stratumPort
+			case "kaspa":
+				cfg.RPCServer = *rpcServer
+			case "prom":
+				cfg.PromPort = *promPort
+			case "hcp":
+				cfg.HealthCheckPort = *healthCheckPort
+			case "log":
+				if !*logFile {
+					cfg.Log.File.Path = ""
+				} else if cfg.Log.File.Path == "" {
+					cfg.Log.File.Path = "bridge.log"
+				}
+			}
+		})
+		return cfg, nil
+	}
+
+	log.Printf("loading config @ `%s`", *configPath)
+	cfg, err := load()
 	if err != nil {
-		log.Printf("config file not found: %s", err)
+		log.Println(err)
 		os.Exit(1)
 	}
-	cfg := kaspastratum.BridgeConfig{}
-	if err := yaml.Unmarshal(rawCfg, &cfg); err != nil {
-		log.Printf("failed parsing config file: %s", err)
+	if err := cfg.Validate(); err != nil {
+		log.Println(err)
 		os.Exit(1)
 	}
 
-	flag.StringVar(&cfg.StratumPort, "stratum", cfg.StratumPort, "stratum port to listen on, default `:5555`")
-	flag.StringVar(&cfg.RPCServer, "kaspa", cfg.RPCServer, "address of the kaspad node, default `localhost:16110`")
-	flag.StringVar(&cfg.PromPort, "prom", cfg.PromPort, "address to serve prom stats, default `:2112`")
-	flag.StringVar(&cfg.HealthCheckPort, "hcp", cfg.HealthCheckPort, `(rarely used) if defined will expose a health check on /readyz, default ""`)
-	flag.Parse()
+	if *printConfig {
+		out, err := yaml.Marshal(cfg.Redacted())
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		fmt.Print(string(out))
+		return
+	}
 
 	log.Println("----------------------------------")
 	log.Printf("initializing bridge")
@@ -38,8 +76,11 @@ func main() {
 	log.Printf("\tstratum:       %s", cfg.StratumPort)
 	log.Printf("\tprom:          %s", cfg.PromPort)
 	log.Printf("\thealth check:  %s", cfg.HealthCheckPort)
+	log.Printf("\tlog file:      %s", cfg.Log.File.Path)
 	log.Println("----------------------------------")
 
+	// SIGHUP re-reads the config, see BridgeConfig.Loader
+	cfg.Loader = load
 	if err := kaspastratum.ListenAndServe(cfg); err != nil {
 		log.Println(err)
 	}
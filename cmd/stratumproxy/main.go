@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"github.com/onemorebsmith/kaspa-pool/src/stratumproxy"
+)
+
+func main() {
+	upstream := flag.String("upstream", "", "stratum address of the pool")
+	user := flag.String("user", "", "wallet.worker the proxy mines as upstream")
+	listen := flag.String("listen", ":5555", "address rigs connect to")
+	rigBytes := flag.Int("rig-bytes", 2, "nonce bytes reserved to tell rigs apart")
+	report := flag.Duration("report", time.Minute, "how often to print per rig stats")
+	flag.Parse()
+	if *upstream == "" || *user == "" {
+		log.Println("-upstream and -user are required")
+		os.Exit(1)
+	}
+
+	proxy, err := stratumproxy.NewProxy(stratumproxy.ProxyConfig{
+		Upstream:          *upstream,
+		User:              *user,
+		Agent:             "kaspa-pool-proxy",
+		Port:              *listen,
+		Logger:            gostratum.DefaultLogger(),
+		RigExtranonceSize: *rigBytes,
+	})
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(*report)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				stats := proxy.Stats()
+				log.Printf("%d rigs connected", len(stats))
+				for _, rig := range stats {
+					log.Printf("\t%-12s %-21s %s accepted: %d, rejected: %d, stale: %d, last share: %s",
+						rig.Worker, rig.RemoteAddr, rig.Extranonce, rig.Accepted, rig.Rejected, rig.Stale,
+						rig.LastShare.Format(time.RFC3339))
+				}
+			}
+		}
+	}()
+
+	log.Printf("proxying %s to %s as %s", *listen, *upstream, *user)
+	if err := proxy.Run(ctx); err != nil {
+		log.Println(err)
+	}
+}
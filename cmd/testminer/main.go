@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"time"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"github.com/onemorebsmith/kaspa-pool/src/kaspaminer"
+)
+
+func main() {
+	pool := flag.String("pool", "localhost:5555", "stratum address of the bridge")
+	user := flag.String("user", "", "wallet.worker to mine as")
+	threads := flag.Int("threads", runtime.NumCPU(), "number of mining threads")
+	agent := flag.String("agent", "testminer/1.0", "miner name sent on subscribe, use `BzMiner` to get single string jobs")
+	report := flag.Duration("report", 10*time.Second, "how often to print stats")
+	flag.Parse()
+	if *user == "" {
+		log.Println("-user is required")
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	miner := kaspaminer.NewMiner(kaspaminer.MinerConfig{
+		Pool:    *pool,
+		User:    *user,
+		Agent:   *agent,
+		Threads: *threads,
+		Logger:  gostratum.DefaultLogger(),
+	})
+	go func() {
+		ticker := time.NewTicker(*report)
+		defer ticker.Stop()
+		last := kaspaminer.MinerStats{}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				stats := miner.Stats()
+				rate := float64(stats.Hashes-last.Hashes) / report.Seconds()
+				log.Printf("hashrate: %.2f kH/s, accepted: %d, rejected: %d, stale: %d",
+					rate/1000, stats.Accepted, stats.Rejected, stats.Stale)
+				last = stats
+			}
+		}
+	}()
+
+	log.Printf("mining on %s as %s with %d threads", *pool, *user, *threads)
+	if err := miner.Run(ctx); err != nil && err != context.Canceled {
+		log.Println(err)
+	}
+	stats := miner.Stats()
+	log.Printf("done, accepted: %d, rejected: %d, stale: %d", stats.Accepted, stats.Rejected, stats.Stale)
+}
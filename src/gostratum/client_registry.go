@@ -0,0 +1,92 @@
+package gostratum
+
+import (
+	"sort"
+	"sync"
+)
+
+// ClientRegistry tracks connected clients by session id, with a secondary
+// index by remote address since any number of rigs can share one IP behind a
+// NAT. Safe for concurrent use
+type ClientRegistry[S any] struct {
+	lock   sync.RWMutex
+	byId   map[uint64]*TypedContext[S]
+	byAddr map[string]map[uint64]*TypedContext[S]
+}
+
+func NewClientRegistry[S any]() *ClientRegistry[S] {
+	return &ClientRegistry[S]{
+		byId:   map[uint64]*TypedContext[S]{},
+		byAddr: map[string]map[uint64]*TypedContext[S]{},
+	}
+}
+
+func (r *ClientRegistry[S]) Add(ctx *TypedContext[S]) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.byId[ctx.id] = ctx
+	sessions, exists := r.byAddr[ctx.RemoteAddr]
+	if !exists {
+		sessions = map[uint64]*TypedContext[S]{}
+		r.byAddr[ctx.RemoteAddr] = sessions
+	}
+	sessions[ctx.id] = ctx
+}
+
+// Remove drops the client, returning false if it wasn't registered
+func (r *ClientRegistry[S]) Remove(ctx *TypedContext[S]) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.byId[ctx.id]; !exists {
+		return false
+	}
+	delete(r.byId, ctx.id)
+	if sessions, exists := r.byAddr[ctx.RemoteAddr]; exists {
+		delete(sessions, ctx.id)
+		if len(sessions) == 0 {
+			delete(r.byAddr, ctx.RemoteAddr)
+		}
+	}
+	return true
+}
+
+func (r *ClientRegistry[S]) Get(sessionId uint64) (*TypedContext[S], bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ctx, exists := r.byId[sessionId]
+	return ctx, exists
+}
+
+// All returns every client, ordered by session id
+func (r *ClientRegistry[S]) All() []*TypedContext[S] {
+	r.lock.RLock()
+	clients := make([]*TypedContext[S], 0, len(r.byId))
+	for _, ctx := range r.byId {
+		clients = append(clients, ctx)
+	}
+	r.lock.RUnlock()
+	return sortSessions(clients)
+}
+
+// ByAddr returns the clients connected from the address, ordered by session id
+func (r *ClientRegistry[S]) ByAddr(addr string) []*TypedContext[S] {
+	r.lock.RLock()
+	sessions := r.byAddr[addr]
+	clients := make([]*TypedContext[S], 0, len(sessions))
+	for _, ctx := range sessions {
+		clients = append(clients, ctx)
+	}
+	r.lock.RUnlock()
+	return sortSessions(clients)
+}
+
+func (r *ClientRegistry[S]) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.byId)
+}
+
+func sortSessions[S any](clients []*TypedContext[S]) []*TypedContext[S] {
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
@@ -0,0 +1,245 @@
+package gostratum
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// connectRecorder hands out the context of every new connection
+type connectRecorder chan *StratumContext
+
+func (cr connectRecorder) OnConnect(ctx *StratumContext)    { cr <- ctx }
+func (cr connectRecorder) OnDisconnect(ctx *StratumContext) {}
+
+func pipeClient(t *testing.T, ctx context.Context, cfg StratumListenerConfig) (*StratumContext, net.Conn) {
+	connected := make(connectRecorder, 1)
+	cfg.ClientListener = connected
+	listener := NewListener(cfg)
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	listener.newClient(ctx, server)
+	return <-connected, client
+}
+
+func expectCancelled(t *testing.T, ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the connection context to be cancelled")
+	}
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", ctx.Err())
+	}
+}
+
+func TestContextCancelledOnClose(t *testing.T) {
+	work := make(chan error, 1)
+	cfg := DefaultConfig(testLogger())
+	cfg.HandlerMap[string(StratumMethodSubmit)] = func(ctx *StratumContext, event JsonRpcEvent) error {
+		go func() { // e.g. a share write still in flight
+			select {
+			case <-ctx.Done():
+				work <- ctx.Err()
+			case <-time.After(5 * time.Second):
+				work <- nil
+			}
+		}()
+		return nil
+	}
+	ctx, client := pipeClient(t, context.Background(), cfg)
+	if _, err := client.Write([]byte(`{"id": 1, "method": "mining.submit", "params": []}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	if err := <-work; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected in flight work to be cancelled, got %v", err)
+	}
+	expectCancelled(t, ctx)
+	if ctx.Connected() {
+		t.Error("expected the context to report disconnected")
+	}
+	if err := ctx.Send(NewEvent("", "mining.notify", nil)); !errors.Is(err, ErrorDisconnected) {
+		t.Errorf("expected send after disconnect to fail, got %v", err)
+	}
+}
+
+func TestContextCancelledOnShutdown(t *testing.T) {
+	server, shutdown := context.WithCancel(context.Background())
+	ctx, client := pipeClient(t, server, DefaultConfig(testLogger()))
+	shutdown()
+
+	expectCancelled(t, ctx)
+	if _, err := bufio.NewReader(client).ReadByte(); err != io.EOF {
+		t.Errorf("expected the socket to be closed, got %v", err)
+	}
+}
+
+func TestContextDisconnect(t *testing.T) {
+	ctx, client := pipeClient(t, context.Background(), DefaultConfig(testLogger()))
+	ctx.Disconnect()
+	ctx.Disconnect() // kicking twice is fine
+
+	expectCancelled(t, ctx)
+	if _, err := bufio.NewReader(client).ReadByte(); err != io.EOF {
+		t.Errorf("expected the socket to be closed, got %v", err)
+	}
+}
+
+func TestContextDelegates(t *testing.T) {
+	type key struct{}
+	deadline := time.Now().Add(time.Minute)
+	parent, cancel := context.WithDeadline(context.WithValue(context.Background(), key{}, "value"), deadline)
+	ctx, _ := NewMockContext[any](parent, testLogger(), nil)
+
+	if d, ok := ctx.Deadline(); !ok || !d.Equal(deadline) {
+		t.Errorf("expected deadline %s, got %s", deadline, d)
+	}
+	if v := ctx.Value(key{}); v != "value" {
+		t.Errorf("expected the parent's value, got %v", v)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("expected a live context, got %v", ctx.Err())
+	}
+	cancel()
+	expectCancelled(t, ctx)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	const writers, messages = 8, 50
+	cfg := DefaultConfig(testLogger())
+	cfg.OutboundQueue = writers * messages
+	ctx, client := pipeClient(t, context.Background(), cfg)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			for j := 0; j < messages; j++ {
+				if err := ctx.Send(NewEvent("", "mining.notify", []any{i, j})); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	reader := bufio.NewReader(client)
+	for read := 0; read < writers*messages; read++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed reading message %d: %s", read, err)
+		}
+		if _, err := UnmarshalEvent(line); err != nil {
+			t.Fatalf("message %d interleaved with another: %s", read, line)
+		}
+	}
+}
+
+func TestQueueFullDisconnects(t *testing.T) {
+	cfg := DefaultConfig(testLogger())
+	cfg.OutboundQueue = 2
+	ctx, _ := pipeClient(t, context.Background(), cfg) // never reads
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = ctx.Send(NewEvent("", "mining.notify", []any{i}))
+	}
+	if !errors.Is(err, ErrorQueueFull) {
+		t.Fatalf("expected the queue to fill up, got %v", err)
+	}
+	expectCancelled(t, ctx)
+	if err := ctx.Send(NewEvent("", "mining.notify", nil)); !errors.Is(err, ErrorDisconnected) {
+		t.Errorf("expected send after disconnect to fail, got %v", err)
+	}
+}
+
+func TestWriteTimeoutDisconnects(t *testing.T) {
+	cfg := DefaultConfig(testLogger())
+	cfg.WriteTimeout = 50 * time.Millisecond
+	ctx, _ := pipeClient(t, context.Background(), cfg) // never reads
+
+	if err := ctx.Send(NewEvent("", "mining.notify", nil)); err != nil {
+		t.Fatal(err)
+	}
+	expectCancelled(t, ctx)
+}
+
+// lifecycleRecorder counts connects and disconnects per connection
+type lifecycleRecorder struct {
+	lock         sync.Mutex
+	connected    []*StratumContext
+	disconnected map[*StratumContext]int
+}
+
+func (lr *lifecycleRecorder) OnConnect(ctx *StratumContext) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	lr.connected = append(lr.connected, ctx)
+}
+
+func (lr *lifecycleRecorder) OnDisconnect(ctx *StratumContext) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	lr.disconnected[ctx]++
+}
+
+func TestClientRegistry(t *testing.T) {
+	recorder := &lifecycleRecorder{disconnected: map[*StratumContext]int{}}
+	cfg := DefaultConfig(testLogger())
+	cfg.ClientListener = recorder
+	listener := NewListener(cfg)
+
+	clients := []net.Conn{}
+	for i := 0; i < 3; i++ {
+		client, server := net.Pipe()
+		clients = append(clients, client)
+		listener.newClient(context.Background(), server)
+	}
+	if count := listener.Clients().Len(); count != 3 {
+		t.Fatalf("expected 3 registered clients, got %d", count)
+	}
+	// pipes all share the same remote address
+	sameAddr := listener.Clients().ByAddr("pipe")
+	if len(sameAddr) != 3 {
+		t.Fatalf("expected 3 clients grouped under the same address, got %d", len(sameAddr))
+	}
+	for i, ctx := range sameAddr {
+		if found, _ := listener.Clients().Get(ctx.SessionId()); found != ctx {
+			t.Errorf("client %d not found by its session id %d", i, ctx.SessionId())
+		}
+		if i > 0 && ctx.SessionId() == sameAddr[i-1].SessionId() {
+			t.Errorf("clients %d and %d share session id %d", i-1, i, ctx.SessionId())
+		}
+	}
+
+	recorder.lock.Lock()
+	recorder.connected[0].Disconnect() // kicked and closing at the same time
+	recorder.lock.Unlock()
+	for _, c := range clients {
+		c.Close()
+	}
+	listener.workerGroup.Wait()
+
+	if count := listener.Clients().Len(); count != 0 {
+		t.Errorf("expected the registry to be empty, got %d clients", count)
+	}
+	if remaining := listener.Clients().ByAddr("pipe"); len(remaining) != 0 {
+		t.Errorf("expected the address index to be empty, got %d clients", len(remaining))
+	}
+	if d := atomic.LoadInt64(&listener.stats.Disconnects); d != 3 {
+		t.Errorf("expected 3 disconnects, got %d", d)
+	}
+	for ctx, count := range recorder.disconnected {
+		if count != 1 {
+			t.Errorf("expected a single disconnect for session %d, got %d", ctx.SessionId(), count)
+		}
+	}
+	if len(recorder.disconnected) != 3 {
+		t.Errorf("expected every client to disconnect, got %d", len(recorder.disconnected))
+	}
+}
@@ -38,14 +38,19 @@ func DefaultConfig(logger *zap.SugaredLogger) StratumListenerConfig {
 }
 
 func DefaultHandlers() StratumHandlerMap {
-	return StratumHandlerMap{
-		string(StratumMethodSubscribe): HandleSubscribe,
-		string(StratumMethodAuthorize): HandleAuthorize,
-		string(StratumMethodSubmit):    HandleSubmit,
+	return DefaultTypedHandlers[any]()
+}
+
+// DefaultTypedHandlers is DefaultHandlers for listeners with state S
+func DefaultTypedHandlers[S any]() TypedHandlerMap[S] {
+	return TypedHandlerMap[S]{
+		string(StratumMethodSubscribe): HandleSubscribe[S],
+		string(StratumMethodAuthorize): HandleAuthorize[S],
+		string(StratumMethodSubmit):    HandleSubmit[S],
 	}
 }
 
-func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
+func HandleAuthorize[S any](ctx *TypedContext[S], event JsonRpcEvent) error {
 	if len(event.Params) < 1 {
 		return fmt.Errorf("malformed event from miner, expected param[1] to be address")
 	}
@@ -69,7 +74,7 @@ func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
 	return nil
 }
 
-func HandleSubscribe(ctx *StratumContext, event JsonRpcEvent) error {
+func HandleSubscribe[S any](ctx *TypedContext[S], event JsonRpcEvent) error {
 	if err := ctx.Reply(NewResponse(event,
 		[]any{true, "EthereumStratum/1.0.0"}, nil)); err != nil {
 		return errors.Wrap(err, "failed to send response to subscribe")
@@ -85,7 +90,7 @@ func HandleSubscribe(ctx *StratumContext, event JsonRpcEvent) error {
 	return nil
 }
 
-func HandleSubmit(ctx *StratumContext, event JsonRpcEvent) error {
+func HandleSubmit[S any](ctx *TypedContext[S], event JsonRpcEvent) error {
 	// stub
 	ctx.Logger.Info("work submission")
 	return nil
@@ -12,6 +12,7 @@ import (
 type MockConnection struct {
 	id      string
 	lock    sync.Mutex // to prevent double closing of channel
+	closed  bool
 	inChan  chan []byte
 	outChan chan []byte
 }
@@ -27,9 +28,15 @@ func NewMockConnection() *MockConnection {
 	}
 }
 
+func (mc *MockConnection) readChan() chan []byte {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.inChan
+}
+
 func (mc *MockConnection) AsyncWriteTestDataToReadBuffer(s string) {
 	go func() {
-		mc.inChan <- []byte(s)
+		mc.readChan() <- []byte(s)
 	}()
 }
 
@@ -46,7 +53,7 @@ func (mc *MockConnection) AsyncReadTestDataFromBuffer(handler func([]byte)) {
 }
 
 func (mc *MockConnection) Read(b []byte) (int, error) {
-	data, ok := <-mc.inChan
+	data, ok := <-mc.readChan()
 	if !ok {
 		return 0, context.DeadlineExceeded
 	}
@@ -61,6 +68,10 @@ func (mc *MockConnection) Write(b []byte) (int, error) {
 func (mc *MockConnection) Close() error {
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
+	if mc.closed {
+		return nil
+	}
+	mc.closed = true
 	close(mc.inChan)
 	close(mc.outChan)
 	return nil
@@ -89,24 +100,19 @@ func (mc *MockConnection) SetDeadline(t time.Time) error {
 
 func (mc *MockConnection) SetReadDeadline(t time.Time) error {
 	go func() {
+		time.Sleep(time.Until(t))
 		mc.lock.Lock()
 		defer mc.lock.Unlock()
-		time.Sleep(time.Until(t))
-		close(mc.inChan)
-		mc.inChan = make(chan []byte)
+		if !mc.closed {
+			close(mc.inChan)
+			mc.inChan = make(chan []byte)
+		}
 	}()
 
 	return nil
 }
 
+// SetWriteDeadline is a no-op, writes block until the test reads them
 func (mc *MockConnection) SetWriteDeadline(t time.Time) error {
-	go func() {
-		mc.lock.Lock()
-		defer mc.lock.Unlock()
-		time.Sleep(time.Until(t))
-		close(mc.outChan)
-		mc.outChan = make(chan []byte)
-	}()
-
 	return nil
 }
@@ -0,0 +1,427 @@
+package gostratum
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	StratumMethodNotify        StratumMethod = "mining.notify"
+	StratumMethodSetDifficulty StratumMethod = "mining.set_difficulty"
+	// params are the extranonce as hex and the number of nonce bytes left to
+	// the miner
+	StratumMethodSetExtranonce StratumMethod = "mining.set_extranonce"
+)
+
+// number of jobs remembered per connection, submits against older jobs are
+// still sent, the pool decides whether they're stale
+const maxClientJobs = 32
+
+const defaultReconnectDelay = 5 * time.Second
+const defaultRequestTimeout = 30 * time.Second
+
+// ClientJob is a job received through mining.notify. Params are kept as sent
+// since the layout depends on the miner dialect the pool picked. Numbers are
+// json.Number, header words don't survive a trip through float64
+type ClientJob struct {
+	Id       string
+	Params   []any
+	Received time.Time
+}
+
+// StratumError is an error reply from the pool
+type StratumError struct {
+	Code    int
+	Message string
+}
+
+func (se *StratumError) Error() string {
+	return fmt.Sprintf("stratum error %d: %s", se.Code, se.Message)
+}
+
+// responseError converts the `[code, message, data]` error of a response
+func responseError(resp JsonRpcResponse) error {
+	if len(resp.Error) == 0 {
+		return nil
+	}
+	se := &StratumError{}
+	if code, ok := resp.Error[0].(json.Number); ok {
+		c, _ := code.Int64()
+		se.Code = int(c)
+	}
+	if len(resp.Error) > 1 {
+		se.Message, _ = resp.Error[1].(string)
+	}
+	return se
+}
+
+var ErrorShareRejected = fmt.Errorf("share rejected")
+
+type StratumClientConfig struct {
+	Address string
+	// User is sent with authorize and submit, `wallet.worker`
+	User   string
+	Agent  string
+	Logger *zap.SugaredLogger
+	// ReconnectDelay is the wait between connection attempts, 5s if unset
+	ReconnectDelay time.Duration
+	// RequestTimeout bounds how long a request waits for its response, 30s
+	// if unset
+	RequestTimeout time.Duration
+	// Dialer overrides how connections are made, mostly for tests
+	Dialer func(ctx context.Context, address string) (net.Conn, error)
+
+	// callbacks are invoked from the read loop, don't block in them
+	OnJob        func(job ClientJob)
+	OnDifficulty func(diff float64)
+	// OnEvent receives any other event from the pool
+	OnEvent func(event JsonRpcEvent)
+}
+
+// StratumClient is the miner side of a stratum v1 connection. It subscribes
+// and authorizes on connect, tracks the jobs and difficulty the pool sends,
+// correlates submits with their responses and reconnects when the connection
+// drops
+type StratumClient struct {
+	StratumClientConfig
+
+	requestId uint64
+	writeLock sync.Mutex
+
+	lock       sync.Mutex
+	conn       net.Conn
+	pending    map[string]chan JsonRpcResponse
+	jobs       map[string]ClientJob
+	jobOrder   []string
+	current    string
+	difficulty float64
+	extranonce string
+}
+
+func NewStratumClient(cfg StratumClientConfig) *StratumClient {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if cfg.ReconnectDelay == 0 {
+		cfg.ReconnectDelay = defaultReconnectDelay
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = defaultRequestTimeout
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = func(ctx context.Context, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "tcp", address)
+		}
+	}
+	cfg.Logger = cfg.Logger.With(zap.String("component", "stratum-client"),
+		zap.String("pool", cfg.Address))
+	return &StratumClient{
+		StratumClientConfig: cfg,
+		pending:             map[string]chan JsonRpcResponse{},
+		jobs:                map[string]ClientJob{},
+	}
+}
+
+// Run connects to the pool and keeps reconnecting until the context is
+// cancelled
+func (c *StratumClient) Run(ctx context.Context) error {
+	for {
+		err := c.runConnection(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.Logger.With(zap.Error(err)).Warn("pool connection lost, reconnecting")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.ReconnectDelay):
+		}
+	}
+}
+
+func (c *StratumClient) runConnection(ctx context.Context) error {
+	conn, err := c.Dialer(ctx, c.Address)
+	if err != nil {
+		return errors.Wrap(err, "failed connecting to pool")
+	}
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-connCtx.Done()
+		conn.Close()
+	}()
+
+	c.lock.Lock()
+	c.conn = conn
+	c.jobs = map[string]ClientJob{}
+	c.jobOrder = nil
+	c.current = ""
+	c.difficulty = 0
+	c.extranonce = ""
+	c.lock.Unlock()
+	defer c.disconnected()
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- c.readLoop(conn)
+		cancel()
+	}()
+
+	if _, err := c.Request(connCtx, StratumMethodSubscribe, c.Agent); err != nil {
+		return errors.Wrap(err, "subscribe failed")
+	}
+	resp, err := c.Request(connCtx, StratumMethodAuthorize, c.User, "x")
+	if err != nil {
+		return errors.Wrap(err, "authorize failed")
+	}
+	if ok, _ := resp.Result.(bool); !ok {
+		return fmt.Errorf("pool refused authorization for %s", c.User)
+	}
+	c.Logger.Info("connected and authorized as ", c.User)
+	return <-readErr
+}
+
+// disconnected drops the connection and fails any requests still waiting on
+// a response
+func (c *StratumClient) disconnected() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *StratumClient) readLoop(conn net.Conn) error {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		// events and responses share the connection, an event has a method
+		msg := struct {
+			JsonRpcEvent
+			Result any   `json:"result"`
+			Error  []any `json:"error"`
+		}{}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&msg); err != nil {
+			c.Logger.With(zap.Error(err)).Warn("malformed message from pool")
+			continue
+		}
+		if msg.Method != "" {
+			c.handleEvent(msg.JsonRpcEvent)
+			continue
+		}
+		c.handleResponse(JsonRpcResponse{Id: msg.Id, Result: msg.Result, Error: msg.Error})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return ErrorDisconnected
+}
+
+func (c *StratumClient) handleEvent(event JsonRpcEvent) {
+	switch event.Method {
+	case StratumMethodSetDifficulty:
+		if len(event.Params) < 1 {
+			c.Logger.Warn("set_difficulty without a difficulty")
+			return
+		}
+		number, ok := event.Params[0].(json.Number)
+		if !ok {
+			c.Logger.Warn(fmt.Sprintf("unexpected difficulty %+v", event.Params[0]))
+			return
+		}
+		diff, err := number.Float64()
+		if err != nil {
+			c.Logger.Warn(fmt.Sprintf("unexpected difficulty %s", number))
+			return
+		}
+		c.lock.Lock()
+		c.difficulty = diff
+		c.lock.Unlock()
+		if c.OnDifficulty != nil {
+			c.OnDifficulty(diff)
+		}
+	case StratumMethodSetExtranonce:
+		extranonce, ok := "", len(event.Params) > 0
+		if ok {
+			extranonce, ok = event.Params[0].(string)
+		}
+		if !ok || len(extranonce) > 16 {
+			c.Logger.Warn(fmt.Sprintf("unexpected extranonce %+v", event.Params))
+			return
+		}
+		c.lock.Lock()
+		c.extranonce = extranonce
+		c.lock.Unlock()
+		if c.OnEvent != nil {
+			c.OnEvent(event)
+		}
+	case StratumMethodNotify:
+		if len(event.Params) < 1 {
+			c.Logger.Warn("notify without a job id")
+			return
+		}
+		job := ClientJob{
+			Id:       fmt.Sprint(event.Params[0]),
+			Params:   event.Params[1:],
+			Received: time.Now(),
+		}
+		c.lock.Lock()
+		c.jobs[job.Id] = job
+		c.jobOrder = append(c.jobOrder, job.Id)
+		for len(c.jobOrder) > maxClientJobs {
+			delete(c.jobs, c.jobOrder[0])
+			c.jobOrder = c.jobOrder[1:]
+		}
+		c.current = job.Id
+		c.lock.Unlock()
+		if c.OnJob != nil {
+			c.OnJob(job)
+		}
+	default:
+		if c.OnEvent != nil {
+			c.OnEvent(event)
+		}
+	}
+}
+
+func (c *StratumClient) handleResponse(resp JsonRpcResponse) {
+	id := fmt.Sprint(resp.Id)
+	c.lock.Lock()
+	ch, exists := c.pending[id]
+	delete(c.pending, id)
+	c.lock.Unlock()
+	if !exists {
+		c.Logger.Debug("response for unknown request ", id)
+		return
+	}
+	ch <- resp
+}
+
+// Request sends a request to the pool and waits for the matching response
+func (c *StratumClient) Request(ctx context.Context, method StratumMethod, params ...any) (JsonRpcResponse, error) {
+	id := atomic.AddUint64(&c.requestId, 1)
+	key := fmt.Sprint(id)
+	respChan := make(chan JsonRpcResponse, 1)
+
+	c.lock.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.lock.Unlock()
+		return JsonRpcResponse{}, ErrorDisconnected
+	}
+	c.pending[key] = respChan
+	c.lock.Unlock()
+
+	encoded, err := json.Marshal(JsonRpcEvent{
+		Id:      id,
+		Version: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		c.dropRequest(key)
+		return JsonRpcResponse{}, errors.Wrap(err, "failed encoding jsonrpc request")
+	}
+	c.writeLock.Lock()
+	_, err = conn.Write(append(encoded, '\n'))
+	c.writeLock.Unlock()
+	if err != nil {
+		c.dropRequest(key)
+		return JsonRpcResponse{}, errors.Wrap(err, "failed writing to pool")
+	}
+
+	timeout := time.NewTimer(c.RequestTimeout)
+	defer timeout.Stop()
+	select {
+	case resp, ok := <-respChan:
+		if !ok {
+			return JsonRpcResponse{}, ErrorDisconnected
+		}
+		return resp, responseError(resp)
+	case <-timeout.C:
+		c.dropRequest(key)
+		return JsonRpcResponse{}, fmt.Errorf("no response to %s after %s", method, c.RequestTimeout)
+	case <-ctx.Done():
+		c.dropRequest(key)
+		return JsonRpcResponse{}, ctx.Err()
+	}
+}
+
+func (c *StratumClient) dropRequest(key string) {
+	c.lock.Lock()
+	delete(c.pending, key)
+	c.lock.Unlock()
+}
+
+// Submit sends a share for the given job and waits for the verdict. A
+// rejected share returns the pool's *StratumError, or ErrorShareRejected if
+// the pool didn't say why
+func (c *StratumClient) Submit(ctx context.Context, jobId string, nonce uint64) error {
+	resp, err := c.Request(ctx, StratumMethodSubmit, c.User, jobId, fmt.Sprintf("0x%016x", nonce))
+	if err != nil {
+		return err
+	}
+	if ok, _ := resp.Result.(bool); !ok {
+		return ErrorShareRejected
+	}
+	return nil
+}
+
+// Connected reports whether there is a live connection to the pool
+func (c *StratumClient) Connected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn != nil
+}
+
+// Difficulty is the last share difficulty set by the pool, 0 until one is set
+func (c *StratumClient) Difficulty() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.difficulty
+}
+
+// Extranonce is the nonce prefix assigned by the pool as hex, empty if the
+// pool didn't assign one. Shares must start with it
+func (c *StratumClient) Extranonce() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.extranonce
+}
+
+// CurrentJob is the most recent job sent by the pool
+func (c *StratumClient) CurrentJob() (ClientJob, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	job, exists := c.jobs[c.current]
+	return job, exists
+}
+
+// Job looks up one of the recent jobs by id
+func (c *StratumClient) Job(id string) (ClientJob, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	job, exists := c.jobs[id]
+	return job, exists
+}
@@ -0,0 +1,110 @@
+package gostratum
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testPool runs a listener with handlers that hand out a job on authorize and
+// accept shares with even nonces
+func testPool(ctx context.Context) *StratumListener {
+	handlers := DefaultHandlers()
+	handlers[string(StratumMethodAuthorize)] = func(ctx *StratumContext, event JsonRpcEvent) error {
+		if err := HandleAuthorize(ctx, event); err != nil {
+			return err
+		}
+		if err := ctx.Send(NewEvent("", string(StratumMethodSetDifficulty), []any{4})); err != nil {
+			return err
+		}
+		return ctx.Send(NewEvent("", string(StratumMethodNotify), []any{"job1", []uint64{1, 2, 3, math.MaxUint64}, 1000}))
+	}
+	handlers[string(StratumMethodSubmit)] = func(ctx *StratumContext, event JsonRpcEvent) error {
+		nonce, _ := strconv.ParseUint(strings.TrimPrefix(event.Params[2].(string), "0x"), 16, 64)
+		if event.Params[1] != "job1" {
+			return ctx.ReplyStaleShare(event.Id)
+		}
+		return ctx.Reply(NewResponse(event, nonce%2 == 0, nil))
+	}
+	cfg := DefaultConfig(testLogger())
+	cfg.HandlerMap = handlers
+	listener := NewListener(cfg)
+	return listener
+}
+
+// pipeDialer connects the client to the listener over in-memory pipes
+func pipeDialer(ctx context.Context, listener *StratumListener, conns chan net.Conn) func(context.Context, string) (net.Conn, error) {
+	return func(context.Context, string) (net.Conn, error) {
+		client, server := net.Pipe()
+		listener.newClient(ctx, server)
+		conns <- server
+		return client, nil
+	}
+}
+
+func TestStratumClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	listener := testPool(ctx)
+
+	conns := make(chan net.Conn, 2)
+	jobs := make(chan ClientJob, 2)
+	client := NewStratumClient(StratumClientConfig{
+		Address:        "pool",
+		User:           "kaspa:abc.rig",
+		Agent:          "test/1.0",
+		Logger:         testLogger(),
+		ReconnectDelay: 10 * time.Millisecond,
+		Dialer:         pipeDialer(ctx, listener, conns),
+		OnJob:          func(job ClientJob) { jobs <- job },
+	})
+	go client.Run(ctx)
+
+	job := <-jobs
+	expected := []any{[]any{json.Number("1"), json.Number("2"), json.Number("3"),
+		json.Number("18446744073709551615")}, json.Number("1000")}
+	if d := cmp.Diff(expected, job.Params); job.Id != "job1" || d != "" {
+		t.Fatalf("unexpected job %s: %s", job.Id, d)
+	}
+	if client.Difficulty() != 4 {
+		t.Fatalf("expected difficulty 4, got %f", client.Difficulty())
+	}
+	if current, _ := client.CurrentJob(); current.Id != "job1" {
+		t.Fatalf("expected job1 to be current, got %s", current.Id)
+	}
+
+	if err := client.Submit(ctx, "job1", 2); err != nil {
+		t.Fatalf("expected share to be accepted, got %s", err)
+	}
+	if err := client.Submit(ctx, "job1", 3); err != ErrorShareRejected {
+		t.Fatalf("expected share to be rejected, got %v", err)
+	}
+	err := client.Submit(ctx, "job0", 2)
+	if se, ok := err.(*StratumError); !ok || se.Code != 21 {
+		t.Fatalf("expected stale share error, got %v", err)
+	}
+
+	// drop the connection, the client should come back and get a fresh job
+	(<-conns).Close()
+	job = <-jobs
+	if job.Id != "job1" {
+		t.Fatalf("expected job after reconnect, got %s", job.Id)
+	}
+	if err := client.Submit(ctx, "job1", 4); err != nil {
+		t.Fatalf("expected share to be accepted after reconnect, got %s", err)
+	}
+}
+
+func TestStratumClientDisconnectedSubmit(t *testing.T) {
+	client := NewStratumClient(StratumClientConfig{Address: "pool"})
+	if err := client.Submit(context.Background(), "job1", 1); err != ErrorDisconnected {
+		t.Fatalf("expected submit without connection to fail, got %v", err)
+	}
+}
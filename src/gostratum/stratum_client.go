@@ -12,10 +12,11 @@ import (
 	"go.uber.org/zap"
 )
 
-func spawnClientListener(ctx *StratumContext, connection net.Conn, s *StratumListener) error {
+func spawnClientListener[S any](ctx *TypedContext[S], connection net.Conn, s *TypedListener[S]) error {
+	defer s.workerGroup.Done()
 	defer func() {
-		connection.Close()
-		s.disconnectChannel <- ctx
+		ctx.Disconnect()
+		s.disconnect(ctx)
 	}()
 
 	for {
@@ -26,12 +27,12 @@ func spawnClientListener(ctx *StratumContext, connection net.Conn, s *StratumLis
 			}
 			return s.HandleEvent(ctx, event)
 		})
+		if ctx.Err() != nil {
+			return ctx.Err() // kicked or server shutting down
+		}
 		if errors.Is(err, os.ErrDeadlineExceeded) {
 			continue // expected timeout
 		}
-		if ctx.Err() != nil {
-			return ctx.Err() // context cancelled
-		}
 		if err != nil { // actual error
 			ctx.Logger.Error("error reading from socket", zap.Error(err))
 			return err
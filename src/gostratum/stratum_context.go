@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,75 +13,178 @@ import (
 	"go.uber.org/zap"
 )
 
-type StratumContext struct {
-	ctx           context.Context
-	RemoteAddr    string
-	WalletAddr    string
-	WorkerName    string
-	RemoteApp     string
-	Logger        *zap.SugaredLogger
-	connection    net.Conn
-	disconnecting bool
-	onDisconnect  chan *StratumContext
-	State         any // gross, but go generics aren't mature enough this can be typed 😭
+// TypedContext is a miner connection along with the state S the listener's
+// StateGenerator created for it. It is also the context of anything done on
+// behalf of the miner, it's cancelled once the miner disconnects, is kicked or
+// the server shuts down
+type TypedContext[S any] struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	id         uint64
+	since      time.Time
+	RemoteAddr string
+	WalletAddr string
+	WorkerName string
+	RemoteApp  string
+	Logger     *zap.SugaredLogger
+	connection net.Conn
+	outbound   chan []byte
+	State      S
 }
 
-func NewMockContext(ctx context.Context, logger *zap.SugaredLogger, state any) (*StratumContext, *MockConnection) {
-	mc := NewMockConnection()
-	return &StratumContext{
+type StratumContext = TypedContext[any]
+
+const (
+	defaultOutboundQueue = 32
+	defaultWriteTimeout  = 10 * time.Second
+)
+
+var sessionCounter uint64
+
+// writerConfig bounds what a connection buffers for a slow miner
+type writerConfig struct {
+	queue   int
+	timeout time.Duration
+}
+
+var defaultWriterConfig = writerConfig{queue: defaultOutboundQueue, timeout: defaultWriteTimeout}
+
+// newContext derives the connection's context from parent and, if there is a
+// connection, starts the writer that owns it
+func newContext[S any](parent context.Context, connection net.Conn, logger *zap.SugaredLogger, state S,
+	wc writerConfig) *TypedContext[S] {
+	ctx, cancel := context.WithCancel(parent)
+	sc := &TypedContext[S]{
 		ctx:        ctx,
+		cancel:     cancel,
+		id:         atomic.AddUint64(&sessionCounter, 1),
+		since:      time.Now(),
+		connection: connection,
 		State:      state,
-		RemoteAddr: "127.0.0.1",
-		WalletAddr: uuid.NewString(),
-		WorkerName: uuid.NewString(),
-		RemoteApp:  "mock.context",
-		Logger:     logger,
-		connection: mc,
-	}, mc
+	}
+	if logger != nil {
+		sc.Logger = logger.With(zap.Uint64("session", sc.id))
+	}
+	if connection != nil {
+		sc.outbound = make(chan []byte, wc.queue)
+		go sc.writer(wc.timeout)
+	}
+	return sc
+}
+
+// writer is the only thing writing to or closing the connection. Messages go
+// out in the order they were queued, a failed or timed out write disconnects
+// the miner. The connection is closed once the context is cancelled so a
+// blocked read returns
+func (sc *TypedContext[S]) writer(timeout time.Duration) {
+	defer sc.connection.Close()
+	for {
+		select {
+		case <-sc.ctx.Done():
+			return
+		case msg := <-sc.outbound:
+			if err := sc.connection.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+				sc.Disconnect()
+				return
+			}
+			if _, err := sc.connection.Write(msg); err != nil {
+				sc.Logger.With(zap.Error(err)).Warn("error writing to socket, disconnecting")
+				sc.Disconnect()
+				return
+			}
+		}
+	}
+}
+
+func NewMockContext[S any](ctx context.Context, logger *zap.SugaredLogger, state S) (*TypedContext[S], *MockConnection) {
+	mc := NewMockConnection()
+	sc := newContext(ctx, net.Conn(mc), logger, state, defaultWriterConfig)
+	sc.RemoteAddr = "127.0.0.1"
+	sc.WalletAddr = uuid.NewString()
+	sc.WorkerName = uuid.NewString()
+	sc.RemoteApp = "mock.context"
+	return sc, mc
+}
+
+// NewDetachedContext creates a context for a miner that doesn't talk json-rpc
+// over its own socket, e.g. a stratum v2 channel, so it can still be handed to
+// the share handlers and metrics. Reply and Send always fail on it
+func NewDetachedContext[S any](ctx context.Context, logger *zap.SugaredLogger, remoteAddr, remoteApp string, state S) *TypedContext[S] {
+	sc := newContext[S](ctx, nil, logger, state, defaultWriterConfig)
+	sc.RemoteAddr = remoteAddr
+	sc.RemoteApp = remoteApp
+	return sc
 }
 
 var ErrorDisconnected = fmt.Errorf("disconnecting")
+var ErrorDetached = fmt.Errorf("context has no stratum connection")
+var ErrorQueueFull = fmt.Errorf("outbound queue full, miner is not reading")
 
-func (sc *StratumContext) Connected() bool {
-	return !sc.disconnecting
+// SessionId identifies the connection, unlike RemoteAddr it's unique even
+// when several rigs connect from the same IP
+func (sc *TypedContext[S]) SessionId() uint64 {
+	return sc.id
 }
 
-func (sc *StratumContext) Reply(response JsonRpcResponse) error {
-	if sc.disconnecting {
-		return ErrorDisconnected
-	}
+// ConnectedAt is when the miner connected
+func (sc *TypedContext[S]) ConnectedAt() time.Time {
+	return sc.since
+}
+
+func (sc *TypedContext[S]) Connected() bool {
+	return sc.ctx.Err() == nil
+}
+
+// Disconnect kicks the miner, cancelling the context and closing the socket
+func (sc *TypedContext[S]) Disconnect() {
+	sc.cancel()
+}
+
+func (sc *TypedContext[S]) Reply(response JsonRpcResponse) error {
 	encoded, err := json.Marshal(response)
 	if err != nil {
 		return errors.Wrap(err, "failed encoding jsonrpc response")
 	}
-	encoded = append(encoded, '\n')
-	_, err = sc.connection.Write(encoded)
-	sc.checkDisconnect(err)
-	return err
+	return sc.write(encoded)
 }
 
-func (sc *StratumContext) Send(event JsonRpcEvent) error {
-	if sc.disconnecting {
-		return ErrorDisconnected
-	}
+func (sc *TypedContext[S]) Send(event JsonRpcEvent) error {
 	encoded, err := json.Marshal(event)
 	if err != nil {
 		return errors.Wrap(err, "failed encoding jsonrpc event")
 	}
+	return sc.write(encoded)
+}
+
+// write queues a message for the writer. A miner that lets its queue fill up
+// is disconnected rather than blocking the caller
+func (sc *TypedContext[S]) write(encoded []byte) error {
+	if !sc.Connected() {
+		return ErrorDisconnected
+	}
+	if sc.connection == nil {
+		return ErrorDetached
+	}
 	encoded = append(encoded, '\n')
-	_, err = sc.connection.Write(encoded)
-	sc.checkDisconnect(err)
-	return err
+	select {
+	case sc.outbound <- encoded:
+		return nil
+	case <-sc.ctx.Done():
+		return ErrorDisconnected
+	default:
+		sc.Disconnect()
+		return ErrorQueueFull
+	}
 }
 
-func (sc *StratumContext) ReplyStaleShare(id any) error {
+func (sc *TypedContext[S]) ReplyStaleShare(id any) error {
 	return sc.Reply(JsonRpcResponse{
 		Id:     id,
 		Result: nil,
 		Error:  []any{21, "Job not found", nil},
 	})
 }
-func (sc *StratumContext) ReplyDupeShare(id any) error {
+func (sc *TypedContext[S]) ReplyDupeShare(id any) error {
 	return sc.Reply(JsonRpcResponse{
 		Id:     id,
 		Result: nil,
@@ -88,7 +192,7 @@ func (sc *StratumContext) ReplyDupeShare(id any) error {
 	})
 }
 
-func (sc *StratumContext) ReplyBadShare(id any) error {
+func (sc *TypedContext[S]) ReplyBadShare(id any) error {
 	return sc.Reply(JsonRpcResponse{
 		Id:     id,
 		Result: nil,
@@ -96,7 +200,7 @@ func (sc *StratumContext) ReplyBadShare(id any) error {
 	})
 }
 
-func (sc *StratumContext) ReplyLowDiffShare(id any) error {
+func (sc *TypedContext[S]) ReplyLowDiffShare(id any) error {
 	return sc.Reply(JsonRpcResponse{
 		Id:     id,
 		Result: nil,
@@ -104,27 +208,20 @@ func (sc *StratumContext) ReplyLowDiffShare(id any) error {
 	})
 }
 
-func (sc *StratumContext) checkDisconnect(err error) {
-	if err != nil { // actual error
-		sc.disconnecting = true
-		sc.onDisconnect <- sc
-	}
-}
-
 // Context interface impl
 
-func (StratumContext) Deadline() (time.Time, bool) {
-	return time.Time{}, false
+func (sc *TypedContext[S]) Deadline() (time.Time, bool) {
+	return sc.ctx.Deadline()
 }
 
-func (StratumContext) Done() <-chan struct{} {
-	return nil
+func (sc *TypedContext[S]) Done() <-chan struct{} {
+	return sc.ctx.Done()
 }
 
-func (StratumContext) Err() error {
-	return nil
+func (sc *TypedContext[S]) Err() error {
+	return sc.ctx.Err()
 }
 
-func (d StratumContext) Value(key any) any {
-	return d.ctx.Value(key)
+func (sc *TypedContext[S]) Value(key any) any {
+	return sc.ctx.Value(key)
 }
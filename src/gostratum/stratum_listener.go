@@ -5,50 +5,66 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
-type DisconnectChannel chan *StratumContext
-type StateGenerator func() any
-type EventHandler func(ctx *StratumContext, event JsonRpcEvent) error
+// The listener types are generic over the per connection state S so handlers
+// get their state typed. The non-generic names are the `any` flavor for users
+// that don't keep any state
 
-type StratumClientListener interface {
-	OnConnect(ctx *StratumContext)
-	OnDisconnect(ctx *StratumContext)
+type TypedStateGenerator[S any] func() S
+type TypedEventHandler[S any] func(ctx *TypedContext[S], event JsonRpcEvent) error
+
+type TypedClientListener[S any] interface {
+	OnConnect(ctx *TypedContext[S])
+	OnDisconnect(ctx *TypedContext[S])
 }
 
-type StratumHandlerMap map[string]EventHandler
+type TypedHandlerMap[S any] map[string]TypedEventHandler[S]
+
+type StateGenerator = TypedStateGenerator[any]
+type EventHandler = TypedEventHandler[any]
+type StratumClientListener = TypedClientListener[any]
+type StratumHandlerMap = TypedHandlerMap[any]
 
 type StratumStats struct {
 	Disconnects int64
 }
 
-type StratumListenerConfig struct {
+type TypedListenerConfig[S any] struct {
 	Logger         *zap.SugaredLogger
-	HandlerMap     StratumHandlerMap
-	ClientListener StratumClientListener
-	StateGenerator StateGenerator
+	HandlerMap     TypedHandlerMap[S]
+	ClientListener TypedClientListener[S]
+	StateGenerator TypedStateGenerator[S]
 	Port           string
+	// OutboundQueue is how many messages are buffered for a client before
+	// it's considered stuck and disconnected, 32 if 0
+	OutboundQueue int
+	// WriteTimeout bounds a single write to a client, 10s if 0
+	WriteTimeout time.Duration
 }
 
-type StratumListener struct {
-	StratumListenerConfig
+type TypedListener[S any] struct {
+	TypedListenerConfig[S]
 
-	clients           sync.Map
-	shuttingDown      bool
-	disconnectChannel DisconnectChannel
-	stats             StratumStats
-	workerGroup       sync.WaitGroup
+	clients     *ClientRegistry[S]
+	stats       StratumStats
+	workerGroup sync.WaitGroup
+	accepting   int32 // see Accepting
 }
 
-func NewListener(cfg StratumListenerConfig) *StratumListener {
-	listener := &StratumListener{
-		StratumListenerConfig: cfg,
-		clients:               sync.Map{},
-		workerGroup:           sync.WaitGroup{},
-		disconnectChannel:     make(DisconnectChannel),
+type StratumListenerConfig = TypedListenerConfig[any]
+type StratumListener = TypedListener[any]
+
+func NewListener[S any](cfg TypedListenerConfig[S]) *TypedListener[S] {
+	listener := &TypedListener[S]{
+		TypedListenerConfig: cfg,
+		clients:             NewClientRegistry[S](),
+		workerGroup:         sync.WaitGroup{},
 	}
 
 	listener.Logger = listener.Logger.With(
@@ -58,16 +74,26 @@ func NewListener(cfg StratumListenerConfig) *StratumListener {
 
 	if listener.StateGenerator == nil {
 		listener.Logger.Warn("no state generator provided, using default")
-		listener.StateGenerator = func() any { return nil }
+		listener.StateGenerator = func() S {
+			var zero S
+			return zero
+		}
+	}
+
+	if listener.OutboundQueue <= 0 {
+		listener.OutboundQueue = defaultOutboundQueue
+	}
+	if listener.WriteTimeout <= 0 {
+		listener.WriteTimeout = defaultWriteTimeout
 	}
 
 	return listener
 }
 
-func (s *StratumListener) Listen(ctx context.Context) error {
-	s.shuttingDown = false
-
-	serverContext, cancel := context.WithCancel(context.Background())
+func (s *TypedListener[S]) Listen(ctx context.Context) error {
+	// clients derive their contexts from this one so they're all
+	// disconnected once the server shuts down
+	serverContext, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	lc := net.ListenConfig{}
@@ -76,45 +102,51 @@ func (s *StratumListener) Listen(ctx context.Context) error {
 		return errors.Wrapf(err, "failed listening to socket %s", s.Port)
 	}
 	defer server.Close()
+	atomic.StoreInt32(&s.accepting, 1)
+	defer atomic.StoreInt32(&s.accepting, 0)
 
-	go s.disconnectListener(serverContext)
+	s.workerGroup.Add(1)
 	go s.tcpListener(serverContext, server)
 
 	// block here until the context is killed
 	<-ctx.Done() // context cancelled, so kill the server
-	s.shuttingDown = true
 	server.Close()
 	s.workerGroup.Wait()
 	return context.Canceled
 }
 
-func (s *StratumListener) newClient(ctx context.Context, connection net.Conn) {
+func (s *TypedListener[S]) newClient(ctx context.Context, connection net.Conn) {
 	addr := connection.RemoteAddr().String()
 	parts := strings.Split(addr, ":")
 	if len(parts) > 0 {
 		addr = parts[0] // trim off the port
 	}
-	clientContext := &StratumContext{
-		ctx:          ctx,
-		RemoteAddr:   addr,
-		Logger:       s.Logger.With(zap.String("client", addr)),
-		connection:   connection,
-		State:        s.StateGenerator(),
-		onDisconnect: s.disconnectChannel,
-	}
+	clientContext := newContext(ctx, connection, s.Logger.With(zap.String("client", addr)),
+		s.StateGenerator(), writerConfig{queue: s.OutboundQueue, timeout: s.WriteTimeout})
+	clientContext.RemoteAddr = addr
 
-	s.Logger.Info("new client connecting - ", addr)
-	s.clients.Store(addr, &clientContext)
+	clientContext.Logger.Info("new client connecting")
+	s.clients.Add(clientContext)
 
 	if s.ClientListener != nil { // TODO: should this be before we spawn the handler?
 		s.ClientListener.OnConnect(clientContext)
 	}
 
+	s.workerGroup.Add(1)
 	go spawnClientListener(clientContext, connection, s)
+}
 
+// Accepting reports whether the listener is up and its last accept succeeded
+func (s *TypedListener[S]) Accepting() bool {
+	return atomic.LoadInt32(&s.accepting) == 1
 }
 
-func (s *StratumListener) HandleEvent(ctx *StratumContext, event JsonRpcEvent) error {
+// Clients are the currently connected clients
+func (s *TypedListener[S]) Clients() *ClientRegistry[S] {
+	return s.clients
+}
+
+func (s *TypedListener[S]) HandleEvent(ctx *TypedContext[S], event JsonRpcEvent) error {
 	if handler, exists := s.HandlerMap[string(event.Method)]; exists {
 		return handler(ctx, event)
 	}
@@ -122,40 +154,33 @@ func (s *StratumListener) HandleEvent(ctx *StratumContext, event JsonRpcEvent) e
 	return nil
 }
 
-func (s *StratumListener) disconnectListener(ctx context.Context) {
-	s.workerGroup.Add(1)
-	defer s.workerGroup.Done()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case client := <-s.disconnectChannel:
-			_, exists := s.clients.LoadAndDelete(client)
-			if exists {
-				s.Logger.Info("client disconnecting - ", client.RemoteAddr)
-				s.stats.Disconnects++
-
-				if s.ClientListener != nil {
-					s.ClientListener.OnDisconnect(client)
-				}
-			}
+// disconnect is called once the client's read loop exits, by then its
+// context has been cancelled
+func (s *TypedListener[S]) disconnect(client *TypedContext[S]) {
+	if s.clients.Remove(client) {
+		client.Logger.Info("client disconnecting")
+		atomic.AddInt64(&s.stats.Disconnects, 1)
+
+		if s.ClientListener != nil {
+			s.ClientListener.OnDisconnect(client)
 		}
 	}
 }
 
-func (s *StratumListener) tcpListener(ctx context.Context, server net.Listener) {
-	s.workerGroup.Add(1)
+func (s *TypedListener[S]) tcpListener(ctx context.Context, server net.Listener) {
 	defer s.workerGroup.Done()
 	for { // listen and spin forever
 		connection, err := server.Accept()
 		if err != nil {
-			if s.shuttingDown {
+			if ctx.Err() != nil {
 				s.Logger.Error("stopping listening due to server shutdown")
 				return
 			}
 			s.Logger.Error("failed to accept incoming connection", zap.Error(err))
+			atomic.StoreInt32(&s.accepting, 0)
 			continue
 		}
+		atomic.StoreInt32(&s.accepting, 1)
 		s.newClient(ctx, connection)
 	}
 }
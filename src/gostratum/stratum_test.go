@@ -32,6 +32,28 @@ func TestAcceptContextLifetime(t *testing.T) {
 	listener.Listen(ctx)
 }
 
+func TestListenerAccepting(t *testing.T) {
+	cfg := DefaultConfig(testLogger())
+	cfg.Port = "127.0.0.1:0"
+	listener := NewListener(cfg)
+	if listener.Accepting() {
+		t.Fatal("expected a listener that hasn't started to not be accepting")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- listener.Listen(ctx) }()
+	for deadline := time.Now().Add(time.Second); !listener.Accepting(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the listener to be accepting")
+		}
+	}
+	cancel()
+	<-stopped
+	if listener.Accepting() {
+		t.Error("expected a stopped listener to not be accepting")
+	}
+}
+
 func TestNewClient(t *testing.T) {
 	logger := testLogger()
 	listener := NewListener(DefaultConfig(logger))
@@ -68,3 +90,30 @@ func TestNewClient(t *testing.T) {
 		t.Fatalf("failed to properly respond to authorize")
 	}
 }
+
+func TestTypedState(t *testing.T) {
+	type counter struct{ authorized int }
+	handlers := DefaultTypedHandlers[*counter]()
+	authorize := handlers[string(StratumMethodAuthorize)]
+	handlers[string(StratumMethodAuthorize)] = func(ctx *TypedContext[*counter], event JsonRpcEvent) error {
+		ctx.State.authorized++ // no assertion needed
+		return authorize(ctx, event)
+	}
+	listener := NewListener(TypedListenerConfig[*counter]{
+		Logger:         testLogger(),
+		HandlerMap:     handlers,
+		StateGenerator: func() *counter { return &counter{} },
+	})
+
+	ctx, mc := NewMockContext(context.Background(), testLogger(), listener.StateGenerator())
+	mc.AsyncReadTestDataFromBuffer(func(b []byte) {})
+	if err := listener.HandleEvent(ctx, NewEvent("1", string(StratumMethodAuthorize), []any{"kaspa:a.rig1"})); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.State.authorized != 1 {
+		t.Errorf("expected the typed state to be updated, got %d", ctx.State.authorized)
+	}
+	if ctx.WalletAddr != "kaspa:a" || ctx.WorkerName != "rig1" {
+		t.Errorf("expected the default handler to run, got wallet '%s' worker '%s'", ctx.WalletAddr, ctx.WorkerName)
+	}
+}
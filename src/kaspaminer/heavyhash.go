@@ -0,0 +1,164 @@
+package kaspaminer
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"math/bits"
+
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/hashes"
+)
+
+// kHeavyHash as implemented in kaspad's pow package. kaspad only exposes it
+// through a full block header, a miner only ever has the pre-pow hash, so the
+// matrix generation and heavy hash are reimplemented here. Tests check the
+// result against kaspad for a real header
+
+const eps float64 = 1e-9
+
+type matrix [64][64]uint16
+
+// Hasher computes pow values for a single job
+type Hasher struct {
+	mat        matrix
+	prePowHash [32]byte
+	timestamp  int64
+}
+
+func NewHasher(prePowHash [32]byte, timestamp int64) *Hasher {
+	return &Hasher{
+		mat:        *generateMatrix(prePowHash),
+		prePowHash: prePowHash,
+		timestamp:  timestamp,
+	}
+}
+
+// Hash returns the pow value of the nonce as a number, a share is valid when
+// it is less or equal than the target
+func (h *Hasher) Hash(nonce uint64) *big.Int {
+	// PRE_POW_HASH || TIME || 32 zero byte padding || NONCE
+	writer := hashes.NewPoWHashWriter()
+	writer.InfallibleWrite(h.prePowHash[:])
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(h.timestamp))
+	writer.InfallibleWrite(buf)
+	zeroes := [32]byte{}
+	writer.InfallibleWrite(zeroes[:])
+	binary.LittleEndian.PutUint64(buf, nonce)
+	writer.InfallibleWrite(buf)
+	powHash := writer.Finalize()
+
+	heavy := h.mat.heavyHash(powHash)
+	// little endian for pow purposes, big.Int wants big endian
+	out := heavy.ByteArray()
+	for i := 0; i < len(out)/2; i++ {
+		out[i], out[len(out)-1-i] = out[len(out)-1-i], out[i]
+	}
+	return new(big.Int).SetBytes(out[:])
+}
+
+func generateMatrix(hash [32]byte) *matrix {
+	var mat matrix
+	generator := newXoShiRo256PlusPlus(hash)
+	for {
+		for i := range mat {
+			for j := 0; j < 64; j += 16 {
+				val := generator.Uint64()
+				for shift := 0; shift < 16; shift++ {
+					mat[i][j+shift] = uint16(val >> (4 * shift) & 0x0F)
+				}
+			}
+		}
+		if mat.computeRank() == 64 {
+			return &mat
+		}
+	}
+}
+
+func (mat *matrix) computeRank() int {
+	var B [64][64]float64
+	for i := range B {
+		for j := range B[0] {
+			B[i][j] = float64(mat[i][j])
+		}
+	}
+	var rank int
+	var rowSelected [64]bool
+	for i := 0; i < 64; i++ {
+		var j int
+		for j = 0; j < 64; j++ {
+			if !rowSelected[j] && math.Abs(B[j][i]) > eps {
+				break
+			}
+		}
+		if j != 64 {
+			rank++
+			rowSelected[j] = true
+			for p := i + 1; p < 64; p++ {
+				B[j][p] /= B[j][i]
+			}
+			for k := 0; k < 64; k++ {
+				if k != j && math.Abs(B[k][i]) > eps {
+					for p := i + 1; p < 64; p++ {
+						B[k][p] -= B[j][p] * B[k][i]
+					}
+				}
+			}
+		}
+	}
+	return rank
+}
+
+func (mat *matrix) heavyHash(hash *externalapi.DomainHash) *externalapi.DomainHash {
+	hashBytes := hash.ByteArray()
+	var vector [64]uint16
+	var product [64]uint16
+	for i := 0; i < 32; i++ {
+		vector[2*i] = uint16(hashBytes[i] >> 4)
+		vector[2*i+1] = uint16(hashBytes[i] & 0x0F)
+	}
+	// matrix-vector multiplication, and convert to 4 bits
+	for i := 0; i < 64; i++ {
+		var sum uint16
+		for j := 0; j < 64; j++ {
+			sum += mat[i][j] * vector[j]
+		}
+		product[i] = sum >> 10
+	}
+
+	// concatenate 4 LSBs back to 8 bit xor with sum1
+	var res [32]byte
+	for i := range res {
+		res[i] = hashBytes[i] ^ (byte(product[2*i]<<4) | byte(product[2*i+1]))
+	}
+	writer := hashes.NewHeavyHashWriter()
+	writer.InfallibleWrite(res[:])
+	return writer.Finalize()
+}
+
+type xoShiRo256PlusPlus struct {
+	s0, s1, s2, s3 uint64
+}
+
+func newXoShiRo256PlusPlus(hash [32]byte) *xoShiRo256PlusPlus {
+	return &xoShiRo256PlusPlus{
+		s0: binary.LittleEndian.Uint64(hash[:8]),
+		s1: binary.LittleEndian.Uint64(hash[8:16]),
+		s2: binary.LittleEndian.Uint64(hash[16:24]),
+		s3: binary.LittleEndian.Uint64(hash[24:32]),
+	}
+}
+
+func (x *xoShiRo256PlusPlus) Uint64() uint64 {
+	res := bits.RotateLeft64(x.s0+x.s3, 23) + x.s0
+	t := x.s1 << 17
+	x.s2 ^= x.s0
+	x.s3 ^= x.s1
+	x.s1 ^= x.s2
+	x.s0 ^= x.s3
+
+	x.s2 ^= t
+	x.s3 = bits.RotateLeft64(x.s3, 45)
+	return res
+}
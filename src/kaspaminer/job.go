@@ -0,0 +1,85 @@
+package kaspaminer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+)
+
+// Job is a mining.notify decoded back into what the pow function needs
+type Job struct {
+	Id         string
+	PrePowHash [32]byte
+	Timestamp  int64
+}
+
+// DecodeJob understands both job formats the bridge sends: four little endian
+// header words followed by the timestamp (see GenerateJobHeader), or a single
+// hex string of the header and little endian timestamp (see
+// GenerateLargeJobParams)
+func DecodeJob(cj gostratum.ClientJob) (Job, error) {
+	job := Job{Id: cj.Id}
+	if len(cj.Params) < 1 {
+		return job, fmt.Errorf("job %s has no params", cj.Id)
+	}
+	switch header := cj.Params[0].(type) {
+	case string:
+		raw, err := hex.DecodeString(header)
+		if err != nil || len(raw) != 40 {
+			return job, fmt.Errorf("job %s: malformed header '%s'", cj.Id, header)
+		}
+		copy(job.PrePowHash[:], raw[:32])
+		job.Timestamp = int64(binary.LittleEndian.Uint64(raw[32:]))
+		return job, nil
+	case []any:
+		if len(header) != 4 || len(cj.Params) < 2 {
+			return job, fmt.Errorf("job %s: expected 4 header words and a timestamp", cj.Id)
+		}
+		for i, word := range header {
+			val, err := parseUint(word)
+			if err != nil {
+				return job, fmt.Errorf("job %s: malformed header word %d: %s", cj.Id, i, err)
+			}
+			binary.LittleEndian.PutUint64(job.PrePowHash[i*8:], val)
+		}
+		ts, err := parseUint(cj.Params[1])
+		if err != nil {
+			return job, fmt.Errorf("job %s: malformed timestamp: %s", cj.Id, err)
+		}
+		job.Timestamp = int64(ts)
+		return job, nil
+	}
+	return job, fmt.Errorf("job %s: unknown job format %+v", cj.Id, cj.Params)
+}
+
+func parseUint(val any) (uint64, error) {
+	switch v := val.(type) {
+	case json.Number:
+		return strconv.ParseUint(string(v), 10, 64)
+	case uint64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("unexpected value %+v", val)
+}
+
+// share difficulty 1 corresponds to a target of 2^224
+var diffOneTarget = new(big.Float).SetMantExp(big.NewFloat(1), 224)
+var maxTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// DifficultyToTarget converts the difficulty from mining.set_difficulty into
+// the share target
+func DifficultyToTarget(diff float64) *big.Int {
+	if diff <= 0 {
+		return maxTarget
+	}
+	target, _ := new(big.Float).Quo(diffOneTarget, big.NewFloat(diff)).Int(nil)
+	if target.Cmp(maxTarget) > 0 {
+		return maxTarget
+	}
+	return target
+}
@@ -0,0 +1,207 @@
+package kaspaminer
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// nonces hashed between checks for new work
+const hashBatch = 256
+
+type MinerConfig struct {
+	Pool    string
+	User    string
+	Agent   string
+	Threads int
+	Logger  *zap.SugaredLogger
+	// Dialer overrides how the pool connection is made, mostly for tests
+	Dialer func(ctx context.Context, address string) (net.Conn, error)
+}
+
+type MinerStats struct {
+	Hashes   uint64
+	Accepted uint64
+	Rejected uint64
+	Stale    uint64
+}
+
+// work is the job currently being mined, replaced wholesale on every notify
+type work struct {
+	job    Job
+	hasher *Hasher
+	target *big.Int
+	// the pool's extranonce occupies the top bytes of the nonce, only the
+	// bits in nonceMask are ours
+	noncePrefix uint64
+	nonceMask   uint64
+}
+
+// nextNonce advances the nonce within the miner's part of the nonce space
+func (w *work) nextNonce(nonce uint64) uint64 {
+	return w.noncePrefix | ((nonce + 1) & w.nonceMask)
+}
+
+// Miner is a reference cpu miner. It is far too slow for mainnet, it exists to
+// drive the bridge end to end against a node at trivial difficulty
+type Miner struct {
+	MinerConfig
+	client *gostratum.StratumClient
+
+	workLock   sync.Mutex
+	workCond   *sync.Cond
+	work       *work
+	generation uint64
+
+	stats MinerStats
+}
+
+func NewMiner(cfg MinerConfig) *Miner {
+	if cfg.Threads <= 0 {
+		cfg.Threads = 1
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	m := &Miner{MinerConfig: cfg}
+	m.workCond = sync.NewCond(&m.workLock)
+	m.client = gostratum.NewStratumClient(gostratum.StratumClientConfig{
+		Address: cfg.Pool,
+		User:    cfg.User,
+		Agent:   cfg.Agent,
+		Logger:  cfg.Logger,
+		Dialer:  cfg.Dialer,
+		OnJob:   m.onJob,
+	})
+	return m
+}
+
+func (m *Miner) onJob(cj gostratum.ClientJob) {
+	job, err := DecodeJob(cj)
+	if err != nil {
+		m.Logger.Error(err.Error())
+		return
+	}
+	w := &work{
+		job:       job,
+		hasher:    NewHasher(job.PrePowHash, job.Timestamp),
+		target:    DifficultyToTarget(m.client.Difficulty()),
+		nonceMask: ^uint64(0),
+	}
+	if extranonce := m.client.Extranonce(); extranonce != "" {
+		prefix, err := strconv.ParseUint(extranonce, 16, 64)
+		if err != nil {
+			m.Logger.Error(fmt.Sprintf("malformed extranonce '%s'", extranonce))
+			return
+		}
+		freeBits := 64 - 4*len(extranonce)
+		w.noncePrefix = prefix << freeBits
+		w.nonceMask = 1<<freeBits - 1
+	}
+	m.workLock.Lock()
+	m.work = w
+	m.generation++
+	m.workLock.Unlock()
+	m.workCond.Broadcast()
+	m.Logger.Debug(fmt.Sprintf("new job %s", job.Id))
+}
+
+// Run mines until the context is cancelled
+func (m *Miner) Run(ctx context.Context) error {
+	wg := sync.WaitGroup{}
+	for i := 0; i < m.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.mine(ctx)
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		// wake idle workers so they can exit, under the lock so a worker
+		// can't miss it between checking the context and waiting
+		m.workLock.Lock()
+		m.workCond.Broadcast()
+		m.workLock.Unlock()
+	}()
+	err := m.client.Run(ctx)
+	wg.Wait()
+	return err
+}
+
+// currentWork blocks until there is something to mine, nil once the context
+// is cancelled
+func (m *Miner) currentWork(ctx context.Context) (*work, uint64) {
+	m.workLock.Lock()
+	defer m.workLock.Unlock()
+	for m.work == nil && ctx.Err() == nil {
+		m.workCond.Wait()
+	}
+	if ctx.Err() != nil {
+		return nil, 0
+	}
+	return m.work, m.generation
+}
+
+func (m *Miner) mine(ctx context.Context) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	w, generation := m.currentWork(ctx)
+	if w == nil {
+		return
+	}
+	nonce := w.nextNonce(rng.Uint64())
+	for ctx.Err() == nil {
+		for i := 0; i < hashBatch; i++ {
+			nonce = w.nextNonce(nonce)
+			if w.hasher.Hash(nonce).Cmp(w.target) <= 0 {
+				go m.submit(ctx, w.job.Id, nonce)
+			}
+		}
+		atomic.AddUint64(&m.stats.Hashes, hashBatch)
+
+		m.workLock.Lock()
+		if m.generation != generation {
+			w, generation = m.work, m.generation
+			nonce = w.nextNonce(rng.Uint64())
+		}
+		m.workLock.Unlock()
+	}
+}
+
+func (m *Miner) submit(ctx context.Context, jobId string, nonce uint64) {
+	err := m.client.Submit(ctx, jobId, nonce)
+	var stratumErr *gostratum.StratumError
+	switch {
+	case err == nil:
+		atomic.AddUint64(&m.stats.Accepted, 1)
+	case errors.As(err, &stratumErr) && stratumErr.Code == 21:
+		atomic.AddUint64(&m.stats.Stale, 1)
+	case errors.Is(err, gostratum.ErrorShareRejected) || errors.As(err, &stratumErr):
+		atomic.AddUint64(&m.stats.Rejected, 1)
+		m.Logger.Warn(fmt.Sprintf("share rejected for job %s: %s", jobId, err))
+	default:
+		if ctx.Err() == nil {
+			m.Logger.Warn(fmt.Sprintf("failed submitting share for job %s: %s", jobId, err))
+		}
+	}
+}
+
+// Stats returns a snapshot of the miner's counters
+func (m *Miner) Stats() MinerStats {
+	return MinerStats{
+		Hashes:   atomic.LoadUint64(&m.stats.Hashes),
+		Accepted: atomic.LoadUint64(&m.stats.Accepted),
+		Rejected: atomic.LoadUint64(&m.stats.Rejected),
+		Stale:    atomic.LoadUint64(&m.stats.Stale),
+	}
+}
@@ -0,0 +1,194 @@
+package kaspaminer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/pow"
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"github.com/onemorebsmith/kaspa-pool/src/kaspastratum"
+	"go.uber.org/zap"
+)
+
+func exampleBlock(t *testing.T) *appmessage.RPCBlock {
+	raw, err := ioutil.ReadFile("../kaspastratum/example_header.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &appmessage.RPCBlock{}
+	if err := json.Unmarshal(raw, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// powValue is the reference pow value for the block with the given nonce,
+// computed by kaspad from the full header
+func powValue(t *testing.T, block *appmessage.RPCBlock, nonce uint64) *pow.State {
+	converted, err := appmessage.RPCBlockToDomainBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := converted.Header.ToMutable()
+	header.SetNonce(nonce)
+	return pow.NewState(header)
+}
+
+// jobParams builds the notify params the bridge would send for the block,
+// round tripped through json the same way a miner receives them
+func jobParams(t *testing.T, block *appmessage.RPCBlock, bigJob bool) gostratum.ClientJob {
+	header, err := kaspastratum.SerializeBlockHeader(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := []any{}
+	if bigJob {
+		params = append(params, kaspastratum.GenerateLargeJobParams(header, uint64(block.Header.Timestamp)))
+	} else {
+		params = append(params, kaspastratum.GenerateJobHeader(header), block.Header.Timestamp)
+	}
+	raw, _ := json.Marshal(params)
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.UseNumber()
+	cj := gostratum.ClientJob{Id: "1"}
+	if err := decoder.Decode(&cj.Params); err != nil {
+		t.Fatal(err)
+	}
+	return cj
+}
+
+func TestHasherMatchesKaspad(t *testing.T) {
+	block := exampleBlock(t)
+	for _, bigJob := range []bool{false, true} {
+		job, err := DecodeJob(jobParams(t, block, bigJob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Timestamp != block.Header.Timestamp {
+			t.Fatalf("big job %t: timestamp decoded as %d, expected %d", bigJob, job.Timestamp, block.Header.Timestamp)
+		}
+		hasher := NewHasher(job.PrePowHash, job.Timestamp)
+		for _, nonce := range []uint64{0, 1, 0xdeadbeef, 1<<64 - 1} {
+			expected := powValue(t, block, nonce).CalculateProofOfWorkValue()
+			if actual := hasher.Hash(nonce); actual.Cmp(expected) != 0 {
+				t.Fatalf("big job %t, nonce %d: expected pow %x, got %x", bigJob, nonce, expected, actual)
+			}
+		}
+	}
+}
+
+func TestDecodeJobErrors(t *testing.T) {
+	for name, params := range map[string][]any{
+		"empty":          {},
+		"short string":   {"abcd"},
+		"bad hex":        {strings.Repeat("zz", 40)},
+		"missing words":  {[]any{json.Number("1")}, json.Number("1")},
+		"no timestamp":   {[]any{json.Number("1"), json.Number("2"), json.Number("3"), json.Number("4")}},
+		"negative word":  {[]any{json.Number("-1"), json.Number("2"), json.Number("3"), json.Number("4")}, json.Number("1")},
+		"unknown format": {json.Number("1")},
+	} {
+		if _, err := DecodeJob(gostratum.ClientJob{Id: "1", Params: params}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// TestMinerEndToEnd mines against a stratum listener serving a template with
+// trivial bits, validating every share the same way kaspad would
+func TestMinerEndToEnd(t *testing.T) {
+	block := exampleBlock(t)
+	block.Header.Bits = 0x207fffff // regtest, practically every hash is a block
+	var shares, blocks, rejected int64
+
+	handlers := gostratum.DefaultHandlers()
+	handlers[string(gostratum.StratumMethodAuthorize)] = func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+		if err := gostratum.HandleAuthorize(ctx, event); err != nil {
+			return err
+		}
+		if err := ctx.Send(gostratum.NewEvent("", string(gostratum.StratumMethodSetDifficulty), []any{1e-7})); err != nil {
+			return err
+		}
+		bigJob := strings.Contains(ctx.RemoteApp, "BzMiner")
+		cj := jobParams(t, block, bigJob)
+		return ctx.Send(gostratum.NewEvent("", string(gostratum.StratumMethodNotify), append([]any{"1"}, cj.Params...)))
+	}
+	handlers[string(gostratum.StratumMethodSubmit)] = func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+		nonce, err := strconv.ParseUint(strings.TrimPrefix(event.Params[2].(string), "0x"), 16, 64)
+		if err != nil {
+			return err
+		}
+		state := powValue(t, block, nonce)
+		if state.CalculateProofOfWorkValue().Cmp(DifficultyToTarget(1e-7)) > 0 {
+			atomic.AddInt64(&rejected, 1)
+			return ctx.ReplyLowDiffShare(event.Id)
+		}
+		atomic.AddInt64(&shares, 1)
+		if state.CheckProofOfWork() {
+			atomic.AddInt64(&blocks, 1)
+		}
+		return ctx.Reply(gostratum.NewResponse(event, true, nil))
+	}
+
+	port := freePort(t)
+	cfg := gostratum.DefaultConfig(zap.NewNop().Sugar())
+	cfg.HandlerMap = handlers
+	cfg.Port = port
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	go gostratum.NewListener(cfg).Listen(ctx)
+
+	// wait for the listener, the miner would otherwise sit out a reconnect
+	for {
+		conn, err := net.Dial("tcp", port)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, agent := range []string{"testminer", "BzMiner"} {
+		minerCtx, stopMiner := context.WithCancel(ctx)
+		miner := NewMiner(MinerConfig{Pool: port, User: "kaspa:abc.rig", Agent: agent, Threads: 2})
+		done := make(chan struct{})
+		go func() {
+			miner.Run(minerCtx)
+			close(done)
+		}()
+		for miner.Stats().Accepted < 3 && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		stopMiner()
+		<-done
+		if miner.Stats().Accepted < 3 {
+			t.Fatalf("%s: expected shares to be accepted, stats %+v", agent, miner.Stats())
+		}
+		if miner.Stats().Rejected != 0 {
+			t.Fatalf("%s: expected no rejected shares, stats %+v", agent, miner.Stats())
+		}
+	}
+	if atomic.LoadInt64(&blocks) == 0 || atomic.LoadInt64(&rejected) != 0 {
+		t.Fatalf("expected blocks and no bad shares, got %d shares, %d blocks, %d rejected",
+			shares, blocks, rejected)
+	}
+}
@@ -0,0 +1,384 @@
+package kaspastratum
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"go.uber.org/zap"
+)
+
+// requireToken rejects admin requests that don't carry the bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ban keeps an address from mining until it expires
+type ban struct {
+	Address string     `json:"address"`
+	Reason  string     `json:"reason,omitempty"`
+	Until   *time.Time `json:"until,omitempty"` // permanent if nil
+}
+
+func (b ban) expired(now time.Time) bool {
+	return b.Until != nil && !now.Before(*b.Until)
+}
+
+// banList is the set of banned miner addresses, shared by every listener.
+// Bans only live in memory, a restart lifts them
+type banList struct {
+	lock sync.Mutex
+	bans map[string]ban
+}
+
+func newBanList() *banList {
+	return &banList{bans: map[string]ban{}}
+}
+
+func (bl *banList) Ban(b ban) {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	bl.bans[b.Address] = b
+}
+
+// Unban lifts the ban on the address, returning false if it wasn't banned
+func (bl *banList) Unban(addr string) bool {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	_, exists := bl.bans[addr]
+	delete(bl.bans, addr)
+	return exists
+}
+
+func (bl *banList) Banned(addr string, now time.Time) bool {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	b, exists := bl.bans[addr]
+	if exists && b.expired(now) {
+		delete(bl.bans, addr)
+		return false
+	}
+	return exists
+}
+
+// List returns the bans in effect, ordered by address
+func (bl *banList) List(now time.Time) []ban {
+	bl.lock.Lock()
+	bans := make([]ban, 0, len(bl.bans))
+	for addr, b := range bl.bans {
+		if b.expired(now) {
+			delete(bl.bans, addr)
+			continue
+		}
+		bans = append(bans, b)
+	}
+	bl.lock.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Address < bans[j].Address })
+	return bans
+}
+
+// sessionInfo is what the admin api reports about a connected miner
+type sessionInfo struct {
+	Id              uint64     `json:"id"`
+	Listener        string     `json:"listener"`
+	Address         string     `json:"address"`
+	Wallet          string     `json:"wallet"`
+	Worker          string     `json:"worker"`
+	RemoteApp       string     `json:"remote_app"`
+	ConnectedAt     time.Time  `json:"connected_at"`
+	Difficulty      float64    `json:"difficulty"`
+	SharesPerMinute float64    `json:"shares_per_minute"`
+	LastSubmit      *time.Time `json:"last_submit,omitempty"`
+}
+
+func newSessionInfo(port string, ctx *MinerContext, now time.Time) sessionInfo {
+	info := sessionInfo{
+		Id:          ctx.SessionId(),
+		Listener:    port,
+		Address:     ctx.RemoteAddr,
+		Wallet:      ctx.WalletAddr,
+		Worker:      ctx.WorkerName,
+		RemoteApp:   ctx.RemoteApp,
+		ConnectedAt: ctx.ConnectedAt(),
+		Difficulty:  ctx.State.Difficulty(),
+	}
+	// averaged over the whole session
+	if minutes := now.Sub(info.ConnectedAt).Minutes(); minutes > 0 {
+		info.SharesPerMinute = float64(ctx.State.Accepted()) / minutes
+	}
+	if last := ctx.State.LastSubmit(); !last.IsZero() {
+		info.LastSubmit = &last
+	}
+	return info
+}
+
+type reconnectRequest struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// seconds the miner should wait before reconnecting
+	Wait int `json:"wait"`
+}
+
+type difficultyRequest struct {
+	Difficulty float64 `json:"difficulty"`
+}
+
+type banRequest struct {
+	// Address to ban, only used by POST /bans, a session is banned by its own
+	Address string `json:"address"`
+	// Duration of the ban, e.g. `24h`, permanent if empty
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// sessionSource is a listener whose miners the admin api manages, the v1
+// listeners and the sv2 handler
+type sessionSource interface {
+	sessions() *gostratum.ClientRegistry[*MiningState]
+	port() string
+	// disconnect drops the miner's connection
+	disconnect(ctx *MinerContext)
+	// sendDifficulty sends the miner a new share difficulty
+	sendDifficulty(ctx *MinerContext, diff float64) error
+}
+
+// sessionAdmin manages the miners connected to the listeners, v1 and v2:
+//
+//	GET    /sessions                    lists sessions, ?wallet= and ?address= filter
+//	GET    /sessions/{id}               a single session
+//	POST   /sessions/{id}/disconnect    kicks the miner
+//	POST   /sessions/{id}/reconnect     {"host": "...", "port": 5555, "wait": 0}, v1 only
+//	POST   /sessions/{id}/difficulty    {"difficulty": 16}
+//	POST   /sessions/{id}/ban           {"duration": "24h", "reason": "..."}
+//	GET    /bans                        lists bans
+//	POST   /bans                        {"address": "...", "duration": "24h", "reason": "..."}
+//	DELETE /bans/{address}              lifts a ban
+type sessionAdmin struct {
+	logger    *zap.SugaredLogger
+	listeners []sessionSource
+	bans      *banList
+}
+
+// Register adds the session and ban endpoints to the admin mux
+func (sa *sessionAdmin) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/sessions", sa.handleSessions)
+	mux.HandleFunc("/sessions/", sa.handleSession)
+	mux.HandleFunc("/bans", sa.handleBans)
+	mux.HandleFunc("/bans/", sa.handleBan)
+}
+
+func (sa *sessionAdmin) find(id uint64) (*MinerContext, sessionSource, bool) {
+	for _, l := range sa.listeners {
+		if ctx, exists := l.sessions().Get(id); exists {
+			return ctx, l, true
+		}
+	}
+	return nil, nil, false
+}
+
+// kick disconnects every session connected from the address
+func (sa *sessionAdmin) kick(addr string) int {
+	kicked := 0
+	for _, l := range sa.listeners {
+		for _, ctx := range l.sessions().ByAddr(addr) {
+			l.disconnect(ctx)
+			kicked++
+		}
+	}
+	return kicked
+}
+
+func (sa *sessionAdmin) ban(req banRequest) (ban, error) {
+	b := ban{Address: req.Address, Reason: req.Reason}
+	if b.Address == "" {
+		return b, fmt.Errorf("address is required")
+	}
+	if req.Duration != "" {
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			return b, fmt.Errorf("malformed duration '%s'", req.Duration)
+		}
+		until := time.Now().Add(duration)
+		b.Until = &until
+	}
+	sa.bans.Ban(b)
+	kicked := sa.kick(b.Address)
+	sa.logger.With(zap.String("address", b.Address), zap.String("duration", req.Duration),
+		zap.String("reason", b.Reason), zap.Int("kicked", kicked)).Info("address banned")
+	return b, nil
+}
+
+func (sa *sessionAdmin) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	wallet, addr := r.URL.Query().Get("wallet"), r.URL.Query().Get("address")
+	now := time.Now()
+	sessions := []sessionInfo{}
+	for _, l := range sa.listeners {
+		port := l.port()
+		for _, ctx := range l.sessions().All() {
+			if (wallet != "" && ctx.WalletAddr != wallet) || (addr != "" && ctx.RemoteAddr != addr) {
+				continue
+			}
+			sessions = append(sessions, newSessionInfo(port, ctx, now))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Id < sessions[j].Id })
+	writeJson(w, sessions)
+}
+
+func (sa *sessionAdmin) handleSession(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	ctx, source, exists := sa.find(id)
+	if !exists {
+		http.Error(w, fmt.Sprintf("session %d is not connected", id), http.StatusNotFound)
+		return
+	}
+
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	expected := http.MethodPost
+	if action == "" {
+		expected = http.MethodGet
+	}
+	if r.Method != expected {
+		w.Header().Set("Allow", expected)
+		http.Error(w, fmt.Sprintf("only %s is supported", expected), http.StatusMethodNotAllowed)
+		return
+	}
+
+	log := sa.logger.With(zap.Uint64("session", id), zap.String("address", ctx.RemoteAddr),
+		zap.String("wallet", ctx.WalletAddr))
+	switch action {
+	case "":
+	case "disconnect":
+		source.disconnect(ctx)
+		log.Info("session disconnected by admin")
+	case "reconnect":
+		req := reconnectRequest{}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		if req.Host == "" || req.Port <= 0 || req.Wait < 0 {
+			http.Error(w, "host and port are required", http.StatusBadRequest)
+			return
+		}
+		if err := ctx.Send(gostratum.JsonRpcEvent{
+			Version: "2.0",
+			Method:  "client.reconnect",
+			Params:  []any{req.Host, req.Port, req.Wait},
+		}); err != nil {
+			http.Error(w, fmt.Sprintf("failed sending reconnect: %s", err), http.StatusConflict)
+			return
+		}
+		log.With(zap.String("host", req.Host), zap.Int("port", req.Port)).Info("session sent to another host by admin")
+	case "difficulty":
+		req := difficultyRequest{}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		if req.Difficulty <= 0 {
+			http.Error(w, "difficulty must be positive", http.StatusBadRequest)
+			return
+		}
+		if err := source.sendDifficulty(ctx, req.Difficulty); err != nil {
+			http.Error(w, fmt.Sprintf("failed sending difficulty: %s", err), http.StatusConflict)
+			return
+		}
+		log.With(zap.Float64("difficulty", req.Difficulty)).Info("session difficulty changed by admin")
+	case "ban":
+		req := banRequest{}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		req.Address = ctx.RemoteAddr
+		b, err := sa.ban(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJson(w, b)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	writeJson(w, newSessionInfo(source.port(), ctx, time.Now()))
+}
+
+func (sa *sessionAdmin) handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, sa.bans.List(time.Now()))
+	case http.MethodPost:
+		req := banRequest{}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		b, err := sa.ban(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJson(w, b)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (sa *sessionAdmin) handleBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "only DELETE is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := strings.TrimPrefix(r.URL.Path, "/bans/")
+	if !sa.bans.Unban(addr) {
+		http.Error(w, fmt.Sprintf("%s is not banned", addr), http.StatusNotFound)
+		return
+	}
+	sa.logger.With(zap.String("address", addr)).Info("address unbanned")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeBody parses the json request body into v, an empty body leaves v
+// as is. Replies with a bad request and returns false if it's malformed
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("malformed request: %s", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,218 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"github.com/onemorebsmith/kaspa-pool/src/stratumv2"
+)
+
+const testAdminToken = "s3cret"
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// receivedEvent reads the next message sent to the miner
+func receivedEvent(t *testing.T, conn *gostratum.MockConnection) gostratum.JsonRpcEvent {
+	events := make(chan gostratum.JsonRpcEvent, 1)
+	conn.AsyncReadTestDataFromBuffer(func(b []byte) {
+		event, err := gostratum.UnmarshalEvent(string(b))
+		if err != nil {
+			t.Error(err)
+		}
+		events <- event
+	})
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a message to be sent to the miner")
+	}
+	return gostratum.JsonRpcEvent{}
+}
+
+func TestSessionAdmin(t *testing.T) {
+	cl := newClientListener(logger, nil, ListenerConfig{Port: ":5555", Mode: MiningModeSolo, Difficulty: 4},
+		"", 0, testMetrics(t))
+	sa := &sessionAdmin{logger: logger, listeners: []sessionSource{cl}, bans: newBanList()}
+	cl.bans = sa.bans
+	mux := http.NewServeMux()
+	sa.Register(mux)
+	handler := requireToken(testAdminToken, mux)
+
+	connect := func(wallet, worker string) (*MinerContext, *gostratum.MockConnection) {
+		ctx, conn := gostratum.NewMockContext(context.Background(), logger, cl.newState())
+		ctx.WalletAddr = wallet
+		ctx.WorkerName = worker
+		cl.OnConnect(ctx)
+		return ctx, conn
+	}
+	rig1, conn1 := connect("kaspa:one", "rig1")
+	rig2, _ := connect("kaspa:two", "rig2")
+	rig1.State.recordSubmit(time.Now(), true)
+
+	for _, auth := range []string{"", "Bearer wrong", testAdminToken} {
+		req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected authorization '%s' to be rejected, got %d", auth, rec.Code)
+		}
+	}
+
+	rec := adminRequest(t, handler, http.MethodGet, "/sessions", "")
+	sessions := []sessionInfo{}
+	if err := json.NewDecoder(rec.Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+	s := sessions[0]
+	if s.Id != rig1.SessionId() || s.Listener != ":5555" || s.Address != "127.0.0.1" || s.Wallet != "kaspa:one" ||
+		s.Worker != "rig1" || s.Difficulty != 4 || s.SharesPerMinute <= 0 || s.LastSubmit == nil {
+		t.Errorf("unexpected session: %+v", s)
+	}
+	if sessions[1].LastSubmit != nil {
+		t.Errorf("expected no last submit for a miner that never submitted")
+	}
+	rec = adminRequest(t, handler, http.MethodGet, "/sessions?wallet=kaspa:two", "")
+	if err := json.NewDecoder(rec.Body).Decode(&sessions); err != nil || len(sessions) != 1 ||
+		sessions[0].Id != rig2.SessionId() {
+		t.Errorf("expected the wallet filter to only return rig2, got %+v", sessions)
+	}
+
+	rig1Path := fmt.Sprintf("/sessions/%d", rig1.SessionId())
+	if rec := adminRequest(t, handler, http.MethodPost, rig1Path+"/difficulty", `{"difficulty": 16}`); rec.Code != http.StatusOK {
+		t.Fatalf("difficulty change failed: %d %s", rec.Code, rec.Body)
+	}
+	event := receivedEvent(t, conn1)
+	if event.Method != "mining.set_difficulty" || event.Params[0] != float64(16) || rig1.State.Difficulty() != 16 {
+		t.Errorf("expected the miner to be sent difficulty 16, got %+v", event)
+	}
+
+	if rec := adminRequest(t, handler, http.MethodPost, rig1Path+"/reconnect",
+		`{"host": "pool2.example", "port": 5555}`); rec.Code != http.StatusOK {
+		t.Fatalf("reconnect failed: %d %s", rec.Code, rec.Body)
+	}
+	event = receivedEvent(t, conn1)
+	if d := cmp.Diff([]any{"pool2.example", float64(5555), float64(0)}, event.Params); event.Method != "client.reconnect" || d != "" {
+		t.Errorf("unexpected reconnect %s: %s", event.Method, d)
+	}
+
+	for _, bad := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodPost, rig1Path + "/difficulty", `{"difficulty": -1}`, http.StatusBadRequest},
+		{http.MethodPost, rig1Path + "/reconnect", `{"port": 5555}`, http.StatusBadRequest},
+		{http.MethodPost, rig1Path + "/difficulty", `{`, http.StatusBadRequest},
+		{http.MethodGet, rig1Path + "/disconnect", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, rig1Path + "/explode", "", http.StatusNotFound},
+		{http.MethodGet, "/sessions/12345678", "", http.StatusNotFound},
+		{http.MethodPost, "/bans", `{"address": "10.0.0.1", "duration": "soon"}`, http.StatusBadRequest},
+		{http.MethodDelete, "/bans/10.0.0.1", "", http.StatusNotFound},
+	} {
+		if rec := adminRequest(t, handler, bad.method, bad.path, bad.body); rec.Code != bad.code {
+			t.Errorf("%s %s: expected %d, got %d", bad.method, bad.path, bad.code, rec.Code)
+		}
+	}
+
+	adminRequest(t, handler, http.MethodPost, fmt.Sprintf("/sessions/%d/disconnect", rig2.SessionId()), "")
+	if rig2.Connected() || !rig1.Connected() {
+		t.Fatalf("expected only rig2 to be disconnected")
+	}
+
+	// banning a session bans its address, kicking every rig behind it
+	if rec := adminRequest(t, handler, http.MethodPost, rig1Path+"/ban",
+		`{"duration": "1h", "reason": "spam"}`); rec.Code != http.StatusOK {
+		t.Fatalf("ban failed: %d %s", rec.Code, rec.Body)
+	}
+	if rig1.Connected() {
+		t.Errorf("expected the banned miner to be disconnected")
+	}
+	bans := []ban{}
+	rec = adminRequest(t, handler, http.MethodGet, "/bans", "")
+	if err := json.NewDecoder(rec.Body).Decode(&bans); err != nil || len(bans) != 1 ||
+		bans[0].Address != "127.0.0.1" || bans[0].Reason != "spam" || bans[0].Until == nil {
+		t.Fatalf("unexpected bans: %+v", bans)
+	}
+	if rig3, _ := connect("kaspa:three", "rig3"); rig3.Connected() {
+		t.Errorf("expected a banned address to be disconnected on connect")
+	}
+
+	if rec := adminRequest(t, handler, http.MethodDelete, "/bans/127.0.0.1", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("unban failed: %d", rec.Code)
+	}
+	if rig4, _ := connect("kaspa:four", "rig4"); !rig4.Connected() {
+		t.Errorf("expected the address to be allowed back after unbanning")
+	}
+}
+
+func TestSessionAdminStratumV2(t *testing.T) {
+	h := newSv2Handler(logger, nil, nil, ListenerConfig{Port: ":5556", Protocol: StratumV2, Difficulty: 4},
+		"", 0, testMetrics(t))
+	sa := &sessionAdmin{logger: logger, listeners: []sessionSource{h}, bans: newBanList()}
+	h.bans = sa.bans
+	mux := http.NewServeMux()
+	sa.Register(mux)
+	handler := requireToken(testAdminToken, mux)
+
+	ch := &stratumv2.Channel{UserIdentity: "kaspa:one.rig1", RemoteAddr: "10.0.0.5:41234"}
+	if err := h.OpenChannel(ch); err != nil {
+		t.Fatal(err)
+	}
+	// what ChannelOpened registers, without sending a job down a channel
+	// that has no connection
+	h.clients.Add(channelContext(ch))
+
+	sessions := []sessionInfo{}
+	rec := adminRequest(t, handler, http.MethodGet, "/sessions", "")
+	if err := json.NewDecoder(rec.Body).Decode(&sessions); err != nil || len(sessions) != 1 {
+		t.Fatalf("expected the sv2 session to be listed, got %+v", sessions)
+	}
+	if s := sessions[0]; s.Listener != ":5556" || s.Address != "10.0.0.5" || s.Wallet != "kaspa:one" || s.Worker != "rig1" {
+		t.Errorf("unexpected session: %+v", s)
+	}
+
+	if !h.AllowConnection("10.0.0.5:41235") {
+		t.Fatalf("expected the address to be allowed before it's banned")
+	}
+	if rec := adminRequest(t, handler, http.MethodPost, fmt.Sprintf("/sessions/%d/ban", sessions[0].Id),
+		`{"reason": "spam"}`); rec.Code != http.StatusOK {
+		t.Fatalf("ban failed: %d %s", rec.Code, rec.Body)
+	}
+	if h.AllowConnection("10.0.0.5:41236") || !h.AllowConnection("10.0.0.6:41236") {
+		t.Errorf("expected only the banned address to be turned away")
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	bans := newBanList()
+	now := time.Now()
+	expired := now.Add(-time.Second)
+	bans.Ban(ban{Address: "10.0.0.1", Until: &expired})
+	bans.Ban(ban{Address: "10.0.0.2"})
+	if bans.Banned("10.0.0.1", now) || !bans.Banned("10.0.0.2", now) {
+		t.Errorf("expected only the permanent ban to be in effect")
+	}
+	if list := bans.List(now); len(list) != 1 || list[0].Address != "10.0.0.2" {
+		t.Errorf("expected expired bans to be dropped, got %+v", list)
+	}
+}
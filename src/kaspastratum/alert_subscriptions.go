@@ -0,0 +1,252 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// AlertSubscription is where the worker alerts of a wallet go
+type AlertSubscription struct {
+	Wallet     string `json:"wallet"`
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// WebhookSecret signs webhook bodies like WebhookConfig.Secret
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+	Email         string `json:"email,omitempty"`
+	// OfflineAfterSeconds overrides WatchdogConfig.OfflineAfter if set
+	OfflineAfterSeconds int64     `json:"offline_after_seconds,omitempty"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+func (sub AlertSubscription) validate(smtp SMTPConfig) error {
+	if sub.Wallet == "" {
+		return fmt.Errorf("wallet is required")
+	}
+	if sub.WebhookURL == "" && sub.Email == "" {
+		return fmt.Errorf("webhook_url or email is required")
+	}
+	if sub.WebhookURL != "" {
+		u, err := url.ParseRequestURI(sub.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("malformed webhook_url")
+		}
+	}
+	if sub.Email != "" {
+		if !smtp.enabled() {
+			return fmt.Errorf("email alerts are not configured on this bridge")
+		}
+		if _, err := mail.ParseAddress(sub.Email); err != nil || strings.ContainsAny(sub.Email, "\r\n") {
+			return fmt.Errorf("malformed email")
+		}
+	}
+	if sub.OfflineAfterSeconds < 0 || time.Duration(sub.OfflineAfterSeconds)*time.Second > maxOfflineAfter {
+		return fmt.Errorf("offline_after_seconds must be between 0 and %d", int64(maxOfflineAfter.Seconds()))
+	}
+	return nil
+}
+
+// redacted is the subscription as the api returns it, without the secret
+func (sub AlertSubscription) redacted() AlertSubscription {
+	if sub.WebhookSecret != "" {
+		sub.WebhookSecret = "<redacted>"
+	}
+	return sub
+}
+
+// subscriptionStore persists alert subscriptions, one per wallet
+type subscriptionStore interface {
+	List() ([]AlertSubscription, error)
+	Put(sub AlertSubscription) error
+	Delete(wallet string) (bool, error)
+}
+
+const createAlertSubscriptions = `CREATE TABLE IF NOT EXISTS worker_alert_subscriptions (
+	wallet TEXT PRIMARY KEY,
+	webhook_url TEXT NOT NULL DEFAULT '',
+	webhook_secret TEXT NOT NULL DEFAULT '',
+	email TEXT NOT NULL DEFAULT '',
+	offline_after_seconds BIGINT NOT NULL DEFAULT 0,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+type pgSubscriptionStore struct {
+	pg *pgx.ConnPool
+}
+
+// newPgSubscriptionStore creates the subscription table if it doesn't exist
+func newPgSubscriptionStore(pg *pgx.ConnPool) (*pgSubscriptionStore, error) {
+	if _, err := pg.Exec(createAlertSubscriptions); err != nil {
+		return nil, errors.Wrap(err, "failed creating worker_alert_subscriptions")
+	}
+	return &pgSubscriptionStore{pg: pg}, nil
+}
+
+func (s *pgSubscriptionStore) List() ([]AlertSubscription, error) {
+	rows, err := s.pg.Query(`SELECT wallet, webhook_url, webhook_secret, email, offline_after_seconds, updated_at
+		FROM worker_alert_subscriptions`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading alert subscriptions")
+	}
+	defer rows.Close()
+	subs := []AlertSubscription{}
+	for rows.Next() {
+		sub := AlertSubscription{}
+		if err := rows.Scan(&sub.Wallet, &sub.WebhookURL, &sub.WebhookSecret, &sub.Email,
+			&sub.OfflineAfterSeconds, &sub.UpdatedAt); err != nil {
+			return nil, errors.Wrap(err, "failed reading alert subscriptions")
+		}
+		subs = append(subs, sub)
+	}
+	return subs, errors.Wrap(rows.Err(), "failed reading alert subscriptions")
+}
+
+func (s *pgSubscriptionStore) Put(sub AlertSubscription) error {
+	_, err := s.pg.Exec(`INSERT INTO worker_alert_subscriptions
+		(wallet, webhook_url, webhook_secret, email, offline_after_seconds, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (wallet) DO UPDATE SET webhook_url = $2, webhook_secret = $3, email = $4,
+			offline_after_seconds = $5, updated_at = $6`,
+		sub.Wallet, sub.WebhookURL, sub.WebhookSecret, sub.Email, sub.OfflineAfterSeconds, sub.UpdatedAt)
+	return errors.Wrap(err, "failed writing alert subscription")
+}
+
+func (s *pgSubscriptionStore) Delete(wallet string) (bool, error) {
+	tag, err := s.pg.Exec(`DELETE FROM worker_alert_subscriptions WHERE wallet = $1`, wallet)
+	if err != nil {
+		return false, errors.Wrap(err, "failed deleting alert subscription")
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Subscribe validates and stores the subscription, replacing the wallet's
+// previous one. Writes are ordered by storeLock rather than lock, so shares
+// keep flowing through the watchdog while postgres is slow
+func (wd *workerWatchdog) Subscribe(sub AlertSubscription) (AlertSubscription, error) {
+	if err := sub.validate(wd.cfg.SMTP); err != nil {
+		return sub, err
+	}
+	sub.UpdatedAt = time.Now().UTC()
+	wd.storeLock.Lock()
+	defer wd.storeLock.Unlock()
+	if err := wd.store.Put(sub); err != nil {
+		return sub, err
+	}
+	wd.lock.Lock()
+	wd.subs[sub.Wallet] = sub
+	wd.lock.Unlock()
+	return sub, nil
+}
+
+func (wd *workerWatchdog) Unsubscribe(wallet string) (bool, error) {
+	wd.storeLock.Lock()
+	defer wd.storeLock.Unlock()
+	deleted, err := wd.store.Delete(wallet)
+	if err != nil {
+		return false, err
+	}
+	wd.lock.Lock()
+	delete(wd.subs, wallet)
+	wd.lock.Unlock()
+	return deleted, nil
+}
+
+func (wd *workerWatchdog) Subscriptions() []AlertSubscription {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+	subs := make([]AlertSubscription, 0, len(wd.subs))
+	for _, sub := range wd.subs {
+		subs = append(subs, sub.redacted())
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Wallet < subs[j].Wallet })
+	return subs
+}
+
+// Register adds the alert api to the admin mux:
+//
+//	GET                /alerts/subscriptions            every subscription
+//	GET, PUT, DELETE   /alerts/subscriptions/{wallet}   one wallet's subscription
+//	GET                /alerts/workers?wallet=          what the watchdog knows of every worker
+func (wd *workerWatchdog) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/alerts/subscriptions", wd.handleSubscriptions)
+	mux.HandleFunc("/alerts/subscriptions/", wd.handleSubscription)
+	mux.HandleFunc("/alerts/workers", wd.handleWorkers)
+}
+
+func (wd *workerWatchdog) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, wd.Subscriptions())
+}
+
+func (wd *workerWatchdog) handleSubscription(w http.ResponseWriter, r *http.Request) {
+	wallet := strings.TrimPrefix(r.URL.Path, "/alerts/subscriptions/")
+	if wallet == "" || strings.Contains(wallet, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		wd.lock.Lock()
+		sub, exists := wd.subs[wallet]
+		wd.lock.Unlock()
+		if !exists {
+			http.Error(w, fmt.Sprintf("%s has no subscription", wallet), http.StatusNotFound)
+			return
+		}
+		writeJson(w, sub.redacted())
+	case http.MethodPut:
+		sub := AlertSubscription{}
+		if !decodeBody(w, r, &sub) {
+			return
+		}
+		sub.Wallet = wallet
+		if err := sub.validate(wd.cfg.SMTP); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sub, err := wd.Subscribe(sub)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		wd.logger.With(zap.String("wallet", wallet), zap.Bool("webhook", sub.WebhookURL != ""),
+			zap.Bool("email", sub.Email != ""), zap.Int64("offline_after_seconds", sub.OfflineAfterSeconds)).
+			Info("worker alerts subscribed")
+		writeJson(w, sub.redacted())
+	case http.MethodDelete:
+		deleted, err := wd.Unsubscribe(wallet)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, fmt.Sprintf("%s has no subscription", wallet), http.StatusNotFound)
+			return
+		}
+		wd.logger.With(zap.String("wallet", wallet)).Info("worker alerts unsubscribed")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "only GET, PUT and DELETE are supported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (wd *workerWatchdog) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, wd.Workers(r.URL.Query().Get("wallet"), time.Now()))
+}
@@ -0,0 +1,148 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
+	"github.com/pkg/errors"
+)
+
+// blockSubmitter submits solved blocks, kaspad's rpc client outside of tests
+type blockSubmitter interface {
+	SubmitBlock(block *externalapi.DomainBlock) (appmessage.RejectReason, error)
+}
+
+// BlockSubmitResult is what became of a block candidate sent to kaspad
+type BlockSubmitResult string
+
+const (
+	BlockAccepted  BlockSubmitResult = "accepted"
+	BlockDuplicate BlockSubmitResult = "duplicate"
+	// BlockStale builds on parents kaspad has moved past, pruned or never
+	// heard of
+	BlockStale         BlockSubmitResult = "stale"
+	BlockBadPow        BlockSubmitResult = "bad_pow"
+	BlockBadTime       BlockSubmitResult = "bad_time"
+	BlockBadDifficulty BlockSubmitResult = "bad_difficulty"
+	// BlockInvalid is any other consensus rule the block broke
+	BlockInvalid BlockSubmitResult = "invalid"
+	// BlockNotSynced means kaspad refused the block while syncing
+	BlockNotSynced BlockSubmitResult = "not_synced"
+	// BlockRPCError means kaspad never judged the block, e.g. the request
+	// timed out or the connection dropped
+	BlockRPCError BlockSubmitResult = "rpc_error"
+)
+
+// rule errors kaspad names in the reject message, checked in order
+var blockRejectRules = []struct {
+	match  string
+	result BlockSubmitResult
+}{
+	{"ErrDuplicateBlock", BlockDuplicate},
+	{"ErrInvalidPoW", BlockBadPow},
+	{"ErrTimeTooOld", BlockBadTime},
+	{"ErrTimeTooMuchInTheFuture", BlockBadTime},
+	{"ErrUnexpectedDifficulty", BlockBadDifficulty},
+	{"ErrMissingParents", BlockStale},
+	{"ErrPrunedBlock", BlockStale},
+	{"is too far behind virtual's DAA score", BlockStale},
+}
+
+// classifySubmit maps the reject reason and error of a SubmitBlock onto a
+// result. kaspad only tells invalid blocks and syncing apart in the reject
+// reason, the broken rule is in the message of the error
+func classifySubmit(reason appmessage.RejectReason, err error) BlockSubmitResult {
+	if err == nil {
+		return BlockAccepted
+	}
+	if reason == appmessage.RejectReasonIsInIBD {
+		return BlockNotSynced
+	}
+	if !errors.Is(err, rpcclient.ErrRPC) {
+		return BlockRPCError
+	}
+	for _, rule := range blockRejectRules {
+		if strings.Contains(err.Error(), rule.match) {
+			return rule.result
+		}
+	}
+	if reason == appmessage.RejectReasonBlockInvalid {
+		return BlockInvalid
+	}
+	return BlockRPCError
+}
+
+// blockSubmission is one block candidate sent to kaspad along with what it
+// took and what came of it
+type blockSubmission struct {
+	Hash            string
+	Wallet          string
+	Worker          string
+	Mode            MiningMode
+	DAAScore        uint64
+	BlueScore       uint64
+	Nonce           uint64
+	TemplateFetched time.Time
+	SubmittedAt     time.Time
+	Latency         time.Duration
+	Result          BlockSubmitResult
+	RejectReason    appmessage.RejectReason
+	Error           string
+}
+
+// submissionStore keeps every block submission for diagnosing reject and
+// orphan rates
+type submissionStore interface {
+	Record(sub blockSubmission) error
+}
+
+const createBlockSubmissions = `CREATE TABLE IF NOT EXISTS block_submissions (
+	id BIGSERIAL PRIMARY KEY,
+	hash TEXT NOT NULL,
+	wallet TEXT NOT NULL,
+	worker TEXT NOT NULL,
+	mode TEXT NOT NULL,
+	daa_score BIGINT NOT NULL,
+	blue_score BIGINT NOT NULL,
+	nonce TEXT NOT NULL,
+	template_fetched_at TIMESTAMPTZ NOT NULL,
+	submitted_at TIMESTAMPTZ NOT NULL,
+	latency_ms DOUBLE PRECISION NOT NULL,
+	result TEXT NOT NULL,
+	reject_reason TEXT NOT NULL,
+	error TEXT NOT NULL
+)`
+
+type pgSubmissionStore struct {
+	pg *pgx.ConnPool
+}
+
+// newPgSubmissionStore creates the submission table if it doesn't exist
+func newPgSubmissionStore(pg *pgx.ConnPool) (*pgSubmissionStore, error) {
+	for _, stmt := range []string{
+		createBlockSubmissions,
+		`CREATE INDEX IF NOT EXISTS block_submissions_submitted_at ON block_submissions (submitted_at)`,
+	} {
+		if _, err := pg.Exec(stmt); err != nil {
+			return nil, errors.Wrap(err, "failed creating block_submissions")
+		}
+	}
+	return &pgSubmissionStore{pg: pg}, nil
+}
+
+func (s *pgSubmissionStore) Record(sub blockSubmission) error {
+	// nonces are stored as hex, the way miners and the logs show them. They
+	// don't fit a signed bigint
+	_, err := s.pg.Exec(`INSERT INTO block_submissions(hash, wallet, worker, mode, daa_score, blue_score,
+		nonce, template_fetched_at, submitted_at, latency_ms, result, reject_reason, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		sub.Hash, sub.Wallet, sub.Worker, string(sub.Mode), int64(sub.DAAScore), int64(sub.BlueScore),
+		fmt.Sprintf("%x", sub.Nonce), sub.TemplateFetched, sub.SubmittedAt,
+		float64(sub.Latency)/float64(time.Millisecond), string(sub.Result), sub.RejectReason.String(), sub.Error)
+	return errors.Wrap(err, "failed writing block submission to pg")
+}
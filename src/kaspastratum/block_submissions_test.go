@@ -0,0 +1,156 @@
+package kaspastratum
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func rejected(message string) error {
+	return errors.Wrap(rpcclient.ErrRPC, message)
+}
+
+func TestClassifySubmit(t *testing.T) {
+	for _, tc := range []struct {
+		reason   appmessage.RejectReason
+		err      error
+		expected BlockSubmitResult
+	}{
+		{appmessage.RejectReasonNone, nil, BlockAccepted},
+		{appmessage.RejectReasonBlockInvalid, rejected("Block rejected. Reason: ErrDuplicateBlock: block 00ff already exists"), BlockDuplicate},
+		{appmessage.RejectReasonBlockInvalid, rejected("Block rejected. Reason: ErrInvalidPoW: block has invalid proof of work"), BlockBadPow},
+		{appmessage.RejectReasonBlockInvalid, rejected("Block rejected. Reason: ErrTimeTooOld: block timestamp is too old"), BlockBadTime},
+		{appmessage.RejectReasonBlockInvalid, rejected("Block rejected. Reason: ErrUnexpectedDifficulty: bits 1 != 2"), BlockBadDifficulty},
+		{appmessage.RejectReasonBlockInvalid, rejected("Block rejected. Reason: ErrMissingParents: missing parents [00ff]"), BlockStale},
+		{appmessage.RejectReasonBlockInvalid, rejected("Block rejected. Reason: block DAA score 1 is too far behind virtual's DAA score 5000"), BlockStale},
+		{appmessage.RejectReasonBlockInvalid, rejected("Block rejected. Reason: ErrBadMerkleRoot: bad merkle root"), BlockInvalid},
+		{appmessage.RejectReasonIsInIBD, rejected("Block not submitted - node is not synced"), BlockNotSynced},
+		{appmessage.RejectReasonNone, errors.New("timeout expired"), BlockRPCError},
+	} {
+		if result := classifySubmit(tc.reason, tc.err); result != tc.expected {
+			t.Errorf("%v: expected %s, got %s", tc.err, tc.expected, result)
+		}
+	}
+}
+
+type fakeSubmitter struct {
+	reason appmessage.RejectReason
+	err    error
+}
+
+func (fs fakeSubmitter) SubmitBlock(*externalapi.DomainBlock) (appmessage.RejectReason, error) {
+	return fs.reason, fs.err
+}
+
+type memorySubmissions []blockSubmission
+
+func (ms *memorySubmissions) Record(sub blockSubmission) error {
+	*ms = append(*ms, sub)
+	return nil
+}
+
+func TestSubmitRecordsAttempts(t *testing.T) {
+	metrics := testMetrics(t)
+	sh := newShareHandler(nil, newTipTracker(), StaleConfig{}, newMemoryDupeFilter(time.Minute), nil, metrics,
+		trace.NewNoopTracerProvider().Tracer(tracerName))
+	submissions := &memorySubmissions{}
+	sh.submissions = submissions
+
+	tc := newTestContext(t)
+	tc.ctx.WalletAddr, tc.ctx.WorkerName = "kaspa:one", "rig1"
+	job, _ := tc.ctx.State.GetJob(tc.jobId)
+	block, err := appmessage.RPCBlockToDomainBlock(job.Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		submitter fakeSubmitter
+		expected  ShareResult
+	}{
+		{fakeSubmitter{}, ShareBlockFound},
+		{fakeSubmitter{appmessage.RejectReasonBlockInvalid, rejected("Block rejected. Reason: ErrDuplicateBlock")}, ShareRejectedStale},
+		{fakeSubmitter{appmessage.RejectReasonBlockInvalid, rejected("Block rejected. Reason: ErrInvalidPoW")}, ShareRejectedBlock},
+		{fakeSubmitter{appmessage.RejectReasonNone, errors.New("timeout expired")}, ShareRejectedBlock},
+	} {
+		sh.kaspa = c.submitter
+		if result := sh.submit(context.Background(), tc.ctx, job, block, 0xdeadbeef); result != c.expected {
+			t.Errorf("%v: expected %s, got %s", c.submitter.err, c.expected, result)
+		}
+	}
+
+	if len(*submissions) != 4 {
+		t.Fatalf("expected every attempt to be recorded, got %d", len(*submissions))
+	}
+	accepted, pow := (*submissions)[0], (*submissions)[2]
+	if accepted.Result != BlockAccepted || accepted.Hash == "" || accepted.Wallet != "kaspa:one" ||
+		accepted.Worker != "rig1" || accepted.Nonce != 0xdeadbeef || accepted.BlueScore != job.Block.Header.BlueScore ||
+		accepted.DAAScore != job.Block.Header.DAAScore || !accepted.TemplateFetched.Equal(job.Fetched) ||
+		accepted.SubmittedAt.Before(job.Fetched) || accepted.Error != "" {
+		t.Errorf("unexpected accepted submission: %+v", accepted)
+	}
+	if pow.Result != BlockBadPow || pow.RejectReason != appmessage.RejectReasonBlockInvalid || pow.Error == "" {
+		t.Errorf("unexpected rejected submission: %+v", pow)
+	}
+	if (*submissions)[3].Result != BlockRPCError {
+		t.Errorf("expected the timeout to be an rpc error, got %s", (*submissions)[3].Result)
+	}
+
+	for result, expected := range map[BlockSubmitResult]float64{
+		BlockAccepted: 1, BlockDuplicate: 1, BlockBadPow: 1, BlockRPCError: 1, BlockStale: 0,
+	} {
+		if v := testutil.ToFloat64(metrics.blockSubmissions.WithLabelValues(string(result))); v != expected {
+			t.Errorf("expected %v %s submissions, got %v", expected, result, v)
+		}
+	}
+	if n := testutil.CollectAndCount(metrics.blockSubmitLatency); n != 4 {
+		t.Errorf("expected a latency series per result, got %d", n)
+	}
+}
+
+// share inserts and block submissions are written from different client
+// goroutines, run with -race
+func TestSubmissionsAndSharesShareThePool(t *testing.T) {
+	store, err := newPgSubmissionStore(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := newShareHandler(nil, newTipTracker(), StaleConfig{}, newMemoryDupeFilter(time.Minute), pg, testMetrics(t),
+		trace.NewNoopTracerProvider().Tracer(tracerName))
+	tc := newTestContext(t)
+	job, _ := tc.ctx.State.GetJob(tc.jobId)
+
+	nonce := uint64(time.Now().UnixNano())
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.Record(blockSubmission{Hash: fmt.Sprintf("race%d", i), Wallet: "kaspa:race",
+				Worker: "rig", Mode: MiningModePool, Nonce: nonce + uint64(i), TemplateFetched: job.Fetched,
+				SubmittedAt: time.Now(), Result: BlockAccepted})
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			_, err := sh.checkStales(context.Background(), tc.ctx, job, nonce+uint64(i))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
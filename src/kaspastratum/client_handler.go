@@ -2,8 +2,6 @@ package kaspastratum
 
 import (
 	"fmt"
-	"regexp"
-	"sync"
 	"time"
 
 	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
@@ -11,93 +9,130 @@ import (
 	"go.uber.org/zap"
 )
 
-var bigJobRegex = regexp.MustCompile(".*BzMiner.*")
-
 type clientListener struct {
 	logger       *zap.SugaredLogger
 	shareHandler *shareHandler
-	clientLock   sync.RWMutex
-	clients      map[string]*gostratum.StratumContext
+	clients      *gostratum.ClientRegistry[*MiningState]
+	listener     *live[ListenerConfig]
+	bans         *banList        // optional, see sessionAdmin
+	watchdog     *workerWatchdog // optional
+	jobs         jobSource
+	metrics      *Metrics
 }
 
-func newClientListener(logger *zap.SugaredLogger, shareHandler *shareHandler) *clientListener {
+func newClientListener(logger *zap.SugaredLogger, shareHandler *shareHandler,
+	config ListenerConfig, poolWallet string, minJobInterval time.Duration, metrics *Metrics) *clientListener {
 	return &clientListener{
 		logger:       logger,
-		clientLock:   sync.RWMutex{},
 		shareHandler: shareHandler,
-		clients:      make(map[string]*gostratum.StratumContext),
+		clients:      gostratum.NewClientRegistry[*MiningState](),
+		listener:     newLive(config),
+		metrics:      metrics,
+		jobs: jobSource{
+			config:         config,
+			poolWallet:     poolWallet,
+			minJobInterval: newLive(minJobInterval),
+			metrics:        metrics,
+		},
 	}
 }
 
-func (c *clientListener) OnConnect(ctx *gostratum.StratumContext) {
-	c.clientLock.Lock()
-	c.clients[ctx.RemoteAddr] = ctx
-	c.clientLock.Unlock()
+// newState stamps a new connection with the listener's current settings
+func (c *clientListener) newState() *MiningState {
+	return ListenerStateGenerator(c.listener.Load())()
+}
+
+func (c *clientListener) reload(lc ListenerConfig, minJobInterval time.Duration) {
+	c.listener.Store(lc)
+	c.jobs.minJobInterval.Store(minJobInterval)
+}
+
+func (c *clientListener) sessions() *gostratum.ClientRegistry[*MiningState] {
+	return c.clients
+}
+
+func (c *clientListener) port() string {
+	return c.listener.Load().Port
+}
+
+func (c *clientListener) disconnect(ctx *MinerContext) {
+	ctx.Disconnect()
+}
+
+func (c *clientListener) sendDifficulty(ctx *MinerContext, diff float64) error {
+	ctx.State.setDifficulty(diff)
+	return ctx.Send(ctx.State.Dialect().DifficultyEvent(diff))
+}
+
+func (c *clientListener) OnConnect(ctx *MinerContext) {
+	c.clients.Add(ctx)
+	if c.bans != nil && c.bans.Banned(ctx.RemoteAddr, time.Now()) {
+		ctx.Logger.Info("disconnecting banned address")
+		ctx.Disconnect()
+		return
+	}
 	go func() {
 		// hacky, but give time for the authorize to go through so we can use the worker name
 		time.Sleep(5 * time.Second)
 	}()
 }
 
-func (c *clientListener) OnDisconnect(ctx *gostratum.StratumContext) {
-	ctx.Done()
-	c.clientLock.Lock()
-	delete(c.clients, ctx.RemoteAddr)
-	c.clientLock.Unlock()
-	RecordDisconnect(ctx)
+func (c *clientListener) OnDisconnect(ctx *MinerContext) {
+	c.clients.Remove(ctx)
+	c.metrics.RecordDisconnect(ctx)
+	c.watchdog.Disconnected(ctx)
 }
 
 func (c *clientListener) NewBlockAvailable(kapi *KaspaApi) {
-	c.clientLock.Lock()
-	addresses := make([]string, 0, len(c.clients))
-	for _, c := range c.clients {
-		if !c.Connected() {
+	addresses := c.sendJobs(kapi)
+	if len(addresses) > 0 {
+		go func() {
+			balances, err := kapi.kaspad.GetBalancesByAddresses(addresses)
+			if err != nil {
+				c.logger.Warn("failed to get balances from kaspa, prom stats will be out of date", zap.Error(err))
+				return
+			}
+			c.metrics.RecordBalances(balances)
+		}()
+	}
+}
+
+// sendJobs sends every connected client a job from a fresh template, returning
+// the wallets that were sent one
+func (c *clientListener) sendJobs(templates templateSource) []string {
+	clients := c.clients.All()
+	addresses := make([]string, 0, len(clients))
+	for _, client := range clients {
+		if !client.Connected() {
 			continue
 		}
-		go func(client *gostratum.StratumContext) {
-			state := GetMiningState(client)
+		go func(client *MinerContext) {
+			state := client.State
 			if client.WalletAddr == "" {
-				RecordWorkerError(client.WalletAddr, ErrFailedBlockFetch)
+				c.metrics.RecordWorkerError(client.WalletAddr, ErrFailedBlockFetch)
 				return // not ready
 			}
 
-			template, err := kapi.GetBlockTemplate(client)
+			job, err := c.jobs.nextJob(templates, client)
 			if err != nil {
-				RecordWorkerError(client.WalletAddr, ErrFailedBlockFetch)
-				client.Logger.Error(fmt.Sprintf("failed fetching new block template from kaspa: %s", err))
+				client.Logger.Error(err.Error())
 				return
 			}
-			state.bigDiff = CalculateTarget(uint64(template.Block.Header.Bits))
-			header, err := SerializeBlockHeader(template.Block)
-			if err != nil {
-				RecordWorkerError(client.WalletAddr, ErrBadDataFromMiner)
-				client.Logger.Error(fmt.Sprintf("failed to serialize block header: %s", err))
-				return
+			if job == nil {
+				return // nothing new for this miner
 			}
-
-			jobId := state.AddJob(template.Block)
-			if !state.initialized {
-				state.initialized = true
-				state.useBigJob = bigJobRegex.MatchString(client.RemoteApp)
+			jobId := job.Id
+			if state.markInitialized() {
 				// first pass through send the difficulty since it's fixed
-				if err := client.Send(gostratum.JsonRpcEvent{
-					Version: "2.0",
-					Method:  "mining.set_difficulty",
-					Params:  []any{fixedDifficulty},
-				}); err != nil {
-					RecordWorkerError(client.WalletAddr, ErrFailedSetDiff)
+				if err := client.Send(state.Dialect().DifficultyEvent(state.Difficulty())); err != nil {
+					c.metrics.RecordWorkerError(client.WalletAddr, ErrFailedSetDiff)
 					client.Logger.Error(errors.Wrap(err, "failed sending difficulty").Error(), zap.Any("context", client))
 					return
 				}
 			}
 
-			jobParams := []any{fmt.Sprintf("%d", jobId)}
-			if state.useBigJob {
-				jobParams = append(jobParams, GenerateLargeJobParams(header, uint64(template.Block.Header.Timestamp)))
-			} else {
-				jobParams = append(jobParams, GenerateJobHeader(header))
-				jobParams = append(jobParams, template.Block.Header.Timestamp)
-			}
+			jobParams := append([]any{jobId},
+				state.Dialect().JobParams(job.Header, uint64(job.Block.Header.Timestamp), job.Clean)...)
 
 			// // normal notify flow
 			if err := client.Send(gostratum.JsonRpcEvent{
@@ -107,28 +142,18 @@ func (c *clientListener) NewBlockAvailable(kapi *KaspaApi) {
 				Params:  jobParams,
 			}); err != nil {
 				if errors.Is(err, gostratum.ErrorDisconnected) {
-					RecordWorkerError(client.WalletAddr, ErrDisconnected)
+					c.metrics.RecordWorkerError(client.WalletAddr, ErrDisconnected)
 					return
 				}
-				RecordWorkerError(client.WalletAddr, ErrFailedSendWork)
+				c.metrics.RecordWorkerError(client.WalletAddr, ErrFailedSendWork)
 				client.Logger.Error(errors.Wrap(err, "failed sending work packet").Error(),
 					zap.Any("context", client))
 			}
 
-			RecordNewJob(client)
-		}(c)
-		addresses = append(addresses, c.WalletAddr)
-	}
-	c.clientLock.Unlock()
-
-	if len(addresses) > 0 {
-		go func() {
-			balances, err := kapi.kaspad.GetBalancesByAddresses(addresses)
-			if err != nil {
-				c.logger.Warn("failed to get balances from kaspa, prom stats will be out of date", zap.Error(err))
-				return
-			}
-			RecordBalances(balances)
-		}()
+			client.Logger.Debug(fmt.Sprintf("sent job %s, clean: %t", jobId, job.Clean))
+			c.metrics.RecordNewJob(client)
+		}(client)
+		addresses = append(addresses, client.WalletAddr)
 	}
+	return addresses
 }
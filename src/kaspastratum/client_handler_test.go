@@ -0,0 +1,227 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+)
+
+// fixedTemplates hands out the example header as the template for everyone
+type fixedTemplates struct {
+	header *appmessage.RPCBlockHeader
+}
+
+func newFixedTemplates(t *testing.T) fixedTemplates {
+	headerRaw, err := ioutil.ReadFile("example_header.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := appmessage.RPCBlockHeader{}
+	if err := json.Unmarshal(headerRaw, &header); err != nil {
+		t.Fatal(err)
+	}
+	return fixedTemplates{header: &header}
+}
+
+func (ft fixedTemplates) GetBlockTemplate(client *MinerContext, payAddress string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	return &appmessage.GetBlockTemplateResponseMessage{
+		Block: &appmessage.RPCBlock{Header: ft.header},
+	}, nil
+}
+
+// receivedMethods reads n messages off the connection, returning their methods
+func receivedMethods(t *testing.T, conn *gostratum.MockConnection, n int) []string {
+	methods := make(chan string)
+	go func() {
+		for i := 0; i < n; i++ {
+			conn.ReadTestDataFromBuffer(func(b []byte) {
+				event, err := gostratum.UnmarshalEvent(string(b))
+				if err != nil {
+					t.Error(err)
+				}
+				methods <- string(event.Method)
+			})
+		}
+	}()
+	received := []string{}
+	for i := 0; i < n; i++ {
+		select {
+		case m := <-methods:
+			received = append(received, m)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %d messages, got %v", n, received)
+		}
+	}
+	return received
+}
+
+func TestJobsForRigsBehindOneIp(t *testing.T) {
+	cl := newClientListener(logger, nil, ListenerConfig{Mode: MiningModeSolo, Difficulty: fixedDifficulty},
+		"", 0, testMetrics(t))
+	rigs := []*MinerContext{}
+	conns := []*gostratum.MockConnection{}
+	for _, worker := range []string{"rig1", "rig2", "rig3"} {
+		ctx, conn := gostratum.NewMockContext(context.Background(), logger, MiningStateGenerator())
+		ctx.WalletAddr = "kaspa:nat"
+		ctx.WorkerName = worker
+		cl.OnConnect(ctx)
+		rigs = append(rigs, ctx)
+		conns = append(conns, conn)
+	}
+	if rigs[0].RemoteAddr != rigs[2].RemoteAddr {
+		t.Fatalf("expected the rigs to share an address")
+	}
+	if grouped := cl.clients.ByAddr(rigs[0].RemoteAddr); len(grouped) != 3 {
+		t.Fatalf("expected 3 rigs behind %s, got %d", rigs[0].RemoteAddr, len(grouped))
+	}
+
+	if wallets := cl.sendJobs(newFixedTemplates(t)); len(wallets) != 3 {
+		t.Fatalf("expected jobs for 3 rigs, got %d", len(wallets))
+	}
+	for i, conn := range conns {
+		methods := receivedMethods(t, conn, 2)
+		if methods[0] != "mining.set_difficulty" || methods[1] != "mining.notify" {
+			t.Errorf("rig %d: expected difficulty and a job, got %v", i, methods)
+		}
+	}
+
+	// one rig leaving doesn't take the others with it
+	cl.OnDisconnect(rigs[0])
+	if remaining := cl.clients.ByAddr(rigs[0].RemoteAddr); len(remaining) != 2 {
+		t.Fatalf("expected 2 rigs left behind %s, got %d", rigs[0].RemoteAddr, len(remaining))
+	}
+	if wallets := cl.sendJobs(newFixedTemplates(t)); len(wallets) != 2 {
+		t.Errorf("expected jobs for the 2 remaining rigs, got %d", len(wallets))
+	}
+}
+
+func TestSubscribeDuringJobSend(t *testing.T) {
+	// a miner subscribing on its read goroutine while the template goroutine
+	// sends it a job, run under -race
+	cl := newClientListener(logger, nil, ListenerConfig{Mode: MiningModeSolo, Difficulty: fixedDifficulty},
+		"", 0, testMetrics(t))
+	// matched on the mock's user agent, so the subscribe leaves RemoteApp,
+	// which like the wallet is only written before jobs are sent, alone
+	ds, err := newDialectSelector([]DialectRule{{Agent: "^mock", Dialect: "bzminer"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, conn := gostratum.NewMockContext(context.Background(), logger, MiningStateGenerator())
+	ctx.WalletAddr = "kaspa:one"
+	cl.OnConnect(ctx)
+
+	subscribed := make(chan error)
+	go func() {
+		subscribed <- ds.HandleSubscribe(ctx, gostratum.NewEvent("1", "mining.subscribe", []any{}))
+	}()
+	cl.sendJobs(newFixedTemplates(t))
+
+	methods := receivedMethods(t, conn, 3)
+	if err := <-subscribed; err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, m := range methods {
+		counts[m]++
+	}
+	if counts["mining.set_difficulty"] != 1 || counts["mining.notify"] != 1 {
+		t.Errorf("expected one difficulty and one job alongside the subscribe reply, got %v", methods)
+	}
+	if name := ctx.State.Dialect().Name(); name != "bzminer" {
+		t.Errorf("expected the bzminer dialect after subscribing, got %s", name)
+	}
+}
+
+// receivedNotify reads messages off the connection until a mining.notify
+func receivedNotify(t *testing.T, conn *gostratum.MockConnection) gostratum.JsonRpcEvent {
+	events := make(chan gostratum.JsonRpcEvent)
+	go func() {
+		for {
+			var event gostratum.JsonRpcEvent
+			conn.ReadTestDataFromBuffer(func(b []byte) {
+				var err error
+				if event, err = gostratum.UnmarshalEvent(string(b)); err != nil {
+					t.Error(err)
+				}
+			})
+			if event.Method == "mining.notify" {
+				events <- event
+				return
+			}
+		}
+	}()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a mining.notify")
+	}
+	return gostratum.JsonRpcEvent{}
+}
+
+func TestNotifyCleanJobs(t *testing.T) {
+	// the built in dialects keep the notify format miners already accept
+	for name, d := range dialects {
+		t.Run(name, func(t *testing.T) {
+			cl := newClientListener(logger, nil, ListenerConfig{Mode: MiningModeSolo, Difficulty: fixedDifficulty},
+				"", 0, testMetrics(t))
+			ctx, conn := gostratum.NewMockContext(context.Background(), logger, MiningStateGenerator())
+			ctx.WalletAddr = "kaspa:one"
+			ctx.State.setDialect(d)
+			cl.OnConnect(ctx)
+
+			cl.sendJobs(newFixedTemplates(t))
+			params := receivedNotify(t, conn).Params
+			if _, ok := params[len(params)-1].(bool); ok {
+				t.Errorf("expected no clean_jobs, got params %v", params)
+			}
+		})
+	}
+
+	ds, err := newDialectSelector([]DialectRule{
+		{Agent: "^clean-standard", Dialect: "standard", CleanJobs: true},
+		{Agent: "^clean-bzminer", Dialect: "bzminer", CleanJobs: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, agent := range []string{"clean-standard", "clean-bzminer"} {
+		d := ds.Select(agent)
+		t.Run(agent, func(t *testing.T) {
+			cl := newClientListener(logger, nil, ListenerConfig{Mode: MiningModeSolo, Difficulty: fixedDifficulty},
+				"", 0, testMetrics(t))
+			ctx, conn := gostratum.NewMockContext(context.Background(), logger, MiningStateGenerator())
+			ctx.WalletAddr = "kaspa:one"
+			ctx.State.setDialect(d)
+			cl.OnConnect(ctx)
+
+			templates := newFixedTemplates(t)
+			expectClean := func(desc string, expected bool) {
+				cl.sendJobs(templates)
+				params := receivedNotify(t, conn).Params
+				if clean, ok := params[len(params)-1].(bool); !ok || clean != expected {
+					t.Errorf("%s: expected clean_jobs %t, got params %v", desc, expected, params)
+				}
+			}
+			expectClean("first job", true)
+
+			// new transactions on the same parents only refresh the job
+			refreshed := *templates.header
+			refreshed.HashMerkleRoot = strings.Repeat("ab", 32)
+			templates.header = &refreshed
+			expectClean("same parents", false)
+
+			// a new block moves the parents, earlier work is stale
+			moved := refreshed
+			moved.Parents = []*appmessage.RPCBlockLevelParents{{ParentHashes: []string{strings.Repeat("cd", 32)}}}
+			templates.header = &moved
+			expectClean("new parents", true)
+		})
+	}
+}
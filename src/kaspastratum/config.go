@@ -0,0 +1,446 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+type BridgeConfig struct {
+	StratumPort     string `yaml:"stratum_port"`
+	RPCServer       string `yaml:"kaspad_address"`
+	PromPort        string `yaml:"prom_port"`
+	HealthCheckPort string `yaml:"health_check_port"`
+	// Health tunes the /livez and /readyz checks on the HealthCheckPort
+	Health HealthConfig `yaml:"health"`
+	// RedisPort is the legacy `host:port` of redis, see Redis
+	RedisPort string `yaml:"redis_port"`
+	// PostgresPort is the legacy `host:port` of postgres, see Postgres
+	PostgresPort string `yaml:"postgres_port"`
+	// Postgres is the share database
+	Postgres PostgresConfig `yaml:"postgres"`
+	// Redis is only needed by the redis dupe filter
+	Redis      RedisConfig `yaml:"redis"`
+	PoolWallet string      `yaml:"pool_wallet"`
+	// Difficulty is the share difficulty of listeners that don't set their own
+	Difficulty float64 `yaml:"difficulty"`
+	// JobWindow is how many of its most recent jobs a miner may submit
+	// against, older ones are stale. 32 if 0
+	JobWindow int `yaml:"job_window"`
+	// JobMaxAge is how long a job may be submitted against, older ones are
+	// stale even within the job window. 2m if 0
+	JobMaxAge time.Duration `yaml:"job_max_age"`
+	// MinJobInterval rate limits jobs that only refresh the current tip
+	// (e.g. new transactions). Jobs for a new tip are always sent immediately
+	MinJobInterval time.Duration `yaml:"min_job_interval"`
+	// Stale controls how far behind the tip a share may be and still be credited
+	Stale StaleConfig `yaml:"stale"`
+	// DupeFilter selects how duplicate shares are detected, `memory` unless
+	// several bridges need to share state
+	DupeFilter DupeFilterConfig `yaml:"dupe_filter"`
+
+	// Listeners allows running several stratum ports side by side, e.g. a solo
+	// port next to the pooled one. If empty, StratumPort is used as a single
+	// solo listener
+	Listeners []ListenerConfig `yaml:"listeners"`
+	// StratumV2Key is the hex encoded private static noise key for v2
+	// listeners
+	StratumV2Key string `yaml:"stratum_v2_key" secret:"true"`
+	// StratumV2AuthorityKey is the hex encoded private key signing the
+	// static key's certificate, at startup and whenever it is renewed. Miners
+	// pin the matching public key, so keep it stable. The static key signs for
+	// itself if unset
+	StratumV2AuthorityKey string `yaml:"stratum_v2_authority_key" secret:"true"`
+	// StratumV2CertValidity is how long those certificates are valid, 1h if 0
+	StratumV2CertValidity time.Duration `yaml:"stratum_v2_cert_validity"`
+	// Dialects map miner user agents onto job/submit formats, checked before
+	// the built in rules
+	Dialects []DialectRule `yaml:"dialects"`
+	// WorkerMetrics bounds the number of per worker prometheus series
+	WorkerMetrics WorkerMetricsConfig `yaml:"worker_metrics"`
+	// Registry the bridge's metrics are registered on, a new one with the go
+	// and process collectors if nil. Set it to run several bridges in one
+	// process or to serve pool level collectors alongside
+	Registry *prometheus.Registry `yaml:"-"`
+	// Notify announces found blocks and outages on webhooks, Discord and
+	// Telegram
+	Notify NotifyConfig `yaml:"notify"`
+	// Watchdog alerts miners who subscribe through the admin api when their
+	// workers stop submitting shares
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+	// Tracing exports spans of the share path over OTLP when configured
+	Tracing TracingConfig `yaml:"tracing"`
+	// Log configures levels, format and the optional log file
+	Log LogConfig `yaml:"log"`
+	// AdminPort serves runtime controls such as /log/level and the session
+	// api, disabled if empty
+	AdminPort string `yaml:"admin_port"`
+	// AdminToken is the bearer token every admin request must carry, required
+	// if AdminPort is set
+	AdminToken string `yaml:"admin_token" secret:"true"`
+	// Loader reloads the config on SIGHUP or a POST to /config/reload on the
+	// admin port, usually LoadConfig on the same path. Reloads are disabled if
+	// nil, see reloader for which settings apply without a restart
+	Loader func() (BridgeConfig, error) `yaml:"-"`
+}
+
+type PostgresConfig struct {
+	// DSN is a postgres:// url or `key=value` connection string. The other
+	// fields are ignored if it's set
+	DSN      string `yaml:"dsn" secret:"true"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"pass" secret:"true"`
+	Database string `yaml:"database"`
+	// MaxConnections bounds the pool shared by the share path, the stores and
+	// the health checks, 10 if 0
+	MaxConnections int `yaml:"max_connections"`
+}
+
+type RedisConfig struct {
+	// URL is a redis:// url, the other fields are ignored if it's set
+	URL      string `yaml:"url" secret:"true"`
+	Address  string `yaml:"address"`
+	Password string `yaml:"password" secret:"true"`
+	DB       int    `yaml:"db"`
+}
+
+const (
+	defaultPostgresPort = 5432
+	maxJobWindow        = 1024
+)
+
+// EnvPrefix prefixes the environment variables overriding the config file.
+// Every setting has one, named after its yaml path, e.g. `postgres.pass` is
+// KASPA_BRIDGE_POSTGRES_PASS. Appending _FILE reads the value from a file
+// instead, e.g. a mounted secret
+const EnvPrefix = "KASPA_BRIDGE_"
+
+// LoadConfig reads the config file, if a path is given, then applies any
+// environment overrides found through lookupEnv, usually os.LookupEnv.
+// Unknown settings in the file are an error so typos don't go unnoticed
+func LoadConfig(path string, lookupEnv func(string) (string, bool)) (BridgeConfig, error) {
+	cfg := BridgeConfig{}
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("failed reading config file: %s", err)
+		}
+		if err := yaml.UnmarshalStrict(raw, &cfg); err != nil {
+			return cfg, fmt.Errorf("failed parsing config file %s: %s", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), EnvPrefix, lookupEnv); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv walks the yaml tagged fields of the struct, setting every scalar
+// that has an environment variable. Lists and maps can only be set in the file
+func applyEnv(v reflect.Value, prefix string, lookupEnv func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(v.Field(i), name+"_", lookupEnv); err != nil {
+				return err
+			}
+			continue
+		}
+		value, exists := lookupEnv(name)
+		if path, fromFile := lookupEnv(name + "_FILE"); fromFile {
+			raw, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %s", name, err)
+			}
+			value, exists = strings.TrimSpace(string(raw)), true
+		}
+		if !exists {
+			continue
+		}
+		if err := setScalar(v.Field(i), value); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func setScalar(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected an integer, got '%s'", value)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a positive integer, got '%s'", value)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a number, got '%s'", value)
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got '%s'", value)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("can only be set in the config file")
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config safe to print, every secret that is
+// set reads `<redacted>`
+func (cfg BridgeConfig) Redacted() BridgeConfig {
+	redact(reflect.ValueOf(&cfg).Elem())
+	return cfg
+}
+
+func redact(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			redact(v.Field(i))
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct:
+			// copy so the original config keeps its secrets
+			redacted := reflect.MakeSlice(field.Type, v.Field(i).Len(), v.Field(i).Len())
+			reflect.Copy(redacted, v.Field(i))
+			for j := 0; j < redacted.Len(); j++ {
+				redact(redacted.Index(j))
+			}
+			v.Field(i).Set(redacted)
+		case field.Tag.Get("secret") == "true" && v.Field(i).String() != "":
+			v.Field(i).SetString("<redacted>")
+		}
+	}
+}
+
+// Validate checks the whole config up front, reporting every problem at once
+func (cfg BridgeConfig) Validate() error {
+	errs := []string{}
+	check := func(setting string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", setting, err))
+		}
+	}
+
+	if cfg.RPCServer == "" {
+		check("kaspad_address", fmt.Errorf("is required"))
+	}
+	listeners, err := cfg.listenerConfigs()
+	check("listeners", err)
+	for _, l := range listeners {
+		if l.Protocol == StratumV2 {
+			_, err := cfg.stratumV2Keys()
+			check("stratum_v2_key", err)
+			break
+		}
+	}
+	check("ports", cfg.validatePorts(listeners))
+	if cfg.AdminPort != "" && cfg.AdminToken == "" {
+		check("admin_token", fmt.Errorf("is required when admin_port is set"))
+	}
+	if cfg.Difficulty < 0 {
+		check("difficulty", fmt.Errorf("must be positive"))
+	}
+	if cfg.JobWindow < 0 || cfg.JobWindow > maxJobWindow {
+		check("job_window", fmt.Errorf("must be between 0 (default) and %d", maxJobWindow))
+	}
+	if cfg.JobMaxAge < 0 {
+		check("job_max_age", fmt.Errorf("must be positive"))
+	}
+	if cfg.MinJobInterval < 0 {
+		check("min_job_interval", fmt.Errorf("must be positive"))
+	}
+	if cfg.Stale.TimeGrace < 0 {
+		check("stale.time_grace", fmt.Errorf("must be positive"))
+	}
+	check("dupe_filter", cfg.validateDupeFilter())
+	_, err = cfg.postgresPoolConfig()
+	check("postgres", err)
+	_, err = cfg.redisOptions()
+	check("redis", err)
+	_, err = newDialectSelector(cfg.Dialects)
+	check("dialects", err)
+	check("health", cfg.Health.validate())
+	check("worker_metrics", cfg.WorkerMetrics.validate())
+	check("notify", cfg.Notify.validate())
+	check("watchdog", cfg.Watchdog.validate())
+	check("tracing", cfg.Tracing.validate())
+	check("log", cfg.Log.validate())
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// validatePorts makes sure every port parses and is only used once
+func (cfg BridgeConfig) validatePorts(listeners []ListenerConfig) error {
+	ports := map[string]string{}
+	for _, l := range listeners {
+		ports[l.Port] = "listener " + l.Port
+	}
+	for _, p := range []struct{ setting, port string }{
+		{"prom_port", cfg.PromPort},
+		{"health_check_port", cfg.HealthCheckPort},
+		{"admin_port", cfg.AdminPort},
+	} {
+		if p.port == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(p.port); err != nil {
+			return fmt.Errorf("%s: %s", p.setting, err)
+		}
+		if other, exists := ports[p.port]; exists {
+			return fmt.Errorf("%s: %s is already used by %s", p.setting, p.port, other)
+		}
+		ports[p.port] = p.setting
+	}
+	return nil
+}
+
+func (cfg BridgeConfig) validateDupeFilter() error {
+	switch cfg.DupeFilter.Mode {
+	case "", DupeFilterMemory:
+	case DupeFilterRedis:
+		if opts, _ := cfg.redisOptions(); opts == nil {
+			return fmt.Errorf("redis mode requires `redis` to be configured")
+		}
+	default:
+		return fmt.Errorf("unknown mode '%s'", cfg.DupeFilter.Mode)
+	}
+	if cfg.DupeFilter.TTL < 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+	return nil
+}
+
+// postgresConfig resolves the share database connection from the dsn, the
+// individual settings or the legacy postgres_port, in that order
+func (cfg BridgeConfig) postgresConfig() (pgx.ConnConfig, error) {
+	pg := cfg.Postgres
+	if pg.DSN != "" {
+		conn, err := pgx.ParseConnectionString(pg.DSN)
+		if err != nil {
+			return conn, fmt.Errorf("malformed dsn: %s", err)
+		}
+		return conn, nil
+	}
+	if pg.Host == "" && pg.Port == 0 && cfg.PostgresPort != "" {
+		host, port, err := net.SplitHostPort(cfg.PostgresPort)
+		if err != nil {
+			return pgx.ConnConfig{}, fmt.Errorf("malformed postgres_port: %s", err)
+		}
+		pg.Host = host
+		if pg.Port, err = strconv.Atoi(port); err != nil {
+			return pgx.ConnConfig{}, fmt.Errorf("malformed postgres_port: %s", err)
+		}
+	}
+	if pg.Host == "" {
+		pg.Host = "localhost"
+	}
+	if pg.Port == 0 {
+		pg.Port = defaultPostgresPort
+	}
+	if pg.Port < 0 || pg.Port > 65535 {
+		return pgx.ConnConfig{}, fmt.Errorf("port %d is out of range", pg.Port)
+	}
+	if pg.User == "" || pg.Database == "" {
+		return pgx.ConnConfig{}, fmt.Errorf("either dsn or user and database are required")
+	}
+	return pgx.ConnConfig{
+		Host:     pg.Host,
+		Port:     uint16(pg.Port),
+		User:     pg.User,
+		Password: pg.Password,
+		Database: pg.Database,
+	}, nil
+}
+
+const (
+	defaultPostgresConnections = 10
+	// how long a share insert waits for a free connection before failing
+	postgresAcquireTimeout = 5 * time.Second
+)
+
+// postgresPoolConfig is the pool every postgres user of the bridge shares, a
+// single pgx.Conn can't be used from several goroutines
+func (cfg BridgeConfig) postgresPoolConfig() (pgx.ConnPoolConfig, error) {
+	conn, err := cfg.postgresConfig()
+	if err != nil {
+		return pgx.ConnPoolConfig{}, err
+	}
+	max := cfg.Postgres.MaxConnections
+	if max == 0 {
+		max = defaultPostgresConnections
+	}
+	if max < 2 {
+		return pgx.ConnPoolConfig{}, fmt.Errorf("max_connections must be at least 2")
+	}
+	return pgx.ConnPoolConfig{
+		ConnConfig:     conn,
+		MaxConnections: max,
+		AcquireTimeout: postgresAcquireTimeout,
+	}, nil
+}
+
+// redisOptions resolves the redis connection from the url, the individual
+// settings or the legacy redis_port, in that order. nil if redis isn't
+// configured at all
+func (cfg BridgeConfig) redisOptions() (*redis.Options, error) {
+	rd := cfg.Redis
+	if rd.URL != "" {
+		opts, err := redis.ParseURL(rd.URL)
+		if err != nil {
+			return nil, fmt.Errorf("malformed url: %s", err)
+		}
+		return opts, nil
+	}
+	if rd.Address == "" {
+		rd.Address = cfg.RedisPort
+	}
+	if rd.Address == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(rd.Address); err != nil {
+		return nil, fmt.Errorf("malformed address: %s", err)
+	}
+	return &redis.Options{Addr: rd.Address, Password: rd.Password, DB: rd.DB}, nil
+}
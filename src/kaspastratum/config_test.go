@@ -0,0 +1,168 @@
+package kaspastratum
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jackc/pgx"
+)
+
+func writeTestFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, exists := env[name]
+		return v, exists
+	}
+}
+
+const testConfigYaml = `
+stratum_port:   ":5555"
+kaspad_address: localhost:16110
+min_job_interval: 2s
+postgres:
+  host:     postgres.data
+  user:     pooladmin
+  database: kaspa-db
+log:
+  level: info
+`
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestFile(t, "config.yaml", testConfigYaml)
+	secret := writeTestFile(t, "pg-pass", "hunter2\n")
+	cfg, err := LoadConfig(path, testEnv(map[string]string{
+		"KASPA_BRIDGE_KASPAD_ADDRESS":      "kaspad:16110",
+		"KASPA_BRIDGE_MIN_JOB_INTERVAL":    "5s",
+		"KASPA_BRIDGE_DIFFICULTY":          "16",
+		"KASPA_BRIDGE_POSTGRES_PORT":       "5433",
+		"KASPA_BRIDGE_POSTGRES_PASS_FILE":  secret,
+		"KASPA_BRIDGE_LOG_LEVEL":           "debug",
+		"KASPA_BRIDGE_LOG_FILE_COMPRESS":   "true",
+		"KASPA_BRIDGE_REDIS_PASSWORD":      "s3cret",
+		"KASPA_BRIDGE_REDIS_ADDRESS":       "redis:6379",
+		"KASPA_BRIDGE_UNRELATED_SOMETHING": "ignored",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is overridden, untouched settings keep the file's values
+	if cfg.StratumPort != ":5555" || cfg.RPCServer != "kaspad:16110" || cfg.MinJobInterval != 5*time.Second ||
+		cfg.Difficulty != 16 || cfg.Log.Level != "debug" || !cfg.Log.File.Compress {
+		t.Errorf("environment not applied: %+v", cfg)
+	}
+	pg, err := cfg.postgresConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := pgx.ConnConfig{Host: "postgres.data", Port: 5433, User: "pooladmin", Password: "hunter2",
+		Database: "kaspa-db"}
+	if d := cmp.Diff(expected, pg); d != "" {
+		t.Errorf("unexpected postgres config: %s", d)
+	}
+	rd, err := cfg.redisOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd.Addr != "redis:6379" || rd.Password != "s3cret" {
+		t.Errorf("unexpected redis config: %+v", rd)
+	}
+
+	redacted := cfg.Redacted()
+	if redacted.Postgres.Password != "<redacted>" || redacted.Redis.Password != "<redacted>" {
+		t.Errorf("secrets not redacted: %+v", redacted)
+	}
+	if redacted.Redis.URL != "" || redacted.Postgres.User != "pooladmin" {
+		t.Errorf("expected unset secrets and non secrets to be left alone: %+v", redacted)
+	}
+	if cfg.Postgres.Password != "hunter2" {
+		t.Errorf("redacting modified the original config")
+	}
+
+	for name, env := range map[string]map[string]string{
+		"malformed duration": {"KASPA_BRIDGE_MIN_JOB_INTERVAL": "soon"},
+		"malformed number":   {"KASPA_BRIDGE_JOB_WINDOW": "many"},
+		"missing file":       {"KASPA_BRIDGE_POSTGRES_PASS_FILE": filepath.Join(t.TempDir(), "nope")},
+	} {
+		if _, err := LoadConfig(path, testEnv(env)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := LoadConfig(writeTestFile(t, "typo.yaml", testConfigYaml+"stratum_prot: \":5556\"\n"),
+		testEnv(nil)); err == nil || !strings.Contains(err.Error(), "stratum_prot") {
+		t.Errorf("expected unknown settings to be rejected, got %v", err)
+	}
+}
+
+func TestConfigDatabases(t *testing.T) {
+	base := BridgeConfig{StratumPort: ":5555", RPCServer: "localhost:16110"}
+
+	cfg := base
+	cfg.Postgres.DSN = "postgres://pool:pass@db:6543/shares"
+	pg, err := cfg.postgresConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pg.Host != "db" || pg.Port != 6543 || pg.User != "pool" || pg.Password != "pass" || pg.Database != "shares" {
+		t.Errorf("dsn not applied: %+v", pg)
+	}
+
+	cfg = base
+	cfg.PostgresPort = "legacy:5434"
+	cfg.Postgres = PostgresConfig{User: "pool", Database: "shares"}
+	if pg, err = cfg.postgresConfig(); err != nil || pg.Host != "legacy" || pg.Port != 5434 {
+		t.Errorf("legacy postgres_port not applied: %+v, %v", pg, err)
+	}
+
+	cfg = base
+	cfg.Postgres = PostgresConfig{User: "pool", Database: "shares"}
+	cfg.Redis.URL = "redis://:pass@cache:6380/2"
+	rd, err := cfg.redisOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd.Addr != "cache:6380" || rd.Password != "pass" || rd.DB != 2 {
+		t.Errorf("redis url not applied: %+v", rd)
+	}
+	if rd, _ := base.redisOptions(); rd != nil {
+		t.Errorf("expected no redis unless configured, got %+v", rd)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	err := BridgeConfig{
+		StratumPort: ":5555",
+		PromPort:    ":5555",
+		AdminPort:   ":5560",
+		JobWindow:   -1,
+		JobMaxAge:   -time.Second,
+		DupeFilter:  DupeFilterConfig{Mode: DupeFilterRedis},
+		Tracing:     TracingConfig{SampleRatio: 2},
+		Log:         LogConfig{Level: "loud"},
+		Postgres:    PostgresConfig{DSN: "postgres://%zz"},
+	}.Validate()
+	if err == nil {
+		t.Fatal("expected the config to be rejected")
+	}
+	// every problem is reported at once
+	for _, setting := range []string{"kaspad_address", "prom_port", "admin_token", "job_window", "job_max_age",
+		"dupe_filter", "tracing", "log", "postgres"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("expected %s to be reported, got %s", setting, err)
+		}
+	}
+}
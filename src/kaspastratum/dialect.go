@@ -0,0 +1,220 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+)
+
+// MinerDialect captures the differences in how miners speak stratum. Every
+// connection picks one when it subscribes, based on its user agent
+type MinerDialect interface {
+	Name() string
+	// SubscribeResult is the result of the mining.subscribe response
+	SubscribeResult(extranonce string) any
+	// DifficultyEvent sets the share difficulty on the miner
+	DifficultyEvent(diff float64) gostratum.JsonRpcEvent
+	// JobParams are the mining.notify params following the job id. Dialects
+	// that send clean_jobs end in it, a clean job tells the miner to drop all
+	// earlier work
+	JobParams(header []byte, timestamp uint64, clean bool) []any
+	// DecodeNonce parses the nonce from a mining.submit. Miners that are given
+	// an extranonce may only submit their part of the nonce
+	DecodeNonce(extranonce string, nonce string) (uint64, error)
+}
+
+// jobFormat is how the pre-pow header and timestamp are encoded in a notify
+type jobFormat int
+
+const (
+	// four little endian header words followed by the timestamp, see
+	// GenerateJobHeader
+	jobFormatWords jobFormat = iota
+	// a single hex string of the header and little endian timestamp, see
+	// GenerateLargeJobParams
+	jobFormatHex
+)
+
+// subscribeFormat is the shape of the mining.subscribe result
+type subscribeFormat int
+
+const (
+	// [true, "EthereumStratum/1.0.0"]
+	subscribeFormatStandard subscribeFormat = iota
+	// [null, extranonce, extranonce2 size], miners expecting this ignore a
+	// later mining.set_extranonce
+	subscribeFormatExtranonce
+)
+
+// dialect implements MinerDialect from a few orthogonal choices, the known
+// miners only differ in these
+type dialect struct {
+	name      string
+	job       jobFormat
+	subscribe subscribeFormat
+	// cleanJobs appends clean_jobs to mining.notify. None of the known miners
+	// are confirmed to accept the extra param, so it is only sent where a
+	// dialect rule asks for it
+	cleanJobs bool
+}
+
+func (d dialect) Name() string {
+	return d.name
+}
+
+func (d dialect) SubscribeResult(extranonce string) any {
+	if d.subscribe == subscribeFormatExtranonce {
+		return []any{nil, extranonce, 8 - len(extranonce)/2}
+	}
+	return []any{true, "EthereumStratum/1.0.0"}
+}
+
+func (d dialect) DifficultyEvent(diff float64) gostratum.JsonRpcEvent {
+	return gostratum.JsonRpcEvent{
+		Version: "2.0",
+		Method:  "mining.set_difficulty",
+		Params:  []any{diff},
+	}
+}
+
+func (d dialect) JobParams(header []byte, timestamp uint64, clean bool) []any {
+	params := []any{GenerateJobHeader(header), timestamp}
+	if d.job == jobFormatHex {
+		params = []any{GenerateLargeJobParams(header, timestamp)}
+	}
+	if d.cleanJobs {
+		params = append(params, clean)
+	}
+	return params
+}
+
+func (d dialect) DecodeNonce(extranonce string, nonce string) (uint64, error) {
+	nonce = strings.TrimPrefix(nonce, "0x")
+	if extranonce != "" {
+		if free := 16 - len(extranonce); len(nonce) <= free {
+			nonce = extranonce + fmt.Sprintf("%0*s", free, nonce)
+		}
+		if !strings.HasPrefix(nonce, extranonce) {
+			return 0, fmt.Errorf("nonce %s outside of extranonce %s", nonce, extranonce)
+		}
+	}
+	return strconv.ParseUint(nonce, 16, 64)
+}
+
+var (
+	// lolMiner, SRBMiner and anything unrecognized
+	DialectStandard MinerDialect = dialect{name: "standard"}
+	DialectBzMiner  MinerDialect = dialect{name: "bzminer", job: jobFormatHex}
+	DialectIceRiver MinerDialect = dialect{name: "iceriver", job: jobFormatHex,
+		subscribe: subscribeFormatExtranonce}
+	DialectGoldshell MinerDialect = dialect{name: "goldshell", subscribe: subscribeFormatExtranonce}
+)
+
+var dialects = map[string]MinerDialect{}
+
+// withCleanJobs is the dialect with clean_jobs added to its notify
+func withCleanJobs(d MinerDialect) MinerDialect {
+	variant := d.(dialect)
+	variant.cleanJobs = true
+	return variant
+}
+
+func init() {
+	for _, d := range []MinerDialect{DialectStandard, DialectBzMiner, DialectIceRiver, DialectGoldshell} {
+		dialects[d.Name()] = d
+	}
+}
+
+// DialectRule maps user agents matching the regex onto a dialect
+type DialectRule struct {
+	Agent   string `yaml:"agent"`
+	Dialect string `yaml:"dialect"`
+	// CleanJobs sends clean_jobs with mining.notify, only for miners known to
+	// accept the extra param
+	CleanJobs bool `yaml:"clean_jobs"`
+}
+
+// rules for the miners we know of, checked after any configured rules
+var defaultDialectRules = []DialectRule{
+	{Agent: "(?i)bzminer", Dialect: "bzminer"},
+	{Agent: "(?i)iceriver", Dialect: "iceriver"},
+	{Agent: "(?i)goldshell", Dialect: "goldshell"},
+}
+
+type dialectMatcher struct {
+	agent   *regexp.Regexp
+	dialect MinerDialect
+}
+
+// dialectSelector picks the dialect for a user agent, first match wins. The
+// rules can be replaced by a config reload
+type dialectSelector struct {
+	rules *live[[]dialectMatcher]
+}
+
+func newDialectSelector(rules []DialectRule) (*dialectSelector, error) {
+	matchers, err := compileDialectRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	return &dialectSelector{rules: newLive(matchers)}, nil
+}
+
+// compileDialectRules compiles the configured rules followed by the defaults
+func compileDialectRules(rules []DialectRule) ([]dialectMatcher, error) {
+	matchers := []dialectMatcher{}
+	for _, rule := range append(append([]DialectRule{}, rules...), defaultDialectRules...) {
+		agent, err := regexp.Compile(rule.Agent)
+		if err != nil {
+			return nil, fmt.Errorf("dialect rule '%s': %s", rule.Agent, err)
+		}
+		d, exists := dialects[rule.Dialect]
+		if !exists {
+			return nil, fmt.Errorf("dialect rule '%s': unknown dialect '%s'", rule.Agent, rule.Dialect)
+		}
+		if rule.CleanJobs {
+			d = withCleanJobs(d)
+		}
+		matchers = append(matchers, dialectMatcher{agent: agent, dialect: d})
+	}
+	return matchers, nil
+}
+
+// update replaces the rules, miners that already subscribed keep their dialect
+func (ds *dialectSelector) update(rules []DialectRule) error {
+	matchers, err := compileDialectRules(rules)
+	if err != nil {
+		return err
+	}
+	ds.rules.Store(matchers)
+	return nil
+}
+
+func (ds *dialectSelector) Select(userAgent string) MinerDialect {
+	for _, rule := range ds.rules.Load() {
+		if rule.agent.MatchString(userAgent) {
+			return rule.dialect
+		}
+	}
+	return DialectStandard
+}
+
+// HandleSubscribe replies to mining.subscribe in the dialect of the miner
+func (ds *dialectSelector) HandleSubscribe(ctx *MinerContext, event gostratum.JsonRpcEvent) error {
+	if len(event.Params) > 0 {
+		if app, ok := event.Params[0].(string); ok {
+			ctx.RemoteApp = app
+		}
+	}
+	state := ctx.State
+	dialect := ds.Select(ctx.RemoteApp)
+	state.setDialect(dialect)
+	if err := ctx.Reply(gostratum.NewResponse(event, dialect.SubscribeResult(""), nil)); err != nil {
+		return fmt.Errorf("failed to send response to subscribe: %s", err)
+	}
+	ctx.Logger.Info(fmt.Sprintf("client subscribed, app: %s, dialect: %s", ctx.RemoteApp, dialect.Name()))
+	return nil
+}
@@ -0,0 +1,118 @@
+package kaspastratum
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// dialectTranscript renders everything a dialect puts on the wire for the
+// example header, one message per line
+func dialectTranscript(t *testing.T, d MinerDialect) string {
+	raw, err := ioutil.ReadFile("./example_header.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(raw, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	header, err := SerializeBlockHeader(&block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe := gostratum.JsonRpcEvent{Id: 1, Version: "2.0", Method: "mining.subscribe"}
+	messages := []any{
+		gostratum.NewResponse(subscribe, d.SubscribeResult(""), nil),
+		gostratum.NewResponse(subscribe, d.SubscribeResult("a1b2"), nil),
+		d.DifficultyEvent(4),
+		gostratum.NewEvent("1", "mining.notify",
+			append([]any{"1"}, d.JobParams(header, uint64(block.Header.Timestamp), true)...)),
+	}
+	out := strings.Builder{}
+	for _, m := range messages {
+		encoded, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write(encoded)
+		out.WriteString("\n")
+	}
+	for _, submit := range []struct{ extranonce, nonce string }{
+		{"", "0x9abb1a6300000000"},
+		{"", "9abb1a6300000000"},
+		{"a1b2", "1a6300000000"},
+		{"a1b2", "a1b21a6300000000"},
+		{"a1b2", "ffff1a6300000000"},
+	} {
+		nonce, err := d.DecodeNonce(submit.extranonce, submit.nonce)
+		fmt.Fprintf(&out, "submit %q %q: %d %v\n", submit.extranonce, submit.nonce, nonce, err)
+	}
+	return out.String()
+}
+
+func TestDialectGolden(t *testing.T) {
+	cases := map[string]MinerDialect{"standard+clean_jobs": withCleanJobs(DialectStandard)}
+	for name, d := range dialects {
+		cases[name] = d
+	}
+	for name, d := range cases {
+		t.Run(name, func(t *testing.T) {
+			actual := dialectTranscript(t, d)
+			path := filepath.Join("testdata", "dialects", name+".golden")
+			if *updateGolden {
+				if err := ioutil.WriteFile(path, []byte(actual), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(string(expected), actual); d != "" {
+				t.Errorf("wire output changed, rerun with -update if intended: %s", d)
+			}
+		})
+	}
+}
+
+func TestDialectSelection(t *testing.T) {
+	ds, err := newDialectSelector([]DialectRule{
+		{Agent: `^lolMiner 1\.`, Dialect: "bzminer"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for agent, expected := range map[string]MinerDialect{
+		"BzMiner/v12.1.0":    DialectBzMiner,
+		"bzminer":            DialectBzMiner,
+		"lolMiner 1.60":      DialectBzMiner, // configured rules come first
+		"lolMiner 2.0":       DialectStandard,
+		"IceRiverMiner-v1.1": DialectIceRiver,
+		"GoldShell/KD-BOX":   DialectGoldshell,
+		"SRBMiner-MULTI/2.1": DialectStandard,
+		"":                   DialectStandard,
+	} {
+		if actual := ds.Select(agent); actual != expected {
+			t.Errorf("agent '%s': expected dialect %s, got %s", agent, expected.Name(), actual.Name())
+		}
+	}
+
+	if _, err := newDialectSelector([]DialectRule{{Agent: "foo", Dialect: "nope"}}); err == nil {
+		t.Error("expected unknown dialect to be rejected")
+	}
+	if _, err := newDialectSelector([]DialectRule{{Agent: "(", Dialect: "standard"}}); err == nil {
+		t.Error("expected malformed agent regex to be rejected")
+	}
+}
@@ -0,0 +1,135 @@
+package kaspastratum
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// dupeFilter detects shares that have already been submitted for a job
+type dupeFilter interface {
+	// Seen records the nonce against the job and reports whether it had
+	// already been submitted
+	Seen(ctx context.Context, job *jobEntry, nonce uint64) (bool, error)
+}
+
+type DupeFilterMode string
+
+const (
+	// DupeFilterMemory tracks nonces in process, no network round trip
+	DupeFilterMemory DupeFilterMode = "memory"
+	// DupeFilterRedis shares nonce sets between bridge instances
+	DupeFilterRedis DupeFilterMode = "redis"
+)
+
+type DupeFilterConfig struct {
+	Mode DupeFilterMode `yaml:"mode"`
+	// how long a template's nonce set is kept after the last submit
+	TTL time.Duration `yaml:"ttl"`
+}
+
+const defaultDupeTTL = 5 * time.Minute
+
+func newDupeFilter(cfg DupeFilterConfig, rd *redis.Client) (dupeFilter, error) {
+	ttl := cfg.TTL
+	if ttl == 0 {
+		ttl = defaultDupeTTL
+	}
+	switch cfg.Mode {
+	case "", DupeFilterMemory:
+		return newMemoryDupeFilter(ttl), nil
+	case DupeFilterRedis:
+		if rd == nil {
+			return nil, fmt.Errorf("redis dupe filter requires a redis connection")
+		}
+		return &redisDupeFilter{client: rd, ttl: ttl}, nil
+	default:
+		return nil, fmt.Errorf("unknown dupe filter mode '%s'", cfg.Mode)
+	}
+}
+
+// dupeKey identifies a job by its template content rather than its id. In
+// pool mode every connection mines the same template, so a nonce replayed on
+// another connection is still caught
+func dupeKey(job *jobEntry) string {
+	header := job.Block.Header
+	return fmt.Sprintf("%s:%d:%d", header.HashMerkleRoot, header.DAAScore, header.Timestamp)
+}
+
+// memoryDupeFilter keeps one nonce set per template for every connection of
+// the bridge. Sets are dropped once nothing was submitted against them for
+// the ttl
+type memoryDupeFilter struct {
+	ttl       time.Duration
+	lock      sync.Mutex
+	sets      map[string]*nonceSet
+	lastSweep time.Time
+}
+
+type nonceSet struct {
+	nonces   map[uint64]struct{}
+	lastSeen time.Time
+}
+
+func newMemoryDupeFilter(ttl time.Duration) *memoryDupeFilter {
+	return &memoryDupeFilter{ttl: ttl, sets: map[string]*nonceSet{}, lastSweep: time.Now()}
+}
+
+func (mf *memoryDupeFilter) Seen(_ context.Context, job *jobEntry, nonce uint64) (bool, error) {
+	key := dupeKey(job)
+	now := time.Now()
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	mf.sweep(now)
+	set, exists := mf.sets[key]
+	if !exists {
+		set = &nonceSet{nonces: map[uint64]struct{}{}}
+		mf.sets[key] = set
+	}
+	set.lastSeen = now
+	if _, seen := set.nonces[nonce]; seen {
+		return true, nil
+	}
+	set.nonces[nonce] = struct{}{}
+	return false, nil
+}
+
+// sweep drops expired sets, at most once per ttl to keep it off the share path
+func (mf *memoryDupeFilter) sweep(now time.Time) {
+	if now.Sub(mf.lastSweep) < mf.ttl {
+		return
+	}
+	mf.lastSweep = now
+	for key, set := range mf.sets {
+		if now.Sub(set.lastSeen) > mf.ttl {
+			delete(mf.sets, key)
+		}
+	}
+}
+
+// redisDupeFilter keeps one set per job, keyed on the template content like
+// the memory filter so the same work handed out by several bridge instances
+// shares a set. Every submit refreshes the ttl, so a set expires once its job
+// is no longer being mined
+type redisDupeFilter struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func redisDupeKey(job *jobEntry) string {
+	return "dupes:" + dupeKey(job)
+}
+
+func (rf *redisDupeFilter) Seen(ctx context.Context, job *jobEntry, nonce uint64) (bool, error) {
+	key := redisDupeKey(job)
+	pipe := rf.client.TxPipeline()
+	added := pipe.SAdd(ctx, key, nonce)
+	pipe.Expire(ctx, key, rf.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return added.Val() == 0, nil
+}
@@ -0,0 +1,146 @@
+package kaspastratum
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+// dupeTemplate is a template that only shares a dupe set with templates of
+// the same merkle root
+func dupeTemplate(root string) *appmessage.RPCBlock {
+	return &appmessage.RPCBlock{Header: &appmessage.RPCBlockHeader{HashMerkleRoot: root}}
+}
+
+func testDupeFilter(t *testing.T, filter dupeFilter) {
+	ctx := context.Background()
+	js := newJobStore(maxjobs, defaultJobMaxAge)
+	now := time.Now().UnixNano()
+	jobA, _ := js.Get(js.Add(dupeTemplate(fmt.Sprintf("a%d", now))))
+	jobB, _ := js.Get(js.Add(dupeTemplate(fmt.Sprintf("b%d", now))))
+
+	for _, tc := range []struct {
+		desc     string
+		job      *jobEntry
+		nonce    uint64
+		expected bool
+	}{
+		{"new nonce", jobA, 1, false},
+		{"same nonce", jobA, 1, true},
+		{"same nonce, other job", jobB, 1, false},
+		{"other nonce", jobA, 2, false},
+	} {
+		dupe, err := filter.Seen(ctx, tc.job, tc.nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dupe != tc.expected {
+			t.Errorf("%s: expected dupe %t, got %t", tc.desc, tc.expected, dupe)
+		}
+	}
+}
+
+func TestMemoryDupeFilter(t *testing.T) {
+	testDupeFilter(t, newMemoryDupeFilter(time.Minute))
+}
+
+func TestMemoryDupeFilterAcrossConnections(t *testing.T) {
+	ctx := context.Background()
+	filter := newMemoryDupeFilter(time.Minute)
+	// in pool mode every connection is sent the same pool wallet template,
+	// each under its own job id
+	template := dupeTemplate("pool")
+	first, second := newJobStore(maxjobs, defaultJobMaxAge), newJobStore(maxjobs, defaultJobMaxAge)
+	jobA, _ := first.Get(first.Add(template))
+	jobB, _ := second.Get(second.Add(template))
+	if jobA.Id == jobB.Id {
+		t.Fatalf("expected connections to issue their own job ids")
+	}
+
+	if dupe, err := filter.Seen(ctx, jobA, 7); err != nil || dupe {
+		t.Fatalf("expected the first submit to be new, got %t %v", dupe, err)
+	}
+	if dupe, err := filter.Seen(ctx, jobB, 7); err != nil || !dupe {
+		t.Fatalf("expected the share replayed on another connection to be a dupe, got %t %v", dupe, err)
+	}
+	other, _ := second.Get(second.Add(dupeTemplate("solo")))
+	if dupe, _ := filter.Seen(ctx, other, 7); dupe {
+		t.Fatalf("expected the nonce to be new for other work")
+	}
+}
+
+func TestRedisDupeFilter(t *testing.T) {
+	filter, err := newDupeFilter(DupeFilterConfig{Mode: DupeFilterRedis, TTL: time.Minute}, rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDupeFilter(t, filter)
+
+	// sets must expire on their own rather than grow forever
+	js := newJobStore(maxjobs, defaultJobMaxAge)
+	job, _ := js.Get(js.Add(testJob(uint64(time.Now().UnixNano()))))
+	if _, err := filter.Seen(context.Background(), job, 1); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := rd.TTL(context.Background(), redisDupeKey(job)).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("expected dupe set ttl to be set, got %s", ttl)
+	}
+}
+
+func TestMemoryDupeFilterExpiry(t *testing.T) {
+	filter := newMemoryDupeFilter(time.Minute)
+	js := newJobStore(maxjobs, defaultJobMaxAge)
+	stale, _ := js.Get(js.Add(dupeTemplate("stale")))
+	live, _ := js.Get(js.Add(dupeTemplate("live")))
+	filter.Seen(context.Background(), stale, 1)
+	filter.Seen(context.Background(), live, 1)
+
+	filter.sets[dupeKey(stale)].lastSeen = time.Now().Add(-2 * time.Minute)
+	filter.lastSweep = time.Now().Add(-2 * time.Minute)
+	filter.Seen(context.Background(), live, 2) // sweeps
+	if _, exists := filter.sets[dupeKey(stale)]; exists {
+		t.Fatalf("expected the idle set to be dropped")
+	}
+	if dupe, _ := filter.Seen(context.Background(), live, 1); !dupe {
+		t.Fatalf("expected the live set to be kept")
+	}
+}
+
+func benchmarkDupeFilter(b *testing.B, filter dupeFilter) {
+	ctx := context.Background()
+	js := newJobStore(maxjobs, defaultJobMaxAge)
+	job, _ := js.Get(js.Add(testJob(uint64(time.Now().UnixNano()))))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := filter.Seen(ctx, job, uint64(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDupeFilterMemory(b *testing.B) {
+	benchmarkDupeFilter(b, newMemoryDupeFilter(time.Minute))
+}
+
+func BenchmarkDupeFilterRedis(b *testing.B) {
+	benchmarkDupeFilter(b, &redisDupeFilter{client: rd, ttl: time.Minute})
+}
+
+// the previous approach, a single global zset that was never trimmed
+func BenchmarkDupeFilterLegacyZSet(b *testing.B) {
+	ctx := context.Background()
+	set := NewZSet(rd, "share_buffer_bench")
+	defer rd.Del(ctx, "share_buffer_bench")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := set.AddValues(ctx, ZSetKVP{
+			Score:  float64(time.Now().Unix()),
+			Member: fmt.Sprintf("%d_%d", 1, i),
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -156,6 +156,28 @@ func BigDiffToLittle(diff *big.Int) float64 {
 	return d
 }
 
+// share difficulty 1 corresponds to a target of 2^224, see fixedDifficulty
+var diffOneTarget = new(big.Float).SetMantExp(big.NewFloat(1), 224)
+var maxTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// DifficultyToTarget converts a stratum share difficulty into a 256 bit
+// target, little endian as used by stratum v2
+func DifficultyToTarget(diff float64) [32]byte {
+	target := maxTarget
+	if diff > 0 {
+		target, _ = new(big.Float).Quo(diffOneTarget, big.NewFloat(diff)).Int(nil)
+		if target.Cmp(maxTarget) > 0 {
+			target = maxTarget
+		}
+	}
+	out := [32]byte{}
+	be := target.Bytes()
+	for i, b := range be {
+		out[len(be)-1-i] = b
+	}
+	return out
+}
+
 func write16(hasher hash.Hash, val uint16) {
 	intBuff := make([]byte, 2)
 	binary.LittleEndian.PutUint16(intBuff, val)
@@ -0,0 +1,196 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx"
+	"go.uber.org/zap"
+)
+
+type HealthConfig struct {
+	// TemplateMaxAge is how long kaspad may go without a new block template
+	// before the bridge reports unready, 30s if 0
+	TemplateMaxAge time.Duration `yaml:"template_max_age"`
+	// StallTimeout is how long the loop polling kaspad may not run before
+	// the bridge reports itself dead, 60s if 0
+	StallTimeout time.Duration `yaml:"stall_timeout"`
+	// CheckTimeout bounds every check, 2s if 0
+	CheckTimeout time.Duration `yaml:"check_timeout"`
+}
+
+const (
+	defaultTemplateMaxAge = 30 * time.Second
+	defaultStallTimeout   = 60 * time.Second
+	defaultCheckTimeout   = 2 * time.Second
+)
+
+func (hc HealthConfig) withDefaults() HealthConfig {
+	if hc.TemplateMaxAge == 0 {
+		hc.TemplateMaxAge = defaultTemplateMaxAge
+	}
+	if hc.StallTimeout == 0 {
+		hc.StallTimeout = defaultStallTimeout
+	}
+	if hc.CheckTimeout == 0 {
+		hc.CheckTimeout = defaultCheckTimeout
+	}
+	return hc
+}
+
+func (hc HealthConfig) validate() error {
+	if hc.TemplateMaxAge < 0 || hc.StallTimeout < 0 || hc.CheckTimeout < 0 {
+		return fmt.Errorf("timeouts must be positive")
+	}
+	return nil
+}
+
+const (
+	healthOk      = "ok"
+	healthFailing = "failing"
+)
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthChecks runs a set of checks concurrently, each bounded by the
+// timeout, and fails if any of them does
+type healthChecks struct {
+	timeout time.Duration
+	checks  []healthCheck
+}
+
+func (hc *healthChecks) Add(name string, check func(ctx context.Context) error) {
+	hc.checks = append(hc.checks, healthCheck{name: name, check: check})
+}
+
+func (hc *healthChecks) Run(ctx context.Context) healthReport {
+	report := healthReport{Status: healthOk, Checks: map[string]checkResult{}}
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, c := range hc.checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, hc.timeout)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- c.check(checkCtx) }()
+			var err error
+			select {
+			case err = <-done:
+			case <-checkCtx.Done():
+				err = fmt.Errorf("timed out after %s", hc.timeout)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				report.Status = healthFailing
+				report.Checks[c.name] = checkResult{Status: healthFailing, Error: err.Error()}
+				return
+			}
+			report.Checks[c.name] = checkResult{Status: healthOk}
+		}(c)
+	}
+	wg.Wait()
+	return report
+}
+
+// Handler replies with the report of every check, 503 if any of them fail
+func (hc *healthChecks) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := hc.Run(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != healthOk {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// healthEndpoints builds the checks behind /livez and /readyz. Liveness only
+// fails if the bridge is stuck and needs restarting, readiness whenever it
+// can't serve miners, e.g. while kaspad is syncing
+func healthEndpoints(cfg HealthConfig, kapi *KaspaApi, pg *pgx.ConnPool, rd *redis.Client,
+	listeners []ListenerConfig, servers []stratumServer) (live *healthChecks, ready *healthChecks) {
+	cfg = cfg.withDefaults()
+	live = &healthChecks{timeout: cfg.CheckTimeout}
+	live.Add("kaspad_loop", func(context.Context) error {
+		return kapi.alive(time.Now(), cfg.StallTimeout)
+	})
+
+	ready = &healthChecks{timeout: cfg.CheckTimeout}
+	ready.Add("kaspad", func(context.Context) error {
+		return kapi.ready(time.Now(), cfg.TemplateMaxAge)
+	})
+	ready.Add("postgres", func(ctx context.Context) error {
+		return pingPool(ctx, pg)
+	})
+	if rd != nil {
+		ready.Add("redis", func(ctx context.Context) error {
+			return rd.Ping(ctx).Err()
+		})
+	}
+	ready.Add("stratum", func(context.Context) error {
+		return serversAccepting(listeners, servers)
+	})
+	return live, ready
+}
+
+// pingPool pings a connection of its own so the probe never touches one a
+// share insert is using
+func pingPool(ctx context.Context, pg *pgx.ConnPool) error {
+	conn, err := pg.AcquireEx(ctx)
+	if err != nil {
+		return err
+	}
+	defer pg.Release(conn)
+	return conn.Ping(ctx)
+}
+
+// serveHealth hosts /livez and /readyz on a mux of their own, nothing else
+// registered on the default one is exposed on the health port
+func serveHealth(ctx context.Context, log *zap.SugaredLogger, port string, live, ready *healthChecks) error {
+	mux := http.NewServeMux()
+	mux.Handle("/livez", live.Handler())
+	mux.Handle("/readyz", ready.Handler())
+	server := &http.Server{Addr: port, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Info("enabling health checks on port " + port)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// serversAccepting fails unless every stratum listener takes connections
+func serversAccepting(listeners []ListenerConfig, servers []stratumServer) error {
+	for i, server := range servers {
+		if !server.Accepting() {
+			return fmt.Errorf("listener %s is not accepting connections", listeners[i].Port)
+		}
+	}
+	return nil
+}
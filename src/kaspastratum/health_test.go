@@ -0,0 +1,106 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHealthChecks(t *testing.T) {
+	checks := &healthChecks{timeout: 50 * time.Millisecond}
+	checks.Add("ok", func(context.Context) error { return nil })
+	healthy := httptest.NewRecorder()
+	checks.Handler().ServeHTTP(healthy, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if healthy.Code != http.StatusOK {
+		t.Errorf("expected passing checks to be ok, got %d", healthy.Code)
+	}
+
+	checks.Add("broken", func(context.Context) error { return fmt.Errorf("connection refused") })
+	checks.Add("hanging", func(ctx context.Context) error {
+		time.Sleep(time.Second) // ignores the context, still reported on time
+		return nil
+	})
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	checks.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected a hanging check to be cut off, took %s", elapsed)
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a failing check to fail the endpoint, got %d", rec.Code)
+	}
+	report := healthReport{}
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	expected := healthReport{
+		Status: healthFailing,
+		Checks: map[string]checkResult{
+			"ok":      {Status: healthOk},
+			"broken":  {Status: healthFailing, Error: "connection refused"},
+			"hanging": {Status: healthFailing, Error: "timed out after 50ms"},
+		},
+	}
+	if d := cmp.Diff(expected, report); d != "" {
+		t.Errorf("unexpected report: %s", d)
+	}
+}
+
+func TestKaspadHealth(t *testing.T) {
+	now := time.Now()
+	ks := &KaspaApi{}
+	if err := ks.ready(now, time.Minute); err == nil {
+		t.Error("expected to be unready before the sync state is known")
+	}
+	ks.syncState = syncSyncing
+	if err := ks.ready(now, time.Minute); err == nil || err.Error() != "kaspad is syncing" {
+		t.Errorf("expected to be unready while syncing, got %v", err)
+	}
+	ks.syncState = syncSynced
+	if err := ks.ready(now, time.Minute); err == nil {
+		t.Error("expected to be unready until a template is seen")
+	}
+	ks.templateSeen(now.Add(-2 * time.Minute))
+	if err := ks.ready(now, time.Minute); err == nil {
+		t.Error("expected a stale template to be unready")
+	}
+	ks.templateSeen(now)
+	if err := ks.ready(now, time.Minute); err != nil {
+		t.Errorf("expected to be ready, got %s", err)
+	}
+	ks.syncState = syncUnreachable
+	if err := ks.ready(now, time.Minute); err == nil {
+		t.Error("expected an unreachable kaspad to be unready")
+	}
+
+	ks.beat(now.Add(-2 * time.Minute))
+	if err := ks.alive(now, time.Minute); err == nil {
+		t.Error("expected a stalled loop to be reported")
+	}
+	ks.beat(now)
+	if err := ks.alive(now, time.Minute); err != nil {
+		t.Errorf("expected to be alive, got %s", err)
+	}
+}
+
+type fakeServer bool
+
+func (fs fakeServer) Listen(ctx context.Context) error { return nil }
+func (fs fakeServer) Accepting() bool                  { return bool(fs) }
+
+func TestServersAccepting(t *testing.T) {
+	listeners := []ListenerConfig{{Port: ":5555"}, {Port: ":5556"}}
+	if err := serversAccepting(listeners, []stratumServer{fakeServer(true), fakeServer(true)}); err != nil {
+		t.Errorf("expected accepting listeners to pass, got %s", err)
+	}
+	err := serversAccepting(listeners, []stratumServer{fakeServer(true), fakeServer(false)})
+	if err == nil || err.Error() != "listener :5556 is not accepting connections" {
+		t.Errorf("expected the stopped listener to be reported, got %v", err)
+	}
+}
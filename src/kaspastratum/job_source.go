@@ -0,0 +1,71 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+)
+
+// preparedJob is a block template that has been registered with a miner's job
+// store and is ready to be encoded for whatever protocol the miner speaks
+type preparedJob struct {
+	Id     string
+	Block  *appmessage.RPCBlock
+	Header []byte // serialized pre-pow header
+	Clean  bool
+}
+
+// templateSource fetches block templates, KaspaApi outside of tests
+type templateSource interface {
+	GetBlockTemplate(client *MinerContext, payAddress string) (*appmessage.GetBlockTemplateResponseMessage, error)
+}
+
+// jobSource builds jobs for miners on a single listener
+type jobSource struct {
+	config     ListenerConfig
+	poolWallet string
+	// minimum time between jobs that don't change the parents, see
+	// templateTracker.shouldSendJob
+	minJobInterval *live[time.Duration]
+	metrics        *Metrics
+}
+
+// payoutAddress is the address the block template coinbase pays to. Solo
+// miners are paid directly, pooled miners mine to the pool wallet
+func (js *jobSource) payoutAddress(client *MinerContext) string {
+	if js.config.Mode == MiningModePool {
+		return js.poolWallet
+	}
+	return client.WalletAddr
+}
+
+// nextJob fetches a template for the client and registers it as a new job.
+// Returns nil if the template hasn't changed enough to be worth sending
+func (js *jobSource) nextJob(templates templateSource, client *MinerContext) (*preparedJob, error) {
+	state := client.State
+	template, err := templates.GetBlockTemplate(client, js.payoutAddress(client))
+	if err != nil {
+		js.metrics.RecordWorkerError(client.WalletAddr, ErrFailedBlockFetch)
+		return nil, errors.Wrap(err, "failed fetching new block template from kaspa")
+	}
+	header, err := SerializeBlockHeader(template.Block)
+	if err != nil {
+		js.metrics.RecordWorkerError(client.WalletAddr, ErrBadDataFromMiner)
+		return nil, fmt.Errorf("failed to serialize block header: %s", err)
+	}
+	send, clean := state.templates.shouldSendJob(
+		fingerprintTemplate(template.Block, header), time.Now(), js.minJobInterval.Load())
+	if !send {
+		return nil, nil // nothing new for this miner
+	}
+	state.setTarget(uint64(template.Block.Header.Bits))
+
+	return &preparedJob{
+		Id:     state.AddJob(template.Block),
+		Block:  template.Block,
+		Header: header,
+		Clean:  clean,
+	}, nil
+}
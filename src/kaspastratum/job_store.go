@@ -0,0 +1,177 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+type JobStatus int
+
+const (
+	JobFound JobStatus = iota
+	// JobExpired means the job was issued to this connection but has since
+	// been evicted, i.e. a stale share
+	JobExpired
+	// JobUnknown means the job id was never issued to this connection
+	JobUnknown
+)
+
+func (js JobStatus) String() string {
+	switch js {
+	case JobFound:
+		return "found"
+	case JobExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// every job store gets its own epoch so ids are unique across connections.
+// Seeded from the clock so ids don't repeat across restarts either
+var jobEpochCounter = uint32(time.Now().Unix())
+
+func nextJobEpoch() uint32 {
+	for {
+		if epoch := atomic.AddUint32(&jobEpochCounter, 1); epoch != 0 {
+			return epoch
+		}
+	}
+}
+
+// job ids are the store epoch followed by a per-store sequence, both as fixed
+// width hex. The sequence is monotonic so a late submit can never alias a
+// newer job, and comparing it against the oldest retained job tells expired
+// jobs apart from ones that never existed
+func formatJobId(epoch, seq uint32) string {
+	return fmt.Sprintf("%08x%08x", epoch, seq)
+}
+
+func parseJobId(id string) (epoch, seq uint32, ok bool) {
+	if len(id) != 16 {
+		return 0, 0, false
+	}
+	e, err := strconv.ParseUint(id[:8], 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	s, err := strconv.ParseUint(id[8:], 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uint32(e), uint32(s), true
+}
+
+type jobEntry struct {
+	Id    string
+	Block *appmessage.RPCBlock
+	// Fetched is when the job was registered, right after its template was
+	// fetched from kaspad
+	Fetched time.Time
+}
+
+// jobStore holds the most recent jobs sent to a single connection. Jobs are
+// evicted once they're older than maxAge, and the oldest go early if more
+// than capacity are issued within it
+type jobStore struct {
+	lock      sync.Mutex
+	capacity  int
+	maxAge    time.Duration
+	epoch     uint32
+	prevEpoch uint32
+	seq       uint32 // last issued sequence
+	oldest    uint32 // oldest retained sequence
+	jobs      map[uint32]*jobEntry
+}
+
+// newJobStore creates a store holding at most capacity jobs, none older than
+// maxAge, defaultJobMaxAge if 0
+func newJobStore(capacity int, maxAge time.Duration) *jobStore {
+	if maxAge <= 0 {
+		maxAge = defaultJobMaxAge
+	}
+	return &jobStore{
+		capacity: capacity,
+		maxAge:   maxAge,
+		epoch:    nextJobEpoch(),
+		oldest:   1,
+		jobs:     make(map[uint32]*jobEntry, capacity),
+	}
+}
+
+func (js *jobStore) Add(job *appmessage.RPCBlock) string {
+	return js.add(job, time.Now())
+}
+
+func (js *jobStore) add(job *appmessage.RPCBlock, now time.Time) string {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+
+	if js.seq == math.MaxUint32 {
+		// sequence exhausted, start over under a new epoch. Anything issued
+		// under the old epoch is reported as expired from here on
+		js.prevEpoch = js.epoch
+		js.epoch = nextJobEpoch()
+		js.seq = 0
+		js.oldest = 1
+		js.jobs = make(map[uint32]*jobEntry, js.capacity)
+	}
+
+	js.seq++
+	id := formatJobId(js.epoch, js.seq)
+	js.jobs[js.seq] = &jobEntry{
+		Id:      id,
+		Block:   job,
+		Fetched: now,
+	}
+	js.evict(now)
+	return id
+}
+
+// evict drops the jobs past maxAge, then the oldest until the store is back
+// within capacity. Jobs are issued in order, so both go from the oldest up
+func (js *jobStore) evict(now time.Time) {
+	for js.oldest < js.seq && now.Sub(js.jobs[js.oldest].Fetched) > js.maxAge {
+		delete(js.jobs, js.oldest)
+		js.oldest++
+	}
+	for len(js.jobs) > js.capacity {
+		delete(js.jobs, js.oldest)
+		js.oldest++
+	}
+}
+
+func (js *jobStore) Get(id string) (*jobEntry, JobStatus) {
+	return js.get(id, time.Now())
+}
+
+func (js *jobStore) get(id string, now time.Time) (*jobEntry, JobStatus) {
+	epoch, seq, ok := parseJobId(id)
+	if !ok {
+		return nil, JobUnknown
+	}
+
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	if epoch != js.epoch {
+		if js.prevEpoch != 0 && epoch == js.prevEpoch {
+			return nil, JobExpired
+		}
+		return nil, JobUnknown
+	}
+	if seq == 0 || seq > js.seq {
+		return nil, JobUnknown
+	}
+	// a miner that isn't sent new jobs keeps its old ones until the next Add,
+	// so age is checked here as well
+	if seq < js.oldest || now.Sub(js.jobs[seq].Fetched) > js.maxAge {
+		return nil, JobExpired
+	}
+	return js.jobs[seq], JobFound
+}
@@ -0,0 +1,117 @@
+package kaspastratum
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+func testJob(blueScore uint64) *appmessage.RPCBlock {
+	return &appmessage.RPCBlock{Header: &appmessage.RPCBlockHeader{BlueScore: blueScore}}
+}
+
+func TestJobStoreEviction(t *testing.T) {
+	js := newJobStore(maxjobs, defaultJobMaxAge)
+	ids := []string{}
+	for i := 0; i < maxjobs*3; i++ {
+		ids = append(ids, js.Add(testJob(uint64(i))))
+	}
+
+	// ids must never repeat, the old store handed out id % 32
+	seen := map[string]struct{}{}
+	for _, id := range ids {
+		if _, exists := seen[id]; exists {
+			t.Fatalf("job id %s issued twice", id)
+		}
+		seen[id] = struct{}{}
+	}
+
+	// oldest jobs were evicted, a late submit must not map onto a newer job
+	for i, id := range ids[:len(ids)-maxjobs] {
+		if job, status := js.Get(id); status != JobExpired || job != nil {
+			t.Fatalf("job %d (%s): expected expired, got %s", i, id, status)
+		}
+	}
+	for i, id := range ids[len(ids)-maxjobs:] {
+		job, status := js.Get(id)
+		if status != JobFound {
+			t.Fatalf("job %s: expected found, got %s", id, status)
+		}
+		if expected := uint64(len(ids) - maxjobs + i); job.Block.Header.BlueScore != expected {
+			t.Fatalf("job %s: got the wrong job back, bluescore %d vs %d", id, job.Block.Header.BlueScore, expected)
+		}
+	}
+}
+
+func TestJobStoreMaxAge(t *testing.T) {
+	js := newJobStore(4, time.Minute)
+	start := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	first := js.add(testJob(1), start)
+	second := js.add(testJob(2), start.Add(30*time.Second))
+	js.add(testJob(3), start.Add(50*time.Second))
+
+	// past the age bound with no new job to evict it yet
+	now := start.Add(70 * time.Second)
+	if _, status := js.get(first, now); status != JobExpired {
+		t.Fatalf("expected the job past max age to be expired, got %s", status)
+	}
+	if _, status := js.get(second, now); status != JobFound {
+		t.Fatalf("expected the younger job to be found, got %s", status)
+	}
+	js.add(testJob(4), now)
+	if len(js.jobs) != 3 {
+		t.Fatalf("expected the job past max age to be evicted, %d jobs left", len(js.jobs))
+	}
+
+	// the capacity still caps jobs issued faster than they age out
+	js.add(testJob(5), now.Add(time.Second))
+	js.add(testJob(6), now.Add(2*time.Second))
+	if _, status := js.get(second, now.Add(2*time.Second)); status != JobExpired || len(js.jobs) != 4 {
+		t.Fatalf("expected the capacity to evict the oldest job, got %s with %d jobs", status, len(js.jobs))
+	}
+}
+
+func TestJobStoreUnknownJobs(t *testing.T) {
+	js := newJobStore(maxjobs, defaultJobMaxAge)
+	other := newJobStore(maxjobs, defaultJobMaxAge)
+	id := js.Add(testJob(1))
+
+	for _, bad := range []string{
+		"", "1", "not-a-job-id-123", // garbage
+		other.Add(testJob(1)),    // issued to another connection
+		formatJobId(js.epoch, 2), // not issued yet
+		formatJobId(js.epoch, 0), // never issued
+	} {
+		if _, status := js.Get(bad); status != JobUnknown {
+			t.Errorf("job '%s': expected unknown, got %s", bad, status)
+		}
+	}
+	if _, status := js.Get(id); status != JobFound {
+		t.Errorf("job '%s': expected found, got %s", id, status)
+	}
+}
+
+func TestJobStoreSequenceWraparound(t *testing.T) {
+	js := newJobStore(maxjobs, defaultJobMaxAge)
+	js.seq = math.MaxUint32 - 1
+	js.oldest = js.seq + 1
+
+	last := js.Add(testJob(1))
+	if _, status := js.Get(last); status != JobFound {
+		t.Fatalf("expected last job before wrap to be found, got %s", status)
+	}
+
+	first := js.Add(testJob(2))
+	if first == last {
+		t.Fatalf("job id reused across wraparound: %s", first)
+	}
+	job, status := js.Get(first)
+	if status != JobFound || job.Block.Header.BlueScore != 2 {
+		t.Fatalf("expected first job after wrap to be found, got %s", status)
+	}
+	if _, status := js.Get(last); status != JobExpired {
+		t.Fatalf("expected job from previous epoch to be expired, got %s", status)
+	}
+}
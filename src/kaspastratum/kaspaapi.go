@@ -3,36 +3,94 @@ package kaspastratum
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
-	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// what the bridge last saw of kaspad's sync state
+const (
+	syncUnknown int32 = iota
+	syncSyncing
+	syncUnreachable
+	syncSynced
+)
+
 type KaspaApi struct {
+	// accessed atomically for the health checks. heartbeat and lastTemplate
+	// are unix nanos
+	syncState    int32
+	heartbeat    int64
+	lastTemplate int64
+
 	address   string
 	logger    *zap.SugaredLogger
 	kaspad    *rpcclient.RPCClient
 	connected bool
+	tip       *tipTracker
+	metrics   *Metrics
+	notifier  *Notifier // optional
 }
 
-func NewKaspaAPI(address string, logger *zap.SugaredLogger) (*KaspaApi, error) {
+func NewKaspaAPI(address string, logger *zap.SugaredLogger, metrics *Metrics) (*KaspaApi, error) {
 	client, err := rpcclient.NewRPCClient(address)
 	if err != nil {
 		return nil, err
 	}
 
 	return &KaspaApi{
+		heartbeat: time.Now().UnixNano(),
 		address:   address,
 		logger:    logger.With(zap.String("component", "kaspaapi:"+address)),
 		kaspad:    client,
 		connected: true,
+		tip:       newTipTracker(),
+		metrics:   metrics,
 	}, nil
 }
 
+// ready fails unless kaspad is synced and announced a new block template
+// within maxAge
+func (ks *KaspaApi) ready(now time.Time, maxAge time.Duration) error {
+	switch atomic.LoadInt32(&ks.syncState) {
+	case syncUnknown:
+		return fmt.Errorf("kaspad sync state not checked yet")
+	case syncSyncing:
+		return fmt.Errorf("kaspad is syncing")
+	case syncUnreachable:
+		return fmt.Errorf("kaspad is unreachable")
+	}
+	last := atomic.LoadInt64(&ks.lastTemplate)
+	if last == 0 {
+		return fmt.Errorf("no block template from kaspad yet")
+	}
+	if age := now.Sub(time.Unix(0, last)); age > maxAge {
+		return fmt.Errorf("last block template from kaspad is %s old", age.Round(time.Second))
+	}
+	return nil
+}
+
+// alive fails if the loop polling kaspad hasn't run within timeout, i.e.
+// it's stuck. Waiting for kaspad to sync still counts as running
+func (ks *KaspaApi) alive(now time.Time, timeout time.Duration) error {
+	if age := now.Sub(time.Unix(0, atomic.LoadInt64(&ks.heartbeat))); age > timeout {
+		return fmt.Errorf("kaspad polling loop stalled for %s", age.Round(time.Second))
+	}
+	return nil
+}
+
+func (ks *KaspaApi) beat(now time.Time) {
+	atomic.StoreInt64(&ks.heartbeat, now.UnixNano())
+}
+
+func (ks *KaspaApi) templateSeen(now time.Time) {
+	atomic.StoreInt64(&ks.lastTemplate, now.UnixNano())
+}
+
 func (ks *KaspaApi) Start(ctx context.Context, blockCb func()) {
 	ks.waitForSync(true)
 	go ks.startBlockTemplateListener(ctx, blockCb)
@@ -57,7 +115,7 @@ func (ks *KaspaApi) startStatsThread(ctx context.Context) {
 				ks.logger.Warn("failed to get network hashrate from kaspa, prom stats will be out of date", zap.Error(err))
 				continue
 			}
-			RecordNetworkStats(response.NetworkHashesPerSecond, dagResponse.BlockCount, dagResponse.Difficulty)
+			ks.metrics.RecordNetworkStats(response.NetworkHashesPerSecond, dagResponse.BlockCount, dagResponse.Difficulty)
 		}
 	}
 }
@@ -80,13 +138,20 @@ func (s *KaspaApi) waitForSync(verbose bool) error {
 		s.logger.Info("checking kaspad sync state")
 	}
 	for {
+		s.beat(time.Now())
 		clientInfo, err := s.kaspad.GetInfo()
 		if err != nil {
+			// only announce the outage once, not on every retry
+			if atomic.SwapInt32(&s.syncState, syncUnreachable) != syncUnreachable {
+				s.notifier.Notify(Event{Kind: EventKaspadDown, Error: err.Error()})
+			}
 			return errors.Wrapf(err, "error fetching server info from kaspad @ %s", s.address)
 		}
 		if clientInfo.IsSynced {
+			atomic.StoreInt32(&s.syncState, syncSynced)
 			break
 		}
+		atomic.StoreInt32(&s.syncState, syncSyncing)
 		s.logger.Warn("Kaspa is not synced, waiting for sync before starting bridge")
 		time.Sleep(5 * time.Second)
 	}
@@ -99,6 +164,7 @@ func (s *KaspaApi) waitForSync(verbose bool) error {
 func (s *KaspaApi) startBlockTemplateListener(ctx context.Context, blockReadyCb func()) {
 	blockReadyChan := make(chan bool)
 	err := s.kaspad.RegisterForNewBlockTemplateNotifications(func(_ *appmessage.NewBlockTemplateNotificationMessage) {
+		s.templateSeen(time.Now())
 		blockReadyChan <- true
 	})
 	if err != nil {
@@ -129,11 +195,14 @@ func (s *KaspaApi) startBlockTemplateListener(ctx context.Context, blockReadyCb
 }
 
 func (ks *KaspaApi) GetBlockTemplate(
-	client *gostratum.StratumContext) (*appmessage.GetBlockTemplateResponseMessage, error) {
-	template, err := ks.kaspad.GetBlockTemplate(client.WalletAddr,
+	client *MinerContext, payAddress string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	template, err := ks.kaspad.GetBlockTemplate(payAddress,
 		fmt.Sprintf(`'%s' via onemorebsmith/kaspa-stratum-bridge_%s`, client.RemoteApp, version))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed fetching new block template from kaspa")
 	}
+	now := time.Now()
+	ks.tip.Update(template.Block.Header.BlueScore, template.Block.Header.DAAScore, now)
+	ks.templateSeen(now)
 	return template, nil
 }
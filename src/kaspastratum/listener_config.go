@@ -0,0 +1,156 @@
+package kaspastratum
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/onemorebsmith/kaspa-pool/src/stratumv2"
+)
+
+type MiningMode string
+
+const (
+	// MiningModeSolo builds templates paying the miner's own wallet
+	MiningModeSolo MiningMode = "solo"
+	// MiningModePool builds templates paying the pool wallet, miners are
+	// credited through the share store
+	MiningModePool MiningMode = "pool"
+)
+
+type StratumProtocol string
+
+const (
+	// StratumV1 is json-rpc over tcp, what practically every kaspa miner speaks
+	StratumV1 StratumProtocol = "v1"
+	// StratumV2 is the binary, noise encrypted mining protocol. The job and
+	// share messages use a private kaspa layout, so spec sv2 miners can't
+	// connect, see the stratumv2 package
+	StratumV2 StratumProtocol = "v2"
+)
+
+type ListenerConfig struct {
+	Port       string          `yaml:"port"`
+	Protocol   StratumProtocol `yaml:"protocol"`
+	Mode       MiningMode      `yaml:"mode"`
+	Difficulty float64         `yaml:"difficulty"`
+	Fee        float64         `yaml:"fee"` // percentage, stored with every share for payouts
+	// JobWindow overrides the bridge's job_window for this listener
+	JobWindow int `yaml:"job_window"`
+	// JobMaxAge overrides the bridge's job_max_age for this listener
+	JobMaxAge time.Duration `yaml:"job_max_age"`
+}
+
+// listenerConfigs resolves the set of stratum listeners to start. The legacy
+// `stratum_port` setting is treated as a single solo listener so existing
+// configs keep their behavior
+func (cfg BridgeConfig) listenerConfigs() ([]ListenerConfig, error) {
+	listeners := append([]ListenerConfig{}, cfg.Listeners...)
+	if len(listeners) == 0 && cfg.StratumPort != "" {
+		listeners = append(listeners, ListenerConfig{
+			Port:     cfg.StratumPort,
+			Protocol: StratumV1,
+			Mode:     MiningModeSolo,
+		})
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no stratum listeners configured")
+	}
+
+	ports := map[string]struct{}{}
+	for i := range listeners {
+		l := &listeners[i]
+		if l.Port == "" {
+			return nil, fmt.Errorf("listener %d: port is required", i)
+		}
+		if _, exists := ports[l.Port]; exists {
+			return nil, fmt.Errorf("listener %d: port %s is used by another listener", i, l.Port)
+		}
+		ports[l.Port] = struct{}{}
+
+		switch l.Protocol {
+		case "":
+			l.Protocol = StratumV1
+		case StratumV1:
+		case StratumV2:
+			if cfg.StratumV2Key == "" {
+				return nil, fmt.Errorf("listener %s: stratum v2 requires `stratum_v2_key` to be set", l.Port)
+			}
+		default:
+			return nil, fmt.Errorf("listener %s: unknown protocol '%s'", l.Port, l.Protocol)
+		}
+
+		switch l.Mode {
+		case "":
+			l.Mode = MiningModeSolo
+		case MiningModeSolo:
+		case MiningModePool:
+			if cfg.PoolWallet == "" {
+				return nil, fmt.Errorf("listener %s: pool mode requires `pool_wallet` to be set", l.Port)
+			}
+		default:
+			return nil, fmt.Errorf("listener %s: unknown mode '%s'", l.Port, l.Mode)
+		}
+
+		if l.Difficulty < 0 {
+			return nil, fmt.Errorf("listener %s: difficulty must be positive", l.Port)
+		}
+		if l.Difficulty == 0 {
+			l.Difficulty = cfg.Difficulty
+		}
+		if l.Difficulty == 0 {
+			l.Difficulty = fixedDifficulty
+		}
+		if l.JobWindow < 0 || l.JobWindow > maxJobWindow {
+			return nil, fmt.Errorf("listener %s: job_window must be between 0 (default) and %d", l.Port, maxJobWindow)
+		}
+		if l.JobWindow == 0 {
+			l.JobWindow = cfg.JobWindow
+		}
+		if l.JobWindow == 0 {
+			l.JobWindow = maxjobs
+		}
+		if l.JobMaxAge < 0 {
+			return nil, fmt.Errorf("listener %s: job_max_age must be positive", l.Port)
+		}
+		if l.JobMaxAge == 0 {
+			l.JobMaxAge = cfg.JobMaxAge
+		}
+		if l.JobMaxAge == 0 {
+			l.JobMaxAge = defaultJobMaxAge
+		}
+		if l.Fee < 0 || l.Fee > 100 {
+			return nil, fmt.Errorf("listener %s: fee must be between 0 and 100", l.Port)
+		}
+	}
+	return listeners, nil
+}
+
+// stratumV2Keys loads the pool's static and authority keys from the hex
+// encoded private keys in the config
+func (cfg BridgeConfig) stratumV2Keys() (stratumv2.ServerKeys, error) {
+	keys := stratumv2.ServerKeys{CertValidity: cfg.StratumV2CertValidity}
+	if cfg.StratumV2CertValidity < 0 {
+		return keys, fmt.Errorf("`stratum_v2_cert_validity` must be positive")
+	}
+	load := func(name, encoded string) (stratumv2.KeyPair, error) {
+		private, err := hex.DecodeString(encoded)
+		if err != nil {
+			return stratumv2.KeyPair{}, fmt.Errorf("malformed `%s`: %s", name, err)
+		}
+		kp, err := stratumv2.NewKeyPair(private)
+		if err != nil {
+			return kp, fmt.Errorf("malformed `%s`: %s", name, err)
+		}
+		return kp, nil
+	}
+	var err error
+	if keys.Static, err = load("stratum_v2_key", cfg.StratumV2Key); err != nil {
+		return keys, err
+	}
+	keys.Authority = keys.Static
+	if cfg.StratumV2AuthorityKey != "" {
+		keys.Authority, err = load("stratum_v2_authority_key", cfg.StratumV2AuthorityKey)
+	}
+	return keys, err
+}
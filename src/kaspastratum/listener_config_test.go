@@ -0,0 +1,67 @@
+package kaspastratum
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestListenerConfigs(t *testing.T) {
+	{ // legacy config maps onto a single solo listener
+		listeners, err := BridgeConfig{StratumPort: ":5555"}.listenerConfigs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []ListenerConfig{{Port: ":5555", Protocol: StratumV1, Mode: MiningModeSolo,
+			Difficulty: fixedDifficulty, JobWindow: maxjobs, JobMaxAge: defaultJobMaxAge}}
+		if d := cmp.Diff(expected, listeners); d != "" {
+			t.Fatalf("legacy listener config incorrect: %s", d)
+		}
+	}
+
+	{ // solo and pool side by side, bridge wide defaults
+		listeners, err := BridgeConfig{
+			PoolWallet:   "kaspa:pool",
+			StratumV2Key: "00",
+			Difficulty:   8,
+			JobWindow:    64,
+			JobMaxAge:    time.Minute,
+			Listeners: []ListenerConfig{
+				{Port: ":5555", Mode: MiningModePool, Fee: 1},
+				{Port: ":5556", Mode: MiningModeSolo, Difficulty: 16, Fee: 0.5, JobWindow: 16, JobMaxAge: 30 * time.Second},
+				{Port: ":5557", Protocol: StratumV2, Mode: MiningModePool},
+			},
+		}.listenerConfigs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []ListenerConfig{
+			{Port: ":5555", Protocol: StratumV1, Mode: MiningModePool, Difficulty: 8, Fee: 1, JobWindow: 64,
+				JobMaxAge: time.Minute},
+			{Port: ":5556", Protocol: StratumV1, Mode: MiningModeSolo, Difficulty: 16, Fee: 0.5, JobWindow: 16,
+				JobMaxAge: 30 * time.Second},
+			{Port: ":5557", Protocol: StratumV2, Mode: MiningModePool, Difficulty: 8, JobWindow: 64,
+				JobMaxAge: time.Minute},
+		}
+		if d := cmp.Diff(expected, listeners); d != "" {
+			t.Fatalf("listener config incorrect: %s", d)
+		}
+	}
+
+	for name, cfg := range map[string]BridgeConfig{
+		"no listeners":     {},
+		"pool w/o wallet":  {Listeners: []ListenerConfig{{Port: ":5555", Mode: MiningModePool}}},
+		"unknown mode":     {Listeners: []ListenerConfig{{Port: ":5555", Mode: "pplns"}}},
+		"duplicate port":   {Listeners: []ListenerConfig{{Port: ":5555"}, {Port: ":5555"}}},
+		"fee out of range": {Listeners: []ListenerConfig{{Port: ":5555", Fee: 101}}},
+		"unknown protocol": {Listeners: []ListenerConfig{{Port: ":5555", Protocol: "v3"}}},
+		"v2 w/o key":       {Listeners: []ListenerConfig{{Port: ":5555", Protocol: StratumV2}}},
+		"huge job window":  {Listeners: []ListenerConfig{{Port: ":5555", JobWindow: maxJobWindow + 1}}},
+		"negative job age": {Listeners: []ListenerConfig{{Port: ":5555", JobMaxAge: -time.Second}}},
+	} {
+		if _, err := cfg.listenerConfigs(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
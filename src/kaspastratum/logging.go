@@ -0,0 +1,325 @@
+package kaspastratum
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-colorable"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// components that can be given their own log level
+const (
+	LogStratum  = "stratum"
+	LogKaspaApi = "kaspaapi"
+	LogShares   = "shares"
+)
+
+var logComponents = []string{LogStratum, LogKaspaApi, LogShares}
+
+type LogConfig struct {
+	// Level is the minimum level logged, info if empty
+	Level string `yaml:"level"`
+	// Format of stdout, `console` (default) or `json`. Files are always json
+	Format string `yaml:"format"`
+	// File also writes the log to disk if a path is set
+	File LogFileConfig `yaml:"file"`
+	// Components overrides the level of a component, see logComponents
+	Components map[string]string `yaml:"components"`
+	// Sampling limits the high volume share logs
+	Sampling LogSamplingConfig `yaml:"sampling"`
+}
+
+type LogFileConfig struct {
+	Path string `yaml:"path"`
+	// rotate once the file reaches this size, 100MB if 0
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// delete rotated files after this many days, 0 keeps them
+	MaxAgeDays int `yaml:"max_age_days"`
+	// how many rotated files to keep, 0 keeps all of them
+	MaxBackups int  `yaml:"max_backups"`
+	Compress   bool `yaml:"compress"`
+}
+
+// LogSamplingConfig logs the first Initial share entries with the same
+// message each second, then only every Thereafter-th. Disabled if Initial is 0
+type LogSamplingConfig struct {
+	Initial    int `yaml:"initial"`
+	Thereafter int `yaml:"thereafter"`
+}
+
+func parseLevel(level string) (zapcore.Level, error) {
+	if level == "" {
+		return zapcore.InfoLevel, nil
+	}
+	l := zapcore.InfoLevel
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("unknown log level '%s'", level)
+	}
+	return l, nil
+}
+
+func isLogComponent(name string) bool {
+	for _, c := range logComponents {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// logLevels holds the root level and the per component overrides. Both can
+// be changed at runtime through the admin endpoint
+type logLevels struct {
+	lock       sync.RWMutex
+	root       zapcore.Level
+	components map[string]zapcore.Level
+}
+
+// level resolves the level of a named logger. The innermost component in the
+// name wins, e.g. `stratum.shares` uses the shares level if one is set
+func (ll *logLevels) level(loggerName string) zapcore.Level {
+	ll.lock.RLock()
+	defer ll.lock.RUnlock()
+	parts := strings.Split(loggerName, ".")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if level, exists := ll.components[parts[i]]; exists {
+			return level
+		}
+	}
+	return ll.root
+}
+
+// min is the lowest level any logger is enabled for
+func (ll *logLevels) min() zapcore.Level {
+	ll.lock.RLock()
+	defer ll.lock.RUnlock()
+	min := ll.root
+	for _, l := range ll.components {
+		if l < min {
+			min = l
+		}
+	}
+	return min
+}
+
+// componentCore filters entries by the level of the logger that wrote them.
+// Share entries are additionally sampled if configured
+type componentCore struct {
+	zapcore.Core
+	sampled zapcore.Core
+	levels  *logLevels
+}
+
+func (c *componentCore) Enabled(level zapcore.Level) bool {
+	return level >= c.levels.min()
+}
+
+func (c *componentCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &componentCore{Core: c.Core.With(fields), levels: c.levels}
+	if c.sampled != nil {
+		clone.sampled = c.sampled.With(fields)
+	}
+	return clone
+}
+
+func (c *componentCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if entry.Level < c.levels.level(entry.LoggerName) {
+		return checked
+	}
+	if c.sampled != nil && (entry.LoggerName == LogShares || strings.HasSuffix(entry.LoggerName, "."+LogShares)) {
+		return c.sampled.Check(entry, checked)
+	}
+	return c.Core.Check(entry, checked)
+}
+
+// logging owns the bridge's log outputs and hands out component loggers
+type logging struct {
+	base    *zap.Logger
+	levels  *logLevels
+	closers []func() error
+}
+
+func (cfg LogConfig) validate() error {
+	if _, err := parseLevel(cfg.Level); err != nil {
+		return err
+	}
+	for component, level := range cfg.Components {
+		if !isLogComponent(component) {
+			return fmt.Errorf("unknown log component '%s', expected one of %s", component,
+				strings.Join(logComponents, ", "))
+		}
+		if _, err := parseLevel(level); err != nil {
+			return err
+		}
+	}
+	switch cfg.Format {
+	case "", "console", "json":
+	default:
+		return fmt.Errorf("unknown log format '%s', expected console or json", cfg.Format)
+	}
+	if cfg.File.MaxSizeMB < 0 || cfg.File.MaxAgeDays < 0 || cfg.File.MaxBackups < 0 {
+		return fmt.Errorf("log file rotation settings must be positive")
+	}
+	if cfg.Sampling.Initial < 0 || cfg.Sampling.Thereafter < 0 {
+		return fmt.Errorf("log sampling settings must be positive")
+	}
+	return nil
+}
+
+func newLogging(cfg LogConfig) (*logging, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	root, _ := parseLevel(cfg.Level)
+	levels := &logLevels{root: root, components: map[string]zapcore.Level{}}
+	for component, level := range cfg.Components {
+		levels.components[component], _ = parseLevel(level)
+	}
+
+	pe := zap.NewProductionEncoderConfig()
+	pe.EncodeTime = zapcore.RFC3339TimeEncoder
+	stdoutEncoder := zapcore.NewConsoleEncoder(pe)
+	if cfg.Format == "json" {
+		stdoutEncoder = zapcore.NewJSONEncoder(pe)
+	}
+	// levels are filtered by componentCore, the outputs take everything
+	all := zapcore.DebugLevel
+	cores := []zapcore.Core{
+		zapcore.NewCore(stdoutEncoder, zapcore.AddSync(colorable.NewColorableStdout()), all),
+	}
+
+	l := &logging{levels: levels}
+	if cfg.File.Path != "" {
+		file := &lumberjack.Logger{
+			Filename:   cfg.File.Path,
+			MaxSize:    cfg.File.MaxSizeMB,
+			MaxAge:     cfg.File.MaxAgeDays,
+			MaxBackups: cfg.File.MaxBackups,
+			Compress:   cfg.File.Compress,
+		}
+		l.closers = append(l.closers, file.Close)
+		cores = append(cores, zapcore.NewCore(zapcore.NewJSONEncoder(pe), zapcore.AddSync(file), all))
+	}
+
+	core := &componentCore{Core: zapcore.NewTee(cores...), levels: levels}
+	if cfg.Sampling.Initial > 0 {
+		core.sampled = zapcore.NewSamplerWithOptions(core.Core, time.Second,
+			cfg.Sampling.Initial, cfg.Sampling.Thereafter)
+	}
+	l.base = zap.New(core)
+	return l, nil
+}
+
+// Logger returns the logger of a component, see logComponents. An empty
+// component is the root logger
+func (l *logging) Logger(component string) *zap.SugaredLogger {
+	if component == "" {
+		return l.base.Sugar()
+	}
+	return l.base.Named(component).Sugar()
+}
+
+func (l *logging) Close() {
+	l.base.Sync()
+	for _, c := range l.closers {
+		c()
+	}
+}
+
+type logLevelState struct {
+	Level      string            `json:"level"`
+	Components map[string]string `json:"components"`
+}
+
+type logLevelChange struct {
+	// Component to change, the root level if empty
+	Component string `json:"component"`
+	// Level to set, an empty level removes a component override
+	Level string `json:"level"`
+}
+
+func (l *logging) levelState() logLevelState {
+	l.levels.lock.RLock()
+	defer l.levels.lock.RUnlock()
+	state := logLevelState{Level: l.levels.root.String(), Components: map[string]string{}}
+	for component, level := range l.levels.components {
+		state.Components[component] = level.String()
+	}
+	return state
+}
+
+func (l *logging) setLevel(change logLevelChange) error {
+	if change.Component != "" && !isLogComponent(change.Component) {
+		return fmt.Errorf("unknown log component '%s'", change.Component)
+	}
+	if change.Component != "" && change.Level == "" {
+		l.levels.lock.Lock()
+		delete(l.levels.components, change.Component)
+		l.levels.lock.Unlock()
+		return nil
+	}
+	if change.Level == "" {
+		return fmt.Errorf("level is required")
+	}
+	level, err := parseLevel(change.Level)
+	if err != nil {
+		return err
+	}
+	l.levels.lock.Lock()
+	defer l.levels.lock.Unlock()
+	if change.Component == "" {
+		l.levels.root = level
+	} else {
+		l.levels.components[change.Component] = level
+	}
+	return nil
+}
+
+// applyLevels replaces the root level and every component override with the
+// ones from the config, used by config reloads. The config must be valid
+func (l *logging) applyLevels(cfg LogConfig) {
+	root, _ := parseLevel(cfg.Level)
+	components := map[string]zapcore.Level{}
+	for component, level := range cfg.Components {
+		components[component], _ = parseLevel(level)
+	}
+	l.levels.lock.Lock()
+	defer l.levels.lock.Unlock()
+	l.levels.root = root
+	l.levels.components = components
+}
+
+// Handler reports the current levels on GET and changes one on PUT, e.g.
+// `{"component": "shares", "level": "debug"}`
+func (l *logging) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			change := logLevelChange{}
+			if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+				http.Error(w, fmt.Sprintf("malformed request: %s", err), http.StatusBadRequest)
+				return
+			}
+			if err := l.setLevel(change); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			l.Logger("").Info(fmt.Sprintf("log level changed, component: '%s', level: '%s'",
+				change.Component, change.Level))
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "only GET and PUT are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l.levelState())
+	})
+}
@@ -0,0 +1,154 @@
+package kaspastratum
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+)
+
+func newFileLogging(t *testing.T, cfg LogConfig) (*logging, func() []map[string]any) {
+	cfg.File.Path = filepath.Join(t.TempDir(), "bridge.log")
+	logs, err := newLogging(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(logs.Close)
+	read := func() []map[string]any {
+		logs.base.Sync()
+		f, err := os.Open(cfg.File.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		entries := []map[string]any{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			entry := map[string]any{}
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+	return logs, read
+}
+
+func logMessages(entries []map[string]any) []string {
+	messages := []string{}
+	for _, e := range entries {
+		messages = append(messages, e["msg"].(string))
+	}
+	return messages
+}
+
+func TestLogComponentLevels(t *testing.T) {
+	logs, read := newFileLogging(t, LogConfig{
+		Level:      "warn",
+		Components: map[string]string{LogShares: "debug"},
+	})
+	logs.Logger("").Info("root info")
+	logs.Logger("").Warn("root warn")
+	logs.Logger(LogKaspaApi).Info("kaspaapi info")
+	logs.Logger(LogStratum).Named(LogShares).Debug("share debug")
+	logs.Logger(LogStratum).Info("stratum info")
+
+	expected := []string{"root warn", "share debug"}
+	if d := cmp.Diff(expected, logMessages(read())); d != "" {
+		t.Fatalf("unexpected log entries: %s", d)
+	}
+
+	for _, cfg := range []LogConfig{
+		{Level: "loud"},
+		{Format: "xml"},
+		{Components: map[string]string{"payouts": "info"}},
+		{Components: map[string]string{LogShares: "loud"}},
+		{Sampling: LogSamplingConfig{Initial: -1}},
+	} {
+		if _, err := newLogging(cfg); err == nil {
+			t.Errorf("expected config %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	logs, read := newFileLogging(t, LogConfig{
+		Sampling: LogSamplingConfig{Initial: 2, Thereafter: 5},
+	})
+	shares := logs.Logger(LogStratum).Named(LogShares)
+	for i := 0; i < 12; i++ {
+		shares.With(zap.Int("nonce", i)).Info("dupe share")
+		logs.Logger(LogStratum).Info("client connecting")
+	}
+
+	counts := map[string]int{}
+	for _, m := range logMessages(read()) {
+		counts[m]++
+	}
+	// first 2, then every 5th of the remaining 10
+	if counts["dupe share"] != 4 {
+		t.Errorf("expected 4 sampled share entries, got %d", counts["dupe share"])
+	}
+	if counts["client connecting"] != 12 {
+		t.Errorf("expected connection logs to be unsampled, got %d", counts["client connecting"])
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	logs, read := newFileLogging(t, LogConfig{})
+	handler := logs.Handler()
+	put := func(body string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/log/level", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	logs.Logger(LogShares).Debug("before")
+	if code := put(`{"component": "shares", "level": "debug"}`); code != http.StatusOK {
+		t.Fatalf("expected level change to succeed, got %d", code)
+	}
+	logs.Logger(LogShares).Debug("after")
+	logs.Logger(LogKaspaApi).Debug("other component")
+	if code := put(`{"component": "shares"}`); code != http.StatusOK {
+		t.Fatalf("expected override removal to succeed, got %d", code)
+	}
+	logs.Logger(LogShares).Debug("removed")
+	if code := put(`{"level": "error"}`); code != http.StatusOK {
+		t.Fatalf("expected root level change to succeed, got %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/log/level", nil))
+	state := logLevelState{}
+	if err := json.NewDecoder(rec.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(logLevelState{Level: "error", Components: map[string]string{}}, state); d != "" {
+		t.Errorf("unexpected level state: %s", d)
+	}
+
+	messages := []string{}
+	for _, m := range logMessages(read()) {
+		if !strings.HasPrefix(m, "log level changed") {
+			messages = append(messages, m)
+		}
+	}
+	if d := cmp.Diff([]string{"after"}, messages); d != "" {
+		t.Errorf("unexpected log entries: %s", d)
+	}
+
+	for _, body := range []string{`{"component": "payouts", "level": "info"}`, `{"level": "loud"}`,
+		`{}`, `not json`} {
+		if code := put(body); code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", body, code)
+		}
+	}
+}
@@ -1,47 +1,146 @@
 package kaspastratum
 
 import (
+	"math"
 	"math/big"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
 )
 
-const maxjobs = 32
+const (
+	// maxjobs is the default job window, see BridgeConfig.JobWindow
+	maxjobs = 32
+	// defaultJobMaxAge is how long a job lasts by default, see
+	// BridgeConfig.JobMaxAge
+	defaultJobMaxAge = 2 * time.Minute
+)
 
 type MiningState struct {
-	Jobs        map[int]*appmessage.RPCBlock
-	JobLock     sync.Mutex
-	jobCounter  int
+	// accessed atomically, first so they're aligned on 32 bit platforms. The
+	// admin api reads and changes them while the miner is mining
+	shareDiff  uint64 // float64 bits, see Difficulty
+	accepted   uint64
+	lastSubmit int64 // unix nanos
+
+	jobs      *jobStore
+	mode      MiningMode
+	fee       float64
+	templates templateTracker
+
+	// the read goroutine sets the dialect on subscribe while jobs are sent
+	// from the template goroutine, lock guards the fields below
+	lock        sync.Mutex
 	bigDiff     big.Int
 	initialized bool
-	useBigJob   bool
+	dialect     MinerDialect
+}
+
+// MinerContext is a miner connection along with its mining state
+type MinerContext = gostratum.TypedContext[*MiningState]
+
+func MiningStateGenerator() *MiningState {
+	state := &MiningState{
+		jobs: newJobStore(maxjobs, defaultJobMaxAge),
+		mode: MiningModeSolo,
+	}
+	state.setDifficulty(fixedDifficulty)
+	return state
+}
+
+// ListenerStateGenerator returns a state generator that stamps every new
+// connection with the mode, difficulty and fee of the listener it came in on
+func ListenerStateGenerator(cfg ListenerConfig) gostratum.TypedStateGenerator[*MiningState] {
+	return func() *MiningState {
+		state := MiningStateGenerator()
+		state.jobs = newJobStore(cfg.JobWindow, cfg.JobMaxAge)
+		state.mode = cfg.Mode
+		state.setDifficulty(cfg.Difficulty)
+		state.fee = cfg.Fee
+		return state
+	}
+}
+
+func (ms *MiningState) AddJob(job *appmessage.RPCBlock) string {
+	return ms.jobs.Add(job)
+}
+
+func (ms *MiningState) GetJob(id string) (*jobEntry, JobStatus) {
+	return ms.jobs.Get(id)
+}
+
+func (ms *MiningState) Mode() MiningMode {
+	return ms.mode
+}
+
+func (ms *MiningState) Fee() float64 {
+	return ms.fee
+}
+
+// Difficulty is the share difficulty the miner was last sent
+func (ms *MiningState) Difficulty() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&ms.shareDiff))
+}
+
+func (ms *MiningState) setDifficulty(diff float64) {
+	atomic.StoreUint64(&ms.shareDiff, math.Float64bits(diff))
+}
+
+// recordSubmit tracks the miner's submits for the admin api
+func (ms *MiningState) recordSubmit(at time.Time, accepted bool) {
+	atomic.StoreInt64(&ms.lastSubmit, at.UnixNano())
+	if accepted {
+		atomic.AddUint64(&ms.accepted, 1)
+	}
+}
+
+// Accepted is the number of shares accepted since the miner connected
+func (ms *MiningState) Accepted() uint64 {
+	return atomic.LoadUint64(&ms.accepted)
+}
+
+// LastSubmit is when the miner last submitted a share, zero if it never has
+func (ms *MiningState) LastSubmit() time.Time {
+	nanos := atomic.LoadInt64(&ms.lastSubmit)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
 }
 
-func MiningStateGenerator() any {
-	return &MiningState{
-		Jobs:    map[int]*appmessage.RPCBlock{},
-		JobLock: sync.Mutex{},
+// Dialect is the stratum flavor the miner speaks, standard until it subscribes
+func (ms *MiningState) Dialect() MinerDialect {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.dialect == nil {
+		return DialectStandard
 	}
+	return ms.dialect
 }
 
-func GetMiningState(ctx *gostratum.StratumContext) *MiningState {
-	return ctx.State.(*MiningState)
+func (ms *MiningState) setDialect(dialect MinerDialect) {
+	ms.lock.Lock()
+	ms.dialect = dialect
+	ms.lock.Unlock()
 }
 
-func (ms *MiningState) AddJob(job *appmessage.RPCBlock) int {
-	ms.jobCounter++
-	idx := ms.jobCounter % maxjobs
-	ms.JobLock.Lock()
-	ms.Jobs[idx] = job
-	ms.JobLock.Unlock()
-	return idx
+// setTarget records the target of the template the miner was last sent
+func (ms *MiningState) setTarget(bits uint64) {
+	target := CalculateTarget(bits)
+	ms.lock.Lock()
+	ms.bigDiff = target
+	ms.lock.Unlock()
 }
 
-func (ms *MiningState) GetJob(id int) (*appmessage.RPCBlock, bool) {
-	ms.JobLock.Lock()
-	job, exists := ms.Jobs[id]
-	ms.JobLock.Unlock()
-	return job, exists
+// markInitialized flags the miner as sent its first job, returning whether
+// this was that first job
+func (ms *MiningState) markInitialized() bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	first := !ms.initialized
+	ms.initialized = true
+	return first
 }
@@ -0,0 +1,527 @@
+package kaspastratum
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type EventKind string
+
+const (
+	EventBlockFound    EventKind = "block_found"
+	EventBlockMatured  EventKind = "block_matured"
+	EventBlockOrphaned EventKind = "block_orphaned"
+	EventPayoutSent    EventKind = "payout_sent"
+	EventKaspadDown    EventKind = "kaspad_down"
+	EventWorkerOffline EventKind = "worker_offline"
+	EventWorkerOnline  EventKind = "worker_online"
+)
+
+// Event is something worth announcing. The bridge sends block_found and
+// kaspad_down itself, the others are for whatever tracks maturity and
+// payouts to hand to Notify. Worker events only go to the wallet's alert
+// subscriptions, see workerWatchdog
+type Event struct {
+	Kind      EventKind `json:"kind"`
+	Time      time.Time `json:"time"`
+	Wallet    string    `json:"wallet,omitempty"`
+	Worker    string    `json:"worker,omitempty"`
+	BlockHash string    `json:"block_hash,omitempty"`
+	BlueScore uint64    `json:"blue_score,omitempty"`
+	// Amount in sompi, payouts only
+	Amount uint64 `json:"amount,omitempty"`
+	TxId   string `json:"tx_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Reason a worker is considered offline and when it last submitted,
+	// worker events only
+	Reason string     `json:"reason,omitempty"`
+	Since  *time.Time `json:"since,omitempty"`
+}
+
+var defaultEventTemplates = map[EventKind]string{
+	EventBlockFound:    "Block {{.BlockHash}} found by {{.Worker}} ({{.Wallet}}) at blue score {{.BlueScore}}",
+	EventBlockMatured:  "Block {{.BlockHash}} matured",
+	EventBlockOrphaned: "Block {{.BlockHash}} was orphaned",
+	EventPayoutSent:    "Sent {{kas .Amount}} KAS to {{.Wallet}}, tx {{.TxId}}",
+	EventKaspadDown:    "kaspad is down: {{.Error}}",
+	EventWorkerOffline: `Worker {{.Worker}} ({{.Wallet}}) is offline ({{.Reason}}), last share {{.Since.UTC.Format "2006-01-02 15:04 MST"}}`,
+	EventWorkerOnline:  "Worker {{.Worker}} ({{.Wallet}}) is back online",
+}
+
+var eventTemplateFuncs = template.FuncMap{
+	// kas formats an amount of sompi
+	"kas": func(sompi uint64) string {
+		return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.8f", float64(sompi)/1e8), "0"), ".")
+	},
+}
+
+type NotifyConfig struct {
+	// Webhooks post every event as json, signed if a secret is set
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	// Discord posts the message to channel webhooks
+	Discord []DiscordConfig `yaml:"discord"`
+	// Telegram sends the message to chats through a bot
+	Telegram []TelegramConfig `yaml:"telegram"`
+	// Templates override the message of an event kind. They're go templates
+	// over Event, e.g. `{{.Worker}} found {{.BlockHash}}`, with `kas` to
+	// format sompi amounts
+	Templates map[EventKind]string `yaml:"templates"`
+	// Retries is how often a failed delivery is retried before the event is
+	// dropped, 5 if 0
+	Retries int `yaml:"retries"`
+	// Backoff is the delay before the first retry, doubling every attempt.
+	// 1s if 0
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Secret signs the body, the hex HMAC-SHA256 is sent as
+	// `X-Signature-256: sha256=<hmac>`
+	Secret string `yaml:"secret" secret:"true"`
+	// Events to send, all of them if empty
+	Events []EventKind `yaml:"events"`
+}
+
+type DiscordConfig struct {
+	WebhookURL string      `yaml:"webhook_url" secret:"true"`
+	Events     []EventKind `yaml:"events"`
+}
+
+type TelegramConfig struct {
+	BotToken string      `yaml:"bot_token" secret:"true"`
+	ChatId   string      `yaml:"chat_id"`
+	Events   []EventKind `yaml:"events"`
+	// APIURL is the bot api, https://api.telegram.org if empty
+	APIURL string `yaml:"api_url"`
+}
+
+const (
+	defaultNotifyRetries = 5
+	defaultNotifyBackoff = time.Second
+	defaultTelegramAPI   = "https://api.telegram.org"
+	notifyQueueSize      = 64
+	notifyTimeout        = 10 * time.Second
+)
+
+func isEventKind(kind EventKind) bool {
+	_, exists := defaultEventTemplates[kind]
+	return exists
+}
+
+func (cfg NotifyConfig) validate() error {
+	if cfg.Retries < 0 || cfg.Backoff < 0 {
+		return fmt.Errorf("retries and backoff must be positive")
+	}
+	for kind, text := range cfg.Templates {
+		if !isEventKind(kind) {
+			return fmt.Errorf("template for unknown event '%s'", kind)
+		}
+		if _, err := template.New(string(kind)).Funcs(eventTemplateFuncs).Parse(text); err != nil {
+			return fmt.Errorf("template for %s: %s", kind, err)
+		}
+	}
+	checkSink := func(name, target string, events []EventKind) error {
+		if target == "" {
+			return fmt.Errorf("%s: url is required", name)
+		}
+		if _, err := url.ParseRequestURI(target); err != nil {
+			return fmt.Errorf("%s: malformed url: %s", name, err)
+		}
+		for _, kind := range events {
+			if !isEventKind(kind) {
+				return fmt.Errorf("%s: unknown event '%s'", name, kind)
+			}
+		}
+		return nil
+	}
+	for i, w := range cfg.Webhooks {
+		if err := checkSink(fmt.Sprintf("webhooks[%d]", i), w.URL, w.Events); err != nil {
+			return err
+		}
+	}
+	for i, d := range cfg.Discord {
+		if err := checkSink(fmt.Sprintf("discord[%d]", i), d.WebhookURL, d.Events); err != nil {
+			return err
+		}
+	}
+	for i, t := range cfg.Telegram {
+		name := fmt.Sprintf("telegram[%d]", i)
+		if t.BotToken == "" || t.ChatId == "" {
+			return fmt.Errorf("%s: bot_token and chat_id are required", name)
+		}
+		api := t.APIURL
+		if api == "" {
+			api = defaultTelegramAPI
+		}
+		if err := checkSink(name, api, t.Events); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notificationSink delivers an event somewhere. Failed sends are retried
+// unless the error is permanent
+type notificationSink interface {
+	Name() string
+	Send(ctx context.Context, event Event, message string) error
+}
+
+// permanentError is a delivery that won't succeed by retrying, e.g. a
+// revoked webhook
+type permanentError struct {
+	error
+}
+
+// post sends the json body, anything but a 2xx is an error. Client errors
+// other than rate limiting are permanent
+func post(ctx context.Context, client *http.Client, target string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err // the url may carry a token, e.g. telegram's
+		}
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil
+	}
+	reply, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	err = fmt.Errorf("status %d: %s", res.StatusCode, strings.TrimSpace(string(reply)))
+	if res.StatusCode/100 == 4 && res.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+type webhookSink struct {
+	client *http.Client
+	cfg    WebhookConfig
+}
+
+// Name is only the host, webhook urls often carry a token in the path
+func (s *webhookSink) Name() string {
+	u, err := url.Parse(s.cfg.URL)
+	if err != nil {
+		return "webhook"
+	}
+	return "webhook " + u.Host
+}
+
+// webhookBody is the event along with the rendered message
+type webhookBody struct {
+	Event
+	Message string `json:"message"`
+}
+
+func (s *webhookSink) Send(ctx context.Context, event Event, message string) error {
+	body, err := json.Marshal(webhookBody{Event: event, Message: message})
+	if err != nil {
+		return permanentError{err}
+	}
+	headers := map[string]string{}
+	if s.cfg.Secret != "" {
+		headers["X-Signature-256"] = "sha256=" + signBody(s.cfg.Secret, body)
+	}
+	return post(ctx, s.client, s.cfg.URL, body, headers)
+}
+
+// signBody is the hex HMAC-SHA256 of the body, for receivers to verify
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type discordSink struct {
+	client *http.Client
+	cfg    DiscordConfig
+}
+
+func (s *discordSink) Name() string { return "discord" }
+
+func (s *discordSink) Send(ctx context.Context, event Event, message string) error {
+	body, _ := json.Marshal(map[string]string{"content": message})
+	return post(ctx, s.client, s.cfg.WebhookURL, body, nil)
+}
+
+type telegramSink struct {
+	client *http.Client
+	cfg    TelegramConfig
+}
+
+func (s *telegramSink) Name() string { return "telegram " + s.cfg.ChatId }
+
+func (s *telegramSink) Send(ctx context.Context, event Event, message string) error {
+	api := s.cfg.APIURL
+	if api == "" {
+		api = defaultTelegramAPI
+	}
+	body, _ := json.Marshal(map[string]string{"chat_id": s.cfg.ChatId, "text": message})
+	return post(ctx, s.client, fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimRight(api, "/"), s.cfg.BotToken),
+		body, nil)
+}
+
+type SMTPConfig struct {
+	// Host of the mail relay, email alerts are disabled if empty
+	Host string `yaml:"host"`
+	// Port 587 if 0. STARTTLS is used whenever the relay offers it
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"pass" secret:"true"`
+	From     string `yaml:"from"`
+}
+
+const defaultSMTPPort = 587
+
+func (cfg SMTPConfig) enabled() bool {
+	return cfg.Host != ""
+}
+
+func (cfg SMTPConfig) validate() error {
+	if !cfg.enabled() {
+		return nil
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("invalid port %d", cfg.Port)
+	}
+	if _, err := mail.ParseAddress(cfg.From); err != nil {
+		return fmt.Errorf("from: %s", err)
+	}
+	return nil
+}
+
+// sendMailFunc is smtp.SendMail, swapped out in tests
+type sendMailFunc func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+type emailSink struct {
+	cfg  SMTPConfig
+	to   string
+	send sendMailFunc
+}
+
+func (s *emailSink) Name() string { return "email " + s.to }
+
+func (s *emailSink) Send(ctx context.Context, event Event, message string) error {
+	port := s.cfg.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	var auth smtp.Auth
+	if s.cfg.User != "" {
+		auth = smtp.PlainAuth("", s.cfg.User, s.cfg.Password, s.cfg.Host)
+	}
+	// worker names come from miners, don't let them add headers
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(message)
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		s.cfg.From, s.to, subject, event.Time.Format(time.RFC1123Z), message)
+	err := s.send(net.JoinHostPort(s.cfg.Host, strconv.Itoa(port)), auth, s.cfg.From, []string{s.to}, []byte(msg))
+	if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code/100 == 5 {
+		return permanentError{err}
+	}
+	return err
+}
+
+// sinkWorker delivers the events of one sink in order, retrying with backoff
+type sinkWorker struct {
+	sink    notificationSink
+	events  map[EventKind]bool // all if nil
+	queue   chan Event
+	retries int
+	backoff time.Duration
+}
+
+func newSinkWorker(sink notificationSink, events []EventKind, retries int, backoff time.Duration) *sinkWorker {
+	w := &sinkWorker{sink: sink, queue: make(chan Event, notifyQueueSize), retries: retries, backoff: backoff}
+	if len(events) > 0 {
+		w.events = map[EventKind]bool{}
+		for _, kind := range events {
+			w.events[kind] = true
+		}
+	}
+	return w
+}
+
+func (w *sinkWorker) wants(kind EventKind) bool {
+	return w.events == nil || w.events[kind]
+}
+
+// deliver sends the event, retrying until it succeeds, fails permanently or
+// runs out of retries
+func (w *sinkWorker) deliver(ctx context.Context, event Event, message string) error {
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		sendCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		err := w.sink.Send(sendCtx, event, message)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if _, permanent := err.(permanentError); permanent || attempt >= w.retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Notifier announces events on the configured sinks in the background. Every
+// sink has its own queue so a slow or broken one doesn't hold up the rest.
+// A nil Notifier drops everything, so it's always safe to call
+type Notifier struct {
+	logger    *zap.SugaredLogger
+	templates map[EventKind]*template.Template
+	workers   []*sinkWorker
+	retries   int
+	backoff   time.Duration
+}
+
+func NewNotifier(cfg NotifyConfig, logger *zap.SugaredLogger) (*Notifier, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	retries, backoff := cfg.Retries, cfg.Backoff
+	if retries == 0 {
+		retries = defaultNotifyRetries
+	}
+	if backoff == 0 {
+		backoff = defaultNotifyBackoff
+	}
+
+	n := &Notifier{logger: logger, templates: map[EventKind]*template.Template{}, retries: retries, backoff: backoff}
+	for kind, text := range defaultEventTemplates {
+		if custom, exists := cfg.Templates[kind]; exists {
+			text = custom
+		}
+		n.templates[kind] = template.Must(template.New(string(kind)).Funcs(eventTemplateFuncs).Parse(text))
+	}
+
+	client := &http.Client{}
+	for _, w := range cfg.Webhooks {
+		n.workers = append(n.workers, newSinkWorker(&webhookSink{client: client, cfg: w}, w.Events, retries, backoff))
+	}
+	for _, d := range cfg.Discord {
+		n.workers = append(n.workers, newSinkWorker(&discordSink{client: client, cfg: d}, d.Events, retries, backoff))
+	}
+	for _, t := range cfg.Telegram {
+		n.workers = append(n.workers, newSinkWorker(&telegramSink{client: client, cfg: t}, t.Events, retries, backoff))
+	}
+	return n, nil
+}
+
+// Start delivers queued events until the context is cancelled
+func (n *Notifier) Start(ctx context.Context) {
+	if n == nil {
+		return
+	}
+	for _, w := range n.workers {
+		go func(w *sinkWorker) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event := <-w.queue:
+					message, err := n.render(event)
+					if err != nil {
+						n.logger.With(zap.String("event", string(event.Kind)), zap.Error(err)).Warn("failed rendering notification")
+						continue
+					}
+					if err := w.deliver(ctx, event, message); err != nil {
+						n.logger.With(zap.String("sink", w.sink.Name()), zap.String("event", string(event.Kind)),
+							zap.Error(err)).Warn("failed sending notification")
+					}
+				}
+			}
+		}(w)
+	}
+}
+
+func (n *Notifier) render(event Event) (string, error) {
+	tmpl, exists := n.templates[event.Kind]
+	if !exists {
+		return "", fmt.Errorf("unknown event '%s'", event.Kind)
+	}
+	out := strings.Builder{}
+	if err := tmpl.Execute(&out, event); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Notify queues the event for every sink that wants it without blocking. If
+// a sink is backed up the event is dropped for it
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, w := range n.workers {
+		if !w.wants(event.Kind) {
+			continue
+		}
+		select {
+		case w.queue <- event:
+		default:
+			n.logger.With(zap.String("sink", w.sink.Name()), zap.String("event", string(event.Kind))).
+				Warn("notification queue full, dropping event")
+		}
+	}
+}
+
+// sendTo delivers the event to the given sinks rather than the configured
+// ones, each in the background with the same retries
+func (n *Notifier) sendTo(ctx context.Context, event Event, sinks ...notificationSink) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	message, err := n.render(event)
+	if err != nil {
+		n.logger.With(zap.String("event", string(event.Kind)), zap.Error(err)).Warn("failed rendering notification")
+		return
+	}
+	for _, sink := range sinks {
+		go func(w *sinkWorker) {
+			if err := w.deliver(ctx, event, message); err != nil {
+				n.logger.With(zap.String("sink", w.sink.Name()), zap.String("event", string(event.Kind)),
+					zap.Error(err)).Warn("failed sending notification")
+			}
+		}(&sinkWorker{sink: sink, retries: n.retries, backoff: n.backoff})
+	}
+}
@@ -0,0 +1,199 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type receivedRequest struct {
+	path      string
+	signature string
+	body      map[string]any
+}
+
+// notifyServer records what it's sent, failing the first `failures` requests
+// with the given status
+func notifyServer(t *testing.T, failures int, status int) (*httptest.Server, func() []receivedRequest) {
+	lock := sync.Mutex{}
+	received := []receivedRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", status)
+			return
+		}
+		raw, _ := ioutil.ReadAll(r.Body)
+		body := map[string]any{}
+		if err := json.Unmarshal(raw, &body); err != nil {
+			t.Error(err)
+		}
+		received = append(received, receivedRequest{
+			path:      r.URL.Path,
+			signature: r.Header.Get("X-Signature-256"),
+			body:      body,
+		})
+		if signature := r.Header.Get("X-Signature-256"); signature != "" && signature != "sha256="+signBody("hunter2", raw) {
+			t.Errorf("bad signature %s", signature)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []receivedRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]receivedRequest{}, received...)
+	}
+}
+
+func waitForRequests(t *testing.T, received func() []receivedRequest, n int) []receivedRequest {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if r := received(); len(r) >= n {
+			return r
+		}
+	}
+	t.Fatalf("expected %d requests, got %d", n, len(received()))
+	return nil
+}
+
+func TestNotifierSinks(t *testing.T) {
+	webhook, webhookReceived := notifyServer(t, 2, http.StatusBadGateway)
+	discord, discordReceived := notifyServer(t, 1, http.StatusTooManyRequests)
+	telegram, telegramReceived := notifyServer(t, 0, 0)
+	notifier, err := NewNotifier(NotifyConfig{
+		Webhooks: []WebhookConfig{{URL: webhook.URL + "/hook", Secret: "hunter2"}},
+		Discord:  []DiscordConfig{{WebhookURL: discord.URL + "/api/webhooks/1/abc", Events: []EventKind{EventBlockFound}}},
+		Telegram: []TelegramConfig{{BotToken: "123:abc", ChatId: "-100", APIURL: telegram.URL}},
+		Templates: map[EventKind]string{
+			EventPayoutSent: "{{.Wallet}} got {{kas .Amount}}",
+		},
+		Backoff: time.Millisecond,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notifier.Start(ctx)
+
+	found := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	notifier.Notify(Event{Kind: EventBlockFound, Time: found, Wallet: "kaspa:abc", Worker: "rig1",
+		BlockHash: "ff00", BlueScore: 42})
+	notifier.Notify(Event{Kind: EventPayoutSent, Wallet: "kaspa:abc", Amount: 150000000})
+
+	// the webhook gets everything, signed, after two retried failures
+	hooks := waitForRequests(t, webhookReceived, 2)
+	if hooks[0].path != "/hook" || hooks[0].signature == "" {
+		t.Errorf("expected a signed post to the hook, got %+v", hooks[0])
+	}
+	expected := map[string]any{
+		"kind": "block_found", "time": "2024-01-02T03:04:05Z", "wallet": "kaspa:abc", "worker": "rig1",
+		"block_hash": "ff00", "blue_score": float64(42),
+		"message": "Block ff00 found by rig1 (kaspa:abc) at blue score 42",
+	}
+	if d := cmp.Diff(expected, hooks[0].body); d != "" {
+		t.Errorf("unexpected webhook body: %s", d)
+	}
+	if hooks[1].body["message"] != "kaspa:abc got 1.5" {
+		t.Errorf("expected the payout template to be overridden, got %v", hooks[1].body["message"])
+	}
+
+	// discord only wants found blocks, retried after being rate limited
+	posts := waitForRequests(t, discordReceived, 1)
+	if d := cmp.Diff(map[string]any{"content": "Block ff00 found by rig1 (kaspa:abc) at blue score 42"},
+		posts[0].body); d != "" || posts[0].path != "/api/webhooks/1/abc" {
+		t.Errorf("unexpected discord post to %s: %s", posts[0].path, d)
+	}
+
+	messages := waitForRequests(t, telegramReceived, 2)
+	if messages[0].path != "/bot123:abc/sendMessage" || messages[0].body["chat_id"] != "-100" ||
+		messages[1].body["text"] != "kaspa:abc got 1.5" {
+		t.Errorf("unexpected telegram messages: %+v", messages)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if len(discordReceived()) != 1 {
+		t.Errorf("expected discord to only get the found block")
+	}
+}
+
+func TestNotifierRetries(t *testing.T) {
+	rejecting, rejected := notifyServer(t, 100, http.StatusNotFound)
+	failing, _ := notifyServer(t, 100, http.StatusInternalServerError)
+	attempts := func(target string) int {
+		count := 0
+		w := newSinkWorker(&webhookSink{client: http.DefaultClient, cfg: WebhookConfig{URL: target}}, nil,
+			3, time.Millisecond)
+		w.sink = countingSink{notificationSink: w.sink, count: &count}
+		if err := w.deliver(context.Background(), Event{Kind: EventKaspadDown}, "down"); err == nil {
+			t.Errorf("expected delivery to %s to fail", target)
+		}
+		return count
+	}
+	if n := attempts(rejecting.URL); n != 1 {
+		t.Errorf("expected client errors not to be retried, got %d attempts", n)
+	}
+	if n := attempts(failing.URL); n != 4 {
+		t.Errorf("expected server errors to be retried 3 times, got %d attempts", n)
+	}
+	if len(rejected()) != 0 {
+		t.Errorf("expected nothing to be received")
+	}
+
+	// nil notifiers are a no-op so callers don't need to check
+	var notifier *Notifier
+	notifier.Notify(Event{Kind: EventBlockFound})
+	notifier.Start(context.Background())
+}
+
+type countingSink struct {
+	notificationSink
+	count *int
+}
+
+func (cs countingSink) Send(ctx context.Context, event Event, message string) error {
+	*cs.count++
+	return cs.notificationSink.Send(ctx, event, message)
+}
+
+func TestNotifyConfigValidate(t *testing.T) {
+	for name, cfg := range map[string]NotifyConfig{
+		"missing url":      {Webhooks: []WebhookConfig{{}}},
+		"unknown event":    {Discord: []DiscordConfig{{WebhookURL: "https://discord.test/hook", Events: []EventKind{"lunch"}}}},
+		"missing chat":     {Telegram: []TelegramConfig{{BotToken: "123:abc"}}},
+		"bad template":     {Templates: map[EventKind]string{EventBlockFound: "{{.Nope"}},
+		"unknown template": {Templates: map[EventKind]string{"lunch": "hi"}},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	cfg := BridgeConfig{Notify: NotifyConfig{
+		Webhooks: []WebhookConfig{{URL: "https://hooks.test", Secret: "hunter2"}},
+		Telegram: []TelegramConfig{{BotToken: "123:abc", ChatId: "1"}},
+	}}
+	redacted := cfg.Redacted()
+	if redacted.Notify.Webhooks[0].Secret != "<redacted>" || redacted.Notify.Telegram[0].BotToken != "<redacted>" {
+		t.Errorf("expected sink secrets to be redacted, got %+v", redacted.Notify)
+	}
+	if cfg.Notify.Webhooks[0].Secret != "hunter2" {
+		t.Errorf("redacting modified the original config")
+	}
+}
+
+func TestWebhookNameHidesToken(t *testing.T) {
+	sink := &webhookSink{cfg: WebhookConfig{URL: "https://hooks.test/services/T000/B000/s3cr3t?token=abc"}}
+	if name := sink.Name(); name != "webhook hooks.test" {
+		t.Errorf("expected only the host in the sink name, got %q", name)
+	}
+}
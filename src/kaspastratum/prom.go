@@ -1,157 +1,163 @@
 package kaspastratum
 
 import (
+	"context"
 	"net/http"
-	"sync"
+	"time"
 
 	"github.com/kaspanet/kaspad/app/appmessage"
-	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
-var workerLabels = []string{
-	"worker", "miner", "wallet", "ip",
-}
-
-var shareCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-	Name: "ks_valid_share_counter",
-	Help: "Number of shares found by worker over time",
-}, workerLabels)
-
-var invalidCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-	Name: "ks_invalid_share_counter",
-	Help: "Number of stale shares found by worker over time",
-}, append(workerLabels, "type"))
-
-var blockCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-	Name: "ks_blocks_mined",
-	Help: "Number of blocks mined over time",
-}, workerLabels)
-
-var disconnectCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-	Name: "ks_worker_disconnect_counter",
-	Help: "Number of disconnects by worker",
-}, workerLabels)
-
-var jobCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-	Name: "ks_worker_job_counter",
-	Help: "Number of jobs sent to the miner by worker over time",
-}, workerLabels)
-
-var balanceGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Name: "ks_balance_by_wallet_gauge",
-	Help: "Gauge representing the wallet balance for connected workers",
-}, []string{"wallet"})
-
-var errorByWallet = promauto.NewCounterVec(prometheus.CounterOpts{
-	Name: "ks_worker_errors",
-	Help: "Gauge representing errors by worker",
-}, []string{"wallet", "error"})
-
-var estimatedNetworkHashrate = promauto.NewGauge(prometheus.GaugeOpts{
-	Name: "ks_estimated_network_hashrate_gauge",
-	Help: "Gauge representing the estimated network hashrate",
-})
-
-var networkDifficulty = promauto.NewGauge(prometheus.GaugeOpts{
-	Name: "ks_network_difficulty_gauge",
-	Help: "Gauge representing the network difficulty",
-})
-
-var networkBlockCount = promauto.NewGauge(prometheus.GaugeOpts{
-	Name: "ks_network_block_count",
-	Help: "Gauge representing the network block count",
-})
-
-func commonLabels(worker *gostratum.StratumContext) prometheus.Labels {
-	return prometheus.Labels{
-		"worker": worker.WorkerName,
-		"miner":  worker.RemoteApp,
-		"wallet": worker.WalletAddr,
-		"ip":     worker.RemoteAddr,
+// Metrics are the prometheus series of a bridge. Everything is registered on
+// the registry handed to NewMetrics, so several bridges can run in one
+// process and pool level collectors can be added next to them
+type Metrics struct {
+	registry *prometheus.Registry
+	workers  *workerMetrics
+
+	estimatedNetworkHashrate prometheus.Gauge
+	networkDifficulty        prometheus.Gauge
+	networkBlockCount        prometheus.Gauge
+	blockSubmissions         *prometheus.CounterVec
+	blockSubmitLatency       *prometheus.HistogramVec
+}
+
+func NewMetrics(registry *prometheus.Registry, cfg WorkerMetricsConfig) (*Metrics, error) {
+	workers, err := newWorkerMetrics(cfg)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metrics{
+		registry: registry,
+		workers:  workers,
+		estimatedNetworkHashrate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ks_estimated_network_hashrate_gauge",
+			Help: "Gauge representing the estimated network hashrate",
+		}),
+		networkDifficulty: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ks_network_difficulty_gauge",
+			Help: "Gauge representing the network difficulty",
+		}),
+		networkBlockCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ks_network_block_count",
+			Help: "Gauge representing the network block count",
+		}),
+		blockSubmissions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ks_block_submissions_total",
+			Help: "Blocks submitted to kaspad by result, see BlockSubmitResult",
+		}, []string{"result"}),
+		blockSubmitLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ks_block_submit_latency_seconds",
+			Help:    "Time kaspad took to answer a block submission by result",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"result"}),
+	}
+	collectors := append(workers.collectors(), m.estimatedNetworkHashrate,
+		m.networkDifficulty, m.networkBlockCount, m.blockSubmissions, m.blockSubmitLatency)
+	for i, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			// only roll back our own, unregistering a collector that failed
+			// would remove the one it clashed with
+			for _, registered := range collectors[:i] {
+				registry.Unregister(registered)
+			}
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func miningMode(worker *MinerContext) MiningMode {
+	if worker.State != nil {
+		return worker.State.mode
 	}
+	return MiningModeSolo
 }
 
-func RecordShareFound(worker *gostratum.StratumContext) {
-	shareCounter.With(commonLabels(worker)).Inc()
+func (m *Metrics) RecordShareFound(worker *MinerContext) {
+	m.workers.shares.With(m.workers.workerLabels(worker)).Inc()
 }
 
-func RecordStaleShare(worker *gostratum.StratumContext) {
-	labels := commonLabels(worker)
-	labels["type"] = "stale"
-	invalidCounter.With(labels).Inc()
+func (m *Metrics) RecordLateShare(worker *MinerContext) {
+	m.workers.lateShares.With(m.workers.workerLabels(worker)).Inc()
 }
 
-func RecordDupeShare(worker *gostratum.StratumContext) {
-	labels := commonLabels(worker)
-	labels["type"] = "duplicate"
-	invalidCounter.With(labels).Inc()
+func (m *Metrics) RecordStaleShare(worker *MinerContext) {
+	m.workers.invalidShare(worker, "stale")
 }
 
-func RecordInvalidShare(worker *gostratum.StratumContext) {
-	labels := commonLabels(worker)
-	labels["type"] = "invalid"
-	invalidCounter.With(labels).Inc()
+func (m *Metrics) RecordDupeShare(worker *MinerContext) {
+	m.workers.invalidShare(worker, "duplicate")
 }
 
-func RecordWeakShare(worker *gostratum.StratumContext) {
-	labels := commonLabels(worker)
-	labels["type"] = "weak"
-	invalidCounter.With(labels).Inc()
+func (m *Metrics) RecordInvalidShare(worker *MinerContext) {
+	m.workers.invalidShare(worker, "invalid")
 }
 
-func RecordBlockFound(worker *gostratum.StratumContext) {
-	blockCounter.With(commonLabels(worker)).Inc()
+func (m *Metrics) RecordWeakShare(worker *MinerContext) {
+	m.workers.invalidShare(worker, "weak")
 }
 
-func RecordDisconnect(worker *gostratum.StratumContext) {
-	disconnectCounter.With(commonLabels(worker)).Inc()
+func (m *Metrics) RecordBlockFound(worker *MinerContext) {
+	m.workers.blocks.With(m.workers.workerLabels(worker)).Inc()
 }
 
-func RecordNewJob(worker *gostratum.StratumContext) {
-	jobCounter.With(commonLabels(worker)).Inc()
+func (m *Metrics) RecordBlockSubmission(result BlockSubmitResult, latency time.Duration) {
+	m.blockSubmissions.WithLabelValues(string(result)).Inc()
+	m.blockSubmitLatency.WithLabelValues(string(result)).Observe(latency.Seconds())
 }
 
-func RecordNetworkStats(hashrate uint64, blockCount uint64, difficulty float64) {
-	estimatedNetworkHashrate.Set(float64(hashrate))
-	networkDifficulty.Set(difficulty)
-	networkBlockCount.Set(float64(blockCount))
+func (m *Metrics) RecordDisconnect(worker *MinerContext) {
+	m.workers.disconnects.With(m.workers.workerLabels(worker)).Inc()
 }
 
-func RecordWorkerError(address string, shortError ErrorShortCodeT) {
-	errorByWallet.With(prometheus.Labels{
-		"wallet": address,
-		"error":  string(shortError),
-	}).Inc()
+func (m *Metrics) RecordNewJob(worker *MinerContext) {
+	m.workers.jobs.With(m.workers.workerLabels(worker)).Inc()
 }
 
-func RecordBalances(response *appmessage.GetBalancesByAddressesResponseMessage) {
+func (m *Metrics) RecordNetworkStats(hashrate uint64, blockCount uint64, difficulty float64) {
+	m.estimatedNetworkHashrate.Set(float64(hashrate))
+	m.networkDifficulty.Set(difficulty)
+	m.networkBlockCount.Set(float64(blockCount))
+}
+
+func (m *Metrics) RecordWorkerError(address string, shortError ErrorShortCodeT) {
+	m.workers.workerError(address, shortError)
+}
+
+func (m *Metrics) RecordBalances(response *appmessage.GetBalancesByAddressesResponseMessage) {
 	unique := map[string]struct{}{}
 	for _, v := range response.Entries {
 		// only set once per run
 		if _, exists := unique[v.Address]; !exists {
-			balanceGauge.With(prometheus.Labels{
-				"wallet": v.Address,
-			}).Set(float64(v.Balance) / 100000000)
+			m.workers.balance(v.Address, float64(v.Balance)/100000000)
 			unique[v.Address] = struct{}{}
 		}
 	}
 }
 
-var promInit sync.Once
+// Handler serves the series of the metrics' registry only
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
 
-func StartPromServer(log *zap.SugaredLogger, port string) {
-	go func() { // prom http handler, separate from the main router
-		promInit.Do(func() {
-			logger := log.With(zap.String("server", "prometheus"))
-			http.Handle("/metrics", promhttp.Handler())
-			logger.Info("hosting prom stats on ", port, "/metrics")
-			if err := http.ListenAndServe(port, nil); err != nil {
-				logger.Error("error serving prom metrics", zap.Error(err))
-			}
-		})
+// Serve hosts /metrics on its own mux until the context is cancelled
+func (m *Metrics) Serve(ctx context.Context, log *zap.SugaredLogger, port string) error {
+	logger := log.With(zap.String("server", "prometheus"))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	server := &http.Server{Addr: port, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
 	}()
+
+	logger.Info("hosting prom stats on ", port, "/metrics")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
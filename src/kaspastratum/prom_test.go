@@ -0,0 +1,52 @@
+package kaspastratum
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testMetrics(t *testing.T) *Metrics {
+	metrics, err := NewMetrics(prometheus.NewRegistry(), WorkerMetricsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metrics
+}
+
+func TestMetricsIsolation(t *testing.T) {
+	a, b := testMetrics(t), testMetrics(t)
+	worker := newMetricsWorker("kaspa:a", "rig1", "10.0.0.1")
+	a.RecordShareFound(worker)
+	a.RecordShareFound(worker)
+	b.RecordShareFound(worker)
+	a.RecordNetworkStats(1000, 5, 1.5)
+
+	if v := testutil.ToFloat64(a.workers.shares.With(a.workers.workerLabels(worker))); v != 2 {
+		t.Errorf("expected 2 shares on the first bridge, got %f", v)
+	}
+	if v := testutil.ToFloat64(b.workers.shares.With(b.workers.workerLabels(worker))); v != 1 {
+		t.Errorf("expected 1 share on the second bridge, got %f", v)
+	}
+	if v := testutil.ToFloat64(b.networkDifficulty); v != 0 {
+		t.Errorf("expected network stats of the first bridge to stay there, got %f", v)
+	}
+
+	// registering the same series twice on one registry must fail
+	if _, err := NewMetrics(a.registry, WorkerMetricsConfig{}); err == nil {
+		t.Error("expected duplicate registration to fail")
+	}
+
+	rec := httptest.NewRecorder()
+	a.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	for _, expected := range []string{`ks_valid_share_counter{`, `ks_network_difficulty_gauge 1.5`} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected %s in the metrics output", expected)
+		}
+	}
+}
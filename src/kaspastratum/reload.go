@@ -0,0 +1,250 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// live is a setting a reload can swap while it's being read
+type live[T any] struct {
+	value atomic.Value
+}
+
+func newLive[T any](v T) *live[T] {
+	l := &live[T]{}
+	l.value.Store(v)
+	return l
+}
+
+func (l *live[T]) Load() T {
+	return l.value.Load().(T)
+}
+
+func (l *live[T]) Store(v T) {
+	l.value.Store(v)
+}
+
+// reloadableListener is a stratum listener whose settings can change in place.
+// Miners already connected keep their difficulty and fee, new connections
+// get the reloaded ones
+type reloadableListener interface {
+	reload(lc ListenerConfig, minJobInterval time.Duration)
+}
+
+// ReloadResult reports what a reload changed. Settings under RestartRequired
+// differ from what the bridge was started with but only take effect once it
+// restarts
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// settings that are applied by a reload, everything else needs a restart.
+// `log` and `listeners` are only partially live, see reloader.diff.
+// kaspad_address is deliberately not live: the rpc client is shared by the
+// template listener, the stats loop and every job fetch without a lock, and
+// the template notifications are registered on it once at startup, so
+// swapping it safely means restarting those loops anyway. The bridge has no
+// rate limit or allowlist settings yet, bans go through the admin api and
+// don't need a reload
+var liveSettings = map[string]bool{
+	"difficulty":       true,
+	"job_window":       true,
+	"job_max_age":      true,
+	"min_job_interval": true,
+	"stale":            true,
+	"dialects":         true,
+}
+
+// reloader re-reads the config and applies the live subset of it to the
+// running bridge without touching any connection
+type reloader struct {
+	lock      sync.Mutex
+	load      func() (BridgeConfig, error)
+	logger    *zap.SugaredLogger
+	logs      *logging
+	shares    *shareHandler
+	dialects  *dialectSelector
+	listeners map[string]reloadableListener // by port
+	// started is the config the bridge was started with, current the last
+	// one applied
+	started BridgeConfig
+	current BridgeConfig
+}
+
+func newReloader(cfg BridgeConfig, logger *zap.SugaredLogger, logs *logging, shares *shareHandler,
+	dialects *dialectSelector) *reloader {
+	return &reloader{
+		load:      cfg.Loader,
+		logger:    logger,
+		logs:      logs,
+		shares:    shares,
+		dialects:  dialects,
+		listeners: map[string]reloadableListener{},
+		started:   cfg,
+		current:   cfg,
+	}
+}
+
+// Reload loads and validates the config, then applies the settings that can
+// change live. Nothing is applied if the new config is invalid
+func (r *reloader) Reload() (ReloadResult, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.load == nil {
+		return ReloadResult{}, fmt.Errorf("reloading is not enabled, no config loader set")
+	}
+	cfg, err := r.load()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	return r.apply(cfg)
+}
+
+func (r *reloader) apply(cfg BridgeConfig) (ReloadResult, error) {
+	if err := cfg.Validate(); err != nil {
+		return ReloadResult{}, err
+	}
+	listeners, _ := cfg.listenerConfigs()
+	if _, err := compileDialectRules(cfg.Dialects); err != nil {
+		return ReloadResult{}, errors.Wrap(err, "invalid dialect config")
+	}
+
+	result := r.diff(cfg, listeners)
+	r.logs.applyLevels(cfg.Log)
+	r.shares.stale.Store(cfg.Stale.withDefaults())
+	r.dialects.update(cfg.Dialects) // compiled above
+	for _, lc := range listeners {
+		if l, exists := r.listeners[lc.Port]; exists {
+			l.reload(lc, cfg.MinJobInterval)
+		}
+	}
+	r.current = cfg
+	r.logger.With(zap.Strings("applied", result.Applied), zap.Strings("restart_required", result.RestartRequired)).
+		Info("config reloaded")
+	return result, nil
+}
+
+// diff compares the new config to the running one. Live settings are
+// compared against the last reload, the rest against what the bridge was
+// started with so they're reported until it restarts
+func (r *reloader) diff(cfg BridgeConfig, listeners []ListenerConfig) ReloadResult {
+	result := ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	started := reflect.ValueOf(r.started)
+	current := reflect.ValueOf(r.current)
+	next := reflect.ValueOf(cfg)
+	for i := 0; i < next.NumField(); i++ {
+		name := strings.Split(next.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		switch {
+		case name == "" || name == "-" || name == "log" || name == "listeners":
+		case liveSettings[name]:
+			if !reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+				result.Applied = append(result.Applied, name)
+			}
+		case !reflect.DeepEqual(started.Field(i).Interface(), next.Field(i).Interface()):
+			result.RestartRequired = append(result.RestartRequired, name)
+		}
+	}
+
+	// only the levels of the log are live, the outputs are opened at startup
+	if r.current.Log.Level != cfg.Log.Level {
+		result.Applied = append(result.Applied, "log.level")
+	}
+	if !reflect.DeepEqual(r.current.Log.Components, cfg.Log.Components) {
+		result.Applied = append(result.Applied, "log.components")
+	}
+	startedLog, nextLog := r.started.Log, cfg.Log
+	startedLog.Level, startedLog.Components = "", nil
+	nextLog.Level, nextLog.Components = "", nil
+	if !reflect.DeepEqual(startedLog, nextLog) {
+		result.RestartRequired = append(result.RestartRequired, "log")
+	}
+
+	// listeners can't be added, removed or change protocol/mode in place
+	startedListeners, _ := r.started.listenerConfigs()
+	currentListeners, _ := r.current.listenerConfigs()
+	if !sameListeners(startedListeners, listeners) {
+		result.RestartRequired = append(result.RestartRequired, "listeners")
+	}
+	for _, lc := range listeners {
+		for _, running := range currentListeners {
+			if running.Port != lc.Port {
+				continue
+			}
+			if running.Difficulty != lc.Difficulty {
+				result.Applied = append(result.Applied, fmt.Sprintf("listeners[%s].difficulty", lc.Port))
+			}
+			if running.Fee != lc.Fee {
+				result.Applied = append(result.Applied, fmt.Sprintf("listeners[%s].fee", lc.Port))
+			}
+			if running.JobWindow != lc.JobWindow {
+				result.Applied = append(result.Applied, fmt.Sprintf("listeners[%s].job_window", lc.Port))
+			}
+			if running.JobMaxAge != lc.JobMaxAge {
+				result.Applied = append(result.Applied, fmt.Sprintf("listeners[%s].job_max_age", lc.Port))
+			}
+		}
+	}
+	return result
+}
+
+func sameListeners(a, b []ListenerConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Port != b[i].Port || a[i].Protocol != b[i].Protocol || a[i].Mode != b[i].Mode {
+			return false
+		}
+	}
+	return true
+}
+
+// Handler reloads the config on POST, replying with the ReloadResult
+func (r *reloader) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := r.Reload()
+		if err != nil {
+			r.logger.With(zap.Error(err)).Warn("config reload rejected")
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// reloadOnHangup reloads the config on every SIGHUP until the context is done
+func (r *reloader) reloadOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if _, err := r.Reload(); err != nil {
+				r.logger.With(zap.Error(err)).Warn("config reload rejected")
+			}
+		}
+	}
+}
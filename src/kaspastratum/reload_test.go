@@ -0,0 +1,141 @@
+package kaspastratum
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap/zapcore"
+)
+
+const reloadConfigYaml = `
+kaspad_address: localhost:16110
+min_job_interval: 2s
+postgres:
+  dsn: postgres://pool@db/shares
+listeners:
+  - port:       ":5555"
+    difficulty: 4
+log:
+  level: info
+`
+
+func TestReload(t *testing.T) {
+	path := writeTestFile(t, "config.yaml", reloadConfigYaml)
+	load := func() (BridgeConfig, error) { return LoadConfig(path, testEnv(nil)) }
+	cfg, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Loader = load
+	listeners, _ := cfg.listenerConfigs()
+
+	logs, err := newLogging(cfg.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialects, _ := newDialectSelector(nil)
+	shares := newShareHandler(nil, newTipTracker(), cfg.Stale, newMemoryDupeFilter(time.Minute), nil, testMetrics(t),
+		trace.NewNoopTracerProvider().Tracer(tracerName))
+	cl := newClientListener(logger, shares, listeners[0], "", cfg.MinJobInterval, testMetrics(t))
+	reloads := newReloader(cfg, logger, logs, shares, dialects)
+	reloads.listeners[":5555"] = cl
+
+	miner, conn := gostratum.NewMockContext(context.Background(), logger, cl.newState())
+	miner.WalletAddr = "kaspa:miner"
+	cl.OnConnect(miner)
+
+	// nothing changed, nothing to report
+	result, err := reloads.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 0 || len(result.RestartRequired) != 0 {
+		t.Errorf("expected an unchanged config to change nothing, got %+v", result)
+	}
+
+	updated := strings.NewReplacer(
+		"min_job_interval: 2s", "min_job_interval: 5s",
+		"localhost:16110", "kaspad:16110",
+		"difficulty: 4", "difficulty: 8\n    fee: 1",
+		"level: info", "level: debug",
+	).Replace(reloadConfigYaml) + "stale:\n  bluescore_grace: 4\n"
+	if err := ioutil.WriteFile(path, []byte(updated), 0600); err != nil {
+		t.Fatal(err)
+	}
+	result, err = reloads.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ReloadResult{
+		Applied: []string{"min_job_interval", "stale", "log.level", "listeners[:5555].difficulty",
+			"listeners[:5555].fee"},
+		RestartRequired: []string{"kaspad_address"},
+	}
+	if d := cmp.Diff(expected, result); d != "" {
+		t.Errorf("unexpected reload result: %s", d)
+	}
+
+	// the miner is still connected and keeps mining at the difficulty it
+	// was given, new connections get the reloaded settings
+	if !miner.Connected() || cl.clients.Len() != 1 {
+		t.Fatalf("expected the miner to survive the reload")
+	}
+	if miner.State.Difficulty() != 4 {
+		t.Errorf("expected the connected miner to keep difficulty 4, got %f", miner.State.Difficulty())
+	}
+	if state := cl.newState(); state.Difficulty() != 8 || state.fee != 1 {
+		t.Errorf("expected new connections to get the reloaded settings, got %+v", state)
+	}
+	if cl.jobs.minJobInterval.Load() != 5*time.Second || shares.stale.Load().BlueScoreGrace != 4 {
+		t.Errorf("job interval or stale settings not applied")
+	}
+	if logs.levels.level("") != zapcore.DebugLevel {
+		t.Errorf("log level not applied")
+	}
+	if wallets := cl.sendJobs(newFixedTemplates(t)); len(wallets) != 1 {
+		t.Fatalf("expected the connected miner to still get jobs, got %v", wallets)
+	}
+	if methods := receivedMethods(t, conn, 2); methods[1] != "mining.notify" {
+		t.Errorf("expected a job after the reload, got %v", methods)
+	}
+
+	// restart settings are reported until the bridge restarts, live ones
+	// only when they change
+	result, _ = reloads.Reload()
+	if d := cmp.Diff(ReloadResult{Applied: []string{}, RestartRequired: []string{"kaspad_address"}},
+		result); d != "" {
+		t.Errorf("unexpected result of reloading again: %s", d)
+	}
+
+	// an invalid config is rejected as a whole
+	invalid := strings.Replace(updated, "difficulty: 8", "difficulty: -1", 1)
+	if err := ioutil.WriteFile(path, []byte(invalid), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloads.Reload(); err == nil {
+		t.Fatal("expected an invalid config to be rejected")
+	}
+	if state := cl.newState(); state.Difficulty() != 8 || logs.levels.level("") != zapcore.DebugLevel {
+		t.Errorf("a rejected reload changed the running settings")
+	}
+
+	// the admin endpoint only reloads on POST
+	rec := httptest.NewRecorder()
+	reloads.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	reloads.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected the invalid config to be reported, got %d", rec.Code)
+	}
+}
@@ -1,209 +1,368 @@
 package kaspastratum
 
 import (
+	"context"
 	"fmt"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/jackc/pgx"
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/consensushashing"
 	"github.com/kaspanet/kaspad/domain/consensus/utils/pow"
 	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
 	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
 type shareHandler struct {
-	kaspa        *rpcclient.RPCClient
-	statsLock    sync.Mutex
-	tipBlueScore uint64
-	redis        redis.Client
-	shareSet     ZSet
-	postgres     *pgx.Conn
+	kaspa     blockSubmitter
+	statsLock sync.Mutex
+	tip       *tipTracker
+	stale     *live[StaleConfig]
+	dupes     dupeFilter
+	postgres  *pgx.ConnPool
+	metrics   *Metrics
+	tracer    trace.Tracer
+	notifier  *Notifier       // optional
+	watchdog  *workerWatchdog // optional
+	// submissions records every block candidate, optional
+	submissions submissionStore
 }
 
-func newShareHandler(kaspa *rpcclient.RPCClient, redis *redis.Client, pg *pgx.Conn) *shareHandler {
-	return &shareHandler{
-		kaspa:     kaspa,
+func newShareHandler(kaspa *rpcclient.RPCClient, tip *tipTracker, stale StaleConfig,
+	dupes dupeFilter, pg *pgx.ConnPool, metrics *Metrics, tracer trace.Tracer) *shareHandler {
+	sh := &shareHandler{
 		statsLock: sync.Mutex{},
-		redis:     *redis,
-		shareSet:  NewZSet(redis, "share_buffer"),
+		tip:       tip,
+		stale:     newLive(stale.withDefaults()),
+		dupes:     dupes,
 		postgres:  pg,
+		metrics:   metrics,
+		tracer:    tracer,
 	}
+	if kaspa != nil {
+		sh.kaspa = kaspa
+	}
+	return sh
 }
 
 type submitInfo struct {
-	block    *appmessage.RPCBlock
-	state    *MiningState
+	jobId    string
 	noncestr string
 	nonceVal uint64
 }
 
-func validateSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) (*submitInfo, error) {
-	if len(event.Params) < 2 {
-		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-		return nil, fmt.Errorf("malformed event, expected at least 2 params")
+// validateSubmit parses a json-rpc mining.submit into the job id and nonce
+func (sh *shareHandler) validateSubmit(spanCtx context.Context, ctx *MinerContext,
+	event gostratum.JsonRpcEvent) (info *submitInfo, err error) {
+	_, span := sh.tracer.Start(spanCtx, "validateSubmit")
+	defer func() { endSpan(span, err) }()
+	if len(event.Params) < 3 {
+		sh.metrics.RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		return nil, fmt.Errorf("malformed event, expected at least 3 params")
 	}
 	jobIdStr, ok := event.Params[1].(string)
 	if !ok {
-		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		sh.metrics.RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
 		return nil, fmt.Errorf("unexpected type for param 1: %+v", event.Params...)
 	}
-	jobId, err := strconv.ParseInt(jobIdStr, 10, 0)
-	if err != nil {
-		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-		return nil, errors.Wrap(err, "job id is not parsable as an number")
-	}
-	state := GetMiningState(ctx)
-	block, exists := state.GetJob(int(jobId))
-	if !exists {
-		RecordWorkerError(ctx.WalletAddr, ErrMissingJob)
-		return nil, fmt.Errorf("job does not exist. stale?")
-	}
 	noncestr, ok := event.Params[2].(string)
 	if !ok {
-		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		sh.metrics.RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
 		return nil, fmt.Errorf("unexpected type for param 2: %+v", event.Params...)
 	}
+	noncestr = strings.Replace(noncestr, "0x", "", 1)
+	// the bridge doesn't hand out extranonces, miners submit the full nonce
+	nonceVal, err := ctx.State.Dialect().DecodeNonce("", noncestr)
+	if err != nil {
+		sh.metrics.RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		return nil, errors.Wrap(err, "failed parsing noncestr")
+	}
+	span.SetAttributes(attrJobId.String(jobIdStr))
 	return &submitInfo{
-		state:    state,
-		block:    block,
-		noncestr: strings.Replace(noncestr, "0x", "", 1),
+		jobId:    jobIdStr,
+		noncestr: noncestr,
+		nonceVal: nonceVal,
 	}, nil
 }
 
 var (
 	ErrStaleShare = fmt.Errorf("stale share")
 	ErrDupeShare  = fmt.Errorf("duplicate share")
+	ErrUnknownJob = fmt.Errorf("job was never issued")
 )
 
-// the max difference between tip blue score and job blue score that we'll accept
-// anything greater than this is considered a stale
-const workWindow = 8
-
-func (sh *shareHandler) checkStales(ctx *gostratum.StratumContext, si *submitInfo) error {
-	tip := sh.tipBlueScore
-	if si.block.Header.BlueScore > tip {
-		sh.tipBlueScore = si.block.Header.BlueScore
-	} else if tip-si.block.Header.BlueScore > workWindow {
-		RecordStaleShare(ctx)
-		return errors.Wrapf(ErrStaleShare, "blueScore %d vs %d", si.block.Header.BlueScore, tip)
-	}
-	val, err := sh.shareSet.AddValues(ctx, ZSetKVP{
-		Score:  float64(time.Now().Unix()),
-		Member: fmt.Sprintf("%d_%d", si.block.Header.BlueScore, si.nonceVal),
-	})
-	if err != nil {
-		return errors.Wrap(err, "failed writing share to redis")
-	}
-	if val > 0 { // val > 0 means new value
-		// credit to miner
-		_, err := sh.postgres.Exec(`INSERT into shares(wallet, bluescore, nonce, timestamp) 
-									 VALUES ($1, $2, $3, $4)`,
-			ctx.WalletAddr, si.block.Header.BlueScore, si.nonceVal, time.Now())
-		if err != nil {
-			return errors.Wrap(err, "failed writing share to pg")
+// ShareResult is the outcome of a submitted share, independent of the
+// protocol the share arrived on
+type ShareResult int
+
+const (
+	ShareAccepted ShareResult = iota
+	// accepted, but mined on a job trailing the tip. See ShareLate
+	ShareAcceptedLate
+	ShareBlockFound
+	ShareRejectedStale
+	ShareRejectedDupe
+	ShareRejectedUnknownJob
+	// the share met the network target but kaspad refused the block
+	ShareRejectedBlock
+)
+
+func (sr ShareResult) String() string {
+	switch sr {
+	case ShareAccepted:
+		return "accepted"
+	case ShareAcceptedLate:
+		return "accepted_late"
+	case ShareBlockFound:
+		return "block_found"
+	case ShareRejectedStale:
+		return "stale"
+	case ShareRejectedDupe:
+		return "duplicate"
+	case ShareRejectedUnknownJob:
+		return "unknown_job"
+	default:
+		return "rejected_block"
+	}
+}
+
+// Accepted reports whether the miner should be told the share was good
+func (sr ShareResult) Accepted() bool {
+	return sr == ShareAccepted || sr == ShareAcceptedLate || sr == ShareBlockFound
+}
+
+// migrateShares adds the columns shares gained since the table was first
+// created: the mode and fee of the listener a share came in on, payouts
+// split and charge by them
+func migrateShares(pg *pgx.ConnPool) error {
+	for _, stmt := range []string{
+		`ALTER TABLE shares ADD COLUMN IF NOT EXISTS mode TEXT`,
+		`ALTER TABLE shares ADD COLUMN IF NOT EXISTS fee DOUBLE PRECISION`,
+	} {
+		if _, err := pg.Exec(stmt); err != nil {
+			return errors.Wrap(err, "failed migrating shares")
 		}
-		return nil
 	}
-	return ErrDupeShare
+	return nil
 }
 
-func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
-	submitInfo, err := validateSubmit(ctx, event)
+func (sh *shareHandler) checkStales(spanCtx context.Context, ctx *MinerContext,
+	job *jobEntry, nonce uint64) (ShareAge, error) {
+	header := job.Block.Header
+	age := sh.tip.Classify(header.BlueScore, header.DAAScore, time.Now(), sh.stale.Load())
+	if age == ShareTooOld {
+		blue, daa := sh.tip.Tip()
+		return age, errors.Wrapf(ErrStaleShare, "blueScore %d vs %d, daaScore %d vs %d",
+			header.BlueScore, blue, header.DAAScore, daa)
+	}
+	dupeCtx, span := sh.tracer.Start(spanCtx, "dupeCheck")
+	dupe, err := sh.dupes.Seen(dupeCtx, job, nonce)
+	span.SetAttributes(attribute.Bool("kaspa.duplicate", dupe))
+	endSpan(span, err)
 	if err != nil {
-		return err
+		return age, errors.Wrap(err, "failed checking for duplicate share")
 	}
-	ctx.Logger.Debug(submitInfo.block.Header.BlueScore, " submit ", submitInfo.noncestr)
-	if GetMiningState(ctx).useBigJob {
-		submitInfo.nonceVal, err = strconv.ParseUint(submitInfo.noncestr, 16, 64)
-		if err != nil {
-			RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-			return errors.Wrap(err, "failed parsing noncestr")
-		}
-	} else {
-		submitInfo.nonceVal, err = strconv.ParseUint(submitInfo.noncestr, 16, 64)
-		if err != nil {
-			RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-			return errors.Wrap(err, "failed parsing noncestr")
-		}
+	if dupe {
+		return age, ErrDupeShare
+	}
+	// credit to miner
+	_, span = sh.tracer.Start(spanCtx, "db.insertShare")
+	_, err = sh.postgres.Exec(`INSERT into shares(wallet, bluescore, nonce, timestamp, mode, fee) 
+								 VALUES ($1, $2, $3, $4, $5, $6)`,
+		ctx.WalletAddr, header.BlueScore, nonce, time.Now(), string(ctx.State.mode), ctx.State.Fee())
+	endSpan(span, err)
+	if err != nil {
+		return age, errors.Wrap(err, "failed writing share to pg")
+	}
+	return age, nil
+}
+
+// processShare validates a share against the job it was mined on, credits it
+// and submits it to kaspad if it solves a block. Shared by every protocol
+// front end, which only have to map the result onto their own replies. An
+// error is only returned when the share could not be processed at all
+func (sh *shareHandler) processShare(spanCtx context.Context, ctx *MinerContext,
+	jobId string, nonce uint64) (result ShareResult, err error) {
+	spanCtx, span := sh.tracer.Start(spanCtx, "processShare",
+		trace.WithAttributes(append(workerAttributes(ctx), attrJobId.String(jobId))...))
+	defer func() {
+		now := time.Now()
+		ctx.State.recordSubmit(now, result.Accepted())
+		sh.watchdog.Share(ctx, now)
+		span.SetAttributes(attrResult.String(result.String()))
+		endSpan(span, err)
+	}()
+
+	log := shareLogger(ctx).With(zap.String("job_id", jobId))
+	job, status := ctx.State.GetJob(jobId)
+	switch status {
+	case JobExpired:
+		log.Info("job expired")
+		sh.metrics.RecordStaleShare(ctx)
+		return ShareRejectedStale, nil
+	case JobUnknown:
+		log.Warn("job was never issued")
+		sh.metrics.RecordWorkerError(ctx.WalletAddr, ErrMissingJob)
+		sh.metrics.RecordInvalidShare(ctx)
+		return ShareRejectedUnknownJob, nil
 	}
-	if err := sh.checkStales(ctx, submitInfo); err != nil {
+	log = log.With(zap.String("nonce", fmt.Sprintf("%x", nonce)))
+	log.With(zap.Uint64("bluescore", job.Block.Header.BlueScore)).Debug("share submitted")
+
+	age, err := sh.checkStales(spanCtx, ctx, job, nonce)
+	if err != nil {
 		if err == ErrDupeShare {
-			ctx.Logger.Info("dupe share "+submitInfo.noncestr, ctx.WorkerName, ctx.WalletAddr)
-			RecordDupeShare(ctx)
-			return ctx.ReplyDupeShare(event.Id)
+			log.Info("dupe share")
+			sh.metrics.RecordDupeShare(ctx)
+			return ShareRejectedDupe, nil
 		} else if errors.Is(err, ErrStaleShare) {
-			ctx.Logger.Info(err.Error(), ctx.WorkerName, ctx.WalletAddr)
-			RecordStaleShare(ctx)
-			return ctx.ReplyStaleShare(event.Id)
+			log.With(zap.Error(err)).Info("stale share")
+			sh.metrics.RecordStaleShare(ctx)
+			return ShareRejectedStale, nil
 		}
-		// unknown error somehow
-		ctx.Logger.Error("unknown error during check stales: ", err.Error())
-		return ctx.ReplyBadShare(event.Id)
+		return ShareRejectedStale, errors.Wrap(err, "unknown error during check stales")
 	}
 
-	converted, err := appmessage.RPCBlockToDomainBlock(submitInfo.block)
+	converted, err := appmessage.RPCBlockToDomainBlock(job.Block)
 	if err != nil {
-		return fmt.Errorf("failed to cast block to mutable block: %+v", err)
+		return ShareRejectedBlock, fmt.Errorf("failed to cast block to mutable block: %+v", err)
 	}
 	mutableHeader := converted.Header.ToMutable()
-	mutableHeader.SetNonce(submitInfo.nonceVal)
+	mutableHeader.SetNonce(nonce)
+	_, powSpan := sh.tracer.Start(spanCtx, "pow")
 	powState := pow.NewState(mutableHeader)
 	powValue := powState.CalculateProofOfWorkValue()
+	powSpan.End()
 
 	// The block hash must be less or equal than the claimed target.
 	if powValue.Cmp(&powState.Target) <= 0 {
-		return sh.submit(ctx, converted, submitInfo.nonceVal, event.Id)
+		return sh.submit(spanCtx, ctx, job, converted, nonce), nil
 	}
 	// remove for now until I can figure it out. No harm here as we're not
 	// } else if powValue.Cmp(fixedDifficultyBI) >= 0 {
 	// 	ctx.Logger.Warn("weak block")
-	// 	RecordWeakShare(ctx)
+	// 	sh.metrics.RecordWeakShare(ctx)
 	// 	return ctx.ReplyLowDiffShare(event.Id)
 	// }
-	RecordShareFound(ctx)
+	if age == ShareLate {
+		sh.metrics.RecordLateShare(ctx)
+		return ShareAcceptedLate, nil
+	}
+	sh.metrics.RecordShareFound(ctx)
+	return ShareAccepted, nil
+}
+
+// shareLogger is the miner's logger as the shares component, so per share
+// logs can be leveled and sampled separately from the connection logs
+func shareLogger(ctx *MinerContext) *zap.SugaredLogger {
+	return ctx.Logger.Named(LogShares).With(zap.String("wallet", ctx.WalletAddr), zap.String("worker", ctx.WorkerName))
+}
+
+func (sh *shareHandler) HandleSubmit(ctx *MinerContext, event gostratum.JsonRpcEvent) error {
+	spanCtx, span := sh.tracer.Start(ctx, "mining.submit",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(workerAttributes(ctx)...))
+	defer span.End()
+	submitInfo, err := sh.validateSubmit(spanCtx, ctx, event)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	result, err := sh.processShare(spanCtx, ctx, submitInfo.jobId, submitInfo.nonceVal)
+	if err != nil {
+		shareLogger(ctx).Error(err.Error())
+		return ctx.ReplyBadShare(event.Id)
+	}
 
+	switch result {
+	case ShareRejectedStale:
+		return ctx.ReplyStaleShare(event.Id)
+	case ShareRejectedDupe:
+		return ctx.ReplyDupeShare(event.Id)
+	case ShareRejectedUnknownJob, ShareRejectedBlock:
+		return ctx.ReplyBadShare(event.Id)
+	}
 	return ctx.Reply(gostratum.JsonRpcResponse{
 		Id:     event.Id,
 		Result: true,
 	})
 }
 
-func (sh *shareHandler) submit(ctx *gostratum.StratumContext,
-	block *externalapi.DomainBlock, nonce uint64, eventId any) error {
+// submit sends the solved block to kaspad and records the attempt along with
+// why kaspad rejected it, if it did
+func (sh *shareHandler) submit(spanCtx context.Context, ctx *MinerContext, job *jobEntry,
+	block *externalapi.DomainBlock, nonce uint64) ShareResult {
 	mutable := block.Header.ToMutable()
 	mutable.SetNonce(nonce)
-	_, err := sh.kaspa.SubmitBlock(&externalapi.DomainBlock{
+	submitted := &externalapi.DomainBlock{
 		Header:       mutable.ToImmutable(),
 		Transactions: block.Transactions,
-	})
-	// print after the submit to get it submitted faster
-	ctx.Logger.Info("submitted block to kaspad")
-	ctx.Logger.Info(fmt.Sprintf("Submitted nonce: %d", nonce))
+	}
+	_, span := sh.tracer.Start(spanCtx, "kaspad.SubmitBlock", trace.WithSpanKind(trace.SpanKindClient))
+	start := time.Now()
+	reason, err := sh.kaspa.SubmitBlock(submitted)
+	latency := time.Since(start)
+	result := classifySubmit(reason, err)
+	span.SetAttributes(attrBlockResult.String(string(result)))
+	endSpan(span, err)
+
+	// everything after the submit to get it submitted faster
+	hash := consensushashing.BlockHash(submitted).String()
+	record := blockSubmission{
+		Hash:            hash,
+		Wallet:          ctx.WalletAddr,
+		Worker:          ctx.WorkerName,
+		Mode:            ctx.State.mode,
+		DAAScore:        submitted.Header.DAAScore(),
+		BlueScore:       submitted.Header.BlueScore(),
+		Nonce:           nonce,
+		TemplateFetched: job.Fetched,
+		SubmittedAt:     start,
+		Latency:         latency,
+		Result:          result,
+		RejectReason:    reason,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	sh.metrics.RecordBlockSubmission(result, latency)
+	log := shareLogger(ctx).With(zap.String("hash", hash), zap.String("nonce", fmt.Sprintf("%x", nonce)),
+		zap.Uint64("daa_score", record.DAAScore), zap.Duration("template_age", start.Sub(job.Fetched)),
+		zap.Duration("latency", latency))
+	if sh.submissions != nil {
+		if err := sh.submissions.Record(record); err != nil {
+			log.With(zap.Error(err)).Error("failed recording block submission")
+		}
+	}
 
 	if err != nil {
 		// :'(
-		if strings.Contains(err.Error(), "ErrDuplicateBlock") {
-			ctx.Logger.Warn("block rejected, stale")
-			// stale
-			RecordStaleShare(ctx)
-			return ctx.ReplyStaleShare(eventId)
-		} else {
-			ctx.Logger.Warn("block rejected, unknown issue (probably bad pow")
-			RecordInvalidShare(ctx)
-			return ctx.ReplyBadShare(eventId)
+		log.With(zap.String("result", string(result)), zap.String("reject_reason", reason.String()), zap.Error(err)).
+			Warn("block rejected")
+		if result == BlockDuplicate || result == BlockStale {
+			sh.metrics.RecordStaleShare(ctx)
+			return ShareRejectedStale
 		}
+		sh.metrics.RecordInvalidShare(ctx)
+		return ShareRejectedBlock
 	}
 
 	// :)
-	ctx.Logger.Info("block accepted")
-	RecordBlockFound(ctx)
-	return ctx.Reply(gostratum.JsonRpcResponse{
-		Result: true,
+	log.Info("block accepted")
+	sh.metrics.RecordBlockFound(ctx)
+	sh.notifier.Notify(Event{
+		Kind:      EventBlockFound,
+		Wallet:    ctx.WalletAddr,
+		Worker:    ctx.WorkerName,
+		BlockHash: hash,
+		BlueScore: record.BlueScore,
 	})
+	return ShareBlockFound
 }
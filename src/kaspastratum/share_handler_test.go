@@ -13,22 +13,29 @@ import (
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
-var pg *pgx.Conn
+var pg *pgx.ConnPool
 var rd *redis.Client
 var logger *zap.SugaredLogger
 
 func TestMain(m *testing.M) {
-	logger, _ = configureZap(BridgeConfig{})
-	var err error
-	pg, err = pgx.Connect(pgx.ConnConfig{
-		Host:     "localhost",
-		Port:     5432,
-		User:     "postgres",
-		Password: "postgres",
-		Database: "kaspa-pool",
+	logs, err := newLogging(LogConfig{})
+	if err != nil {
+		panic(err)
+	}
+	logger = logs.Logger("")
+	pg, err = pgx.NewConnPool(pgx.ConnPoolConfig{
+		ConnConfig: pgx.ConnConfig{
+			Host:     "localhost",
+			Port:     5432,
+			User:     "postgres",
+			Password: "postgres",
+			Database: "kaspa-pool",
+		},
+		MaxConnections: 4,
 	})
 	if err != nil {
 		panic(err)
@@ -43,16 +50,19 @@ func TestMain(m *testing.M) {
 	}
 	rd.Del(context.Background(), "share_buffer")
 	defer pg.Close()
+	if err := migrateShares(pg); err != nil {
+		panic(err)
+	}
 	defer rd.Close()
 
 	m.Run()
 }
 
 type testContext struct {
-	ctx    *gostratum.StratumContext
-	conn   *gostratum.MockConnection
-	block  *appmessage.RPCBlock
-	jobIdx int
+	ctx   *MinerContext
+	conn  *gostratum.MockConnection
+	block *appmessage.RPCBlock
+	jobId string
 }
 
 func newTestContext(t *testing.T) *testContext {
@@ -67,21 +77,22 @@ func newTestContext(t *testing.T) *testContext {
 		t.Fatal(err)
 	}
 
-	state := GetMiningState(ctx)
-	jobIdx := state.AddJob(&appmessage.RPCBlock{
+	state := ctx.State
+	jobId := state.AddJob(&appmessage.RPCBlock{
 		Header: &header,
 	})
 
 	return &testContext{
-		ctx:    ctx,
-		conn:   conn,
-		block:  &appmessage.RPCBlock{Header: &header},
-		jobIdx: jobIdx,
+		ctx:   ctx,
+		conn:  conn,
+		block: &appmessage.RPCBlock{Header: &header},
+		jobId: jobId,
 	}
 }
 
 func TestShareLogging(t *testing.T) {
-	sh := newShareHandler(nil, rd, pg)
+	sh := newShareHandler(nil, newTipTracker(), StaleConfig{}, newMemoryDupeFilter(time.Minute), pg, testMetrics(t),
+		trace.NewNoopTracerProvider().Tracer(tracerName))
 	tc := newTestContext(t)
 
 	// Submit a good share, should be recorded and respond w/ no errors
@@ -96,7 +107,7 @@ func TestShareLogging(t *testing.T) {
 	})
 	nonce := time.Now().Unix()
 	err := sh.HandleSubmit(tc.ctx, gostratum.NewEvent("1", "mining.submit", []any{
-		"", fmt.Sprintf("%d", tc.jobIdx), fmt.Sprintf("%d", nonce),
+		"", tc.jobId, fmt.Sprintf("%d", nonce),
 	}))
 	if err != nil {
 		t.Fatalf("submit failed, should have allowed share submission")
@@ -113,7 +124,7 @@ func TestShareLogging(t *testing.T) {
 		}
 	})
 	err = sh.HandleSubmit(tc.ctx, gostratum.NewEvent("1", "mining.submit", []any{
-		"", fmt.Sprintf("%d", tc.jobIdx), fmt.Sprintf("%d", nonce),
+		"", tc.jobId, fmt.Sprintf("%d", nonce),
 	}))
 	if err != nil { // allow the submission but return error to the miner
 		t.Fatalf("submit failed, should have allowed share submission")
@@ -0,0 +1,286 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"github.com/onemorebsmith/kaspa-pool/src/stratumv2"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// sv2Handler plugs stratum v2 channels into the same job source and share
+// handler as the v1 listener. Every channel gets a detached StratumContext so
+// shares, metrics and job tracking work the same regardless of protocol
+type sv2Handler struct {
+	logger       *zap.SugaredLogger
+	kapi         *KaspaApi
+	shareHandler *shareHandler
+	jobs         jobSource
+	listener     *live[ListenerConfig]
+	channelLock  sync.RWMutex
+	channels     map[*stratumv2.Channel]struct{}
+	clients      *gostratum.ClientRegistry[*MiningState]
+	metrics      *Metrics
+	bans         *banList        // optional, see sessionAdmin
+	watchdog     *workerWatchdog // optional
+}
+
+func newSv2Handler(logger *zap.SugaredLogger, kapi *KaspaApi, shareHandler *shareHandler,
+	config ListenerConfig, poolWallet string, minJobInterval time.Duration, metrics *Metrics) *sv2Handler {
+	return &sv2Handler{
+		logger:       logger,
+		kapi:         kapi,
+		shareHandler: shareHandler,
+		listener:     newLive(config),
+		channels:     map[*stratumv2.Channel]struct{}{},
+		clients:      gostratum.NewClientRegistry[*MiningState](),
+		metrics:      metrics,
+		jobs: jobSource{
+			config:         config,
+			poolWallet:     poolWallet,
+			minJobInterval: newLive(minJobInterval),
+			metrics:        metrics,
+		},
+	}
+}
+
+func (h *sv2Handler) reload(lc ListenerConfig, minJobInterval time.Duration) {
+	h.listener.Store(lc)
+	h.jobs.minJobInterval.Store(minJobInterval)
+}
+
+// sv2Channel is what the handler keeps for every channel
+type sv2Channel struct {
+	ctx *MinerContext
+	// held while a job is built and sent, so the NewMiningJob/SetNewPrevHash
+	// pairs of two templates never interleave and jobs go out in the order
+	// they were issued
+	sendLock sync.Mutex
+	// sv2 job ids are only the sequence part of the job id, the full ids
+	// they were sent for are kept so a share for a job issued before an
+	// epoch roll still resolves to that job
+	idLock sync.Mutex
+	ids    map[uint32]string
+	sent   []uint32 // ids in the order they were sent
+}
+
+// remember maps the sv2 job id onto the full job id. Ids are kept for twice
+// the job window, so jobs the store just evicted are reported as stale rather
+// than unknown
+func (sc *sv2Channel) remember(seq uint32, id string) {
+	sc.idLock.Lock()
+	defer sc.idLock.Unlock()
+	sc.ids[seq] = id
+	sc.sent = append(sc.sent, seq)
+	if keep := 2 * sc.ctx.State.jobs.capacity; len(sc.sent) > keep {
+		for _, old := range sc.sent[:len(sc.sent)-keep] {
+			delete(sc.ids, old)
+		}
+		sc.sent = append([]uint32{}, sc.sent[len(sc.sent)-keep:]...)
+	}
+}
+
+// jobId is the full job id the sv2 job id was sent for, empty if unknown
+func (sc *sv2Channel) jobId(seq uint32) string {
+	sc.idLock.Lock()
+	defer sc.idLock.Unlock()
+	return sc.ids[seq]
+}
+
+func channelState(ch *stratumv2.Channel) *sv2Channel {
+	return ch.State.(*sv2Channel)
+}
+
+func channelContext(ch *stratumv2.Channel) *MinerContext {
+	return channelState(ch).ctx
+}
+
+// remoteHost trims the port off a connection's address, bans and sessions go
+// by the host the same as on the v1 listeners
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (h *sv2Handler) AllowConnection(remoteAddr string) bool {
+	return h.bans == nil || !h.bans.Banned(remoteHost(remoteAddr), time.Now())
+}
+
+func (h *sv2Handler) sessions() *gostratum.ClientRegistry[*MiningState] {
+	return h.clients
+}
+
+func (h *sv2Handler) port() string {
+	return h.listener.Load().Port
+}
+
+// channel finds the channel the session is on
+func (h *sv2Handler) channel(ctx *MinerContext) (*stratumv2.Channel, bool) {
+	h.channelLock.RLock()
+	defer h.channelLock.RUnlock()
+	for ch := range h.channels {
+		if channelContext(ch) == ctx {
+			return ch, true
+		}
+	}
+	return nil, false
+}
+
+func (h *sv2Handler) disconnect(ctx *MinerContext) {
+	if ch, exists := h.channel(ctx); exists {
+		ch.Close()
+	}
+}
+
+func (h *sv2Handler) sendDifficulty(ctx *MinerContext, diff float64) error {
+	ch, exists := h.channel(ctx)
+	if !exists {
+		return gostratum.ErrorDisconnected
+	}
+	ctx.State.setDifficulty(diff)
+	return ch.SetTarget(DifficultyToTarget(diff))
+}
+
+func (h *sv2Handler) OpenChannel(ch *stratumv2.Channel) error {
+	// same `wallet.worker` convention as mining.authorize
+	parts := strings.Split(ch.UserIdentity, ".")
+	if parts[0] == "" {
+		return fmt.Errorf("missing wallet address in user identity")
+	}
+	ctx := gostratum.NewDetachedContext(context.Background(), ch.Logger,
+		remoteHost(ch.RemoteAddr), ch.Setup.Vendor, ListenerStateGenerator(h.listener.Load())())
+	ctx.WalletAddr = parts[0]
+	if len(parts) >= 2 {
+		ctx.WorkerName = parts[1]
+	}
+	ch.State = &sv2Channel{ctx: ctx, ids: map[uint32]string{}}
+	ch.Target = DifficultyToTarget(ctx.State.Difficulty())
+	return nil
+}
+
+func (h *sv2Handler) ChannelOpened(ch *stratumv2.Channel) {
+	h.channelLock.Lock()
+	h.channels[ch] = struct{}{}
+	h.channelLock.Unlock()
+	h.clients.Add(channelContext(ch))
+	// no need to wait for the next template, the wallet is known up front
+	go h.sendJob(h.kapi, ch)
+}
+
+func (h *sv2Handler) CloseChannel(ch *stratumv2.Channel) {
+	h.channelLock.Lock()
+	delete(h.channels, ch)
+	h.channelLock.Unlock()
+	ctx := channelContext(ch)
+	h.clients.Remove(ctx)
+	// stops anything still in flight for the channel
+	ctx.Disconnect()
+	h.metrics.RecordDisconnect(ctx)
+	h.watchdog.Disconnected(ctx)
+}
+
+// SubmitShare validates a share. Kaspa jobs carry the template timestamp so
+// NTime is ignored, the share is checked against the job as it was issued
+func (h *sv2Handler) SubmitShare(ch *stratumv2.Channel, share *stratumv2.SubmitSharesStandard) error {
+	ctx := channelContext(ch)
+	spanCtx, span := h.shareHandler.tracer.Start(ctx, "SubmitSharesStandard",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(workerAttributes(ctx)...))
+	defer span.End()
+	jobId := channelState(ch).jobId(share.JobId)
+	result, err := h.shareHandler.processShare(spanCtx, ctx, jobId, share.Nonce)
+	if err != nil {
+		return err
+	}
+	switch result {
+	case ShareRejectedStale:
+		return &stratumv2.ShareError{Code: stratumv2.ErrCodeStaleShare}
+	case ShareRejectedDupe:
+		return &stratumv2.ShareError{Code: stratumv2.ErrCodeDuplicateShare}
+	case ShareRejectedUnknownJob:
+		return &stratumv2.ShareError{Code: stratumv2.ErrCodeInvalidJobId}
+	case ShareRejectedBlock:
+		return &stratumv2.ShareError{Code: stratumv2.ErrCodeInvalidShare}
+	}
+	return nil
+}
+
+func (h *sv2Handler) NewBlockAvailable(kapi *KaspaApi) {
+	h.channelLock.RLock()
+	defer h.channelLock.RUnlock()
+	for ch := range h.channels {
+		go h.sendJob(kapi, ch)
+	}
+}
+
+func (h *sv2Handler) sendJob(templates templateSource, ch *stratumv2.Channel) {
+	state := channelState(ch)
+	state.sendLock.Lock()
+	defer state.sendLock.Unlock()
+	ctx := state.ctx
+	job, err := h.jobs.nextJob(templates, ctx)
+	if err != nil {
+		ctx.Logger.Error(err.Error())
+		return
+	}
+	if job == nil {
+		return // nothing new for this miner
+	}
+	newJob, prevHash, err := encodeSv2Job(job)
+	if err != nil {
+		h.metrics.RecordWorkerError(ctx.WalletAddr, ErrFailedSendWork)
+		ctx.Logger.Error(err.Error())
+		return
+	}
+	state.remember(newJob.JobId, job.Id)
+	if err := ch.SendJob(newJob, prevHash); err != nil {
+		h.metrics.RecordWorkerError(ctx.WalletAddr, ErrFailedSendWork)
+		ctx.Logger.Error(errors.Wrap(err, "failed sending work packet").Error())
+		return
+	}
+	ctx.Logger.Debug(fmt.Sprintf("sent job %s, clean: %t", job.Id, job.Clean))
+	h.metrics.RecordNewJob(ctx)
+}
+
+// encodeSv2Job maps a kaspa job onto the sv2 messages. The pre-pow header hash
+// takes the place of the merkle root and the sequence part of the job id is
+// the numeric sv2 job id. Clean jobs come with a SetNewPrevHash so the miner
+// drops its previous work
+func encodeSv2Job(job *preparedJob) (stratumv2.NewMiningJob, *stratumv2.SetNewPrevHash, error) {
+	_, seq, ok := parseJobId(job.Id)
+	if !ok {
+		return stratumv2.NewMiningJob{}, nil, fmt.Errorf("malformed job id %s", job.Id)
+	}
+	header := job.Block.Header
+	newJob := stratumv2.NewMiningJob{
+		JobId:     seq,
+		Version:   uint32(header.Version),
+		Timestamp: uint64(header.Timestamp),
+	}
+	copy(newJob.MerkleRoot[:], job.Header)
+	if !job.Clean {
+		return newJob, nil, nil
+	}
+
+	prevHash := &stratumv2.SetNewPrevHash{
+		MinNTime: uint64(header.Timestamp),
+		NBits:    header.Bits,
+	}
+	if len(header.Parents) > 0 && len(header.Parents[0].ParentHashes) > 0 {
+		parent, err := hex.DecodeString(header.Parents[0].ParentHashes[0])
+		if err != nil {
+			return newJob, nil, errors.Wrap(err, "malformed parent hash in template")
+		}
+		copy(prevHash.PrevHash[:], parent)
+	}
+	return newJob, prevHash, nil
+}
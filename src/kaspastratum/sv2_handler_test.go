@@ -0,0 +1,125 @@
+package kaspastratum
+
+import (
+	"context"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"github.com/onemorebsmith/kaspa-pool/src/stratumv2"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestDifficultyToTarget(t *testing.T) {
+	for _, tc := range []struct {
+		diff     float64
+		expected *big.Int
+	}{
+		{fixedDifficulty, fixedDifficultyBI},
+		{1, new(big.Int).Lsh(big.NewInt(1), 224)},
+		{0.5, new(big.Int).Lsh(big.NewInt(1), 225)},
+	} {
+		target := DifficultyToTarget(tc.diff)
+		// sv2 targets are little endian
+		be := make([]byte, 32)
+		for i, b := range target {
+			be[31-i] = b
+		}
+		if actual := new(big.Int).SetBytes(be); actual.Cmp(tc.expected) != 0 {
+			t.Errorf("diff %f: expected target %x, got %x", tc.diff, tc.expected, actual)
+		}
+	}
+	if DifficultyToTarget(0) != [32]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff} {
+		t.Errorf("expected zero difficulty to accept everything")
+	}
+}
+
+func TestEncodeSv2Job(t *testing.T) {
+	block := testJob(100)
+	block.Header.Timestamp = 1662696346000
+	block.Header.Bits = 453325233
+	block.Header.Parents = []*appmessage.RPCBlockLevelParents{
+		{ParentHashes: []string{"0102030000000000000000000000000000000000000000000000000000000000"}},
+	}
+	header := make([]byte, 32)
+	header[0] = 0xaa
+	store := newJobStore(maxjobs, defaultJobMaxAge)
+
+	job := &preparedJob{Id: store.Add(block), Block: block, Header: header, Clean: true}
+	newJob, prevHash, err := encodeSv2Job(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newJob.JobId != 1 || newJob.MerkleRoot[0] != 0xaa || newJob.Timestamp != 1662696346000 {
+		t.Errorf("unexpected job %+v", newJob)
+	}
+	if prevHash == nil || prevHash.PrevHash[2] != 0x03 || prevHash.NBits != 453325233 {
+		t.Fatalf("expected clean job to come with the parent hash, got %+v", prevHash)
+	}
+	job = &preparedJob{Id: store.Add(block), Block: block, Header: header}
+	if newJob, prevHash, err = encodeSv2Job(job); err != nil {
+		t.Fatal(err)
+	}
+	if newJob.JobId != 2 || prevHash != nil {
+		t.Errorf("expected job 2 without a prev hash, got %+v %+v", newJob, prevHash)
+	}
+}
+
+func TestSv2JobIdsAcrossEpochRoll(t *testing.T) {
+	sh := newShareHandler(nil, newTipTracker(), StaleConfig{}, newMemoryDupeFilter(time.Minute), nil, testMetrics(t),
+		trace.NewNoopTracerProvider().Tracer(tracerName))
+	h := newSv2Handler(logger, nil, sh, ListenerConfig{Mode: MiningModePool, JobWindow: 4}, "", 0, testMetrics(t))
+	ctx, _ := gostratum.NewMockContext(context.Background(), logger,
+		ListenerStateGenerator(ListenerConfig{Mode: MiningModePool, JobWindow: 4})())
+	ctx.WalletAddr = "kaspa:one"
+	state := &sv2Channel{ctx: ctx, ids: map[uint32]string{}}
+	ch := &stratumv2.Channel{State: state}
+
+	issue := func(block *appmessage.RPCBlock) (uint32, string) {
+		job := &preparedJob{Id: ctx.State.AddJob(block), Block: block, Header: make([]byte, 32)}
+		newJob, _, err := encodeSv2Job(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.remember(newJob.JobId, job.Id)
+		return newJob.JobId, job.Id
+	}
+	ctx.State.jobs.seq = math.MaxUint32 - 1
+	ctx.State.jobs.oldest = ctx.State.jobs.seq + 1
+	beforeSeq, before := issue(testJob(1))
+	afterSeq, after := issue(testJob(2))
+	if beforeSeq != math.MaxUint32 || afterSeq != 1 {
+		t.Fatalf("expected the sequence to roll over, got %d then %d", beforeSeq, afterSeq)
+	}
+	if state.jobId(beforeSeq) != before || state.jobId(afterSeq) != after {
+		t.Fatalf("sv2 job ids don't map back to the jobs they were sent for")
+	}
+
+	for _, tc := range []struct {
+		desc     string
+		seq      uint32
+		expected string
+	}{
+		// evicted by the roll, but it was a real job so the share is stale
+		{"job from before the roll", beforeSeq, stratumv2.ErrCodeStaleShare},
+		{"job never sent", 7, stratumv2.ErrCodeInvalidJobId},
+	} {
+		err := h.SubmitShare(ch, &stratumv2.SubmitSharesStandard{JobId: tc.seq, Nonce: 1})
+		if se, ok := err.(*stratumv2.ShareError); !ok || se.Code != tc.expected {
+			t.Errorf("%s: expected %s, got %v", tc.desc, tc.expected, err)
+		}
+	}
+
+	// ids are forgotten once the job window has long moved past them
+	for i := 0; i < 8; i++ {
+		issue(testJob(uint64(3 + i)))
+	}
+	if state.jobId(afterSeq) != "" || len(state.ids) != 8 {
+		t.Errorf("expected only the last 8 sv2 job ids to be kept, got %d", len(state.ids))
+	}
+}
@@ -0,0 +1,73 @@
+package kaspastratum
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+// templateFingerprint identifies the work contained in a block template. The
+// serialized header hash excludes timestamp and nonce, so two templates that
+// only differ by timestamp produce the same fingerprint
+type templateFingerprint struct {
+	parents    string
+	merkleRoot string
+	daaScore   uint64
+	header     string
+}
+
+func fingerprintTemplate(block *appmessage.RPCBlock, serializedHeader []byte) templateFingerprint {
+	parents := strings.Builder{}
+	for _, level := range block.Header.Parents {
+		for _, hash := range level.ParentHashes {
+			parents.WriteString(hash)
+		}
+		parents.WriteByte('|')
+	}
+	return templateFingerprint{
+		parents:    parents.String(),
+		merkleRoot: block.Header.HashMerkleRoot,
+		daaScore:   block.Header.DAAScore,
+		header:     hex.EncodeToString(serializedHeader),
+	}
+}
+
+// templateTracker decides whether a freshly fetched template is worth sending
+// to a miner. Sending a job for every poll churns the miner's work and evicts
+// jobs that are still being hashed, so only real changes produce new jobs
+type templateTracker struct {
+	lock        sync.Mutex
+	last        templateFingerprint
+	lastJobTime time.Time
+	hasJob      bool
+}
+
+// shouldSendJob reports whether a job built from the template should be sent
+// and whether it is a clean job. A clean job means the parents changed, so all
+// previously issued work builds on an old tip and the miner must switch right
+// away; those are always sent. Changes that keep the parents (new transactions,
+// DAA score bumps) only refresh the job and are limited to one per minInterval
+func (tt *templateTracker) shouldSendJob(fp templateFingerprint, now time.Time,
+	minInterval time.Duration) (send bool, clean bool) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+
+	switch {
+	case !tt.hasJob:
+		clean = true
+	case fp == tt.last:
+		return false, false
+	case fp.parents != tt.last.parents:
+		clean = true
+	case now.Sub(tt.lastJobTime) < minInterval:
+		return false, false
+	}
+
+	tt.last = fp
+	tt.lastJobTime = now
+	tt.hasJob = true
+	return true, clean
+}
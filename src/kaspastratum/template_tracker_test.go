@@ -0,0 +1,35 @@
+package kaspastratum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTemplateTracker(t *testing.T) {
+	tt := templateTracker{}
+	now := time.Now()
+	base := templateFingerprint{parents: "a|", merkleRoot: "m1", daaScore: 1, header: "h1"}
+
+	check := func(desc string, fp templateFingerprint, at time.Time, expectSend, expectClean bool) {
+		send, clean := tt.shouldSendJob(fp, at, time.Second)
+		if send != expectSend || clean != expectClean {
+			t.Fatalf("%s: expected send=%t clean=%t, got send=%t clean=%t",
+				desc, expectSend, expectClean, send, clean)
+		}
+	}
+
+	check("first job", base, now, true, true)
+	check("unchanged template", base, now.Add(10*time.Millisecond), false, false)
+
+	refreshed := base
+	refreshed.merkleRoot = "m2"
+	refreshed.header = "h2"
+	check("refresh inside interval", refreshed, now.Add(500*time.Millisecond), false, false)
+	check("refresh after interval", refreshed, now.Add(1500*time.Millisecond), true, false)
+
+	newTip := refreshed
+	newTip.parents = "b|"
+	newTip.daaScore = 2
+	newTip.header = "h3"
+	check("new tip inside interval", newTip, now.Add(1600*time.Millisecond), true, true)
+}
@@ -0,0 +1,145 @@
+package kaspastratum
+
+import (
+	"sync"
+	"time"
+)
+
+// ShareAge classifies a share by how far the job it was mined on is behind
+// the current DAG tip
+type ShareAge int
+
+const (
+	// ShareCurrent is built on the latest known tip
+	ShareCurrent ShareAge = iota
+	// ShareLate is behind the tip but inside the grace window. It is still
+	// credited to the miner but tracked separately from current shares
+	ShareLate
+	// ShareTooOld is outside the grace window and rejected as stale
+	ShareTooOld
+)
+
+func (sa ShareAge) String() string {
+	switch sa {
+	case ShareCurrent:
+		return "current"
+	case ShareLate:
+		return "late"
+	default:
+		return "too_old"
+	}
+}
+
+type StaleConfig struct {
+	// how many blue scores a job may trail the tip by and still be accepted
+	BlueScoreGrace uint64 `yaml:"bluescore_grace"`
+	// how many DAA scores a job may trail the virtual DAA score of the latest
+	// template by. The DAA score also counts red blocks, so it runs ahead of
+	// the blue score
+	DAAScoreGrace uint64 `yaml:"daascore_grace"`
+	// how long after the tip moved past a job it may still be accepted
+	TimeGrace time.Duration `yaml:"time_grace"`
+}
+
+const defaultBlueScoreGrace = 8
+const defaultDAAScoreGrace = 2 * defaultBlueScoreGrace
+const defaultTimeGrace = 10 * time.Second
+
+func (sc StaleConfig) withDefaults() StaleConfig {
+	if sc.BlueScoreGrace == 0 {
+		sc.BlueScoreGrace = defaultBlueScoreGrace
+	}
+	if sc.DAAScoreGrace == 0 {
+		sc.DAAScoreGrace = defaultDAAScoreGrace
+	}
+	if sc.TimeGrace == 0 {
+		sc.TimeGrace = defaultTimeGrace
+	}
+	return sc
+}
+
+type tipAdvance struct {
+	blueScore uint64
+	seen      time.Time
+}
+
+// max number of tip advances remembered, anything older than this is too old
+// regardless of the configured grace
+const maxTipHistory = 256
+
+// tipTracker follows the DAG tip as seen in block templates fetched from
+// kaspad, and remembers when the tip advanced so share age can be measured in
+// both blue score and wall-clock time
+type tipTracker struct {
+	lock    sync.RWMutex
+	history []tipAdvance // ascending by blue score
+	daa     uint64
+}
+
+func newTipTracker() *tipTracker {
+	return &tipTracker{
+		history: make([]tipAdvance, 0, maxTipHistory),
+	}
+}
+
+// Update records a template's blue and DAA score. Scores only move forward,
+// templates trailing the known tip are ignored
+func (tt *tipTracker) Update(blueScore, daaScore uint64, now time.Time) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	if daaScore > tt.daa {
+		tt.daa = daaScore
+	}
+	if len(tt.history) > 0 && tt.history[len(tt.history)-1].blueScore >= blueScore {
+		return
+	}
+	if len(tt.history) == maxTipHistory {
+		copy(tt.history, tt.history[1:])
+		tt.history = tt.history[:len(tt.history)-1]
+	}
+	tt.history = append(tt.history, tipAdvance{blueScore: blueScore, seen: now})
+}
+
+// Tip returns the latest known blue and DAA score
+func (tt *tipTracker) Tip() (blueScore uint64, daaScore uint64) {
+	tt.lock.RLock()
+	defer tt.lock.RUnlock()
+	if len(tt.history) == 0 {
+		return 0, tt.daa
+	}
+	return tt.history[len(tt.history)-1].blueScore, tt.daa
+}
+
+// Classify determines the age of a share mined on a job with the given blue
+// and DAA score. A job too far behind the virtual DAA score is too old no
+// matter its blue score, kaspad would reject a block built on it. The
+// wall-clock grace is measured from the moment the tip first moved past the
+// job, not from when the job was issued, so a job that stays current for a
+// long time is never penalized
+func (tt *tipTracker) Classify(jobBlueScore, jobDAAScore uint64, now time.Time, cfg StaleConfig) ShareAge {
+	tt.lock.RLock()
+	defer tt.lock.RUnlock()
+	if tt.daa > jobDAAScore && tt.daa-jobDAAScore > cfg.DAAScoreGrace {
+		return ShareTooOld
+	}
+	if len(tt.history) == 0 {
+		return ShareCurrent // nothing known yet, nothing to compare against
+	}
+	tip := tt.history[len(tt.history)-1].blueScore
+	if jobBlueScore >= tip {
+		return ShareCurrent
+	}
+	if tip-jobBlueScore > cfg.BlueScoreGrace {
+		return ShareTooOld
+	}
+	// find the first advance that superseded the job
+	for _, adv := range tt.history {
+		if adv.blueScore > jobBlueScore {
+			if now.Sub(adv.seen) > cfg.TimeGrace {
+				return ShareTooOld
+			}
+			return ShareLate
+		}
+	}
+	return ShareTooOld
+}
@@ -0,0 +1,74 @@
+package kaspastratum
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTipTrackerClassify(t *testing.T) {
+	cfg := StaleConfig{BlueScoreGrace: 4, DAAScoreGrace: 10, TimeGrace: 5 * time.Second}
+	tt := newTipTracker()
+	start := time.Now()
+
+	if age := tt.Classify(1, 1, start, cfg); age != ShareCurrent {
+		t.Fatalf("expected shares to be current before any tip is known, got %s", age)
+	}
+
+	// tip advances by one every second
+	for i := uint64(100); i <= 110; i++ {
+		tt.Update(i, i*2, start.Add(time.Duration(i-100)*time.Second))
+	}
+	// older templates must not move the tip backwards
+	tt.Update(50, 100, start.Add(20*time.Second))
+	if blue, daa := tt.Tip(); blue != 110 || daa != 220 {
+		t.Fatalf("unexpected tip %d/%d", blue, daa)
+	}
+
+	now := start.Add(10 * time.Second)
+	for _, tc := range []struct {
+		desc     string
+		score    uint64
+		daa      uint64
+		now      time.Time
+		expected ShareAge
+	}{
+		{"on the tip", 110, 220, now, ShareCurrent},
+		{"ahead of the tip", 111, 222, now, ShareCurrent},
+		{"one behind", 109, 218, now, ShareLate},
+		{"at the blue score grace", 106, 212, now, ShareLate},
+		{"past the blue score grace", 105, 210, now, ShareTooOld},
+		// the DAA score also counts red blocks, it can fall behind on its own
+		{"at the daa score grace", 110, 210, now, ShareCurrent},
+		{"past the daa score grace", 110, 209, now, ShareTooOld},
+		{"late and past the daa score grace", 109, 209, now, ShareTooOld},
+		// 109 was superseded at +10s, so 5s of grace runs out at +15s
+		{"inside the time grace", 109, 218, start.Add(15 * time.Second), ShareLate},
+		{"past the time grace", 109, 218, start.Add(16 * time.Second), ShareTooOld},
+		{"before history", 10, 20, now, ShareTooOld},
+	} {
+		if age := tt.Classify(tc.score, tc.daa, tc.now, cfg); age != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.desc, tc.expected, age)
+		}
+	}
+}
+
+func TestTipTrackerConcurrentAccess(t *testing.T) {
+	cfg := StaleConfig{}.withDefaults()
+	tt := newTipTracker()
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < maxTipHistory*2; i++ {
+				tt.Update(uint64(i), uint64(i), time.Now())
+				tt.Classify(uint64(i-w), uint64(i-w), time.Now(), cfg)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if blue, _ := tt.Tip(); blue != maxTipHistory*2-1 {
+		t.Fatalf("unexpected tip %d", blue)
+	}
+}
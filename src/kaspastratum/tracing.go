@@ -0,0 +1,89 @@
+package kaspastratum
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/onemorebsmith/kaspa-pool/src/kaspastratum"
+
+// TracingConfig exports OpenTelemetry spans of the share and block submission
+// path. Tracing is a no-op unless an endpoint is set
+type TracingConfig struct {
+	// OTLPEndpoint is the host:port of an OTLP/HTTP collector
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+	// Insecure sends spans over plain http
+	Insecure bool `yaml:"insecure"`
+	// SampleRatio is the fraction of submits traced, defaults to all of them
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func (cfg TracingConfig) validate() error {
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// newTracerProvider returns the provider spans are created from, along with a
+// shutdown func that flushes anything not exported yet
+func newTracerProvider(cfg TracingConfig) (trace.TracerProvider, func(context.Context) error, error) {
+	if cfg.OTLPEndpoint == "" {
+		return trace.NewNoopTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("kaspa-stratum-bridge"),
+			semconv.ServiceVersionKey.String(version))),
+	)
+	return provider, provider.Shutdown, nil
+}
+
+var (
+	attrWallet      = attribute.Key("kaspa.wallet")
+	attrWorker      = attribute.Key("kaspa.worker")
+	attrJobId       = attribute.Key("kaspa.job_id")
+	attrResult      = attribute.Key("kaspa.share_result")
+	attrBlockResult = attribute.Key("kaspa.block_result")
+)
+
+func workerAttributes(ctx *MinerContext) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attrWallet.String(ctx.WalletAddr),
+		attrWorker.String(ctx.WorkerName),
+	}
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,146 @@
+package kaspastratum
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTracedShareHandler(t *testing.T) (*shareHandler, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return newShareHandler(nil, newTipTracker(), StaleConfig{}, newMemoryDupeFilter(time.Minute), pg,
+		testMetrics(t), provider.Tracer(tracerName)), recorder
+}
+
+// spanPaths flattens the recorded spans into sorted `parent/child` paths
+func spanPaths(recorder *tracetest.SpanRecorder) []string {
+	spans := recorder.Ended()
+	byId := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range spans {
+		byId[s.SpanContext().SpanID().String()] = s
+	}
+	paths := []string{}
+	for _, s := range spans {
+		path := s.Name()
+		for parent, ok := byId[s.Parent().SpanID().String()]; ok; parent, ok = byId[parent.Parent().SpanID().String()] {
+			path = parent.Name() + "/" + path
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func findSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, s := range recorder.Ended() {
+		if s.Name() == name {
+			return s
+		}
+	}
+	t.Fatalf("no span named %s", name)
+	return nil
+}
+
+func spanAttribute(s sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTraceMalformedSubmit(t *testing.T) {
+	sh, recorder := newTracedShareHandler(t)
+	tc := newTestContext(t)
+	if err := sh.HandleSubmit(tc.ctx, gostratum.NewEvent("1", "mining.submit", []any{
+		"", tc.jobId, "not a nonce",
+	})); err == nil {
+		t.Fatal("expected malformed nonce to be rejected")
+	}
+
+	expected := []string{"mining.submit", "mining.submit/validateSubmit"}
+	if d := cmp.Diff(expected, spanPaths(recorder)); d != "" {
+		t.Fatalf("unexpected spans: %s", d)
+	}
+	validate := findSpan(t, recorder, "validateSubmit")
+	if validate.Status().Code != codes.Error {
+		t.Errorf("expected validateSubmit to be marked failed, got %s", validate.Status().Code)
+	}
+	root := findSpan(t, recorder, "mining.submit")
+	if actual := spanAttribute(root, attrWallet); actual != tc.ctx.WalletAddr {
+		t.Errorf("expected wallet %s on the root span, got '%s'", tc.ctx.WalletAddr, actual)
+	}
+	if actual := spanAttribute(root, attrWorker); actual != tc.ctx.WorkerName {
+		t.Errorf("expected worker %s on the root span, got '%s'", tc.ctx.WorkerName, actual)
+	}
+}
+
+func TestTraceUnknownJob(t *testing.T) {
+	sh, recorder := newTracedShareHandler(t)
+	tc := newTestContext(t)
+	tc.conn.AsyncReadTestDataFromBuffer(func(b []byte) {})
+	if err := sh.HandleSubmit(tc.ctx, gostratum.NewEvent("1", "mining.submit", []any{
+		"", "ffff", "1",
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"mining.submit", "mining.submit/processShare", "mining.submit/validateSubmit"}
+	if d := cmp.Diff(expected, spanPaths(recorder)); d != "" {
+		t.Fatalf("unexpected spans: %s", d)
+	}
+	process := findSpan(t, recorder, "processShare")
+	if actual := spanAttribute(process, attrJobId); actual != "ffff" {
+		t.Errorf("expected job id ffff on processShare, got '%s'", actual)
+	}
+	if actual := spanAttribute(process, attrResult); actual != ShareRejectedUnknownJob.String() {
+		t.Errorf("expected result %s, got '%s'", ShareRejectedUnknownJob, actual)
+	}
+}
+
+func TestTraceAcceptedShare(t *testing.T) {
+	sh, recorder := newTracedShareHandler(t)
+	tc := newTestContext(t)
+	tc.conn.AsyncReadTestDataFromBuffer(func(b []byte) {})
+	nonce := fmt.Sprintf("%x", time.Now().UnixNano())
+	if err := sh.HandleSubmit(tc.ctx, gostratum.NewEvent("1", "mining.submit", []any{
+		"", tc.jobId, nonce,
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"mining.submit",
+		"mining.submit/processShare",
+		"mining.submit/processShare/db.insertShare",
+		"mining.submit/processShare/dupeCheck",
+		"mining.submit/processShare/pow",
+		"mining.submit/validateSubmit",
+	}
+	if d := cmp.Diff(expected, spanPaths(recorder)); d != "" {
+		t.Fatalf("unexpected spans: %s", d)
+	}
+	process := findSpan(t, recorder, "processShare")
+	if actual := spanAttribute(process, attrResult); actual != ShareAccepted.String() {
+		t.Errorf("expected result %s, got '%s'", ShareAccepted, actual)
+	}
+	for _, s := range recorder.Ended() {
+		if s.Status().Code == codes.Error {
+			t.Errorf("unexpected error on span %s: %s", s.Name(), s.Status().Description)
+		}
+		if !strings.HasPrefix(s.InstrumentationLibrary().Name, tracerName) {
+			t.Errorf("span %s created by unexpected tracer %s", s.Name(), s.InstrumentationLibrary().Name)
+		}
+	}
+}
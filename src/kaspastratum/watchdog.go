@@ -0,0 +1,288 @@
+package kaspastratum
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type WatchdogConfig struct {
+	// OfflineAfter is how long a worker may go without submitting a share
+	// before its wallet's subscribers are alerted, unless their subscription
+	// sets its own threshold. 15m if 0
+	OfflineAfter time.Duration `yaml:"offline_after"`
+	// CheckInterval is how often workers are checked, 30s if 0
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// SMTP sends email alerts, subscriptions can only use webhooks without it
+	SMTP SMTPConfig `yaml:"smtp"`
+}
+
+const (
+	defaultOfflineAfter  = 15 * time.Minute
+	defaultWatchdogCheck = 30 * time.Second
+	// a worker is never considered offline before missing this many of its
+	// usual shares, so slow rigs on a high difficulty don't flap
+	offlineShareIntervals = 5
+	// longest threshold a subscription may set
+	maxOfflineAfter = 24 * time.Hour
+	// workers silent for this long are forgotten
+	workerForgetAfter = 7 * 24 * time.Hour
+)
+
+func (cfg WatchdogConfig) withDefaults() WatchdogConfig {
+	if cfg.OfflineAfter == 0 {
+		cfg.OfflineAfter = defaultOfflineAfter
+	}
+	if cfg.CheckInterval == 0 {
+		cfg.CheckInterval = defaultWatchdogCheck
+	}
+	return cfg
+}
+
+func (cfg WatchdogConfig) validate() error {
+	if cfg.OfflineAfter < 0 || cfg.OfflineAfter > maxOfflineAfter {
+		return fmt.Errorf("offline_after must be between 0 and %s", maxOfflineAfter)
+	}
+	if cfg.CheckInterval < 0 {
+		return fmt.Errorf("check_interval must be positive")
+	}
+	if err := cfg.SMTP.validate(); err != nil {
+		return fmt.Errorf("smtp: %s", err)
+	}
+	return nil
+}
+
+// workerActivity is what the watchdog knows of one wallet.worker
+type workerActivity struct {
+	wallet      string
+	worker      string
+	sessions    map[uint64]bool // connected sessions that submitted shares
+	lastShare   time.Time
+	avgInterval time.Duration // moving average of the time between shares
+	alerted     bool          // offline alert sent, cleared by the next share
+}
+
+// workerStatus is a worker as reported by the admin api
+type workerStatus struct {
+	Wallet                string    `json:"wallet"`
+	Worker                string    `json:"worker"`
+	Connected             bool      `json:"connected"`
+	LastShare             time.Time `json:"last_share"`
+	ExpectedShareInterval float64   `json:"expected_share_interval_seconds"`
+	Offline               bool      `json:"offline"`
+}
+
+// workerWatchdog tracks when every wallet.worker last submitted a share and
+// alerts the wallet's subscribers once a worker has been silent for longer
+// than its threshold, and again once it's back. Workers are only known from
+// their shares, so a rig that never comes back after a bridge restart goes
+// unnoticed
+type workerWatchdog struct {
+	lock      sync.Mutex
+	storeLock sync.Mutex // orders subscription writes, see Subscribe
+	logger    *zap.SugaredLogger
+	cfg       WatchdogConfig
+	notifier  *Notifier
+	store     subscriptionStore
+	sendMail  sendMailFunc
+	ctx       context.Context // alerts are delivered until it's cancelled
+	subs      map[string]AlertSubscription
+	workers   map[string]*workerActivity
+}
+
+func newWorkerWatchdog(cfg WatchdogConfig, logger *zap.SugaredLogger, notifier *Notifier,
+	store subscriptionStore) (*workerWatchdog, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	subs, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	wd := &workerWatchdog{
+		logger:   logger,
+		cfg:      cfg.withDefaults(),
+		notifier: notifier,
+		store:    store,
+		sendMail: smtp.SendMail,
+		ctx:      context.Background(),
+		subs:     map[string]AlertSubscription{},
+		workers:  map[string]*workerActivity{},
+	}
+	for _, sub := range subs {
+		wd.subs[sub.Wallet] = sub
+	}
+	return wd, nil
+}
+
+// Start checks for offline workers until the context is cancelled
+func (wd *workerWatchdog) Start(ctx context.Context) {
+	wd.lock.Lock()
+	wd.ctx = ctx
+	wd.lock.Unlock()
+	go func() {
+		ticker := time.NewTicker(wd.cfg.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				wd.check(now)
+			}
+		}
+	}()
+}
+
+func workerKey(wallet, worker string) string {
+	return wallet + "." + worker
+}
+
+// Share records a submit from the miner, accepted or not, as a sign of life
+func (wd *workerWatchdog) Share(ctx *MinerContext, at time.Time) {
+	if wd == nil || ctx.WalletAddr == "" {
+		return
+	}
+	wd.lock.Lock()
+	key := workerKey(ctx.WalletAddr, ctx.WorkerName)
+	w, exists := wd.workers[key]
+	if !exists {
+		w = &workerActivity{wallet: ctx.WalletAddr, worker: ctx.WorkerName, sessions: map[uint64]bool{}}
+		wd.workers[key] = w
+	} else if !w.alerted {
+		// the gap of an outage says nothing about the worker's share rate
+		interval := at.Sub(w.lastShare)
+		if w.avgInterval == 0 {
+			w.avgInterval = interval
+		} else {
+			w.avgInterval += (interval - w.avgInterval) / 5
+		}
+	}
+	w.sessions[ctx.SessionId()] = true
+	w.lastShare = at
+	recovered := w.alerted
+	w.alerted = false
+	sub, subscribed := wd.subs[w.wallet]
+	wd.lock.Unlock()
+
+	if recovered && subscribed {
+		wd.alert(sub, Event{Kind: EventWorkerOnline, Time: at, Wallet: w.wallet, Worker: w.worker})
+	}
+}
+
+// Disconnected drops the miner's session from its worker
+func (wd *workerWatchdog) Disconnected(ctx *MinerContext) {
+	if wd == nil || ctx.WalletAddr == "" {
+		return
+	}
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+	if w, exists := wd.workers[workerKey(ctx.WalletAddr, ctx.WorkerName)]; exists {
+		delete(w.sessions, ctx.SessionId())
+	}
+}
+
+// threshold is how long the worker may stay silent, the subscription's or
+// the configured one but never less than a few of its usual share intervals
+func (wd *workerWatchdog) threshold(w *workerActivity, sub AlertSubscription) time.Duration {
+	threshold := wd.cfg.OfflineAfter
+	if sub.OfflineAfterSeconds > 0 {
+		threshold = time.Duration(sub.OfflineAfterSeconds) * time.Second
+	}
+	if expected := offlineShareIntervals * w.avgInterval; expected > threshold {
+		threshold = expected
+	}
+	return threshold
+}
+
+// check alerts on every subscribed worker that went offline since the last
+// check and forgets the ones gone for good
+func (wd *workerWatchdog) check(now time.Time) {
+	type pending struct {
+		sub   AlertSubscription
+		event Event
+	}
+	alerts := []pending{}
+	wd.lock.Lock()
+	for key, w := range wd.workers {
+		silence := now.Sub(w.lastShare)
+		if silence > workerForgetAfter {
+			delete(wd.workers, key)
+			continue
+		}
+		sub, subscribed := wd.subs[w.wallet]
+		if !subscribed || w.alerted || silence <= wd.threshold(w, sub) {
+			continue
+		}
+		w.alerted = true
+		reason := "no shares"
+		if len(w.sessions) == 0 {
+			reason = "disconnected"
+		}
+		since := w.lastShare
+		alerts = append(alerts, pending{sub: sub, event: Event{
+			Kind:   EventWorkerOffline,
+			Time:   now,
+			Wallet: w.wallet,
+			Worker: w.worker,
+			Reason: reason,
+			Since:  &since,
+		}})
+	}
+	wd.lock.Unlock()
+
+	for _, a := range alerts {
+		wd.logger.With(zap.String("wallet", a.event.Wallet), zap.String("worker", a.event.Worker),
+			zap.String("reason", a.event.Reason), zap.Time("last_share", *a.event.Since)).Info("worker offline")
+		wd.alert(a.sub, a.event)
+	}
+}
+
+// alert sends the event to wherever the subscription asks for
+func (wd *workerWatchdog) alert(sub AlertSubscription, event Event) {
+	sinks := []notificationSink{}
+	if sub.WebhookURL != "" {
+		sinks = append(sinks, &webhookSink{
+			client: http.DefaultClient,
+			cfg:    WebhookConfig{URL: sub.WebhookURL, Secret: sub.WebhookSecret},
+		})
+	}
+	if sub.Email != "" && wd.cfg.SMTP.enabled() {
+		sinks = append(sinks, &emailSink{cfg: wd.cfg.SMTP, to: sub.Email, send: wd.sendMail})
+	}
+	wd.lock.Lock()
+	ctx := wd.ctx
+	wd.lock.Unlock()
+	wd.notifier.sendTo(ctx, event, sinks...)
+}
+
+// Workers reports every known worker, of one wallet if it's set
+func (wd *workerWatchdog) Workers(wallet string, now time.Time) []workerStatus {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+	workers := []workerStatus{}
+	for _, w := range wd.workers {
+		if wallet != "" && w.wallet != wallet {
+			continue
+		}
+		sub := wd.subs[w.wallet]
+		workers = append(workers, workerStatus{
+			Wallet:                w.wallet,
+			Worker:                w.worker,
+			Connected:             len(w.sessions) > 0,
+			LastShare:             w.lastShare,
+			ExpectedShareInterval: w.avgInterval.Seconds(),
+			Offline:               now.Sub(w.lastShare) > wd.threshold(w, sub),
+		})
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workerKey(workers[i].Wallet, workers[i].Worker) < workerKey(workers[j].Wallet, workers[j].Worker)
+	})
+	return workers
+}
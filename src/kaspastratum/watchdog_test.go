@@ -0,0 +1,284 @@
+package kaspastratum
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+)
+
+// memorySubscriptions stands in for postgres
+type memorySubscriptions struct {
+	lock sync.Mutex
+	subs map[string]AlertSubscription
+}
+
+func (m *memorySubscriptions) List() ([]AlertSubscription, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	subs := []AlertSubscription{}
+	for _, sub := range m.subs {
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (m *memorySubscriptions) Put(sub AlertSubscription) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.subs[sub.Wallet] = sub
+	return nil
+}
+
+func (m *memorySubscriptions) Delete(wallet string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, exists := m.subs[wallet]
+	delete(m.subs, wallet)
+	return exists, nil
+}
+
+type sentMail struct {
+	addr string
+	to   []string
+	msg  string
+}
+
+func testWatchdog(t *testing.T, cfg WatchdogConfig, subs ...AlertSubscription) (*workerWatchdog, func() []sentMail) {
+	notifier, err := NewNotifier(NotifyConfig{Backoff: time.Millisecond}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memorySubscriptions{subs: map[string]AlertSubscription{}}
+	for _, sub := range subs {
+		store.Put(sub)
+	}
+	wd, err := newWorkerWatchdog(cfg, logger, notifier, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := sync.Mutex{}
+	mails := []sentMail{}
+	wd.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		mails = append(mails, sentMail{addr: addr, to: to, msg: string(msg)})
+		return nil
+	}
+	return wd, func() []sentMail {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]sentMail{}, mails...)
+	}
+}
+
+func watchedMiner(wallet, worker string) *MinerContext {
+	ctx, _ := gostratum.NewMockContext(context.Background(), logger, MiningStateGenerator())
+	ctx.WalletAddr = wallet
+	ctx.WorkerName = worker
+	return ctx
+}
+
+func TestWorkerWatchdog(t *testing.T) {
+	hook, received := notifyServer(t, 0, 0)
+	wd, mails := testWatchdog(t, WatchdogConfig{SMTP: SMTPConfig{Host: "smtp.test", From: "alerts@pool.test"}},
+		AlertSubscription{Wallet: "kaspa:one", WebhookURL: hook.URL, WebhookSecret: "hunter2",
+			Email: "miner@example.com", OfflineAfterSeconds: 60})
+
+	start := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	fast, slow, gone := watchedMiner("kaspa:one", "fast"), watchedMiner("kaspa:one", "slow"),
+		watchedMiner("kaspa:one", "gone")
+	unsubscribed := watchedMiner("kaspa:two", "rig")
+	for i := 0; i < 3; i++ {
+		wd.Share(fast, start.Add(time.Duration(i)*10*time.Second))
+		wd.Share(slow, start.Add(time.Duration(i)*100*time.Second))
+	}
+	wd.Share(gone, start.Add(20*time.Second))
+	wd.Share(unsubscribed, start)
+	wd.Disconnected(gone)
+
+	wd.check(start.Add(70 * time.Second))
+	if len(received()) != 0 {
+		t.Fatalf("expected no worker to be offline yet, got %+v", received())
+	}
+
+	// slow submits every 100s so it gets 5 of those rather than 60s
+	wd.check(start.Add(90 * time.Second))
+	alerts := waitForRequests(t, received, 2)
+	byWorker := map[string]receivedRequest{}
+	for _, a := range alerts {
+		byWorker[a.body["worker"].(string)] = a
+	}
+	if a := byWorker["fast"]; a.body["kind"] != "worker_offline" || a.body["reason"] != "no shares" ||
+		a.signature == "" || a.body["message"] != "Worker fast (kaspa:one) is offline (no shares), last share 2024-01-02 03:00 UTC" {
+		t.Errorf("unexpected alert for fast: %+v", a)
+	}
+	if a := byWorker["gone"]; a.body["reason"] != "disconnected" {
+		t.Errorf("expected gone to be reported disconnected, got %+v", a)
+	}
+
+	// alerts go out once per outage
+	wd.check(start.Add(120 * time.Second))
+	wd.check(start.Add(800 * time.Second))
+	alerts = waitForRequests(t, received, 3)
+	if alerts[2].body["worker"] != "slow" {
+		t.Errorf("expected slow to go offline after 5 of its share intervals, got %+v", alerts[2])
+	}
+
+	wd.Share(fast, start.Add(900*time.Second))
+	alerts = waitForRequests(t, received, 4)
+	if alerts[3].body["kind"] != "worker_online" || alerts[3].body["worker"] != "fast" {
+		t.Errorf("expected fast to be reported back online, got %+v", alerts[3])
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(received()); n != 4 {
+		t.Errorf("expected 4 alerts, got %d", n)
+	}
+
+	sent := mails()
+	if len(sent) != 4 {
+		t.Fatalf("expected every alert to be mailed too, got %d", len(sent))
+	}
+	for _, m := range sent {
+		if m.addr != "smtp.test:587" || len(m.to) != 1 || m.to[0] != "miner@example.com" ||
+			!strings.Contains(m.msg, "\r\nSubject: Worker ") {
+			t.Errorf("unexpected mail: %+v", m)
+		}
+	}
+
+	statuses := wd.Workers("kaspa:one", start.Add(900*time.Second))
+	if len(statuses) != 3 || statuses[0].Worker != "fast" || statuses[0].Offline || !statuses[0].Connected ||
+		statuses[1].Worker != "gone" || !statuses[1].Offline || statuses[1].Connected {
+		t.Errorf("unexpected worker statuses: %+v", statuses)
+	}
+
+	wd.check(start.Add(workerForgetAfter + time.Hour))
+	if statuses := wd.Workers("", start); len(statuses) != 0 {
+		t.Errorf("expected long gone workers to be forgotten, got %+v", statuses)
+	}
+}
+
+func TestAlertSubscriptionApi(t *testing.T) {
+	wd, _ := testWatchdog(t, WatchdogConfig{})
+	mux := http.NewServeMux()
+	wd.Register(mux)
+	handler := requireToken(testAdminToken, mux)
+
+	for _, bad := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodPut, "/alerts/subscriptions/kaspa:one", `{}`, http.StatusBadRequest},
+		{http.MethodPut, "/alerts/subscriptions/kaspa:one", `{"webhook_url": "ftp://nope"}`, http.StatusBadRequest},
+		{http.MethodPut, "/alerts/subscriptions/kaspa:one", `{"email": "miner@example.com"}`, http.StatusBadRequest},
+		{http.MethodPut, "/alerts/subscriptions/kaspa:one",
+			`{"webhook_url": "https://hooks.test", "offline_after_seconds": 999999}`, http.StatusBadRequest},
+		{http.MethodGet, "/alerts/subscriptions/kaspa:one", "", http.StatusNotFound},
+		{http.MethodDelete, "/alerts/subscriptions/kaspa:one", "", http.StatusNotFound},
+		{http.MethodPost, "/alerts/subscriptions/kaspa:one", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/alerts/subscriptions", "", http.StatusMethodNotAllowed},
+	} {
+		if rec := adminRequest(t, handler, bad.method, bad.path, bad.body); rec.Code != bad.code {
+			t.Errorf("%s %s %s: expected %d, got %d", bad.method, bad.path, bad.body, bad.code, rec.Code)
+		}
+	}
+
+	rec := adminRequest(t, handler, http.MethodPut, "/alerts/subscriptions/kaspa:one",
+		`{"webhook_url": "https://hooks.test", "webhook_secret": "hunter2", "offline_after_seconds": 300}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("subscribing failed: %d %s", rec.Code, rec.Body)
+	}
+	sub := AlertSubscription{}
+	if err := json.NewDecoder(rec.Body).Decode(&sub); err != nil || sub.Wallet != "kaspa:one" ||
+		sub.WebhookSecret != "<redacted>" || sub.OfflineAfterSeconds != 300 || sub.UpdatedAt.IsZero() {
+		t.Errorf("unexpected subscription: %+v", sub)
+	}
+	if stored, _ := wd.store.List(); len(stored) != 1 || stored[0].WebhookSecret != "hunter2" {
+		t.Errorf("expected the subscription to be stored with its secret, got %+v", stored)
+	}
+
+	subs := []AlertSubscription{}
+	rec = adminRequest(t, handler, http.MethodGet, "/alerts/subscriptions", "")
+	if err := json.NewDecoder(rec.Body).Decode(&subs); err != nil || len(subs) != 1 || subs[0].Wallet != "kaspa:one" {
+		t.Errorf("unexpected subscriptions: %+v", subs)
+	}
+
+	if rec := adminRequest(t, handler, http.MethodDelete, "/alerts/subscriptions/kaspa:one", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("unsubscribing failed: %d", rec.Code)
+	}
+	if stored, _ := wd.store.List(); len(stored) != 0 || len(wd.Subscriptions()) != 0 {
+		t.Errorf("expected the subscription to be gone, got %+v", stored)
+	}
+}
+
+// slowSubscriptions holds every write until released
+type slowSubscriptions struct {
+	memorySubscriptions
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (s *slowSubscriptions) Put(sub AlertSubscription) error {
+	s.writing <- struct{}{}
+	<-s.release
+	return s.memorySubscriptions.Put(sub)
+}
+
+func TestSubscribeDoesNotBlockShares(t *testing.T) {
+	wd, _ := testWatchdog(t, WatchdogConfig{})
+	store := &slowSubscriptions{
+		memorySubscriptions: memorySubscriptions{subs: map[string]AlertSubscription{}},
+		writing:             make(chan struct{}),
+		release:             make(chan struct{}),
+	}
+	wd.store = store
+
+	subscribed := make(chan error)
+	go func() {
+		_, err := wd.Subscribe(AlertSubscription{Wallet: "kaspa:one", WebhookURL: "https://example.com/hook"})
+		subscribed <- err
+	}()
+	<-store.writing
+
+	shared := make(chan struct{})
+	go func() {
+		wd.Share(watchedMiner("kaspa:one", "rig"), time.Now())
+		close(shared)
+	}()
+	select {
+	case <-shared:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected shares to go through while the subscription is written")
+	}
+
+	close(store.release)
+	if err := <-subscribed; err != nil {
+		t.Fatal(err)
+	}
+	if subs := wd.Subscriptions(); len(subs) != 1 || subs[0].Wallet != "kaspa:one" {
+		t.Errorf("expected the subscription once it's stored, got %+v", subs)
+	}
+}
+
+func TestWatchdogConfigValidate(t *testing.T) {
+	for name, cfg := range map[string]WatchdogConfig{
+		"negative threshold": {OfflineAfter: -time.Second},
+		"threshold too long": {OfflineAfter: 48 * time.Hour},
+		"smtp without from":  {SMTP: SMTPConfig{Host: "smtp.test"}},
+		"bad smtp port":      {SMTP: SMTPConfig{Host: "smtp.test", From: "a@b.test", Port: 70000}},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	cfg := BridgeConfig{Watchdog: WatchdogConfig{SMTP: SMTPConfig{Host: "smtp.test", Password: "hunter2"}}}
+	if cfg.Redacted().Watchdog.SMTP.Password != "<redacted>" {
+		t.Errorf("expected the smtp password to be redacted")
+	}
+}
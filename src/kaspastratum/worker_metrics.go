@@ -0,0 +1,302 @@
+package kaspastratum
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// overflowLabel is what every label of a worker past the MaxWorkers cap reads
+const overflowLabel = "other"
+
+var allWorkerLabels = []string{
+	"worker", "miner", "wallet", "ip", "mode", "session",
+}
+
+// session is opt in, every reconnect would start new series
+var defaultWorkerLabels = []string{
+	"worker", "miner", "wallet", "ip", "mode",
+}
+
+// WorkerMetricsConfig keeps the number of per worker series in check. With
+// thousands of short lived miners every label combination is a new series
+type WorkerMetricsConfig struct {
+	// Labels the worker series are split by, any of worker, miner, wallet, ip,
+	// mode and session. Defaults to all but session, e.g. `[wallet]`
+	// aggregates by wallet
+	Labels []string `yaml:"labels"`
+	// TTL deletes the series of workers that haven't been seen for this long,
+	// 0 keeps them forever
+	TTL time.Duration `yaml:"ttl"`
+	// MaxWorkers caps the number of tracked label sets, workers past the cap
+	// are counted as `other`. 0 is unlimited
+	MaxWorkers int `yaml:"max_workers"`
+}
+
+func (cfg WorkerMetricsConfig) labels() ([]string, error) {
+	if len(cfg.Labels) == 0 {
+		return defaultWorkerLabels, nil
+	}
+	seen := map[string]struct{}{}
+	for _, l := range cfg.Labels {
+		known := false
+		for _, k := range allWorkerLabels {
+			known = known || k == l
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown worker label '%s', expected one of %s", l,
+				strings.Join(allWorkerLabels, ", "))
+		}
+		if _, exists := seen[l]; exists {
+			return nil, fmt.Errorf("worker label '%s' listed twice", l)
+		}
+		seen[l] = struct{}{}
+	}
+	return cfg.Labels, nil
+}
+
+func (cfg WorkerMetricsConfig) validate() error {
+	if _, err := cfg.labels(); err != nil {
+		return err
+	}
+	if cfg.TTL < 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+	if cfg.MaxWorkers < 0 {
+		return fmt.Errorf("max_workers must be positive")
+	}
+	return nil
+}
+
+type trackedSeries struct {
+	labels   prometheus.Labels
+	lastSeen time.Time
+}
+
+// seriesTracker remembers when a label set was last written to, so series of
+// workers that went away can be deleted
+type seriesTracker struct {
+	max    int
+	series map[string]*trackedSeries
+}
+
+func newSeriesTracker(max int) *seriesTracker {
+	return &seriesTracker{max: max, series: map[string]*trackedSeries{}}
+}
+
+// track returns the labels to record under, which are the overflow labels if
+// the set is new and the tracker is full
+func (st *seriesTracker) track(labels prometheus.Labels, now time.Time) prometheus.Labels {
+	key := seriesKey(labels)
+	if _, exists := st.series[key]; !exists && st.max > 0 && len(st.series) >= st.max {
+		overflow := prometheus.Labels{}
+		for k := range labels {
+			overflow[k] = overflowLabel
+		}
+		labels, key = overflow, seriesKey(overflow)
+	}
+	entry, exists := st.series[key]
+	if !exists {
+		entry = &trackedSeries{labels: labels}
+		st.series[key] = entry
+	}
+	entry.lastSeen = now
+	return entry.labels
+}
+
+// expire forgets and returns every label set not seen since the cutoff
+func (st *seriesTracker) expire(cutoff time.Time) []prometheus.Labels {
+	expired := []prometheus.Labels{}
+	for key, entry := range st.series {
+		if entry.lastSeen.Before(cutoff) {
+			expired = append(expired, entry.labels)
+			delete(st.series, key)
+		}
+	}
+	return expired
+}
+
+func seriesKey(labels prometheus.Labels) string {
+	key := strings.Builder{}
+	for _, l := range allWorkerLabels {
+		key.WriteString(labels[l])
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+// workerMetrics are the series labelled by worker and wallet, see
+// WorkerMetricsConfig for how their number is bounded
+type workerMetrics struct {
+	labels     []string
+	walletErrs bool // whether errors are split by wallet
+	ttl        time.Duration
+	now        func() time.Time
+
+	lock    sync.Mutex
+	workers *seriesTracker
+	wallets *seriesTracker
+
+	shares      *prometheus.CounterVec
+	lateShares  *prometheus.CounterVec
+	invalid     *prometheus.CounterVec
+	blocks      *prometheus.CounterVec
+	disconnects *prometheus.CounterVec
+	jobs        *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+	balances    *prometheus.GaugeVec
+}
+
+func newWorkerMetrics(cfg WorkerMetricsConfig) (*workerMetrics, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	labels, _ := cfg.labels()
+	errorLabels := []string{"error"}
+	walletErrs := false
+	for _, l := range labels {
+		if l == "wallet" {
+			walletErrs = true
+			errorLabels = []string{"wallet", "error"}
+		}
+	}
+
+	wm := &workerMetrics{
+		labels:     labels,
+		walletErrs: walletErrs,
+		ttl:        cfg.TTL,
+		now:        time.Now,
+		workers:    newSeriesTracker(cfg.MaxWorkers),
+		wallets:    newSeriesTracker(cfg.MaxWorkers),
+		shares: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ks_valid_share_counter",
+			Help: "Number of shares found by worker over time",
+		}, labels),
+		lateShares: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ks_late_share_counter",
+			Help: "Number of shares behind the tip but inside the stale grace window, still credited",
+		}, labels),
+		invalid: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ks_invalid_share_counter",
+			Help: "Number of stale shares found by worker over time",
+		}, append(append([]string{}, labels...), "type")),
+		blocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ks_blocks_mined",
+			Help: "Number of blocks mined over time",
+		}, labels),
+		disconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ks_worker_disconnect_counter",
+			Help: "Number of disconnects by worker",
+		}, labels),
+		jobs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ks_worker_job_counter",
+			Help: "Number of jobs sent to the miner by worker over time",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ks_worker_errors",
+			Help: "Gauge representing errors by worker",
+		}, errorLabels),
+		balances: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ks_balance_by_wallet_gauge",
+			Help: "Gauge representing the wallet balance for connected workers",
+		}, []string{"wallet"}),
+	}
+	return wm, nil
+}
+
+func (wm *workerMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{wm.shares, wm.lateShares, wm.invalid, wm.blocks,
+		wm.disconnects, wm.jobs, wm.errors, wm.balances}
+}
+
+func (wm *workerMetrics) workerLabels(worker *MinerContext) prometheus.Labels {
+	all := prometheus.Labels{
+		"worker":  worker.WorkerName,
+		"miner":   worker.RemoteApp,
+		"wallet":  worker.WalletAddr,
+		"ip":      worker.RemoteAddr,
+		"mode":    string(miningMode(worker)),
+		"session": strconv.FormatUint(worker.SessionId(), 10),
+	}
+	labels := prometheus.Labels{}
+	for _, l := range wm.labels {
+		labels[l] = all[l]
+	}
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	return wm.workers.track(labels, wm.now())
+}
+
+func (wm *workerMetrics) walletLabels(wallet string) prometheus.Labels {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	return wm.wallets.track(prometheus.Labels{"wallet": wallet}, wm.now())
+}
+
+func (wm *workerMetrics) invalidShare(worker *MinerContext, kind string) {
+	labels := prometheus.Labels{"type": kind}
+	for k, v := range wm.workerLabels(worker) {
+		labels[k] = v
+	}
+	wm.invalid.With(labels).Inc()
+}
+
+func (wm *workerMetrics) workerError(wallet string, shortError ErrorShortCodeT) {
+	labels := prometheus.Labels{"error": string(shortError)}
+	if wm.walletErrs {
+		labels["wallet"] = wm.walletLabels(wallet)["wallet"]
+	}
+	wm.errors.With(labels).Inc()
+}
+
+func (wm *workerMetrics) balance(wallet string, balance float64) {
+	wm.balances.With(wm.walletLabels(wallet)).Set(balance)
+}
+
+// prune deletes the series of every worker and wallet not seen within the ttl
+func (wm *workerMetrics) prune() {
+	if wm.ttl == 0 {
+		return
+	}
+	// the series are deleted under the lock too, otherwise a worker coming
+	// back in between would be tracked again but lose the series it wrote
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	cutoff := wm.now().Add(-wm.ttl)
+	workers := wm.workers.expire(cutoff)
+	wallets := wm.wallets.expire(cutoff)
+	for _, labels := range workers {
+		for _, vec := range []*prometheus.CounterVec{wm.shares, wm.lateShares, wm.invalid,
+			wm.blocks, wm.disconnects, wm.jobs} {
+			vec.DeletePartialMatch(labels)
+		}
+	}
+	for _, labels := range wallets {
+		if wm.walletErrs {
+			wm.errors.DeletePartialMatch(labels)
+		}
+		wm.balances.DeletePartialMatch(labels)
+	}
+}
+
+// pruneLoop periodically prunes until the context is cancelled
+func (wm *workerMetrics) pruneLoop(ctx context.Context) {
+	if wm.ttl == 0 {
+		return
+	}
+	ticker := time.NewTicker(wm.ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wm.prune()
+		}
+	}
+}
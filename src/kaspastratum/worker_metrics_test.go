@@ -0,0 +1,143 @@
+package kaspastratum
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newMetricsWorker(wallet, worker, ip string) *MinerContext {
+	ctx := gostratum.NewDetachedContext(context.Background(), nil, ip, "test.miner", MiningStateGenerator())
+	ctx.WalletAddr = wallet
+	ctx.WorkerName = worker
+	return ctx
+}
+
+func newTestWorkerMetrics(t *testing.T, cfg WorkerMetricsConfig) (*workerMetrics, *time.Time) {
+	wm, err := newWorkerMetrics(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	wm.now = func() time.Time { return now }
+	return wm, &now
+}
+
+func TestWorkerMetricsLabels(t *testing.T) {
+	wm, _ := newTestWorkerMetrics(t, WorkerMetricsConfig{Labels: []string{"wallet"}})
+	for _, w := range []*MinerContext{
+		newMetricsWorker("kaspa:a", "rig1", "10.0.0.1"),
+		newMetricsWorker("kaspa:a", "rig2", "10.0.0.2"),
+		newMetricsWorker("kaspa:b", "rig1", "10.0.0.3"),
+	} {
+		wm.shares.With(wm.workerLabels(w)).Inc()
+		wm.invalidShare(w, "stale")
+		wm.workerError(w.WalletAddr, ErrBadDataFromMiner)
+	}
+	if count := testutil.CollectAndCount(wm.shares); count != 2 {
+		t.Errorf("expected shares aggregated into 2 wallets, got %d series", count)
+	}
+	if count := testutil.CollectAndCount(wm.invalid); count != 2 {
+		t.Errorf("expected invalid shares aggregated into 2 wallets, got %d series", count)
+	}
+	if v := testutil.ToFloat64(wm.shares.WithLabelValues("kaspa:a")); v != 2 {
+		t.Errorf("expected 2 shares for wallet a, got %f", v)
+	}
+
+	// without the wallet label errors are only split by error
+	wm, _ = newTestWorkerMetrics(t, WorkerMetricsConfig{Labels: []string{"worker", "mode"}})
+	wm.workerError("kaspa:a", ErrBadDataFromMiner)
+	wm.workerError("kaspa:b", ErrBadDataFromMiner)
+	if v := testutil.ToFloat64(wm.errors.WithLabelValues(string(ErrBadDataFromMiner))); v != 2 {
+		t.Errorf("expected 2 errors, got %f", v)
+	}
+
+	// rigs behind one ip are told apart by session
+	wm, _ = newTestWorkerMetrics(t, WorkerMetricsConfig{Labels: []string{"ip", "session"}})
+	for _, w := range []*MinerContext{
+		newMetricsWorker("kaspa:a", "rig1", "10.0.0.1"),
+		newMetricsWorker("kaspa:a", "rig2", "10.0.0.1"),
+	} {
+		wm.shares.With(wm.workerLabels(w)).Inc()
+	}
+	if count := testutil.CollectAndCount(wm.shares); count != 2 {
+		t.Errorf("expected a series per session, got %d series", count)
+	}
+
+	for _, cfg := range []WorkerMetricsConfig{
+		{Labels: []string{"hostname"}},
+		{Labels: []string{"wallet", "wallet"}},
+		{TTL: -time.Second},
+		{MaxWorkers: -1},
+	} {
+		if _, err := newWorkerMetrics(cfg); err == nil {
+			t.Errorf("expected config %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestWorkerMetricsOverflow(t *testing.T) {
+	wm, _ := newTestWorkerMetrics(t, WorkerMetricsConfig{Labels: []string{"wallet", "worker"}, MaxWorkers: 2})
+	for _, w := range []*MinerContext{
+		newMetricsWorker("kaspa:a", "rig1", "10.0.0.1"),
+		newMetricsWorker("kaspa:a", "rig2", "10.0.0.1"),
+		newMetricsWorker("kaspa:b", "rig1", "10.0.0.2"),
+		newMetricsWorker("kaspa:c", "rig1", "10.0.0.3"),
+		newMetricsWorker("kaspa:a", "rig1", "10.0.0.1"), // already tracked
+	} {
+		wm.jobs.With(wm.workerLabels(w)).Inc()
+	}
+	if count := testutil.CollectAndCount(wm.jobs); count != 3 {
+		t.Errorf("expected 2 workers and the overflow bucket, got %d series", count)
+	}
+	if v := testutil.ToFloat64(wm.jobs.WithLabelValues("kaspa:a", "rig1")); v != 2 {
+		t.Errorf("expected 2 jobs for the tracked worker, got %f", v)
+	}
+	if v := testutil.ToFloat64(wm.jobs.WithLabelValues(overflowLabel, overflowLabel)); v != 2 {
+		t.Errorf("expected 2 jobs in the overflow bucket, got %f", v)
+	}
+}
+
+func TestWorkerMetricsPrune(t *testing.T) {
+	wm, now := newTestWorkerMetrics(t, WorkerMetricsConfig{TTL: time.Minute})
+	gone := newMetricsWorker("kaspa:a", "rig1", "10.0.0.1")
+	active := newMetricsWorker("kaspa:b", "rig1", "10.0.0.2")
+
+	wm.shares.With(wm.workerLabels(gone)).Inc()
+	wm.invalidShare(gone, "stale")
+	wm.invalidShare(gone, "duplicate")
+	wm.workerError(gone.WalletAddr, ErrDisconnected)
+	wm.balance(gone.WalletAddr, 1)
+
+	*now = now.Add(45 * time.Second)
+	wm.shares.With(wm.workerLabels(active)).Inc()
+	wm.balance(active.WalletAddr, 1)
+	wm.prune()
+	if count := testutil.CollectAndCount(wm.shares); count != 2 {
+		t.Fatalf("expected no series pruned inside the ttl, got %d series", count)
+	}
+
+	*now = now.Add(30 * time.Second)
+	wm.prune()
+	if count := testutil.CollectAndCount(wm.shares); count != 1 {
+		t.Errorf("expected the gone worker's shares pruned, got %d series", count)
+	}
+	if count := testutil.CollectAndCount(wm.invalid); count != 0 {
+		t.Errorf("expected the gone worker's invalid shares pruned, got %d series", count)
+	}
+	if count := testutil.CollectAndCount(wm.errors); count != 0 {
+		t.Errorf("expected the gone wallet's errors pruned, got %d series", count)
+	}
+	if count := testutil.CollectAndCount(wm.balances); count != 1 {
+		t.Errorf("expected the gone wallet's balance pruned, got %d series", count)
+	}
+
+	// a pruned worker coming back starts new series
+	wm.shares.With(wm.workerLabels(gone)).Inc()
+	if count := testutil.CollectAndCount(wm.shares); count != 2 {
+		t.Errorf("expected the returning worker to be tracked again, got %d series", count)
+	}
+}
@@ -0,0 +1,346 @@
+package stratumproxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// bytes of the nonce reserved per rig, 2 bytes allows 65535 rigs
+const defaultRigExtranonceSize = 2
+
+type ProxyConfig struct {
+	// Upstream is the pool address, User the `wallet.worker` the proxy mines
+	// as. Rigs are only visible locally
+	Upstream string
+	User     string
+	Agent    string
+	// Port is the address rigs connect to
+	Port   string
+	Logger *zap.SugaredLogger
+	// RigExtranonceSize is the number of nonce bytes used to tell rigs apart
+	RigExtranonceSize int
+	// Upstream client settings, see gostratum.StratumClientConfig
+	ReconnectDelay time.Duration
+}
+
+// RigStats are the local counters for a single downstream rig
+type RigStats struct {
+	RemoteAddr string
+	Worker     string
+	Extranonce string
+	Connected  time.Time
+	LastShare  time.Time
+	Accepted   int64
+	Rejected   int64
+	Stale      int64
+}
+
+// rig is the state of a downstream connection
+type rig struct {
+	id         uint32
+	lock       sync.Mutex
+	extranonce string
+	stats      RigStats
+}
+
+type rigContext = gostratum.TypedContext[*rig]
+
+// Proxy keeps a single upstream session and serves its jobs to any number of
+// downstream rigs. Every rig gets its own extranonce, carved out of the
+// upstream's nonce space, so rigs never duplicate each other's work and
+// shares can be forwarded upstream as is
+type Proxy struct {
+	ProxyConfig
+	upstream *gostratum.StratumClient
+	listener *gostratum.TypedListener[*rig]
+
+	lock  sync.RWMutex
+	rigs  map[*rigContext]*rig
+	ids   map[uint32]struct{}
+	next  uint32
+	maxId uint32
+}
+
+func NewProxy(cfg ProxyConfig) (*Proxy, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if cfg.RigExtranonceSize == 0 {
+		cfg.RigExtranonceSize = defaultRigExtranonceSize
+	}
+	if cfg.RigExtranonceSize < 1 || cfg.RigExtranonceSize > 4 {
+		return nil, fmt.Errorf("rig extranonce size must be between 1 and 4 bytes, got %d", cfg.RigExtranonceSize)
+	}
+	p := &Proxy{
+		ProxyConfig: cfg,
+		rigs:        map[*rigContext]*rig{},
+		ids:         map[uint32]struct{}{},
+		maxId:       uint32(1<<(8*cfg.RigExtranonceSize) - 1),
+	}
+	p.upstream = gostratum.NewStratumClient(gostratum.StratumClientConfig{
+		Address:        cfg.Upstream,
+		User:           cfg.User,
+		Agent:          cfg.Agent,
+		Logger:         cfg.Logger,
+		ReconnectDelay: cfg.ReconnectDelay,
+		OnJob:          p.onJob,
+		OnDifficulty:   p.onDifficulty,
+		OnEvent:        p.onEvent,
+	})
+
+	handlers := gostratum.DefaultTypedHandlers[*rig]()
+	handlers[string(gostratum.StratumMethodSubscribe)] = p.handleSubscribe
+	handlers[string(gostratum.StratumMethodAuthorize)] = p.handleAuthorize
+	handlers[string(gostratum.StratumMethodSubmit)] = p.handleSubmit
+	p.listener = gostratum.NewListener(gostratum.TypedListenerConfig[*rig]{
+		Logger:         cfg.Logger.With(zap.String("component", "proxy")),
+		HandlerMap:     handlers,
+		ClientListener: p,
+		StateGenerator: func() *rig { return &rig{} },
+		Port:           cfg.Port,
+	})
+	return p, nil
+}
+
+// Run connects upstream and serves rigs until the context is cancelled
+func (p *Proxy) Run(ctx context.Context) error {
+	errChan := make(chan error, 2)
+	go func() { errChan <- p.upstream.Run(ctx) }()
+	go func() { errChan <- p.listener.Listen(ctx) }()
+	err := <-errChan
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+func (p *Proxy) OnConnect(ctx *rigContext) {
+	r := ctx.State
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// take the next free id, ids of disconnected rigs are reused once the
+	// counter wraps
+	for i := uint32(0); i < p.maxId; i++ {
+		p.next = p.next%p.maxId + 1
+		if _, used := p.ids[p.next]; !used {
+			r.id = p.next
+			break
+		}
+	}
+	if r.id == 0 {
+		ctx.Logger.Error("no extranonce space left for rig")
+		return
+	}
+	p.ids[r.id] = struct{}{}
+	r.stats = RigStats{RemoteAddr: ctx.RemoteAddr, Connected: time.Now()}
+	p.rigs[ctx] = r
+}
+
+func (p *Proxy) OnDisconnect(ctx *rigContext) {
+	r := ctx.State
+	p.lock.Lock()
+	delete(p.rigs, ctx)
+	delete(p.ids, r.id)
+	p.lock.Unlock()
+}
+
+// rigExtranonce is the upstream extranonce followed by the rig id
+func (p *Proxy) rigExtranonce(r *rig) (string, error) {
+	upstream := p.upstream.Extranonce()
+	extranonce := upstream + fmt.Sprintf("%0*x", 2*p.RigExtranonceSize, r.id)
+	if len(extranonce) >= 16 {
+		return "", fmt.Errorf("upstream extranonce '%s' leaves no room for rig ids", upstream)
+	}
+	return extranonce, nil
+}
+
+func (p *Proxy) sendExtranonce(ctx *rigContext) error {
+	r := ctx.State
+	if r.id == 0 {
+		return fmt.Errorf("rig has no extranonce assigned")
+	}
+	extranonce, err := p.rigExtranonce(r)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.extranonce = extranonce
+	r.stats.Extranonce = extranonce
+	r.lock.Unlock()
+	return ctx.Send(gostratum.NewEvent("", string(gostratum.StratumMethodSetExtranonce),
+		[]any{extranonce, 8 - len(extranonce)/2}))
+}
+
+func (p *Proxy) handleSubscribe(ctx *rigContext, event gostratum.JsonRpcEvent) error {
+	if err := gostratum.HandleSubscribe(ctx, event); err != nil {
+		return err
+	}
+	return p.sendExtranonce(ctx)
+}
+
+func (p *Proxy) handleAuthorize(ctx *rigContext, event gostratum.JsonRpcEvent) error {
+	if err := gostratum.HandleAuthorize(ctx, event); err != nil {
+		return err
+	}
+	r := ctx.State
+	r.lock.Lock()
+	r.stats.Worker = ctx.WorkerName
+	r.lock.Unlock()
+
+	// bring the rig up to speed, from here on it gets everything upstream sends
+	if diff := p.upstream.Difficulty(); diff != 0 {
+		if err := p.sendDifficulty(ctx, diff); err != nil {
+			return err
+		}
+	}
+	if job, exists := p.upstream.CurrentJob(); exists {
+		return p.sendJob(ctx, job)
+	}
+	return nil
+}
+
+// rigNonce parses a submitted nonce. Rigs either submit the full nonce,
+// which must start with their extranonce, or only their part of it
+func rigNonce(extranonce, submitted string) (uint64, error) {
+	submitted = strings.TrimPrefix(submitted, "0x")
+	if free := 16 - len(extranonce); len(submitted) <= free {
+		submitted = extranonce + fmt.Sprintf("%0*s", free, submitted)
+	}
+	if len(submitted) != 16 || !strings.HasPrefix(submitted, extranonce) {
+		return 0, fmt.Errorf("nonce %s outside of extranonce %s", submitted, extranonce)
+	}
+	return strconv.ParseUint(submitted, 16, 64)
+}
+
+func (p *Proxy) handleSubmit(ctx *rigContext, event gostratum.JsonRpcEvent) error {
+	r := ctx.State
+	if len(event.Params) < 3 {
+		return ctx.ReplyBadShare(event.Id)
+	}
+	jobId := fmt.Sprint(event.Params[1])
+	nonceStr, _ := event.Params[2].(string)
+	r.lock.Lock()
+	extranonce := r.extranonce
+	r.lock.Unlock()
+	nonce, err := rigNonce(extranonce, nonceStr)
+	if err != nil {
+		ctx.Logger.Warn(err.Error())
+		p.recordShare(r, false, false)
+		return ctx.ReplyBadShare(event.Id)
+	}
+
+	err = p.upstream.Submit(ctx, jobId, nonce)
+	var stratumErr *gostratum.StratumError
+	switch {
+	case err == nil:
+		p.recordShare(r, true, false)
+		return ctx.Reply(gostratum.NewResponse(event, true, nil))
+	case errors.As(err, &stratumErr):
+		p.recordShare(r, false, stratumErr.Code == 21)
+		// pass the pool's verdict through as is
+		return ctx.Reply(gostratum.JsonRpcResponse{
+			Id:    event.Id,
+			Error: []any{stratumErr.Code, stratumErr.Message, nil},
+		})
+	case errors.Is(err, gostratum.ErrorShareRejected):
+		p.recordShare(r, false, false)
+		return ctx.Reply(gostratum.NewResponse(event, false, nil))
+	}
+	ctx.Logger.With(zap.Error(err)).Warn("failed forwarding share upstream")
+	return ctx.ReplyBadShare(event.Id)
+}
+
+func (p *Proxy) recordShare(r *rig, accepted, stale bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stats.LastShare = time.Now()
+	switch {
+	case accepted:
+		r.stats.Accepted++
+	case stale:
+		r.stats.Stale++
+	default:
+		r.stats.Rejected++
+	}
+}
+
+func (p *Proxy) sendDifficulty(ctx *rigContext, diff float64) error {
+	return ctx.Send(gostratum.NewEvent("", string(gostratum.StratumMethodSetDifficulty), []any{diff}))
+}
+
+func (p *Proxy) sendJob(ctx *rigContext, job gostratum.ClientJob) error {
+	return ctx.Send(gostratum.NewEvent("", string(gostratum.StratumMethodNotify),
+		append([]any{job.Id}, job.Params...)))
+}
+
+// authorizedRigs are the rigs ready to receive work
+func (p *Proxy) authorizedRigs() []*rigContext {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	rigs := make([]*rigContext, 0, len(p.rigs))
+	for ctx := range p.rigs {
+		if ctx.Connected() && ctx.WalletAddr != "" {
+			rigs = append(rigs, ctx)
+		}
+	}
+	return rigs
+}
+
+func (p *Proxy) onJob(job gostratum.ClientJob) {
+	for _, ctx := range p.authorizedRigs() {
+		if err := p.sendJob(ctx, job); err != nil {
+			ctx.Logger.With(zap.Error(err)).Warn("failed sending job to rig")
+		}
+	}
+}
+
+func (p *Proxy) onDifficulty(diff float64) {
+	for _, ctx := range p.authorizedRigs() {
+		if err := p.sendDifficulty(ctx, diff); err != nil {
+			ctx.Logger.With(zap.Error(err)).Warn("failed sending difficulty to rig")
+		}
+	}
+}
+
+func (p *Proxy) onEvent(event gostratum.JsonRpcEvent) {
+	if event.Method != gostratum.StratumMethodSetExtranonce {
+		return
+	}
+	// upstream prefix changed, every rig needs a new one
+	p.lock.RLock()
+	rigs := make([]*rigContext, 0, len(p.rigs))
+	for ctx := range p.rigs {
+		rigs = append(rigs, ctx)
+	}
+	p.lock.RUnlock()
+	for _, ctx := range rigs {
+		if err := p.sendExtranonce(ctx); err != nil {
+			ctx.Logger.With(zap.Error(err)).Warn("failed updating rig extranonce")
+		}
+	}
+}
+
+// Stats returns the counters of every authorized rig, ordered by extranonce
+func (p *Proxy) Stats() []RigStats {
+	p.lock.RLock()
+	stats := make([]RigStats, 0, len(p.rigs))
+	for _, r := range p.rigs {
+		r.lock.Lock()
+		if r.stats.Worker != "" {
+			stats = append(stats, r.stats)
+		}
+		r.lock.Unlock()
+	}
+	p.lock.RUnlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Extranonce < stats[j].Extranonce })
+	return stats
+}
@@ -0,0 +1,181 @@
+package stratumproxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/onemorebsmith/kaspa-pool/src/gostratum"
+	"github.com/onemorebsmith/kaspa-pool/src/kaspaminer"
+	"go.uber.org/zap"
+)
+
+func TestRigNonce(t *testing.T) {
+	for _, tc := range []struct {
+		extranonce, submitted string
+		expected              uint64
+		valid                 bool
+	}{
+		{"ab0001", "0xab00010000000005", 0xab00010000000005, true},
+		{"ab0001", "ab00010000000005", 0xab00010000000005, true},
+		{"ab0001", "5", 0xab00010000000005, true},          // suffix only
+		{"ab0001", "0000000005", 0xab00010000000005, true}, // padded suffix
+		{"ab0001", "0xab00020000000005", 0, false},         // another rig's space
+		{"ab0001", "0xab0001000000000005", 0, false},       // too long
+		{"", "0x0000000000000005", 5, true},
+	} {
+		nonce, err := rigNonce(tc.extranonce, tc.submitted)
+		if tc.valid != (err == nil) {
+			t.Errorf("%s/%s: expected valid %t, got %v", tc.extranonce, tc.submitted, tc.valid, err)
+		}
+		if tc.valid && nonce != tc.expected {
+			t.Errorf("%s/%s: expected nonce %x, got %x", tc.extranonce, tc.submitted, tc.expected, nonce)
+		}
+	}
+}
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitForListener(ctx context.Context, t *testing.T, address string) {
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if ctx.Err() != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testPool is the upstream. It assigns the proxy an extranonce and accepts
+// any share inside it, rejecting duplicates
+type testPool struct {
+	lock   sync.Mutex
+	nonces map[string]int
+	bad    int
+}
+
+func (tp *testPool) handlers() gostratum.StratumHandlerMap {
+	handlers := gostratum.DefaultHandlers()
+	handlers[string(gostratum.StratumMethodSubscribe)] = func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+		if err := gostratum.HandleSubscribe(ctx, event); err != nil {
+			return err
+		}
+		return ctx.Send(gostratum.NewEvent("", string(gostratum.StratumMethodSetExtranonce), []any{"ab", 7}))
+	}
+	handlers[string(gostratum.StratumMethodAuthorize)] = func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+		if err := gostratum.HandleAuthorize(ctx, event); err != nil {
+			return err
+		}
+		if err := ctx.Send(gostratum.NewEvent("", string(gostratum.StratumMethodSetDifficulty), []any{1e-7})); err != nil {
+			return err
+		}
+		return ctx.Send(gostratum.NewEvent("", string(gostratum.StratumMethodNotify),
+			[]any{"1", []uint64{1, 2, 3, 4}, 1000}))
+	}
+	handlers[string(gostratum.StratumMethodSubmit)] = func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+		nonce := strings.TrimPrefix(event.Params[2].(string), "0x")
+		tp.lock.Lock()
+		defer tp.lock.Unlock()
+		if !strings.HasPrefix(nonce, "ab") || tp.nonces[nonce] > 0 {
+			tp.bad++
+			return ctx.ReplyBadShare(event.Id)
+		}
+		tp.nonces[nonce]++
+		return ctx.Reply(gostratum.NewResponse(event, true, nil))
+	}
+	return handlers
+}
+
+// TestProxyEndToEnd runs pool, proxy and two cpu rigs in process. Every rig
+// must mine in its own slice of the pool's extranonce
+func TestProxyEndToEnd(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	pool := &testPool{nonces: map[string]int{}}
+	poolPort := freePort(t)
+	cfg := gostratum.DefaultConfig(zap.NewNop().Sugar())
+	cfg.HandlerMap = pool.handlers()
+	cfg.Port = poolPort
+	go gostratum.NewListener(cfg).Listen(ctx)
+	waitForListener(ctx, t, poolPort)
+
+	proxyPort := freePort(t)
+	proxy, err := NewProxy(ProxyConfig{
+		Upstream: poolPort,
+		User:     "kaspa:farm.proxy",
+		Port:     proxyPort,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run(ctx)
+	waitForListener(ctx, t, proxyPort)
+	// rigs only get work once the upstream session is up
+	for proxy.upstream.Extranonce() == "" || proxy.upstream.Difficulty() == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("proxy never connected upstream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rigs := []*kaspaminer.Miner{}
+	for _, worker := range []string{"rig1", "rig2"} {
+		rig := kaspaminer.NewMiner(kaspaminer.MinerConfig{Pool: proxyPort, User: "kaspa:farm." + worker})
+		rigs = append(rigs, rig)
+		go rig.Run(ctx)
+	}
+	for ctx.Err() == nil {
+		if rigs[0].Stats().Accepted >= 3 && rigs[1].Stats().Accepted >= 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, rig := range rigs {
+		if stats := rig.Stats(); stats.Accepted < 3 || stats.Rejected != 0 {
+			t.Fatalf("rig %d: expected accepted shares and no rejects, got %+v", i, stats)
+		}
+	}
+
+	stats := proxy.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 rigs in proxy stats, got %+v", stats)
+	}
+	seen := map[string]bool{}
+	for _, rig := range stats {
+		if !strings.HasPrefix(rig.Extranonce, "ab") || len(rig.Extranonce) != 6 || seen[rig.Extranonce] {
+			t.Fatalf("rig %s has bad extranonce %s", rig.Worker, rig.Extranonce)
+		}
+		seen[rig.Extranonce] = true
+		if rig.Accepted < 3 || rig.Rejected != 0 {
+			t.Fatalf("rig %s: unexpected stats %+v", rig.Worker, rig)
+		}
+	}
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.bad != 0 {
+		t.Fatalf("pool saw %d bad shares", pool.bad)
+	}
+	prefixes := map[string]int{}
+	for nonce := range pool.nonces {
+		prefixes[nonce[:6]]++
+	}
+	if len(prefixes) != 2 {
+		t.Fatalf("expected shares from 2 rigs upstream, got %+v", prefixes)
+	}
+}
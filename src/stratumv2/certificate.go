@@ -0,0 +1,203 @@
+package stratumv2
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerKeys are what the pool proves itself with during the handshake
+type ServerKeys struct {
+	Static KeyPair
+	// Authority signs a certificate for the static key on every handshake,
+	// miners pin its public key rather than the static one
+	Authority KeyPair
+	// CertValidity is how long those certificates are valid, 1h if 0
+	CertValidity time.Duration
+}
+
+const defaultCertValidity = time.Hour
+
+func (keys ServerKeys) certValidity() time.Duration {
+	if keys.CertValidity == 0 {
+		return defaultCertValidity
+	}
+	return keys.CertValidity
+}
+
+// certificateLen is the size of the SIGNATURE_NOISE_MESSAGE
+const certificateLen = 2 + 4 + 4 + 64
+
+// certificate is the SIGNATURE_NOISE_MESSAGE ending the handshake: the
+// authority's schnorr signature over the pool's static key and the window
+// the signature is valid in, unix seconds
+type certificate struct {
+	Version       uint16
+	ValidFrom     uint32
+	NotValidAfter uint32
+	Signature     [64]byte
+}
+
+func (c *certificate) encode() []byte {
+	e := encoder{}
+	e.u16(c.Version)
+	e.u32(c.ValidFrom)
+	e.u32(c.NotValidAfter)
+	e.buf = append(e.buf, c.Signature[:]...)
+	return e.buf
+}
+
+func decodeCertificate(raw []byte) (c certificate, err error) {
+	if len(raw) != certificateLen {
+		return c, fmt.Errorf("expected %d byte certificate, got %d", certificateLen, len(raw))
+	}
+	d := decoder{buf: raw}
+	c.Version = d.u16()
+	c.ValidFrom = d.u32()
+	c.NotValidAfter = d.u32()
+	copy(c.Signature[:], d.take(64))
+	return c, nil
+}
+
+// digest is what the authority signs, the static key is x-only
+func (c *certificate) digest(static []byte) []byte {
+	e := encoder{}
+	e.u16(c.Version)
+	e.u32(c.ValidFrom)
+	e.u32(c.NotValidAfter)
+	sum := sha256.Sum256(append(e.buf, static...))
+	return sum[:]
+}
+
+func signCertificate(keys ServerKeys, now time.Time) (certificate, error) {
+	c := certificate{
+		ValidFrom:     uint32(now.Unix()),
+		NotValidAfter: uint32(now.Add(keys.certValidity()).Unix()),
+	}
+	aux := make([]byte, 32)
+	if _, err := rand.Read(aux); err != nil {
+		return c, err
+	}
+	sig, err := schnorrSign(keys.Authority.privateKey(), c.digest(keys.Static.Public[:]), aux)
+	c.Signature = sig
+	return c, err
+}
+
+// Identity is the pool's static key along with a certificate for it. The
+// certificate is signed up front and renewed in the background, so the
+// authority key is never used on behalf of a connecting client
+type Identity struct {
+	keys ServerKeys
+	lock sync.RWMutex
+	cert certificate
+}
+
+// NewIdentity signs the first certificate for the static key
+func NewIdentity(keys ServerKeys) (*Identity, error) {
+	id := &Identity{keys: keys}
+	return id, id.renew(time.Now())
+}
+
+func (id *Identity) renew(now time.Time) error {
+	cert, err := signCertificate(id.keys, now)
+	if err != nil {
+		return err
+	}
+	id.lock.Lock()
+	defer id.lock.Unlock()
+	id.cert = cert
+	return nil
+}
+
+func (id *Identity) certificate() certificate {
+	id.lock.RLock()
+	defer id.lock.RUnlock()
+	return id.cert
+}
+
+// RenewInterval is how often the certificate should be re-signed, half its
+// validity so there is always a valid one
+func (id *Identity) RenewInterval() time.Duration {
+	return id.keys.certValidity() / 2
+}
+
+// Renew signs a new certificate valid from now
+func (id *Identity) Renew() error {
+	return id.renew(time.Now())
+}
+
+func (c *certificate) verify(authority, static []byte, now time.Time) error {
+	if !schnorrVerify(authority, c.digest(static), c.Signature[:]) {
+		return fmt.Errorf("certificate is not signed by authority %s", EncodeAuthorityKey(authority))
+	}
+	if unix := now.Unix(); unix < int64(c.ValidFrom) || unix > int64(c.NotValidAfter) {
+		return fmt.Errorf("certificate is only valid from %s to %s",
+			time.Unix(int64(c.ValidFrom), 0).UTC(), time.Unix(int64(c.NotValidAfter), 0).UTC())
+	}
+	return nil
+}
+
+// authority public keys are shared as base58check with a two byte version
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var authorityKeyVersion = []byte{1, 0}
+
+// EncodeAuthorityKey encodes an x-only public key the way miners configure
+// the pool's authority key
+func EncodeAuthorityKey(public []byte) string {
+	payload := append(append([]byte{}, authorityKeyVersion...), public...)
+	payload = append(payload, checksum(payload)...)
+	n := new(big.Int).SetBytes(payload)
+	radix, mod := big.NewInt(58), new(big.Int)
+	out := []byte{}
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range payload {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+// ParseAuthorityKey decodes an authority key from EncodeAuthorityKey
+func ParseAuthorityKey(encoded string) ([]byte, error) {
+	n := new(big.Int)
+	zeros := 0
+	for i, c := range encoded {
+		digit := strings.IndexRune(base58Alphabet, c)
+		if digit < 0 {
+			return nil, fmt.Errorf("malformed authority key: invalid character %q", c)
+		}
+		if digit == 0 && i == zeros {
+			zeros++
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+	payload := append(make([]byte, zeros), n.Bytes()...)
+	if len(payload) != len(authorityKeyVersion)+keyLen+4 {
+		return nil, fmt.Errorf("malformed authority key: unexpected length %d", len(payload))
+	}
+	body, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if string(checksum(body)) != string(sum) || string(body[:2]) != string(authorityKeyVersion) {
+		return nil, fmt.Errorf("malformed authority key: bad checksum or version")
+	}
+	return body[2:], nil
+}
+
+func checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
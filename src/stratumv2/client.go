@@ -0,0 +1,103 @@
+package stratumv2
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Client is a minimal sv2 mining client. It exists so the listener can be
+// exercised end to end without external mining software
+type Client struct {
+	conn *Conn
+}
+
+// Dial connects to a pool, runs the noise handshake and sets up a mining
+// protocol connection. If authority is set the pool's certificate must be
+// signed by it, see ParseAuthorityKey
+func Dial(address string, authority []byte, vendor string) (*Client, error) {
+	raw, err := net.DialTimeout("tcp", address, setupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewClient(raw, authority, vendor)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewClient sets up a mining protocol connection over an existing socket
+func NewClient(raw net.Conn, authority []byte, vendor string) (*Client, error) {
+	raw.SetDeadline(time.Now().Add(setupTimeout))
+	defer raw.SetDeadline(time.Time{})
+
+	conn, err := Handshake(raw, authority)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(&SetupConnection{
+		Protocol:   ProtocolMining,
+		MinVersion: ProtocolVersion,
+		MaxVersion: ProtocolVersion,
+		Vendor:     vendor,
+	}); err != nil {
+		return nil, err
+	}
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	switch m := msg.(type) {
+	case *SetupConnectionSuccess:
+		return &Client{conn: conn}, nil
+	case *SetupConnectionError:
+		return nil, fmt.Errorf("pool rejected connection: %s", m.ErrorCode)
+	}
+	return nil, fmt.Errorf("unexpected response to SetupConnection: 0x%02x", msg.MsgType())
+}
+
+// PoolKey is the static key the pool presented during the handshake
+func (c *Client) PoolKey() []byte {
+	return c.conn.RemoteStatic
+}
+
+// OpenChannel opens a standard channel. The pool may start sending jobs as
+// soon as the channel is open, read them with ReadMessage
+func (c *Client) OpenChannel(requestId uint32, user string) (*OpenStandardMiningChannelSuccess, error) {
+	if err := c.conn.WriteMessage(&OpenStandardMiningChannel{
+		RequestId:    requestId,
+		UserIdentity: user,
+	}); err != nil {
+		return nil, err
+	}
+	msg, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	switch m := msg.(type) {
+	case *OpenStandardMiningChannelSuccess:
+		return m, nil
+	case *OpenMiningChannelError:
+		return nil, fmt.Errorf("pool rejected channel: %s", m.ErrorCode)
+	}
+	return nil, fmt.Errorf("unexpected response to OpenStandardMiningChannel: 0x%02x", msg.MsgType())
+}
+
+func (c *Client) Submit(share SubmitSharesStandard) error {
+	return c.conn.WriteMessage(&share)
+}
+
+func (c *Client) CloseChannel(channelId uint32) error {
+	return c.conn.WriteMessage(&CloseChannel{ChannelId: channelId})
+}
+
+// ReadMessage blocks until the next message from the pool arrives
+func (c *Client) ReadMessage() (Message, error) {
+	return c.conn.ReadMessage()
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
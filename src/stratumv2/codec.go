@@ -0,0 +1,104 @@
+package stratumv2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// encoder/decoder for the sv2 binary data types. Everything is little endian,
+// strings and byte arrays are length prefixed
+
+var ErrShortMessage = fmt.Errorf("message too short")
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) u8(v uint8) { e.buf = append(e.buf, v) }
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.u8(1)
+	} else {
+		e.u8(0)
+	}
+}
+
+func (e *encoder) u16(v uint16) {
+	e.buf = append(e.buf, byte(v), byte(v>>8))
+}
+
+func (e *encoder) u24(v uint32) {
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16))
+}
+
+func (e *encoder) u32(v uint32) {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) u64(v uint64) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) f32(v float32) { e.u32(math.Float32bits(v)) }
+
+func (e *encoder) u256(v [32]byte) { e.buf = append(e.buf, v[:]...) }
+
+// str0_255, anything longer is truncated
+func (e *encoder) str(v string) {
+	if len(v) > math.MaxUint8 {
+		v = v[:math.MaxUint8]
+	}
+	e.u8(uint8(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// b0_32
+func (e *encoder) b032(v []byte) {
+	if len(v) > 32 {
+		v = v[:32]
+	}
+	e.u8(uint8(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if len(d.buf) < n {
+		d.err = ErrShortMessage
+		return make([]byte, n)
+	}
+	out := d.buf[:n]
+	d.buf = d.buf[n:]
+	return out
+}
+
+func (d *decoder) u8() uint8    { return d.take(1)[0] }
+func (d *decoder) bool() bool   { return d.u8() != 0 }
+func (d *decoder) u16() uint16  { return binary.LittleEndian.Uint16(d.take(2)) }
+func (d *decoder) u32() uint32  { return binary.LittleEndian.Uint32(d.take(4)) }
+func (d *decoder) u64() uint64  { return binary.LittleEndian.Uint64(d.take(8)) }
+func (d *decoder) f32() float32 { return math.Float32frombits(d.u32()) }
+func (d *decoder) str() string  { return string(d.take(int(d.u8()))) }
+func (d *decoder) b032() []byte { return append([]byte{}, d.take(int(d.u8()))...) }
+func (d *decoder) u256() (v [32]byte) {
+	copy(v[:], d.take(32))
+	return v
+}
+
+func (d *decoder) u24() uint32 {
+	b := d.take(3)
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
@@ -0,0 +1,178 @@
+package stratumv2
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const frameHeaderLen = 6
+
+// noise transport messages are limited to 64KiB including the mac, so
+// payloads are encrypted in chunks of this size
+const maxChunkPlaintext = 65535 - macLen
+
+// max payload size representable by the u24 length in the frame header
+const maxPayloadLen = 1<<24 - 1
+
+// nothing a miner sends comes close, refuse anything bigger rather than
+// allocating whatever the header claims
+const maxInboundPayload = 1 << 18
+
+// channelMsgBit is set in the extension type of messages addressed to a
+// specific channel
+const channelMsgBit uint16 = 0x8000
+
+type Frame struct {
+	ExtensionType uint16
+	MsgType       uint8
+	Payload       []byte
+}
+
+// IsChannelMessage reports whether the channel_msg bit is set
+func (f Frame) IsChannelMessage() bool {
+	return f.ExtensionType&channelMsgBit != 0
+}
+
+func encodeFrameHeader(extensionType uint16, msgType uint8, length int) []byte {
+	e := encoder{}
+	e.u16(extensionType)
+	e.u8(msgType)
+	e.u24(uint32(length))
+	return e.buf
+}
+
+// Conn is an encrypted sv2 connection. Reads must happen from a single
+// goroutine, writes are safe for concurrent use
+type Conn struct {
+	conn      net.Conn
+	send      *cipherState
+	recv      *cipherState
+	writeLock sync.Mutex
+	// static key of the pool, only set on the client side
+	RemoteStatic []byte
+}
+
+// Accept runs the responder side of the noise handshake on a fresh connection
+func Accept(conn net.Conn, id *Identity) (*Conn, error) {
+	send, recv, err := handshakeResponder(conn, id)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn, send: send, recv: recv}, nil
+}
+
+// Handshake runs the initiator side of the noise handshake on a fresh
+// connection. If authority is provided the pool's certificate must be signed
+// by it and currently valid
+func Handshake(conn net.Conn, authority []byte) (*Conn, error) {
+	send, recv, rs, cert, err := handshakeInitiator(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(authority) > 0 {
+		if err := cert.verify(authority, rs, time.Now()); err != nil {
+			return nil, errors.Wrap(ErrHandshakeFailed, err.Error())
+		}
+	}
+	return &Conn{conn: conn, send: send, recv: recv, RemoteStatic: rs}, nil
+}
+
+func (c *Conn) WriteFrame(f Frame) error {
+	if len(f.Payload) > maxPayloadLen {
+		return fmt.Errorf("payload too large: %d", len(f.Payload))
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	header, err := c.send.encrypt(nil, encodeFrameHeader(f.ExtensionType, f.MsgType, len(f.Payload)))
+	if err != nil {
+		return err
+	}
+	out := header
+	for remaining := f.Payload; len(remaining) > 0; {
+		n := len(remaining)
+		if n > maxChunkPlaintext {
+			n = maxChunkPlaintext
+		}
+		chunk, err := c.send.encrypt(nil, remaining[:n])
+		if err != nil {
+			return err
+		}
+		out = append(out, chunk...)
+		remaining = remaining[n:]
+	}
+	_, err = c.conn.Write(out)
+	return err
+}
+
+func (c *Conn) ReadFrame() (Frame, error) {
+	encHeader := make([]byte, frameHeaderLen+macLen)
+	if _, err := io.ReadFull(c.conn, encHeader); err != nil {
+		return Frame{}, err
+	}
+	rawHeader, err := c.recv.decrypt(nil, encHeader)
+	if err != nil {
+		return Frame{}, err
+	}
+	d := decoder{buf: rawHeader}
+	frame := Frame{
+		ExtensionType: d.u16(),
+		MsgType:       d.u8(),
+	}
+	length := int(d.u24())
+	if length > maxInboundPayload {
+		return Frame{}, fmt.Errorf("frame too large: %d", length)
+	}
+
+	frame.Payload = make([]byte, 0, length)
+	for remaining := length; remaining > 0; {
+		n := remaining
+		if n > maxChunkPlaintext {
+			n = maxChunkPlaintext
+		}
+		chunk := make([]byte, n+macLen)
+		if _, err := io.ReadFull(c.conn, chunk); err != nil {
+			return Frame{}, err
+		}
+		plain, err := c.recv.decrypt(nil, chunk)
+		if err != nil {
+			return Frame{}, err
+		}
+		frame.Payload = append(frame.Payload, plain...)
+		remaining -= n
+	}
+	return frame, nil
+}
+
+// WriteMessage encodes and sends a message
+func (c *Conn) WriteMessage(msg Message) error {
+	ext := uint16(0)
+	if msg.channelMessage() {
+		ext |= channelMsgBit
+	}
+	e := encoder{}
+	msg.encode(&e)
+	return c.WriteFrame(Frame{ExtensionType: ext, MsgType: msg.MsgType(), Payload: e.buf})
+}
+
+// ReadMessage reads and decodes the next message
+func (c *Conn) ReadMessage() (Message, error) {
+	frame, err := c.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMessage(frame)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
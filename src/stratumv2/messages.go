@@ -0,0 +1,398 @@
+package stratumv2
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Mining protocol message types. Framing, encryption and the connection and
+// channel messages follow the sv2 spec, but sv2 has no kaspa profile and
+// kaspa's header doesn't fit the bitcoin one. NewMiningJob, SetNewPrevHash and
+// SubmitSharesStandard therefore use a private kaspa layout, see each of them.
+// Spec sv2 miners and proxies can't mine on this, only clients built against
+// this package, e.g. Client
+const (
+	MsgSetupConnection                  uint8 = 0x00
+	MsgSetupConnectionSuccess           uint8 = 0x01
+	MsgSetupConnectionError             uint8 = 0x02
+	MsgOpenStandardMiningChannel        uint8 = 0x10
+	MsgOpenStandardMiningChannelSuccess uint8 = 0x11
+	MsgOpenMiningChannelError           uint8 = 0x12
+	MsgNewMiningJob                     uint8 = 0x15
+	MsgCloseChannel                     uint8 = 0x18
+	MsgSubmitSharesStandard             uint8 = 0x1a
+	MsgSubmitSharesSuccess              uint8 = 0x1c
+	MsgSubmitSharesError                uint8 = 0x1d
+	MsgSetNewPrevHash                   uint8 = 0x20
+	MsgSetTarget                        uint8 = 0x21
+)
+
+const ProtocolMining uint8 = 0
+
+// Error codes sent back to the miner
+const (
+	ErrCodeUnsupportedProtocol = "unsupported-protocol"
+	ErrCodeProtocolVersion     = "protocol-version-mismatch"
+	ErrCodeUnknownUser         = "unknown-user"
+	ErrCodeInvalidChannelId    = "invalid-channel-id"
+	ErrCodeInvalidJobId        = "invalid-job-id"
+	ErrCodeStaleShare          = "stale-share"
+	ErrCodeDuplicateShare      = "duplicate-share"
+	ErrCodeDifficultyTooLow    = "difficulty-too-low"
+	ErrCodeInvalidShare        = "invalid-share"
+)
+
+// Message is any sv2 mining protocol message
+type Message interface {
+	MsgType() uint8
+	channelMessage() bool
+	encode(e *encoder)
+	decode(d *decoder)
+}
+
+type SetupConnection struct {
+	Protocol        uint8
+	MinVersion      uint16
+	MaxVersion      uint16
+	Flags           uint32
+	EndpointHost    string
+	EndpointPort    uint16
+	Vendor          string
+	HardwareVersion string
+	Firmware        string
+	DeviceId        string
+}
+
+func (SetupConnection) MsgType() uint8       { return MsgSetupConnection }
+func (SetupConnection) channelMessage() bool { return false }
+func (m *SetupConnection) encode(e *encoder) {
+	e.u8(m.Protocol)
+	e.u16(m.MinVersion)
+	e.u16(m.MaxVersion)
+	e.u32(m.Flags)
+	e.str(m.EndpointHost)
+	e.u16(m.EndpointPort)
+	e.str(m.Vendor)
+	e.str(m.HardwareVersion)
+	e.str(m.Firmware)
+	e.str(m.DeviceId)
+}
+func (m *SetupConnection) decode(d *decoder) {
+	m.Protocol = d.u8()
+	m.MinVersion = d.u16()
+	m.MaxVersion = d.u16()
+	m.Flags = d.u32()
+	m.EndpointHost = d.str()
+	m.EndpointPort = d.u16()
+	m.Vendor = d.str()
+	m.HardwareVersion = d.str()
+	m.Firmware = d.str()
+	m.DeviceId = d.str()
+}
+
+type SetupConnectionSuccess struct {
+	UsedVersion uint16
+	Flags       uint32
+}
+
+func (SetupConnectionSuccess) MsgType() uint8       { return MsgSetupConnectionSuccess }
+func (SetupConnectionSuccess) channelMessage() bool { return false }
+func (m *SetupConnectionSuccess) encode(e *encoder) {
+	e.u16(m.UsedVersion)
+	e.u32(m.Flags)
+}
+func (m *SetupConnectionSuccess) decode(d *decoder) {
+	m.UsedVersion = d.u16()
+	m.Flags = d.u32()
+}
+
+type SetupConnectionError struct {
+	Flags     uint32
+	ErrorCode string
+}
+
+func (SetupConnectionError) MsgType() uint8       { return MsgSetupConnectionError }
+func (SetupConnectionError) channelMessage() bool { return false }
+func (m *SetupConnectionError) encode(e *encoder) {
+	e.u32(m.Flags)
+	e.str(m.ErrorCode)
+}
+func (m *SetupConnectionError) decode(d *decoder) {
+	m.Flags = d.u32()
+	m.ErrorCode = d.str()
+}
+
+type OpenStandardMiningChannel struct {
+	RequestId       uint32
+	UserIdentity    string
+	NominalHashRate float32
+	MaxTarget       [32]byte
+}
+
+func (OpenStandardMiningChannel) MsgType() uint8       { return MsgOpenStandardMiningChannel }
+func (OpenStandardMiningChannel) channelMessage() bool { return false }
+func (m *OpenStandardMiningChannel) encode(e *encoder) {
+	e.u32(m.RequestId)
+	e.str(m.UserIdentity)
+	e.f32(m.NominalHashRate)
+	e.u256(m.MaxTarget)
+}
+func (m *OpenStandardMiningChannel) decode(d *decoder) {
+	m.RequestId = d.u32()
+	m.UserIdentity = d.str()
+	m.NominalHashRate = d.f32()
+	m.MaxTarget = d.u256()
+}
+
+type OpenStandardMiningChannelSuccess struct {
+	RequestId        uint32
+	ChannelId        uint32
+	Target           [32]byte
+	ExtranoncePrefix []byte
+	GroupChannelId   uint32
+}
+
+func (OpenStandardMiningChannelSuccess) MsgType() uint8 {
+	return MsgOpenStandardMiningChannelSuccess
+}
+func (OpenStandardMiningChannelSuccess) channelMessage() bool { return false }
+func (m *OpenStandardMiningChannelSuccess) encode(e *encoder) {
+	e.u32(m.RequestId)
+	e.u32(m.ChannelId)
+	e.u256(m.Target)
+	e.b032(m.ExtranoncePrefix)
+	e.u32(m.GroupChannelId)
+}
+func (m *OpenStandardMiningChannelSuccess) decode(d *decoder) {
+	m.RequestId = d.u32()
+	m.ChannelId = d.u32()
+	m.Target = d.u256()
+	m.ExtranoncePrefix = d.b032()
+	m.GroupChannelId = d.u32()
+}
+
+type OpenMiningChannelError struct {
+	RequestId uint32
+	ErrorCode string
+}
+
+func (OpenMiningChannelError) MsgType() uint8       { return MsgOpenMiningChannelError }
+func (OpenMiningChannelError) channelMessage() bool { return false }
+func (m *OpenMiningChannelError) encode(e *encoder) {
+	e.u32(m.RequestId)
+	e.str(m.ErrorCode)
+}
+func (m *OpenMiningChannelError) decode(d *decoder) {
+	m.RequestId = d.u32()
+	m.ErrorCode = d.str()
+}
+
+// NewMiningJob uses the private kaspa layout, not the spec one. There is no
+// merkle root for the miner to roll, so MerkleRoot carries the 32 byte pre-pow
+// header hash, and the template timestamp is appended since it is an input to
+// the kHeavyHash pow rather than something the miner may pick
+type NewMiningJob struct {
+	ChannelId  uint32
+	JobId      uint32
+	FutureJob  bool
+	Version    uint32
+	MerkleRoot [32]byte
+	Timestamp  uint64
+}
+
+func (NewMiningJob) MsgType() uint8       { return MsgNewMiningJob }
+func (NewMiningJob) channelMessage() bool { return true }
+func (m *NewMiningJob) encode(e *encoder) {
+	e.u32(m.ChannelId)
+	e.u32(m.JobId)
+	e.bool(m.FutureJob)
+	e.u32(m.Version)
+	e.u256(m.MerkleRoot)
+	e.u64(m.Timestamp)
+}
+func (m *NewMiningJob) decode(d *decoder) {
+	m.ChannelId = d.u32()
+	m.JobId = d.u32()
+	m.FutureJob = d.bool()
+	m.Version = d.u32()
+	m.MerkleRoot = d.u256()
+	m.Timestamp = d.u64()
+}
+
+// SetNewPrevHash activates a future job. In the private kaspa layout PrevHash
+// is the first direct parent of the template and MinNTime is widened to the 64
+// bit millisecond timestamp kaspa uses
+type SetNewPrevHash struct {
+	ChannelId uint32
+	JobId     uint32
+	PrevHash  [32]byte
+	MinNTime  uint64
+	NBits     uint32
+}
+
+func (SetNewPrevHash) MsgType() uint8       { return MsgSetNewPrevHash }
+func (SetNewPrevHash) channelMessage() bool { return true }
+func (m *SetNewPrevHash) encode(e *encoder) {
+	e.u32(m.ChannelId)
+	e.u32(m.JobId)
+	e.u256(m.PrevHash)
+	e.u64(m.MinNTime)
+	e.u32(m.NBits)
+}
+func (m *SetNewPrevHash) decode(d *decoder) {
+	m.ChannelId = d.u32()
+	m.JobId = d.u32()
+	m.PrevHash = d.u256()
+	m.MinNTime = d.u64()
+	m.NBits = d.u32()
+}
+
+type SetTarget struct {
+	ChannelId     uint32
+	MaximumTarget [32]byte
+}
+
+func (SetTarget) MsgType() uint8       { return MsgSetTarget }
+func (SetTarget) channelMessage() bool { return true }
+func (m *SetTarget) encode(e *encoder) {
+	e.u32(m.ChannelId)
+	e.u256(m.MaximumTarget)
+}
+func (m *SetTarget) decode(d *decoder) {
+	m.ChannelId = d.u32()
+	m.MaximumTarget = d.u256()
+}
+
+// SubmitSharesStandard uses the private kaspa layout, nonce and ntime are
+// widened to 64 bits
+type SubmitSharesStandard struct {
+	ChannelId      uint32
+	SequenceNumber uint32
+	JobId          uint32
+	Nonce          uint64
+	NTime          uint64
+	Version        uint32
+}
+
+func (SubmitSharesStandard) MsgType() uint8       { return MsgSubmitSharesStandard }
+func (SubmitSharesStandard) channelMessage() bool { return true }
+func (m *SubmitSharesStandard) encode(e *encoder) {
+	e.u32(m.ChannelId)
+	e.u32(m.SequenceNumber)
+	e.u32(m.JobId)
+	e.u64(m.Nonce)
+	e.u64(m.NTime)
+	e.u32(m.Version)
+}
+func (m *SubmitSharesStandard) decode(d *decoder) {
+	m.ChannelId = d.u32()
+	m.SequenceNumber = d.u32()
+	m.JobId = d.u32()
+	m.Nonce = d.u64()
+	m.NTime = d.u64()
+	m.Version = d.u32()
+}
+
+type SubmitSharesSuccess struct {
+	ChannelId               uint32
+	LastSequenceNumber      uint32
+	NewSubmitsAcceptedCount uint32
+	NewSharesSum            uint64
+}
+
+func (SubmitSharesSuccess) MsgType() uint8       { return MsgSubmitSharesSuccess }
+func (SubmitSharesSuccess) channelMessage() bool { return true }
+func (m *SubmitSharesSuccess) encode(e *encoder) {
+	e.u32(m.ChannelId)
+	e.u32(m.LastSequenceNumber)
+	e.u32(m.NewSubmitsAcceptedCount)
+	e.u64(m.NewSharesSum)
+}
+func (m *SubmitSharesSuccess) decode(d *decoder) {
+	m.ChannelId = d.u32()
+	m.LastSequenceNumber = d.u32()
+	m.NewSubmitsAcceptedCount = d.u32()
+	m.NewSharesSum = d.u64()
+}
+
+type SubmitSharesError struct {
+	ChannelId      uint32
+	SequenceNumber uint32
+	ErrorCode      string
+}
+
+func (SubmitSharesError) MsgType() uint8       { return MsgSubmitSharesError }
+func (SubmitSharesError) channelMessage() bool { return true }
+func (m *SubmitSharesError) encode(e *encoder) {
+	e.u32(m.ChannelId)
+	e.u32(m.SequenceNumber)
+	e.str(m.ErrorCode)
+}
+func (m *SubmitSharesError) decode(d *decoder) {
+	m.ChannelId = d.u32()
+	m.SequenceNumber = d.u32()
+	m.ErrorCode = d.str()
+}
+
+type CloseChannel struct {
+	ChannelId  uint32
+	ReasonCode string
+}
+
+func (CloseChannel) MsgType() uint8       { return MsgCloseChannel }
+func (CloseChannel) channelMessage() bool { return true }
+func (m *CloseChannel) encode(e *encoder) {
+	e.u32(m.ChannelId)
+	e.str(m.ReasonCode)
+}
+func (m *CloseChannel) decode(d *decoder) {
+	m.ChannelId = d.u32()
+	m.ReasonCode = d.str()
+}
+
+func newMessage(msgType uint8) (Message, error) {
+	switch msgType {
+	case MsgSetupConnection:
+		return &SetupConnection{}, nil
+	case MsgSetupConnectionSuccess:
+		return &SetupConnectionSuccess{}, nil
+	case MsgSetupConnectionError:
+		return &SetupConnectionError{}, nil
+	case MsgOpenStandardMiningChannel:
+		return &OpenStandardMiningChannel{}, nil
+	case MsgOpenStandardMiningChannelSuccess:
+		return &OpenStandardMiningChannelSuccess{}, nil
+	case MsgOpenMiningChannelError:
+		return &OpenMiningChannelError{}, nil
+	case MsgNewMiningJob:
+		return &NewMiningJob{}, nil
+	case MsgSetNewPrevHash:
+		return &SetNewPrevHash{}, nil
+	case MsgSetTarget:
+		return &SetTarget{}, nil
+	case MsgSubmitSharesStandard:
+		return &SubmitSharesStandard{}, nil
+	case MsgSubmitSharesSuccess:
+		return &SubmitSharesSuccess{}, nil
+	case MsgSubmitSharesError:
+		return &SubmitSharesError{}, nil
+	case MsgCloseChannel:
+		return &CloseChannel{}, nil
+	}
+	return nil, fmt.Errorf("unsupported message type 0x%02x", msgType)
+}
+
+// DecodeMessage decodes the payload of a frame
+func DecodeMessage(f Frame) (Message, error) {
+	msg, err := newMessage(f.MsgType)
+	if err != nil {
+		return nil, err
+	}
+	d := decoder{buf: f.Payload}
+	msg.decode(&d)
+	if d.err != nil {
+		return nil, errors.Wrapf(d.err, "failed decoding message 0x%02x", f.MsgType)
+	}
+	return msg, nil
+}
@@ -0,0 +1,329 @@
+package stratumv2
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Noise_NX handshake as specified for the stratum v2 transport. The initiator
+// (miner) has no static key. The responder (pool) sends its static key
+// encrypted, followed by a certificate for it signed by an authority key the
+// miner pins. Public keys go over the wire ElligatorSwift encoded
+//
+//	-> e
+//	<- e, ee, s, es, SIGNATURE_NOISE_MESSAGE
+const noiseProtocolName = "Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256"
+
+const (
+	keyLen      = 32
+	macLen      = chacha20poly1305.Overhead
+	hashLen     = sha256.Size
+	maxNonce    = ^uint64(0)
+	handshakeA1 = ellswiftLen // e
+	// e, enc(s), enc(certificate)
+	handshakeA2 = ellswiftLen + ellswiftLen + macLen + certificateLen + macLen
+)
+
+var ErrHandshakeFailed = fmt.Errorf("noise handshake failed")
+
+// KeyPair is a secp256k1 key, Public is the x-only public key
+type KeyPair struct {
+	Private [keyLen]byte
+	Public  [keyLen]byte
+}
+
+func GenerateKeyPair() (KeyPair, error) {
+	private, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return KeyPair{}, err
+	}
+	return NewKeyPair(private.Serialize())
+}
+
+// NewKeyPair derives the key pair for an existing private key. The pool's
+// keys should be loaded this way so the public keys miners pin stay the same
+// across restarts
+func NewKeyPair(private []byte) (KeyPair, error) {
+	kp := KeyPair{}
+	if len(private) != keyLen {
+		return kp, fmt.Errorf("expected %d byte private key, got %d", keyLen, len(private))
+	}
+	d := secp256k1.ModNScalar{}
+	if overflow := d.SetByteSlice(private); overflow || d.IsZero() {
+		return kp, fmt.Errorf("private key out of range")
+	}
+	copy(kp.Private[:], private)
+	copy(kp.Public[:], schnorr.SerializePubKey(secp256k1.NewPrivateKey(&d).PubKey()))
+	return kp, nil
+}
+
+func (kp KeyPair) privateKey() *secp256k1.PrivateKey {
+	return secp256k1.PrivKeyFromBytes(kp.Private[:])
+}
+
+// ellswift is a fresh random encoding of the public key
+func (kp KeyPair) ellswift() ([]byte, error) {
+	return ellswiftEncode(feFromBytes(kp.Public[:]), rand.Reader)
+}
+
+// cipherState encrypts one direction of the transport
+type cipherState struct {
+	key    [32]byte
+	hasKey bool
+	nonce  uint64
+}
+
+func (cs *cipherState) init(key []byte) {
+	copy(cs.key[:], key)
+	cs.hasKey = true
+	cs.nonce = 0
+}
+
+func (cs *cipherState) nonceBytes() []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(n[4:], cs.nonce)
+	return n
+}
+
+func (cs *cipherState) encrypt(ad, plaintext []byte) ([]byte, error) {
+	if !cs.hasKey {
+		return plaintext, nil
+	}
+	if cs.nonce == maxNonce {
+		return nil, fmt.Errorf("noise nonce exhausted")
+	}
+	aead, err := chacha20poly1305.New(cs.key[:])
+	if err != nil {
+		return nil, err
+	}
+	out := aead.Seal(nil, cs.nonceBytes(), plaintext, ad)
+	cs.nonce++
+	return out, nil
+}
+
+func (cs *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if !cs.hasKey {
+		return ciphertext, nil
+	}
+	if cs.nonce == maxNonce {
+		return nil, fmt.Errorf("noise nonce exhausted")
+	}
+	aead, err := chacha20poly1305.New(cs.key[:])
+	if err != nil {
+		return nil, err
+	}
+	out, err := aead.Open(nil, cs.nonceBytes(), ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	cs.nonce++
+	return out, nil
+}
+
+type symmetricState struct {
+	cs cipherState
+	ck [hashLen]byte
+	h  [hashLen]byte
+}
+
+func newSymmetricState() *symmetricState {
+	ss := &symmetricState{}
+	if len(noiseProtocolName) <= hashLen {
+		copy(ss.h[:], noiseProtocolName)
+	} else {
+		ss.h = sha256.Sum256([]byte(noiseProtocolName))
+	}
+	ss.ck = ss.h
+	ss.mixHash(nil) // empty prologue
+	return ss
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h[:])
+	h.Write(data)
+	copy(ss.h[:], h.Sum(nil))
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	ck, key := hkdf2(ss.ck[:], ikm)
+	copy(ss.ck[:], ck)
+	ss.cs.init(key)
+}
+
+func (ss *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := ss.cs.encrypt(ss.h[:], plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decrypt(ss.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split derives the transport keys, the first for initiator -> responder
+func (ss *symmetricState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf2(ss.ck[:], nil)
+	c1, c2 := &cipherState{}, &cipherState{}
+	c1.init(k1)
+	c2.init(k2)
+	return c1, c2
+}
+
+func hmacSha256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// hkdf2 is the two output HKDF from the noise spec
+func hkdf2(ck, ikm []byte) ([]byte, []byte) {
+	temp := hmacSha256(ck, ikm)
+	out1 := hmacSha256(temp, []byte{0x01})
+	out2 := hmacSha256(temp, out1, []byte{0x02})
+	return out1, out2
+}
+
+// handshakeInitiator performs the client side of the handshake and returns
+// the send and receive ciphers along with the responder's x-only static key
+// and certificate
+func handshakeInitiator(rw io.ReadWriter) (send, recv *cipherState, remoteStatic []byte,
+	cert certificate, err error) {
+	fail := func(err error) (*cipherState, *cipherState, []byte, certificate, error) {
+		return nil, nil, nil, cert, err
+	}
+	ss := newSymmetricState()
+	e, err := GenerateKeyPair()
+	if err != nil {
+		return fail(err)
+	}
+	ee, err := e.ellswift()
+	if err != nil {
+		return fail(err)
+	}
+
+	// -> e
+	ss.mixHash(ee)
+	if _, err := ss.encryptAndHash(nil); err != nil {
+		return fail(err)
+	}
+	if _, err := rw.Write(ee); err != nil {
+		return fail(err)
+	}
+
+	// <- e, ee, s, es, SIGNATURE_NOISE_MESSAGE
+	msg := make([]byte, handshakeA2)
+	if _, err := io.ReadFull(rw, msg); err != nil {
+		return fail(err)
+	}
+	re := msg[:ellswiftLen]
+	ss.mixHash(re)
+	secret, err := ellswiftXDH(e.privateKey(), ee, re, re)
+	if err != nil {
+		return fail(ErrHandshakeFailed)
+	}
+	ss.mixKey(secret)
+	staticEnd := ellswiftLen + ellswiftLen + macLen
+	rs, err := ss.decryptAndHash(msg[ellswiftLen:staticEnd])
+	if err != nil {
+		return fail(ErrHandshakeFailed)
+	}
+	secret, err = ellswiftXDH(e.privateKey(), ee, rs, rs)
+	if err != nil {
+		return fail(ErrHandshakeFailed)
+	}
+	ss.mixKey(secret)
+	rawCert, err := ss.decryptAndHash(msg[staticEnd:])
+	if err != nil {
+		return fail(ErrHandshakeFailed)
+	}
+	if cert, err = decodeCertificate(rawCert); err != nil {
+		return fail(ErrHandshakeFailed)
+	}
+
+	static, err := ellswiftDecode(rs)
+	if err != nil {
+		return fail(ErrHandshakeFailed)
+	}
+
+	c1, c2 := ss.split()
+	return c1, c2, static.Bytes()[:], cert, nil
+}
+
+// handshakeResponder performs the pool side of the handshake and returns the
+// send and receive ciphers
+func handshakeResponder(rw io.ReadWriter, id *Identity) (send, recv *cipherState, err error) {
+	ss := newSymmetricState()
+
+	// -> e
+	re := make([]byte, handshakeA1)
+	if _, err := io.ReadFull(rw, re); err != nil {
+		return nil, nil, err
+	}
+	ss.mixHash(re)
+	if _, err := ss.decryptAndHash(nil); err != nil {
+		return nil, nil, ErrHandshakeFailed
+	}
+
+	// <- e, ee, s, es, SIGNATURE_NOISE_MESSAGE
+	e, err := GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	ee, err := e.ellswift()
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := make([]byte, 0, handshakeA2)
+	msg = append(msg, ee...)
+	ss.mixHash(ee)
+	secret, err := ellswiftXDH(e.privateKey(), re, ee, re)
+	if err != nil {
+		return nil, nil, ErrHandshakeFailed
+	}
+	ss.mixKey(secret)
+	s, err := id.keys.Static.ellswift()
+	if err != nil {
+		return nil, nil, err
+	}
+	encStatic, err := ss.encryptAndHash(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg = append(msg, encStatic...)
+	secret, err = ellswiftXDH(id.keys.Static.privateKey(), re, s, re)
+	if err != nil {
+		return nil, nil, ErrHandshakeFailed
+	}
+	ss.mixKey(secret)
+	cert := id.certificate()
+	payload, err := ss.encryptAndHash(cert.encode())
+	if err != nil {
+		return nil, nil, err
+	}
+	msg = append(msg, payload...)
+	if _, err := rw.Write(msg); err != nil {
+		return nil, nil, err
+	}
+
+	c1, c2 := ss.split()
+	return c2, c1, nil
+}
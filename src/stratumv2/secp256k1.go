@@ -0,0 +1,197 @@
+package stratumv2
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// secp256k1 for the noise handshake: x-only ECDH on ElligatorSwift encoded
+// keys (BIP324) and schnorr signatures for the certificate (BIP340). The curve
+// comes from dcrd's secp256k1 and the signatures from btcec, only the
+// ElligatorSwift mapping, which neither has, is built here on their constant
+// time field arithmetic
+
+type fieldVal = secp256k1.FieldVal
+
+// every helper returns a normalized value, which is all the others accept
+func feSmall(v uint16) *fieldVal     { return new(fieldVal).SetInt(v) }
+func feAdd(a, b *fieldVal) *fieldVal { return new(fieldVal).Add2(a, b).Normalize() }
+func feSub(a, b *fieldVal) *fieldVal { return new(fieldVal).NegateVal(b, 1).Add(a).Normalize() }
+func feMul(a, b *fieldVal) *fieldVal { return new(fieldVal).Mul2(a, b).Normalize() }
+func feNeg(a *fieldVal) *fieldVal    { return new(fieldVal).NegateVal(a, 1).Normalize() }
+func feInv(a *fieldVal) *fieldVal    { return new(fieldVal).Set(a).Inverse().Normalize() }
+func feDiv(a, b *fieldVal) *fieldVal { return feMul(a, feInv(b)) }
+func feSquare(a *fieldVal) *fieldVal { return new(fieldVal).SquareVal(a).Normalize() }
+func feCube(a *fieldVal) *fieldVal   { return feMul(a, feSquare(a)) }
+func curveRHS(x *fieldVal) *fieldVal { return feAdd(feCube(x), feSmall(7)) }
+func validX(x *fieldVal) bool        { _, ok := feSqrt(curveRHS(x)); return ok }
+
+func feSqrt(a *fieldVal) (*fieldVal, bool) {
+	r := new(fieldVal)
+	ok := r.SquareRootVal(a)
+	return r.Normalize(), ok
+}
+
+// feFromBytes reduces a 32 byte big endian integer into the field
+func feFromBytes(b []byte) *fieldVal {
+	f := new(fieldVal)
+	f.SetByteSlice(b)
+	return f.Normalize()
+}
+
+// the root of -3 BIP324 uses, a^((p+1)/4) like SquareRootVal finds
+var sqrtMinus3, _ = feSqrt(feNeg(feSmall(3)))
+
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// ellswiftLen is the size of an ElligatorSwift encoded public key
+const ellswiftLen = 64
+
+// xSwiftEC decodes the field elements (u, t) to an x coordinate on the curve.
+// BIP324 shows every (u, t) decodes to one, the error only guards against
+// that not holding for bytes a peer made up
+func xSwiftEC(u, t *fieldVal) (*fieldVal, error) {
+	if u.IsZero() {
+		u = feSmall(1)
+	}
+	if t.IsZero() {
+		t = feSmall(1)
+	}
+	if feAdd(curveRHS(u), feSquare(t)).IsZero() {
+		t = feMul(feSmall(2), t)
+	}
+	X := feDiv(feSub(curveRHS(u), feSquare(t)), feMul(feSmall(2), t))
+	Y := feDiv(feAdd(X, t), feMul(sqrtMinus3, u))
+	half := feInv(feSmall(2))
+	for _, x := range []*fieldVal{
+		feAdd(u, feMul(feSmall(4), feSquare(Y))),
+		feMul(feSub(feNeg(feDiv(X, Y)), u), half),
+		feMul(feSub(feDiv(X, Y), u), half),
+	} {
+		if validX(x) {
+			return x, nil
+		}
+	}
+	return nil, fmt.Errorf("xswiftec found no point")
+}
+
+func ellswiftDecode(encoded []byte) (*fieldVal, error) {
+	if len(encoded) != ellswiftLen {
+		return nil, fmt.Errorf("expected %d byte ellswift key, got %d", ellswiftLen, len(encoded))
+	}
+	return xSwiftEC(feFromBytes(encoded[:32]), feFromBytes(encoded[32:]))
+}
+
+// ellswiftEncode encodes the x coordinate as random field elements (u, t)
+// that decode to it. t is solved for so that x is the first candidate
+// xSwiftEC tries, u + 4Y^2, giving t = sqrt(-3)uY +- sqrt(-3u^2Y^2 - u^3 - 7)
+func ellswiftEncode(x *fieldVal, random io.Reader) ([]byte, error) {
+	raw := make([]byte, 33)
+	for {
+		if _, err := io.ReadFull(random, raw); err != nil {
+			return nil, err
+		}
+		u := feFromBytes(raw[:32])
+		if u.IsZero() {
+			continue
+		}
+		Y, ok := feSqrt(feDiv(feSub(x, u), feSmall(4)))
+		if !ok {
+			continue
+		}
+		root, ok := feSqrt(feSub(feNeg(feMul(feMul(feSmall(3), feSquare(u)), feSquare(Y))), curveRHS(u)))
+		if !ok {
+			continue
+		}
+		if raw[32]&1 == 1 {
+			root = feNeg(root)
+		}
+		t := feAdd(feMul(feMul(sqrtMinus3, u), Y), root)
+		if t.IsZero() {
+			continue
+		}
+		if decoded, err := xSwiftEC(u, t); err != nil || !decoded.Equals(x) {
+			continue
+		}
+		return append(u.Bytes()[:], t.Bytes()[:]...), nil
+	}
+}
+
+// scalarMult is k*P with k split into two random shares. dcrd only has
+// variable time multiplication, blinding keeps its timing from following the
+// long lived static key
+func scalarMult(k *secp256k1.ModNScalar, pt *secp256k1.JacobianPoint) (*secp256k1.JacobianPoint, error) {
+	blind, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	rest := new(secp256k1.ModNScalar).NegateVal(&blind.Key).Add(k)
+	var a, b, sum secp256k1.JacobianPoint
+	secp256k1.ScalarMultNonConst(&blind.Key, pt, &a)
+	secp256k1.ScalarMultNonConst(rest, pt, &b)
+	secp256k1.AddNonConst(&a, &b, &sum)
+	sum.ToAffine()
+	return &sum, nil
+}
+
+// ellswiftXDH is BIP324's x-only ECDH on ElligatorSwift encoded keys. The
+// shared secret is hashed with both encodings, the initiator's first
+func ellswiftXDH(private *secp256k1.PrivateKey, initiator, responder []byte, remote []byte) ([]byte, error) {
+	x, err := ellswiftDecode(remote)
+	if err != nil {
+		return nil, err
+	}
+	y := new(fieldVal)
+	if !secp256k1.DecompressY(x, false, y) {
+		return nil, fmt.Errorf("ellswift key is not on the curve")
+	}
+	pt := secp256k1.MakeJacobianPoint(x, y, feSmall(1))
+	shared, err := scalarMult(&private.Key, &pt)
+	if err != nil {
+		return nil, err
+	}
+	// there is no point with x = 0, so that is the point at infinity
+	if shared.X.IsZero() {
+		return nil, fmt.Errorf("ecdh produced the point at infinity")
+	}
+	return taggedHash("bip324_ellswift_xonly_ecdh", initiator, responder, shared.X.Bytes()[:]), nil
+}
+
+// schnorrSign is BIP340 signing of a 32 byte message
+func schnorrSign(private *secp256k1.PrivateKey, msg []byte, aux []byte) ([64]byte, error) {
+	sig := [64]byte{}
+	nonce := [32]byte{}
+	copy(nonce[:], aux)
+	signed, err := schnorr.Sign(private, msg, schnorr.CustomNonce(nonce))
+	if err != nil {
+		return sig, err
+	}
+	copy(sig[:], signed.Serialize())
+	return sig, nil
+}
+
+// schnorrVerify is BIP340 verification against an x-only public key
+func schnorrVerify(public []byte, msg []byte, sig []byte) bool {
+	key, err := schnorr.ParsePubKey(public)
+	if err != nil {
+		return false
+	}
+	parsed, err := schnorr.ParseSignature(sig)
+	if err != nil {
+		return false
+	}
+	return parsed.Verify(msg, key)
+}
@@ -0,0 +1,354 @@
+package stratumv2
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const ProtocolVersion uint16 = 2
+
+// time allowed for the noise handshake and SetupConnection
+const setupTimeout = 10 * time.Second
+
+// handshakes run at once unless ListenerConfig.MaxHandshakes says otherwise,
+// connections past that wait their turn within the setup timeout
+const defaultMaxHandshakes = 64
+
+// Handler connects the sv2 front end to the pool. Implementations own the job
+// source and share validation, the listener only deals with the protocol
+type Handler interface {
+	// OpenChannel is called for every new standard channel. Set ch.Target and
+	// ch.State as needed, returning an error rejects the channel
+	OpenChannel(ch *Channel) error
+	// ChannelOpened is called once the miner has been told the channel is
+	// open, this is where the first job should be sent
+	ChannelOpened(ch *Channel)
+	// SubmitShare validates a share. Returning a *ShareError rejects it with
+	// the given code, any other error rejects it as an invalid share
+	SubmitShare(ch *Channel, share *SubmitSharesStandard) error
+	// CloseChannel is called when a channel is closed by the miner or the
+	// connection goes away
+	CloseChannel(ch *Channel)
+}
+
+// ConnectionFilter is optionally implemented by a Handler to turn away
+// connections, e.g. from banned addresses, before the handshake is run
+type ConnectionFilter interface {
+	AllowConnection(remoteAddr string) bool
+}
+
+type ShareError struct {
+	Code string
+}
+
+func (se *ShareError) Error() string {
+	return se.Code
+}
+
+// Channel is a standard mining channel opened on a connection
+type Channel struct {
+	Id           uint32
+	UserIdentity string
+	RemoteAddr   string
+	Setup        SetupConnection
+	Logger       *zap.SugaredLogger
+	// share target for the channel, set by the handler in OpenChannel
+	Target [32]byte
+	// handler owned state
+	State any
+
+	conn  *Conn
+	close context.CancelFunc
+}
+
+// SendJob sends a job to the channel. If prevHash is provided the job is
+// sent as a future job and immediately activated, telling the miner to drop
+// all previous work
+func (ch *Channel) SendJob(job NewMiningJob, prevHash *SetNewPrevHash) error {
+	job.ChannelId = ch.Id
+	job.FutureJob = prevHash != nil
+	if err := ch.conn.WriteMessage(&job); err != nil {
+		return err
+	}
+	if prevHash != nil {
+		prevHash.ChannelId = ch.Id
+		prevHash.JobId = job.JobId
+		return ch.conn.WriteMessage(prevHash)
+	}
+	return nil
+}
+
+// Close drops the connection the channel was opened on, closing it along with
+// any other channel on the connection
+func (ch *Channel) Close() {
+	ch.close()
+}
+
+func (ch *Channel) SetTarget(target [32]byte) error {
+	ch.Target = target
+	return ch.conn.WriteMessage(&SetTarget{ChannelId: ch.Id, MaximumTarget: target})
+}
+
+type ListenerConfig struct {
+	Logger        *zap.SugaredLogger
+	Handler       Handler
+	Keys          ServerKeys
+	Port          string
+	MaxHandshakes int
+}
+
+type Listener struct {
+	ListenerConfig
+
+	identity       *Identity
+	handshakes     chan struct{}
+	channelCounter uint32
+	workerGroup    sync.WaitGroup
+	accepting      int32 // see Accepting
+}
+
+func NewListener(cfg ListenerConfig) *Listener {
+	if cfg.MaxHandshakes <= 0 {
+		cfg.MaxHandshakes = defaultMaxHandshakes
+	}
+	listener := &Listener{ListenerConfig: cfg, handshakes: make(chan struct{}, cfg.MaxHandshakes)}
+	listener.Logger = listener.Logger.With(
+		zap.String("component", "stratumv2"),
+		zap.String("address", listener.Port),
+	)
+	return listener
+}
+
+// Listen accepts connections until the context is cancelled
+func (s *Listener) Listen(ctx context.Context) error {
+	identity, err := NewIdentity(s.Keys)
+	if err != nil {
+		return errors.Wrap(err, "failed signing the pool certificate")
+	}
+	s.identity = identity
+	go s.renewCertificate(ctx)
+
+	lc := net.ListenConfig{}
+	server, err := lc.Listen(ctx, "tcp", s.Port)
+	if err != nil {
+		return errors.Wrapf(err, "failed listening to socket %s", s.Port)
+	}
+	s.Logger.With(zap.String("authority_key", EncodeAuthorityKey(s.Keys.Authority.Public[:]))).
+		Info("stratum v2 listening")
+	atomic.StoreInt32(&s.accepting, 1)
+	defer atomic.StoreInt32(&s.accepting, 0)
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	for {
+		conn, err := server.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				s.workerGroup.Wait()
+				return context.Canceled
+			}
+			s.Logger.With(zap.Error(err)).Error("failed to accept incoming connection")
+			atomic.StoreInt32(&s.accepting, 0)
+			continue
+		}
+		atomic.StoreInt32(&s.accepting, 1)
+		s.workerGroup.Add(1)
+		go func() {
+			defer s.workerGroup.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// renewCertificate keeps the certificate sent in handshakes valid
+func (s *Listener) renewCertificate(ctx context.Context) {
+	ticker := time.NewTicker(s.identity.RenewInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.identity.Renew(); err != nil {
+				s.Logger.With(zap.Error(err)).Error("failed renewing the pool certificate")
+			}
+		}
+	}
+}
+
+// Accepting reports whether the listener is up and its last accept succeeded
+func (s *Listener) Accepting() bool {
+	return atomic.LoadInt32(&s.accepting) == 1
+}
+
+func (s *Listener) serveConn(ctx context.Context, raw net.Conn) {
+	logger := s.Logger.With(zap.String("client", raw.RemoteAddr().String()))
+	defer raw.Close()
+	// tear down the socket when the server stops so the read loop exits
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-connCtx.Done()
+		raw.Close()
+	}()
+
+	if filter, ok := s.Handler.(ConnectionFilter); ok && !filter.AllowConnection(raw.RemoteAddr().String()) {
+		logger.Info("connection turned away")
+		return
+	}
+	raw.SetDeadline(time.Now().Add(setupTimeout))
+	conn, err := s.handshake(connCtx, raw)
+	if err != nil {
+		logger.With(zap.Error(err)).Warn("noise handshake failed")
+		return
+	}
+	setup, err := s.setupConnection(conn)
+	if err != nil {
+		logger.With(zap.Error(err)).Warn("connection setup failed")
+		return
+	}
+	raw.SetDeadline(time.Time{})
+	logger = logger.With(zap.String("vendor", setup.Vendor))
+	logger.Info("stratum v2 client connected")
+
+	channels := map[uint32]*Channel{}
+	defer func() {
+		for _, ch := range channels {
+			s.Handler.CloseChannel(ch)
+		}
+	}()
+
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			if connCtx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				logger.With(zap.Error(err)).Info("stratum v2 client disconnected")
+			}
+			return
+		}
+		switch m := msg.(type) {
+		case *OpenStandardMiningChannel:
+			ch := &Channel{
+				Id:           atomic.AddUint32(&s.channelCounter, 1),
+				UserIdentity: m.UserIdentity,
+				RemoteAddr:   raw.RemoteAddr().String(),
+				Setup:        *setup,
+				conn:         conn,
+				close:        cancel,
+			}
+			ch.Logger = logger.With(zap.Uint32("channel", ch.Id), zap.String("user", ch.UserIdentity))
+			if err := s.Handler.OpenChannel(ch); err != nil {
+				ch.Logger.With(zap.Error(err)).Warn("rejected channel")
+				if err := conn.WriteMessage(&OpenMiningChannelError{
+					RequestId: m.RequestId,
+					ErrorCode: ErrCodeUnknownUser,
+				}); err != nil {
+					logger.With(zap.Error(err)).Warn("failed writing to client")
+					return
+				}
+				continue
+			}
+			channels[ch.Id] = ch
+			if err := conn.WriteMessage(&OpenStandardMiningChannelSuccess{
+				RequestId: m.RequestId,
+				ChannelId: ch.Id,
+				Target:    ch.Target,
+			}); err != nil {
+				logger.With(zap.Error(err)).Warn("failed writing to client")
+				return
+			}
+			s.Handler.ChannelOpened(ch)
+		case *SubmitSharesStandard:
+			if err := s.submitShare(channels, conn, m); err != nil {
+				logger.With(zap.Error(err)).Warn("failed writing to client")
+				return
+			}
+		case *CloseChannel:
+			if ch, exists := channels[m.ChannelId]; exists {
+				delete(channels, m.ChannelId)
+				s.Handler.CloseChannel(ch)
+			}
+		default:
+			logger.Debug(fmt.Sprintf("ignoring unexpected message 0x%02x", msg.MsgType()))
+		}
+	}
+}
+
+// handshake runs the noise handshake once one of the handshake slots is free,
+// so a flood of connections can't tie up every core
+func (s *Listener) handshake(ctx context.Context, raw net.Conn) (*Conn, error) {
+	timeout := time.NewTimer(setupTimeout)
+	defer timeout.Stop()
+	select {
+	case s.handshakes <- struct{}{}:
+	case <-timeout.C:
+		return nil, fmt.Errorf("timed out waiting for a handshake slot")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-s.handshakes }()
+	return Accept(raw, s.identity)
+}
+
+func (s *Listener) setupConnection(conn *Conn) (*SetupConnection, error) {
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	setup, ok := msg.(*SetupConnection)
+	if !ok {
+		return nil, fmt.Errorf("expected SetupConnection, got 0x%02x", msg.MsgType())
+	}
+	if setup.Protocol != ProtocolMining {
+		conn.WriteMessage(&SetupConnectionError{ErrorCode: ErrCodeUnsupportedProtocol})
+		return nil, fmt.Errorf("unsupported protocol %d", setup.Protocol)
+	}
+	if setup.MinVersion > ProtocolVersion || setup.MaxVersion < ProtocolVersion {
+		conn.WriteMessage(&SetupConnectionError{ErrorCode: ErrCodeProtocolVersion})
+		return nil, fmt.Errorf("unsupported version range %d-%d", setup.MinVersion, setup.MaxVersion)
+	}
+	if err := conn.WriteMessage(&SetupConnectionSuccess{UsedVersion: ProtocolVersion}); err != nil {
+		return nil, err
+	}
+	return setup, nil
+}
+
+func (s *Listener) submitShare(channels map[uint32]*Channel, conn *Conn, share *SubmitSharesStandard) error {
+	ch, exists := channels[share.ChannelId]
+	if !exists {
+		return conn.WriteMessage(&SubmitSharesError{
+			ChannelId:      share.ChannelId,
+			SequenceNumber: share.SequenceNumber,
+			ErrorCode:      ErrCodeInvalidChannelId,
+		})
+	}
+	if err := s.Handler.SubmitShare(ch, share); err != nil {
+		code := ErrCodeInvalidShare
+		var shareErr *ShareError
+		if errors.As(err, &shareErr) {
+			code = shareErr.Code
+		} else {
+			ch.Logger.With(zap.Error(err)).Error("error processing share")
+		}
+		return conn.WriteMessage(&SubmitSharesError{
+			ChannelId:      share.ChannelId,
+			SequenceNumber: share.SequenceNumber,
+			ErrorCode:      code,
+		})
+	}
+	return conn.WriteMessage(&SubmitSharesSuccess{
+		ChannelId:               share.ChannelId,
+		LastSequenceNumber:      share.SequenceNumber,
+		NewSubmitsAcceptedCount: 1,
+		NewSharesSum:            1,
+	})
+}
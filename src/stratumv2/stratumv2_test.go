@@ -0,0 +1,504 @@
+package stratumv2
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+)
+
+func testLogger() *zap.SugaredLogger {
+	return zap.NewNop().Sugar()
+}
+
+func testKeys(t *testing.T) ServerKeys {
+	static, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ServerKeys{Static: static, Authority: authority}
+}
+
+func testIdentity(t *testing.T, keys ServerKeys) *Identity {
+	id, err := NewIdentity(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// testListener is a listener that can serve connections without Listen
+func testListener(t *testing.T, cfg ListenerConfig) *Listener {
+	cfg.Logger = testLogger()
+	listener := NewListener(cfg)
+	listener.identity = testIdentity(t, cfg.Keys)
+	return listener
+}
+
+func pipe(t *testing.T, keys ServerKeys, pinned []byte) (*Conn, *Conn) {
+	clientRaw, serverRaw := net.Pipe()
+	serverConn := make(chan *Conn)
+	id := testIdentity(t, keys)
+	go func() {
+		conn, err := Accept(serverRaw, id)
+		if err != nil {
+			t.Error(err)
+		}
+		serverConn <- conn
+	}()
+	client, err := Handshake(clientRaw, pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, <-serverConn
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	keys := testKeys(t)
+	client, server := pipe(t, keys, keys.Authority.Public[:])
+	if !bytes.Equal(client.RemoteStatic, keys.Static.Public[:]) {
+		t.Fatalf("client learned the wrong pool key")
+	}
+
+	// both directions, including a payload that spans several noise chunks
+	large := bytes.Repeat([]byte{0xab}, maxChunkPlaintext*2+10)
+	for _, payload := range [][]byte{{}, []byte("hello"), large} {
+		go client.WriteFrame(Frame{ExtensionType: channelMsgBit, MsgType: 0x42, Payload: payload})
+		frame, err := server.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.MsgType != 0x42 || !frame.IsChannelMessage() || !bytes.Equal(frame.Payload, payload) {
+			t.Fatalf("frame mangled in transit, %d bytes", len(payload))
+		}
+
+		go server.WriteFrame(Frame{MsgType: 0x24, Payload: payload})
+		frame, err = client.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.MsgType != 0x24 || frame.IsChannelMessage() || !bytes.Equal(frame.Payload, payload) {
+			t.Fatalf("frame mangled in transit, %d bytes", len(payload))
+		}
+	}
+}
+
+func TestNoiseHandshakeKeyPinning(t *testing.T) {
+	keys := testKeys(t)
+	otherKey, _ := GenerateKeyPair()
+	clientRaw, serverRaw := net.Pipe()
+	go Accept(serverRaw, testIdentity(t, keys))
+	if _, err := Handshake(clientRaw, otherKey.Public[:]); err == nil {
+		t.Fatalf("expected handshake to fail against an unexpected authority")
+	}
+
+	// the pool's certificate must be valid right now
+	now := time.Now()
+	cert, err := signCertificate(keys, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, static := keys.Authority.Public[:], keys.Static.Public[:]
+	if err := cert.verify(authority, static, now.Add(time.Minute)); err != nil {
+		t.Errorf("expected the certificate to be valid, got %s", err)
+	}
+	if err := cert.verify(authority, static, now.Add(-time.Minute)); err == nil {
+		t.Errorf("expected a certificate from the future to be rejected")
+	}
+	if err := cert.verify(authority, static, now.Add(defaultCertValidity+time.Minute)); err == nil {
+		t.Errorf("expected an expired certificate to be rejected")
+	}
+	if err := cert.verify(authority, otherKey.Public[:], now); err == nil {
+		t.Errorf("expected the certificate to only cover the pool's static key")
+	}
+}
+
+func TestSecp256k1Vectors(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	// BIP340 test vectors 0 and 1
+	for _, v := range []struct{ private, public, aux, msg, sig string }{
+		{"0000000000000000000000000000000000000000000000000000000000000003",
+			"f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"e907831f80848d1069a5371b402410364bdf1c5f8307b0084c55f1ce2dca8215" +
+				"25f66a4a85ea8b71e482a74f382d2ce5ebeee8fdb2172f477df4900d310536c0"},
+		{"b7e151628aed2a6abf7158809cf4f3c762e7160f38b4da56a784d9045190cfef",
+			"dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659",
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"243f6a8885a308d313198a2e03707344a4093822299f31d0082efa98ec4e6c89",
+			"6896bd60eeae296db48a229ff71dfe071bde413e6d43f917dc8dcf8c78de3341" +
+				"8906d11ac976abccb20b091292bff4ea897efcb639ea871cfa95f6de339e4b0a"},
+	} {
+		kp, err := NewKeyPair(decode(v.private))
+		if err != nil || hex.EncodeToString(kp.Public[:]) != v.public {
+			t.Fatalf("unexpected public key %x for %s", kp.Public, v.private)
+		}
+		sig, err := schnorrSign(kp.privateKey(), decode(v.msg), decode(v.aux))
+		if err != nil || hex.EncodeToString(sig[:]) != v.sig {
+			t.Errorf("unexpected signature %x", sig)
+		}
+		if !schnorrVerify(kp.Public[:], decode(v.msg), sig[:]) {
+			t.Errorf("signature %x did not verify", sig)
+		}
+		sig[0] ^= 1
+		if schnorrVerify(kp.Public[:], decode(v.msg), sig[:]) {
+			t.Errorf("tampered signature verified")
+		}
+	}
+
+	// BIP324 ElligatorSwift, (0, 0) decodes like (1, 1)
+	decodeX := func(encoded []byte) []byte {
+		x, err := ellswiftDecode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return x.Bytes()[:]
+	}
+	if x := decodeX(make([]byte, ellswiftLen)); hex.EncodeToString(x) !=
+		"edd1fd3e327ce90cc7a3542614289aee9682003e9cf7dcc9cf2ca9743be5aa0c" {
+		t.Errorf("unexpected xswiftec(0, 0) %x", x)
+	}
+	if _, err := ellswiftDecode(make([]byte, 10)); err == nil {
+		t.Errorf("expected a short ellswift key to be rejected")
+	}
+	a, _ := GenerateKeyPair()
+	b, _ := GenerateKeyPair()
+	for i := 0; i < 20; i++ {
+		ea, err := a.ellswift()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x := decodeX(ea); !bytes.Equal(x, a.Public[:]) {
+			t.Fatalf("encoding of %x decodes to %x", a.Public, x)
+		}
+		eb, _ := b.ellswift()
+		ab, _ := ellswiftXDH(a.privateKey(), ea, eb, eb)
+		ba, _ := ellswiftXDH(b.privateKey(), ea, eb, ea)
+		if !bytes.Equal(ab, ba) {
+			t.Fatalf("both sides must derive the same secret")
+		}
+	}
+}
+
+func TestAuthorityKeyEncoding(t *testing.T) {
+	kp, _ := GenerateKeyPair()
+	encoded := EncodeAuthorityKey(kp.Public[:])
+	decoded, err := ParseAuthorityKey(encoded)
+	if err != nil || !bytes.Equal(decoded, kp.Public[:]) {
+		t.Fatalf("%s did not round trip: %x %v", encoded, decoded, err)
+	}
+	tampered := []byte(encoded)
+	tampered[5] = map[bool]byte{true: '2', false: '3'}[tampered[5] == '3']
+	if _, err := ParseAuthorityKey(string(tampered)); err == nil {
+		t.Errorf("expected a bad checksum to be rejected")
+	}
+	if _, err := ParseAuthorityKey("0OIl"); err == nil {
+		t.Errorf("expected characters outside the alphabet to be rejected")
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, msg := range []Message{
+		&SetupConnection{Protocol: ProtocolMining, MinVersion: 2, MaxVersion: 2, Flags: 1,
+			EndpointHost: "pool", EndpointPort: 3336, Vendor: "v", HardwareVersion: "h",
+			Firmware: "f", DeviceId: "d"},
+		&SetupConnectionSuccess{UsedVersion: 2, Flags: 3},
+		&SetupConnectionError{Flags: 1, ErrorCode: ErrCodeProtocolVersion},
+		&OpenStandardMiningChannel{RequestId: 1, UserIdentity: "kaspa:abc.rig", NominalHashRate: 1.5e9,
+			MaxTarget: [32]byte{1, 2, 3}},
+		&OpenStandardMiningChannelSuccess{RequestId: 1, ChannelId: 2, Target: [32]byte{4},
+			ExtranoncePrefix: []byte{1, 2}, GroupChannelId: 3},
+		&OpenMiningChannelError{RequestId: 1, ErrorCode: ErrCodeUnknownUser},
+		&NewMiningJob{ChannelId: 1, JobId: 2, FutureJob: true, Version: 1, MerkleRoot: [32]byte{9},
+			Timestamp: 1662696346000},
+		&SetNewPrevHash{ChannelId: 1, JobId: 2, PrevHash: [32]byte{8}, MinNTime: 1662696346000, NBits: 453325233},
+		&SetTarget{ChannelId: 1, MaximumTarget: [32]byte{7}},
+		&SubmitSharesStandard{ChannelId: 1, SequenceNumber: 2, JobId: 3, Nonce: 0xdeadbeefcafe,
+			NTime: 1662696346000, Version: 1},
+		&SubmitSharesSuccess{ChannelId: 1, LastSequenceNumber: 2, NewSubmitsAcceptedCount: 3, NewSharesSum: 4},
+		&SubmitSharesError{ChannelId: 1, SequenceNumber: 2, ErrorCode: ErrCodeStaleShare},
+		&CloseChannel{ChannelId: 1, ReasonCode: "bye"},
+	} {
+		e := encoder{}
+		msg.encode(&e)
+		decoded, err := DecodeMessage(Frame{MsgType: msg.MsgType(), Payload: e.buf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := cmp.Diff(msg, decoded); d != "" {
+			t.Errorf("message 0x%02x did not survive a round trip: %s", msg.MsgType(), d)
+		}
+
+		// truncated payloads must fail rather than decode garbage
+		if len(e.buf) > 0 {
+			if _, err := DecodeMessage(Frame{MsgType: msg.MsgType(), Payload: e.buf[:len(e.buf)-1]}); err == nil {
+				t.Errorf("message 0x%02x: expected error decoding truncated payload", msg.MsgType())
+			}
+		}
+	}
+}
+
+type testHandler struct {
+	banned bool // turns every connection away
+	lock   sync.Mutex
+	opened []*Channel
+	closed []*Channel
+	shares []SubmitSharesStandard
+}
+
+func (th *testHandler) AllowConnection(remoteAddr string) bool {
+	return !th.banned
+}
+
+func (th *testHandler) OpenChannel(ch *Channel) error {
+	if ch.UserIdentity == "" {
+		return fmt.Errorf("no user")
+	}
+	ch.Target = [32]byte{0xff}
+	th.lock.Lock()
+	th.opened = append(th.opened, ch)
+	th.lock.Unlock()
+	return nil
+}
+
+func (th *testHandler) ChannelOpened(ch *Channel) {
+	ch.SendJob(NewMiningJob{JobId: 1, MerkleRoot: [32]byte{1}, Timestamp: 1000},
+		&SetNewPrevHash{MinNTime: 1000})
+}
+
+func (th *testHandler) SubmitShare(ch *Channel, share *SubmitSharesStandard) error {
+	th.lock.Lock()
+	th.shares = append(th.shares, *share)
+	th.lock.Unlock()
+	if share.JobId != 1 {
+		return &ShareError{Code: ErrCodeInvalidJobId}
+	}
+	return nil
+}
+
+func (th *testHandler) CloseChannel(ch *Channel) {
+	th.lock.Lock()
+	th.closed = append(th.closed, ch)
+	th.lock.Unlock()
+}
+
+func TestListenerEndToEnd(t *testing.T) {
+	keys := testKeys(t)
+	handler := &testHandler{}
+	listener := testListener(t, ListenerConfig{Handler: handler, Keys: keys})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clientRaw, serverRaw := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		listener.serveConn(ctx, serverRaw)
+		close(done)
+	}()
+
+	client, err := NewClient(clientRaw, keys.Authority.Public[:], "test-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.OpenChannel(1, ""); err == nil {
+		t.Fatalf("expected channel without a user to be rejected")
+	}
+	channel, err := client.OpenChannel(2, "kaspa:abc.rig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.RequestId != 2 || channel.Target != [32]byte{0xff} {
+		t.Fatalf("unexpected channel %+v", channel)
+	}
+
+	// job is sent as a future job and activated right away
+	msg, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, ok := msg.(*NewMiningJob)
+	if !ok || job.ChannelId != channel.ChannelId || !job.FutureJob || job.Timestamp != 1000 {
+		t.Fatalf("expected job, got %+v", msg)
+	}
+	msg, err = client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev, ok := msg.(*SetNewPrevHash); !ok || prev.JobId != job.JobId {
+		t.Fatalf("expected prev hash activating the job, got %+v", msg)
+	}
+
+	for i, tc := range []struct {
+		share    SubmitSharesStandard
+		expected Message
+	}{
+		{SubmitSharesStandard{ChannelId: channel.ChannelId, SequenceNumber: 1, JobId: 1, Nonce: 1},
+			&SubmitSharesSuccess{ChannelId: channel.ChannelId, LastSequenceNumber: 1,
+				NewSubmitsAcceptedCount: 1, NewSharesSum: 1}},
+		{SubmitSharesStandard{ChannelId: channel.ChannelId, SequenceNumber: 2, JobId: 7, Nonce: 2},
+			&SubmitSharesError{ChannelId: channel.ChannelId, SequenceNumber: 2, ErrorCode: ErrCodeInvalidJobId}},
+		{SubmitSharesStandard{ChannelId: 999, SequenceNumber: 3, JobId: 1, Nonce: 3},
+			&SubmitSharesError{ChannelId: 999, SequenceNumber: 3, ErrorCode: ErrCodeInvalidChannelId}},
+	} {
+		if err := client.Submit(tc.share); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := cmp.Diff(tc.expected, msg); d != "" {
+			t.Fatalf("share %d: unexpected response: %s", i, d)
+		}
+	}
+
+	client.Close()
+	<-done
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if len(handler.shares) != 2 {
+		t.Fatalf("expected 2 shares to reach the handler, got %d", len(handler.shares))
+	}
+	if len(handler.closed) != 1 || handler.closed[0] != handler.opened[0] {
+		t.Fatalf("expected the open channel to be closed on disconnect")
+	}
+}
+
+func TestListenerRejectsUnsupportedVersion(t *testing.T) {
+	listener := testListener(t, ListenerConfig{Handler: &testHandler{}, Keys: testKeys(t)})
+	clientRaw, serverRaw := net.Pipe()
+	go listener.serveConn(context.Background(), serverRaw)
+
+	conn, err := Handshake(clientRaw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(&SetupConnection{Protocol: ProtocolMining, MinVersion: 3, MaxVersion: 4}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := msg.(*SetupConnectionError); !ok || m.ErrorCode != ErrCodeProtocolVersion {
+		t.Fatalf("expected version mismatch, got %+v", msg)
+	}
+}
+
+func TestListenerTurnsAwayConnections(t *testing.T) {
+	listener := testListener(t, ListenerConfig{Handler: &testHandler{banned: true}, Keys: testKeys(t)})
+	clientRaw, serverRaw := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		listener.serveConn(context.Background(), serverRaw)
+		close(done)
+	}()
+	if _, err := Handshake(clientRaw, nil); err == nil {
+		t.Fatalf("expected the connection to be closed before the handshake")
+	}
+	<-done
+}
+
+func TestChannelClose(t *testing.T) {
+	keys := testKeys(t)
+	handler := &testHandler{}
+	listener := testListener(t, ListenerConfig{Handler: handler, Keys: keys})
+	clientRaw, serverRaw := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		listener.serveConn(context.Background(), serverRaw)
+		close(done)
+	}()
+	client, err := NewClient(clientRaw, keys.Authority.Public[:], "test-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.OpenChannel(1, "kaspa:abc.rig"); err != nil {
+		t.Fatal(err)
+	}
+	// the job and the prev hash activating it
+	for i := 0; i < 2; i++ {
+		if _, err := client.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler.lock.Lock()
+	ch := handler.opened[0]
+	handler.lock.Unlock()
+	ch.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected closing the channel to drop the connection")
+	}
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if len(handler.closed) != 1 {
+		t.Fatalf("expected the handler to be told the channel closed")
+	}
+}
+
+func TestListenerBoundsHandshakes(t *testing.T) {
+	listener := testListener(t, ListenerConfig{Handler: &testHandler{}, Keys: testKeys(t), MaxHandshakes: 1})
+	listener.handshakes <- struct{}{} // a handshake in progress
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, serverRaw := net.Pipe()
+	if _, err := listener.handshake(ctx, serverRaw); err == nil {
+		t.Fatalf("expected the handshake to wait for the one in progress")
+	}
+
+	<-listener.handshakes
+	clientRaw, serverRaw := net.Pipe()
+	go Handshake(clientRaw, nil)
+	if _, err := listener.handshake(context.Background(), serverRaw); err != nil {
+		t.Fatalf("expected the handshake to run once the slot is free, got %s", err)
+	}
+	if len(listener.handshakes) != 0 {
+		t.Fatalf("expected the slot to be released")
+	}
+}
+
+func TestIdentitySignsAhead(t *testing.T) {
+	keys := testKeys(t)
+	id := testIdentity(t, keys)
+	first := id.certificate()
+	// every handshake gets the same certificate until it is renewed
+	if id.certificate() != first {
+		t.Fatalf("expected the certificate to be reused")
+	}
+	if err := id.renew(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	renewed := id.certificate()
+	if renewed.ValidFrom <= first.ValidFrom {
+		t.Fatalf("expected a newer certificate, got %+v", renewed)
+	}
+	if err := renewed.verify(keys.Authority.Public[:], keys.Static.Public[:], time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if id.RenewInterval() != defaultCertValidity/2 {
+		t.Errorf("expected renewal at half the validity, got %s", id.RenewInterval())
+	}
+}